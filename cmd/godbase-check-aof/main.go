@@ -0,0 +1,224 @@
+// godbase-check-aof validates an AOF, reports where it's corrupt and can
+// truncate it back to its last valid record, or to a point in time when
+// it was written with timestamp annotations.
+//
+//	godbase-check-aof [-fix] [-dump] [-truncate-to-timestamp time] <file.aof | file.manifest>
+//
+// Given a manifest, every file it lists is checked in load order. A base
+// file starting with a snapshot preamble has the snapshot checked too.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/aof"
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/maniktherana/godbase/pkg/snapshot"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout))
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) int {
+	fs := flag.NewFlagSet("godbase-check-aof", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	fix := fs.Bool("fix", false, "truncate the AOF to its last valid record")
+	dump := fs.Bool("dump", false, "print every record as a readable command")
+	until := fs.String("truncate-to-timestamp", "", "truncate the AOF to the dataset as of a unix time or RFC 3339 time")
+	fs.Usage = func() {
+		fmt.Fprintln(stdout, "Usage: godbase-check-aof [-fix] [-dump] [-truncate-to-timestamp time] <file.aof | file.manifest>")
+		fs.PrintDefaults()
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	path := fs.Arg(0)
+	answers := bufio.NewReader(stdin)
+
+	if *until != "" {
+		ts, err := parseTime(*until)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			return 2
+		}
+		return truncateToTimestamp(path, ts, answers, stdout)
+	}
+
+	files := []string{path}
+	if strings.HasSuffix(path, ".manifest") {
+		files, err = aof.Files(path)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			return 1
+		}
+	}
+
+	status := 0
+	for _, file := range files {
+		records, keys := 0, 0
+		preamble := snapshot.Handler{
+			String: func(string, string, int64) error {
+				keys++
+				return nil
+			},
+			Hash: func(string, map[string]string) error {
+				keys++
+				return nil
+			},
+		}
+		err := aof.CheckFile(file, preamble, func(record aof.Record) error {
+			if record.Preamble {
+				if *dump {
+					fmt.Fprintf(stdout, "%d: snapshot preamble with %d keys\n", record.Offset, keys)
+				}
+				return nil
+			}
+			if record.Timestamp != 0 {
+				if *dump {
+					fmt.Fprintf(stdout, "%d: #TS %d (%s)\n", record.Offset, record.Timestamp, time.Unix(record.Timestamp, 0).UTC().Format(time.RFC3339))
+				}
+				return nil
+			}
+
+			records++
+			if *dump {
+				fmt.Fprintf(stdout, "%d: %s\n", record.Offset, format(record.Value))
+			}
+			return nil
+		})
+
+		var corrupt *aof.CorruptError
+		if !errors.As(err, &corrupt) {
+			if err != nil {
+				fmt.Fprintln(stdout, err)
+				status = 1
+				continue
+			}
+			if keys > 0 {
+				fmt.Fprintf(stdout, "%s: OK, snapshot preamble with %d keys and %d records\n", file, keys, records)
+				continue
+			}
+			fmt.Fprintf(stdout, "%s: OK, %d records\n", file, records)
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			return 1
+		}
+		lost := info.Size() - corrupt.Offset
+		fmt.Fprintf(stdout, "%s: %d valid records, then a %s\n", file, records, describe(corrupt))
+
+		if !*fix {
+			fmt.Fprintf(stdout, "Run with -fix to truncate it to %d bytes, losing the last %d bytes\n", corrupt.Offset, lost)
+			status = 1
+			continue
+		}
+
+		fmt.Fprintf(stdout, "This will shrink %s from %d to %d bytes, losing %d bytes. Continue? [y/N]: ", file, info.Size(), corrupt.Offset, lost)
+		if !confirm(answers) {
+			fmt.Fprintln(stdout, "Aborted")
+			status = 1
+			continue
+		}
+
+		err = os.Truncate(file, corrupt.Offset)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "Truncated %s to %d bytes\n", file, corrupt.Offset)
+	}
+
+	return status
+}
+
+// truncateToTimestamp cuts the AOF back to the dataset as of ts, which
+// the server then loads as usual.
+func truncateToTimestamp(path string, ts int64, answers *bufio.Reader, stdout io.Writer) int {
+	cut, err := aof.FindTimestamp(path, ts)
+	if err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+	if cut == nil {
+		fmt.Fprintln(stdout, "Nothing in the AOF was written after", time.Unix(ts, 0).UTC().Format(time.RFC3339))
+		return 0
+	}
+
+	info, err := os.Stat(cut.File)
+	if err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "This will shrink %s from %d to %d bytes", cut.File, info.Size(), cut.Size)
+	if len(cut.Dropped) > 0 {
+		fmt.Fprintf(stdout, " and delete %s", strings.Join(cut.Dropped, ", "))
+	}
+	fmt.Fprint(stdout, ". Continue? [y/N]: ")
+	if !confirm(answers) {
+		fmt.Fprintln(stdout, "Aborted")
+		return 1
+	}
+
+	err = cut.Apply()
+	if err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "Truncated %s to %d bytes\n", cut.File, cut.Size)
+	return 0
+}
+
+// parseTime parses a unix time in seconds or an RFC 3339 time.
+func parseTime(s string) (int64, error) {
+	ts, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		return ts, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected a unix time or an RFC 3339 time such as 2006-01-02T15:04:05Z", s)
+	}
+	return t.Unix(), nil
+}
+
+func confirm(answers *bufio.Reader) bool {
+	answer, _ := answers.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func describe(err *aof.CorruptError) string {
+	if err.Truncated {
+		return fmt.Sprintf("truncated record at offset %d", err.Offset)
+	}
+	return fmt.Sprintf("bad record at offset %d: %v", err.Offset, err.Err)
+}
+
+// format prints a command the way redis-cli MONITOR does.
+func format(value resp.Value) string {
+	args := make([]string, len(value.Array))
+	for i, arg := range value.Array {
+		args[i] = strconv.Quote(arg.Bulk)
+	}
+	return strings.Join(args, " ")
+}
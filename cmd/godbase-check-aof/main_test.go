@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/maniktherana/godbase/pkg/snapshot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeAof(t *testing.T, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.aof")
+	require.NoError(t, os.WriteFile(path, []byte(data), 0666))
+	return path
+}
+
+func TestCheckValid(t *testing.T) {
+	path := writeAof(t, string(resp.Command("SET", "key", "a b").Marshal())+string(resp.Command("DEL", "key").Marshal()))
+
+	var out bytes.Buffer
+	assert.Equal(t, 0, run([]string{"-dump", path}, nil, &out))
+	assert.Equal(t, "0: \"SET\" \"key\" \"a b\"\n31: \"DEL\" \"key\"\n"+path+": OK, 2 records\n", out.String())
+}
+
+func TestCheckPreamble(t *testing.T) {
+	var preamble bytes.Buffer
+	w := snapshot.NewWriter(&preamble, false)
+	require.NoError(t, w.String("key", "value", 0))
+	require.NoError(t, w.Hash("hash", 1, func(yield func(field, value string) bool) {
+		yield("field", "value")
+	}))
+	require.NoError(t, w.Close())
+	path := writeAof(t, preamble.String()+string(resp.Command("DEL", "key").Marshal()))
+
+	var out bytes.Buffer
+	assert.Equal(t, 0, run([]string{"-dump", path}, nil, &out))
+	assert.Equal(t, fmt.Sprintf("0: snapshot preamble with 2 keys\n%d: \"DEL\" \"key\"\n", preamble.Len())+
+		path+": OK, snapshot preamble with 2 keys and 1 records\n", out.String())
+}
+
+func TestCheckCorrupt(t *testing.T) {
+	valid := string(resp.Command("SET", "key", "value").Marshal())
+	path := writeAof(t, valid+"garbage\r\n"+valid)
+
+	var out bytes.Buffer
+	assert.Equal(t, 1, run([]string{path}, nil, &out))
+	assert.Contains(t, out.String(), "1 valid records, then a bad record at offset 33")
+	assert.Contains(t, out.String(), "Run with -fix")
+
+	// Nothing changes unless the fix is confirmed.
+	out.Reset()
+	assert.Equal(t, 1, run([]string{"-fix", path}, strings.NewReader("n\n"), &out))
+	assert.Contains(t, out.String(), "Aborted")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Len(t, data, 2*len(valid)+len("garbage\r\n"))
+
+	out.Reset()
+	assert.Equal(t, 0, run([]string{"-fix", path}, strings.NewReader("y\n"), &out))
+	assert.Contains(t, out.String(), "losing 42 bytes")
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, valid, string(data))
+
+	out.Reset()
+	assert.Equal(t, 0, run([]string{path}, nil, &out))
+}
+
+func TestCheckTruncated(t *testing.T) {
+	valid := string(resp.Command("SET", "key", "value").Marshal())
+	path := writeAof(t, valid+"*3\r\n$3\r\nSE")
+
+	var out bytes.Buffer
+	assert.Equal(t, 1, run([]string{path}, nil, &out))
+	assert.Contains(t, out.String(), "truncated record at offset 33")
+}
+
+func TestCheckManifest(t *testing.T) {
+	dir := t.TempDir()
+	valid := string(resp.Command("SET", "key", "value").Marshal())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test.aof.1.base.aof"), []byte(valid), 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test.aof.1.incr.aof"), []byte(valid+"*1"), 0666))
+	manifest := filepath.Join(dir, "test.aof.manifest")
+	require.NoError(t, os.WriteFile(manifest, []byte("file test.aof.1.base.aof seq 1 type b\nfile test.aof.1.incr.aof seq 1 type i\n"), 0666))
+
+	var out bytes.Buffer
+	assert.Equal(t, 1, run([]string{manifest}, nil, &out))
+	assert.Contains(t, out.String(), filepath.Join(dir, "test.aof.1.base.aof")+": OK, 1 records")
+	assert.Contains(t, out.String(), filepath.Join(dir, "test.aof.1.incr.aof")+": 1 valid records, then a truncated record at offset 33")
+}
+
+func TestCheckUsage(t *testing.T) {
+	var out bytes.Buffer
+	assert.Equal(t, 2, run(nil, nil, &out))
+	assert.Contains(t, out.String(), "Usage")
+}
+
+func TestTruncateToTimestamp(t *testing.T) {
+	first := "#TS:1760796000\r\n" + string(resp.Command("SET", "key", "old").Marshal())
+	path := writeAof(t, first+"#TS:1760796300\r\n"+string(resp.Command("SET", "key", "new").Marshal()))
+
+	var out bytes.Buffer
+	assert.Equal(t, 0, run([]string{"-dump", path}, nil, &out))
+	assert.Contains(t, out.String(), "0: #TS 1760796000 (2025-10-18T14:00:00Z)\n")
+
+	out.Reset()
+	assert.Equal(t, 2, run([]string{"-truncate-to-timestamp", "yesterday", path}, nil, &out))
+
+	out.Reset()
+	assert.Equal(t, 0, run([]string{"-truncate-to-timestamp", "2025-10-18T14:03:00Z", path}, strings.NewReader("y\n"), &out))
+	assert.Contains(t, out.String(), "Truncated")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, first, string(data))
+
+	out.Reset()
+	assert.Equal(t, 0, run([]string{"-truncate-to-timestamp", "1760796000", path}, nil, &out))
+	assert.Contains(t, out.String(), "Nothing in the AOF was written after")
+}
@@ -1,115 +1,323 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/maniktherana/godbase/pkg/Database"
 	"github.com/maniktherana/godbase/pkg/aof"
+	"github.com/maniktherana/godbase/pkg/config"
 	"github.com/maniktherana/godbase/pkg/handler"
+	"github.com/maniktherana/godbase/pkg/rdb"
 	"github.com/maniktherana/godbase/pkg/resp"
-	"github.com/maniktherana/godbase/pkg/writer"
+	"github.com/maniktherana/godbase/pkg/snapshot"
 	"io"
 	"net"
-	"strings"
+	"os"
+	"time"
 )
 
-func handleConnection(conn net.Conn, kv *Database.Kv, aof *aof.Aof) {
+// syncedConn holds back what's sent to a client until the writes it ran
+// are on disk, which WaitSync only waits for with appendfsync always.
+// Everything sent goes through it: replies flushed once a pipeline is
+// answered, ones the writer sends by itself once its buffer is full, and
+// messages pushed from other goroutines. So no reply to a write gets out
+// before the write is durable, whatever follows it.
+type syncedConn struct {
+	net.Conn
+	aof *aof.Aof
+	// whether the client ran writes since the last sync, guarded by the
+	// client's lock like everything it sends
+	unsynced bool
+}
+
+func (c *syncedConn) Write(b []byte) (int, error) {
+	// A write that can't be persisted is never acknowledged: the
+	// connection is closed instead, and writes are refused with -MISCONF
+	// until the AOF recovers.
+	if c.unsynced {
+		err := c.aof.WaitSync()
+		if err != nil {
+			return 0, fmt.Errorf("syncing AOF: %w", err)
+		}
+		c.unsynced = false
+	}
+
+	return c.Conn.Write(b)
+}
+
+func handleConnection(conn net.Conn, kv *Database.Kv, aof *aof.Aof, cfg *config.Config) {
 	defer conn.Close()
-	kv.Clients[conn.RemoteAddr().String()] = conn
+	addr := conn.RemoteAddr().String()
+	synced := &syncedConn{Conn: conn, aof: aof}
+	client := handler.NewClient(addr, synced)
+	defer client.Close()
+	fmt.Println("Client connected: ", addr)
+
+	// A single reader and writer live for the whole connection so that
+	// bytes already buffered for pipelined commands are never dropped.
+	r := resp.NewResp(conn)
+	r.Limits = resp.Limits{
+		MaxBulkLen:       cfg.ProtoMaxBulkLen,
+		MaxMultiBulkLen:  cfg.MaxMultiBulkLen,
+		QueryBufferLimit: cfg.ClientQueryBufferLimit,
+	}
+	// serve answers what was read, returning whether the connection stays
+	// open. The client is locked meanwhile, so nothing is pushed to it in
+	// the middle of a reply.
+	serve := func(value resp.Value, err error) bool {
+		client.Lock()
+		defer client.Unlock()
 
-	for {
-		r := resp.NewResp(conn)
-		value, err := r.Read()
 		if err != nil {
-			if err == io.EOF {
-				fmt.Println("Client disconnected: ", conn.RemoteAddr().String())
-			} else {
-				fmt.Println("ERR IS", err)
+			var protocolErr *resp.ProtocolError
+			if !errors.As(err, &protocolErr) {
+				if err == io.EOF {
+					fmt.Println("Client disconnected: ", addr)
+				} else {
+					fmt.Println("ERR IS", err)
+				}
+				return false
 			}
-			return
+
+			// Tell the client what went wrong before hanging up, like
+			// Redis does.
+			fmt.Println("Closing client", addr, "after", err)
+			client.Flags |= handler.ClientCloseAfterReply
+			err = client.Reply(resp.Value{Typ: "error", Str: "ERR " + err.Error()})
 		} else {
-			fmt.Println("Client connected: ", conn.RemoteAddr().String())
+			client.LastInteraction = time.Now()
+			err = execute(value, kv, client, synced)
+		}
+		if err != nil {
+			fmt.Println("Error writing response:", err)
+			return false
 		}
 
-		if value.Typ != "array" {
-			fmt.Println("Invalid request, expected array")
-			continue
+		// Only flush once every pipelined command we have received has
+		// been answered, so a whole batch goes out in a single write.
+		closing := client.Flags&handler.ClientCloseAfterReply != 0
+		if r.Buffered() == 0 || closing {
+			err = client.Flush()
+			if err != nil {
+				fmt.Println("Error writing response:", err)
+				return false
+			}
 		}
 
-		if len(value.Array) == 0 {
-			fmt.Println("Invalid request, expected array length > 0")
-			continue
+		return !closing
+	}
+
+	for {
+		value, err := r.Read()
+		if !serve(value, err) {
+			return
 		}
+	}
+}
 
-		command := strings.ToUpper(value.Array[0].Bulk)
-		args := value.Array[1:]
+// execute runs a single request and buffers its reply for client, whose
+// connection is conn. Invalid requests get no reply. Commands without
+// FlagLoading are refused while the dataset is being loaded, commands with
+// FlagDenyOOM while it's over maxmemory, and write commands while it can't
+// be persisted.
+func execute(value resp.Value, kv *Database.Kv, client *handler.Client, conn *syncedConn) error {
+	if value.Typ != "array" {
+		fmt.Println("Invalid request, expected array")
+		return nil
+	}
 
-		writer := writer.NewWriter(conn)
+	if len(value.Array) == 0 {
+		fmt.Println("Invalid request, expected array length > 0")
+		return nil
+	}
 
-		handler, ok := handler.Handlers[command]
-		if !ok {
-			fmt.Println("Invalid command: ", command)
-			err := writer.Write(resp.Value{Typ: "string", Str: ""})
-			if err != nil {
-				fmt.Println("Error writing response:", err)
-				break
-			}
-			continue
+	cmd, args, err := handler.Lookup(value.Array)
+	if err != nil {
+		return client.Reply(resp.Value{Typ: "error", Str: err.Error()})
+	}
+
+	if !cmd.Has(handler.FlagLoading) && handler.Loading() {
+		return client.Reply(resp.Value{Typ: "error", Str: handler.ErrLoading.Error()})
+	}
+
+	// Keys are evicted before any command runs, but only the ones that may
+	// grow the dataset are refused when that isn't enough.
+	err = kv.FreeMemory()
+	if err != nil && cmd.Has(handler.FlagDenyOOM) {
+		return client.Reply(resp.Value{Typ: "error", Str: err.Error()})
+	}
+
+	if cmd.Has(handler.FlagWrite) {
+		err = handler.DiskError(kv)
+		if err != nil {
+			return client.Reply(resp.Value{Typ: "error", Str: err.Error()})
 		}
+		// Marked before the command runs, as its reply may be sent as soon
+		// as it's buffered.
+		conn.unsynced = true
+	}
+
+	return cmd.Call(args, kv, client)
+}
 
-		if command == "SET" || command == "HSET" {
-			err := aof.Write(value)
+func main() {
+	cfg, err := config.Parse(os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
+
+	kv := Database.NewKv()
+	kv.MaxMemory = int64(cfg.Maxmemory)
+	kv.MaxMemoryPolicy = cfg.MaxmemoryPolicy
+	kv.MaxMemorySamples = cfg.MaxmemorySamples
+	kv.LFULogFactor = cfg.LfuLogFactor
+	kv.LFUDecayTime = cfg.LfuDecayTime
+	kv.HashMaxListpackEntries = cfg.HashMaxListpackEntries
+	kv.HashMaxListpackValue = cfg.HashMaxListpackValue
+	kv.StringCompressMinSize = cfg.StringCompressMinSize
+	kv.LazyFreeLazyEviction = cfg.LazyfreeLazyEviction
+	kv.LazyFreeLazyServerDel = cfg.LazyfreeLazyServerDel
+
+	a, err := aof.NewAof(cfg.AppendDirname, cfg.AppendFilename, aof.FsyncPolicy(cfg.Appendfsync))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer a.Close()
+	a.AutoRewritePercentage = cfg.AutoAofRewritePercentage
+	a.AutoRewriteMinSize = int64(cfg.AutoAofRewriteMinSize)
+	a.LoadTruncated = cfg.AofLoadTruncated
+	a.Timestamps = cfg.AofTimestampEnabled
+	a.Checksums = cfg.AofChecksumEnabled
+	a.Snapshot = func(emit func(resp.Value) error) error {
+		return handler.Dump(kv, emit)
+	}
+	if cfg.AofUseRdbPreamble {
+		a.Preamble = func(w io.Writer) error {
+			sw := snapshot.NewWriter(w, cfg.Rdbcompression)
+			err := handler.WritePreamble(kv, sw)
 			if err != nil {
-				fmt.Println("Error writing response:", err)
-				break
+				return err
 			}
+			return sw.Close()
 		}
+	}
+	a.LoadPreamble = handler.SnapshotLoader(kv)
+	a.Progress = handler.LoadingProgress
+	kv.Aof = a
+	handler.RegisterInfo("persistence", a.Info)
 
-		result := handler(args, kv)
-		writer.Write(result)
+	snapshots := snapshot.New(cfg.Dbfilename, cfg.Save)
+	defer snapshots.Close()
+	snapshots.Compress = cfg.Rdbcompression
+	if cfg.SnapshotFormat == "rdb" {
+		snapshots.Encode = func(w io.Writer) snapshot.Encoder {
+			return rdb.NewWriter(w)
+		}
 	}
-}
+	snapshots.Decode = rdb.Decode
+	snapshots.Dump = func(w snapshot.Encoder) error {
+		return handler.WriteSnapshot(kv, w)
+	}
+	snapshots.Progress = handler.LoadingProgress
+	kv.Snapshots = snapshots
+	kv.StopWritesOnBgsaveError = cfg.StopWritesOnBgsaveError
+	handler.RegisterInfo("persistence", snapshots.Info)
+
+	go handler.SampleMemory(100 * time.Millisecond)
 
-func main() {
 	// Create a new server
 	l, err := net.Listen("tcp", ":6379")
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-
-	kv := Database.NewKv()
+	defer l.Close()
 	fmt.Println("Listening on port :6379")
 
-	aof, err := aof.NewAof("database.aof")
+	// Clients are accepted while the dataset is loaded, so they can tell a
+	// server that's loading from one that's down.
+	handler.StartLoading()
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(l, kv, a, cfg)
+	}()
+
+	err = load(a, kv)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Println("Error loading AOF:", err)
+		var corrupt *aof.CorruptError
+		if errors.As(err, &corrupt) {
+			fmt.Println("Make a backup of the AOF and run godbase-check-aof -fix on it to drop everything from the bad record on")
+		}
 		return
 	}
-	defer aof.Close()
 
-	aof.Read(func(value resp.Value) {
-		command := strings.ToUpper(value.Array[0].Bulk)
-		args := value.Array[1:]
-
-		handler, ok := handler.Handlers[command]
-		if !ok {
-			fmt.Println("Invalid command: ", command)
-			return
+	// Only effective writes reach the AOF, already rewritten by the
+	// command that made them. This is set up after loading so replayed
+	// commands aren't appended again, and before loading stops lets
+	// writes in.
+	kv.Propagator = func(value resp.Value) {
+		err := a.Write(value)
+		if err != nil {
+			fmt.Println("Error writing to AOF:", err)
 		}
+		snapshots.Changed()
+	}
+	handler.StopLoading()
+	fmt.Println("Dataset loaded, ready to accept commands")
 
-		handler(args, kv)
-	})
-
-	defer l.Close()
+	fmt.Println(<-served)
+}
 
+// serve accepts connections on l until it fails.
+func serve(l net.Listener, kv *Database.Kv, a *aof.Aof, cfg *config.Config) error {
 	for {
 		// Listen for connections
 		conn, err := l.Accept()
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
 		}
 
-		go handleConnection(conn, kv, aof)
+		go handleConnection(conn, kv, a, cfg)
 	}
 }
+
+// load restores the dataset from the snapshot, if there is one, and the
+// part of the AOF written after it.
+func load(a *aof.Aof, kv *Database.Kv) error {
+	pos, loaded, err := handler.LoadSnapshot(kv)
+	if err != nil {
+		return err
+	}
+	if !loaded {
+		return loadAof(a, kv, aof.Position{})
+	}
+
+	if pos != (aof.Position{}) {
+		err = loadAof(a, kv, pos)
+		if err != aof.ErrPositionGone {
+			return err
+		}
+	}
+
+	// The AOF doesn't carry on from the snapshot: it was rewritten since,
+	// lost writes the snapshot has, or was started afresh.
+	if a.Size() > 0 {
+		fmt.Println("The AOF doesn't carry on from the snapshot, loading all of it instead")
+		kv.LockAll()
+		kv.Reset()
+		kv.UnlockAll()
+		return loadAof(a, kv, aof.Position{})
+	}
+
+	// An empty AOF gets the dataset from the snapshot, so it's complete
+	// again.
+	return a.BgRewrite()
+}
+
+// loadAof replays the write commands logged in the AOF from pos on into
+// kv.
+func loadAof(a *aof.Aof, kv *Database.Kv, pos aof.Position) error {
+	return a.Replay(pos, handler.NewReplayer(kv).Apply)
+}
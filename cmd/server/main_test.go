@@ -0,0 +1,718 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/aof"
+	"github.com/maniktherana/godbase/pkg/config"
+	"github.com/maniktherana/godbase/pkg/handler"
+	"github.com/maniktherana/godbase/pkg/rdb"
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/maniktherana/godbase/pkg/snapshot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingConn counts the number of writes the server makes to the socket.
+type countingConn struct {
+	net.Conn
+	writes atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+func newTestServer(t *testing.T, cfg *config.Config) (client net.Conn, server *countingConn) {
+	t.Helper()
+
+	a, err := aof.NewAof(t.TempDir(), "test.aof", aof.FsyncPolicy(cfg.Appendfsync))
+	require.NoError(t, err)
+	t.Cleanup(func() { a.Close() })
+
+	serverConn, clientConn := net.Pipe()
+	server = &countingConn{Conn: serverConn}
+	go handleConnection(server, Database.NewKv(), a, cfg)
+	t.Cleanup(func() { clientConn.Close() })
+
+	return clientConn, server
+}
+
+func command(args ...string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return sb.String()
+}
+
+// readReply reads a single simple string, error, null or bulk reply.
+func readReply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	line = strings.TrimSuffix(line, "\r\n")
+
+	if line[0] != '$' || line == "$-1" {
+		return line
+	}
+
+	bulk, err := r.ReadString('\n')
+	require.NoError(t, err)
+	return strings.TrimSuffix(bulk, "\r\n")
+}
+
+func TestPipeline(t *testing.T) {
+	tt := []struct {
+		name     string
+		commands int
+	}{
+		{name: "Small", commands: 10},
+		{name: "Thousands", commands: 5000},
+		{name: "Large", commands: 50000},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := newTestServer(t, config.Default())
+
+			var pipeline strings.Builder
+			for i := range tc.commands {
+				pipeline.WriteString(command("SET", fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)))
+				pipeline.WriteString(command("GET", fmt.Sprintf("key%d", i)))
+			}
+
+			go func() {
+				client.Write([]byte(pipeline.String()))
+			}()
+
+			r := bufio.NewReader(client)
+			for i := range tc.commands {
+				assert.Equal(t, "+OK", readReply(t, r))
+				assert.Equal(t, fmt.Sprintf("+value%d", i), readReply(t, r))
+			}
+
+			// Replies are batched, so the server should make far fewer
+			// writes than the number of commands it answered.
+			assert.Less(t, server.writes.Load(), int64(tc.commands*2))
+		})
+	}
+}
+
+func TestPipelineSplitAcrossWrites(t *testing.T) {
+	client, _ := newTestServer(t, config.Default())
+
+	pipeline := command("SET", "hello", "world") + command("GET", "hello") + command("PING")
+
+	// Send the pipeline one byte at a time to make sure commands split
+	// across reads are still parsed in order.
+	go func() {
+		for i := range len(pipeline) {
+			client.Write([]byte{pipeline[i]})
+		}
+	}()
+
+	r := bufio.NewReader(client)
+	assert.Equal(t, "+OK", readReply(t, r))
+	assert.Equal(t, "+world", readReply(t, r))
+	assert.Equal(t, "+PONG", readReply(t, r))
+}
+
+func TestReset(t *testing.T) {
+	client, _ := newTestServer(t, config.Default())
+	go func() {
+		client.Write([]byte(command("RESET") + command("PING")))
+	}()
+
+	r := bufio.NewReader(client)
+	assert.Equal(t, "+RESET", readReply(t, r))
+	assert.Equal(t, "+PONG", readReply(t, r))
+}
+
+func TestProtocolErrorClosesConnection(t *testing.T) {
+	cfg := config.Default()
+	cfg.ProtoMaxBulkLen = 1024
+	cfg.MaxMultiBulkLen = 8
+
+	tt := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"HugeMultiBulk", "*2147483647\r\n", "-ERR Protocol error: invalid multibulk length"},
+		{"HugeBulk", "*3\r\n$3\r\nSET\r\n$999999999999\r\n", "-ERR Protocol error: invalid bulk length"},
+		{"BulkOverLimit", "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1025\r\n", "-ERR Protocol error: invalid bulk length"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client, _ := newTestServer(t, cfg)
+
+			// The valid command in front of the bad one still gets its
+			// reply.
+			go func() {
+				client.Write([]byte(command("PING") + tc.input))
+			}()
+
+			r := bufio.NewReader(client)
+			assert.Equal(t, "+PONG", readReply(t, r))
+			assert.Equal(t, tc.expected, readReply(t, r))
+
+			_, err := r.ReadByte()
+			assert.ErrorIs(t, err, io.EOF)
+		})
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	client, _ := newTestServer(t, config.Default())
+
+	go func() {
+		client.Write([]byte(command("FOO", "bar") + command("GET") + command("PING")))
+	}()
+
+	r := bufio.NewReader(client)
+	assert.Equal(t, "-ERR unknown command 'FOO', with args beginning with: 'bar' ", readReply(t, r))
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command", readReply(t, r))
+	assert.Equal(t, "+PONG", readReply(t, r))
+}
+
+func TestAofPropagation(t *testing.T) {
+	dir := t.TempDir()
+	a, err := aof.NewAof(dir, "test.aof", aof.FsyncEverysec)
+	require.NoError(t, err)
+
+	kv := Database.NewKv()
+	kv.Propagator = func(value resp.Value) {
+		require.NoError(t, a.Write(value))
+	}
+
+	serverConn, client := net.Pipe()
+	go handleConnection(serverConn, kv, a, config.Default())
+	defer client.Close()
+
+	go func() {
+		client.Write([]byte(command("SET", "a", "1") +
+			command("SET", "a", "2", "NX") +
+			command("SET", "b", "1", "XX") +
+			command("SET", "c", "1", "EX", "1000") +
+			command("SET", "d", "1", "BOGUS") +
+			command("GET", "a") +
+			command("HSET", "h", "f", "v")))
+	}()
+
+	r := bufio.NewReader(client)
+	for range 7 {
+		readReply(t, r)
+	}
+	require.NoError(t, a.Close())
+
+	data, err := os.ReadFile(filepath.Join(dir, "test.aof.1.incr.aof"))
+	require.NoError(t, err)
+	logged := string(data)
+	assert.True(t, strings.HasPrefix(logged, command("SET", "a", "1")+"*5\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n1\r\n$4\r\nPXAT\r\n"), logged)
+	assert.True(t, strings.HasSuffix(logged, command("HSET", "h", "f", "v")), logged)
+	assert.NotContains(t, logged, "NX")
+	assert.NotContains(t, logged, "BOGUS")
+	assert.NotContains(t, logged, "GET")
+
+	// Replaying the AOF gives back the same dataset.
+	a, err = aof.NewAof(dir, "test.aof", aof.FsyncEverysec)
+	require.NoError(t, err)
+	defer a.Close()
+
+	replayed := Database.NewKv()
+	require.NoError(t, loadAof(a, replayed, aof.Position{}))
+	assert.Equal(t, kv.Strings(), replayed.Strings())
+	assert.Equal(t, kv.Hashes(), replayed.Hashes())
+}
+
+// persistence is a dataset logged to an AOF with snapshots, set up the way
+// main does it.
+type persistence struct {
+	kv        *Database.Kv
+	aof       *aof.Aof
+	snapshots *snapshot.Snapshots
+}
+
+func openPersistence(t *testing.T, aofDir, snapshotPath string) *persistence {
+	t.Helper()
+
+	p := &persistence{kv: Database.NewKv()}
+	a, err := aof.NewAof(aofDir, "test.aof", aof.FsyncNo)
+	require.NoError(t, err)
+	a.Snapshot = func(emit func(resp.Value) error) error {
+		return handler.Dump(p.kv, emit)
+	}
+	a.Preamble = func(w io.Writer) error {
+		sw := snapshot.NewWriter(w, true)
+		err := handler.WritePreamble(p.kv, sw)
+		if err != nil {
+			return err
+		}
+		return sw.Close()
+	}
+	a.LoadPreamble = handler.SnapshotLoader(p.kv)
+	p.aof = a
+	p.snapshots = snapshot.New(snapshotPath, nil)
+	p.snapshots.Dump = func(w snapshot.Encoder) error {
+		return handler.WriteSnapshot(p.kv, w)
+	}
+	p.snapshots.Decode = rdb.Decode
+	p.kv.Aof = a
+	p.kv.Snapshots = p.snapshots
+
+	require.NoError(t, load(a, p.kv))
+	p.kv.Propagator = func(value resp.Value) {
+		require.NoError(t, a.Write(value))
+	}
+	return p
+}
+
+func (p *persistence) run(t *testing.T, args ...string) {
+	t.Helper()
+
+	cmd, rest, err := handler.Lookup(resp.Command(args...).Array)
+	require.NoError(t, err)
+	client := handler.NewClient("test", io.Discard)
+	defer client.Close()
+	require.NoError(t, cmd.Call(rest, p.kv, client))
+}
+
+func (p *persistence) close(t *testing.T) {
+	t.Helper()
+
+	p.snapshots.Close()
+	require.NoError(t, p.aof.Close())
+}
+
+func TestLoadSnapshotThenAofTail(t *testing.T) {
+	aofDir := t.TempDir()
+	snapshotPath := filepath.Join(t.TempDir(), "dump.gdb")
+
+	p := openPersistence(t, aofDir, snapshotPath)
+	p.run(t, "SET", "a", "1")
+	// Changed behind the AOF's back, so only the snapshot has it.
+	p.kv.SetString("a", Database.NewString("snapshot", 0))
+	require.NoError(t, p.snapshots.Save())
+	p.run(t, "SET", "b", "2")
+	p.run(t, "HSET", "h", "f", "v")
+	p.close(t)
+
+	// Only the part of the AOF after the snapshot is replayed.
+	p = openPersistence(t, aofDir, snapshotPath)
+	assert.Equal(t, "snapshot", p.kv.Strings()["a"].String())
+	assert.Equal(t, "2", p.kv.Strings()["b"].String())
+	assert.Equal(t, map[string]map[string]string{"h": {"f": "v"}}, p.kv.Hashes())
+
+	// Once the AOF is rewritten it no longer carries on from the snapshot
+	// and is loaded in full instead.
+	p.run(t, "DEL", "b")
+	require.NoError(t, p.aof.BgRewrite())
+	p.close(t)
+
+	p = openPersistence(t, aofDir, snapshotPath)
+	assert.Equal(t, "snapshot", p.kv.Strings()["a"].String())
+	assert.NotContains(t, p.kv.Strings(), "b")
+	p.close(t)
+}
+
+func TestLoadSnapshotIntoEmptyAof(t *testing.T) {
+	snapshotPath := filepath.Join(t.TempDir(), "dump.gdb")
+
+	p := openPersistence(t, t.TempDir(), snapshotPath)
+	p.run(t, "SET", "a", "1")
+	require.NoError(t, p.snapshots.Save())
+	p.close(t)
+
+	// Starting with a new AOF and the snapshot rewrites the AOF, so it
+	// has the dataset too.
+	aofDir := t.TempDir()
+	p = openPersistence(t, aofDir, snapshotPath)
+	assert.Equal(t, "1", p.kv.Strings()["a"].String())
+	p.close(t)
+	require.NoError(t, os.Remove(snapshotPath))
+
+	p = openPersistence(t, aofDir, snapshotPath)
+	assert.Equal(t, "1", p.kv.Strings()["a"].String())
+	p.close(t)
+}
+
+func TestLoadAofWithPreamble(t *testing.T) {
+	aofDir := t.TempDir()
+	snapshotPath := filepath.Join(t.TempDir(), "dump.gdb")
+
+	p := openPersistence(t, aofDir, snapshotPath)
+	p.run(t, "SET", "a", "1")
+	p.run(t, "SET", "gone", "1", "PX", "1")
+	p.run(t, "HSET", "h", "f", "v")
+	require.NoError(t, p.aof.BgRewrite())
+	p.close(t)
+
+	data, err := os.ReadFile(filepath.Join(aofDir, "test.aof.1.base.aof"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), snapshot.Magic))
+
+	// The commands after the preamble are replayed on top of it.
+	p = openPersistence(t, aofDir, snapshotPath)
+	p.run(t, "SET", "a", "2")
+	p.run(t, "HSET", "h", "g", "w")
+	p.close(t)
+
+	time.Sleep(2 * time.Millisecond)
+	p = openPersistence(t, aofDir, snapshotPath)
+	assert.Equal(t, "2", p.kv.Strings()["a"].String())
+	assert.NotContains(t, p.kv.Strings(), "gone")
+	assert.Equal(t, map[string]map[string]string{"h": {"f": "v", "g": "w"}}, p.kv.Hashes())
+	p.close(t)
+}
+
+func TestRDBSnapshots(t *testing.T) {
+	aofDir := t.TempDir()
+	snapshotPath := filepath.Join(t.TempDir(), "dump.rdb")
+
+	// A dump from Redis is loaded as the snapshot.
+	f, err := os.Create(snapshotPath)
+	require.NoError(t, err)
+	w := rdb.NewWriter(f)
+	require.NoError(t, w.Aux("redis-ver", "7.2.0"))
+	require.NoError(t, w.String("a", "1", 0))
+	require.NoError(t, w.Hash("h", 1, func(yield func(field, value string) bool) {
+		yield("f", "v")
+	}))
+	require.NoError(t, w.Close())
+	require.NoError(t, f.Close())
+
+	p := openPersistence(t, aofDir, snapshotPath)
+	assert.Equal(t, "1", p.kv.Strings()["a"].String())
+	assert.Equal(t, map[string]map[string]string{"h": {"f": "v"}}, p.kv.Hashes())
+
+	// and SAVE writes one Redis can load.
+	p.snapshots.Encode = func(w io.Writer) snapshot.Encoder {
+		return rdb.NewWriter(w)
+	}
+	p.run(t, "SET", "b", "2")
+	require.NoError(t, p.snapshots.Save())
+	p.close(t)
+
+	data, err := os.ReadFile(snapshotPath)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "REDIS0009"))
+
+	require.NoError(t, os.RemoveAll(aofDir))
+	p = openPersistence(t, aofDir, snapshotPath)
+	assert.Equal(t, "1", p.kv.Strings()["a"].String())
+	assert.Equal(t, "2", p.kv.Strings()["b"].String())
+	p.close(t)
+}
+
+func TestMisconf(t *testing.T) {
+	a, err := aof.NewAof(t.TempDir(), "test.aof", aof.FsyncAlways)
+	require.NoError(t, err)
+	defer a.Close()
+
+	kv := Database.NewKv()
+	kv.Aof = a
+	kv.Propagator = func(value resp.Value) {
+		a.Write(value)
+	}
+
+	serverConn, client := net.Pipe()
+	go handleConnection(serverConn, kv, a, config.Default())
+	defer client.Close()
+	r := bufio.NewReader(client)
+	run := func(args ...string) string {
+		go client.Write([]byte(command(args...)))
+		return readReply(t, r)
+	}
+
+	assert.Equal(t, "+OK", run("SET", "a", "1"))
+
+	// Writes to /dev/full fail like they do on a full disk.
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("no /dev/full:", err)
+	}
+	a.Mu.Lock()
+	file := a.File
+	a.File = full
+	a.Mu.Unlock()
+	// A write fails and is kept back until the disk takes it.
+	a.Write(resp.Command("SET", "b", "2"))
+
+	assert.Equal(t, "-MISCONF Errors writing to the AOF file: write /dev/full: no space left on device", run("SET", "a", "2"))
+	assert.Equal(t, "+1", run("GET", "a"))
+	assert.Equal(t, "+PONG", run("PING"))
+
+	// Once the disk has room again, writes are accepted again.
+	a.Mu.Lock()
+	a.File = file
+	a.Mu.Unlock()
+	full.Close()
+	assert.Eventually(t, func() bool {
+		return a.Err() == nil
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "+OK", run("SET", "a", "3"))
+	assert.Equal(t, "+3", run("GET", "a"))
+}
+
+// syncCheckingConn records how many fsyncs the AOF had made when the
+// server first wrote to the socket after being armed.
+type syncCheckingConn struct {
+	net.Conn
+	aof    *aof.Aof
+	armed  atomic.Bool
+	fsyncs atomic.Int64
+}
+
+func (c *syncCheckingConn) Write(b []byte) (int, error) {
+	if c.armed.CompareAndSwap(true, false) {
+		c.fsyncs.Store(fsyncs(c.aof))
+	}
+	return c.Conn.Write(b)
+}
+
+// fsyncs returns how many fsyncs the AOF made, as INFO reports it.
+func fsyncs(a *aof.Aof) int64 {
+	for _, field := range a.Info() {
+		if n, ok := strings.CutPrefix(field, "aof_fsyncs:"); ok {
+			fsyncs, _ := strconv.ParseInt(n, 10, 64)
+			return fsyncs
+		}
+	}
+	return -1
+}
+
+// newAlwaysServer returns a server with appendfsync always, along with
+// its AOF and the server side of the connection.
+func newAlwaysServer(t *testing.T) (client net.Conn, a *aof.Aof, server *syncCheckingConn) {
+	t.Helper()
+
+	a, err := aof.NewAof(t.TempDir(), "test.aof", aof.FsyncAlways)
+	require.NoError(t, err)
+	t.Cleanup(func() { a.Close() })
+
+	kv := Database.NewKv()
+	kv.Propagator = func(value resp.Value) {
+		a.Write(value)
+	}
+
+	serverConn, client := net.Pipe()
+	server = &syncCheckingConn{Conn: serverConn, aof: a}
+	go handleConnection(server, kv, a, config.Default())
+	t.Cleanup(func() { client.Close() })
+
+	return client, a, server
+}
+
+func TestRepliesWaitForSync(t *testing.T) {
+	client, a, server := newAlwaysServer(t)
+	r := bufio.NewReader(client)
+	big := strings.Repeat("x", 8192)
+	go client.Write([]byte(command("SET", "big", big)))
+	require.Equal(t, "+OK", readReply(t, r))
+
+	// The reply to GET fills the writer's buffer, which sends it by itself
+	// before the pipeline is done, but not before the SET is on disk.
+	before := fsyncs(a)
+	server.armed.Store(true)
+	go client.Write([]byte(command("SET", "a", "1") + command("GET", "big")))
+	assert.Equal(t, "+OK", readReply(t, r))
+	assert.Equal(t, "+"+big, readReply(t, r))
+	assert.Greater(t, server.fsyncs.Load(), before)
+}
+
+func TestPushWaitsForSync(t *testing.T) {
+	a, err := aof.NewAof(t.TempDir(), "test.aof", aof.FsyncAlways)
+	require.NoError(t, err)
+	defer a.Close()
+
+	kv := Database.NewKv()
+	kv.Propagator = func(value resp.Value) {
+		a.Write(value)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	conn := &syncCheckingConn{Conn: serverConn, aof: a}
+	synced := &syncedConn{Conn: conn, aof: a}
+	client := handler.NewClient("test", synced)
+	defer client.Close()
+
+	// A write whose reply is still buffered, as in the middle of a batch,
+	// when a message is pushed to the client.
+	before := fsyncs(a)
+	conn.armed.Store(true)
+	client.Lock()
+	set := resp.Value{Typ: "array", Array: []resp.Value{
+		{Typ: "bulk", Bulk: "SET"}, {Typ: "bulk", Bulk: "a"}, {Typ: "bulk", Bulk: "1"},
+	}}
+	require.NoError(t, execute(set, kv, client, synced))
+	client.Unlock()
+
+	go client.Push(resp.Value{Typ: "array", Array: []resp.Value{
+		{Typ: "bulk", Bulk: "message"}, {Typ: "bulk", Bulk: "news"}, {Typ: "bulk", Bulk: "hi"},
+	}})
+
+	r := bufio.NewReader(clientConn)
+	assert.Equal(t, "+OK", readReply(t, r))
+	assert.Equal(t, "*3", readReply(t, r))
+	assert.Greater(t, conn.fsyncs.Load(), before)
+}
+
+func TestOOM(t *testing.T) {
+	a, err := aof.NewAof(t.TempDir(), "test.aof", aof.FsyncNo)
+	require.NoError(t, err)
+	defer a.Close()
+
+	kv := Database.NewKv()
+	serverConn, client := net.Pipe()
+	go handleConnection(serverConn, kv, a, config.Default())
+	defer client.Close()
+	r := bufio.NewReader(client)
+	run := func(args ...string) string {
+		go client.Write([]byte(command(args...)))
+		return readReply(t, r)
+	}
+
+	assert.Equal(t, "+OK", run("SET", "a", "1"))
+	assert.Equal(t, "+OK", run("SET", "b", "2"))
+	kv.MaxMemory = kv.Used() - 1
+
+	// Under noeviction, commands that may grow the dataset are refused,
+	// while the rest still run.
+	assert.Equal(t, "-OOM command not allowed when used memory > 'maxmemory'.", run("SET", "c", "3"))
+	assert.Equal(t, "-OOM command not allowed when used memory > 'maxmemory'.", run("HSET", "h", "f", "v"))
+	assert.Equal(t, "+1", run("GET", "a"))
+	assert.Equal(t, ":1", run("DEL", "b"))
+	assert.Equal(t, "+OK", run("SET", "c", "3"))
+}
+
+func TestLoadingReplies(t *testing.T) {
+	handler.StartLoading()
+	defer handler.StopLoading()
+
+	client, _ := newTestServer(t, config.Default())
+	r := bufio.NewReader(client)
+	run := func(args ...string) string {
+		go client.Write([]byte(command(args...)))
+		return readReply(t, r)
+	}
+
+	assert.Equal(t, "+PONG", run("PING"))
+	assert.Equal(t, "-LOADING Redis is loading the dataset in memory", run("SET", "a", "1"))
+	assert.Equal(t, "-LOADING Redis is loading the dataset in memory", run("GET", "a"))
+
+	// INFO is a multi line bulk string.
+	go client.Write([]byte(command("INFO", "PERSISTENCE")))
+	var n int
+	_, err := fmt.Fscanf(r, "$%d\r\n", &n)
+	require.NoError(t, err)
+	info := make([]byte, n+2)
+	_, err = io.ReadFull(r, info)
+	require.NoError(t, err)
+	assert.Contains(t, string(info), "loading:1\r\n")
+
+	handler.StopLoading()
+	assert.Equal(t, "+OK", run("SET", "a", "1"))
+	assert.Equal(t, "+1", run("GET", "a"))
+}
+
+// writeBenchmarkAof writes an AOF of n commands to dir, the kind a busy
+// server logs: mostly SETs over a million keys, some with a TTL, along
+// with HSETs and DELs.
+func writeBenchmarkAof(b *testing.B, dir string, n int) int64 {
+	b.Helper()
+
+	a, err := aof.NewAof(dir, "bench.aof", aof.FsyncNo)
+	require.NoError(b, err)
+	require.NoError(b, a.Close())
+
+	f, err := os.OpenFile(filepath.Join(dir, "bench.aof.1.incr.aof"), os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(b, err)
+	defer f.Close()
+	w := bufio.NewWriterSize(f, 1<<20)
+
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	buf := []byte{}
+	for i := range n {
+		key := "key:" + strconv.Itoa(i%1000000)
+		var value resp.Value
+		switch i % 10 {
+		case 0:
+			value = resp.Command("SET", key, "value-"+strconv.Itoa(i), "PXAT", future)
+		case 1, 2:
+			value = resp.Command("HSET", "hash:"+strconv.Itoa(i%10000), "field:"+strconv.Itoa(i%100), "value-"+strconv.Itoa(i))
+		case 3:
+			value = resp.Command("DEL", key)
+		default:
+			value = resp.Command("SET", key, "value-"+strconv.Itoa(i))
+		}
+		buf = value.AppendMarshal(buf[:0])
+		_, err := w.Write(buf)
+		require.NoError(b, err)
+	}
+	require.NoError(b, w.Flush())
+
+	info, err := f.Stat()
+	require.NoError(b, err)
+	return info.Size()
+}
+
+// BenchmarkLoadAof replays an AOF of 10M commands, about 530 MB, the way
+// startup does and, for comparison, with every command going through the
+// command table and its handler one at a time. On a single Xeon core, so
+// without parsing running alongside applying:
+//
+//	BenchmarkLoadAof/replay     1  8901602490 ns/op  59.86 MB/s  1123393 commands/s
+//	BenchmarkLoadAof/commands   1 13637606133 ns/op  39.07 MB/s   733267 commands/s
+func BenchmarkLoadAof(b *testing.B) {
+	const n = 10_000_000
+	dir := b.TempDir()
+	size := writeBenchmarkAof(b, dir, n)
+
+	a, err := aof.NewAof(dir, "bench.aof", aof.FsyncNo)
+	require.NoError(b, err)
+	defer a.Close()
+
+	run := func(b *testing.B, load func(kv *Database.Kv) error) {
+		b.SetBytes(size)
+		b.ReportAllocs()
+		for range b.N {
+			require.NoError(b, load(Database.NewKv()))
+		}
+		b.ReportMetric(float64(n)*float64(b.N)/b.Elapsed().Seconds(), "commands/s")
+	}
+
+	b.Run("replay", func(b *testing.B) {
+		run(b, func(kv *Database.Kv) error {
+			return loadAof(a, kv, aof.Position{})
+		})
+	})
+	b.Run("commands", func(b *testing.B) {
+		client := handler.NewClient("bench", io.Discard)
+		defer client.Close()
+		run(b, func(kv *Database.Kv) error {
+			return a.Read(func(value resp.Value) {
+				cmd, args, err := handler.Lookup(value.Array)
+				if err == nil {
+					cmd.Call(args, kv, client)
+				}
+			})
+		})
+	})
+}
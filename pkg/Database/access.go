@@ -0,0 +1,123 @@
+package Database
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// lfuInitVal is the counter of new keys under an LFU policy, so they get a
+// chance to be accessed before they're evicted.
+const lfuInitVal = 5
+
+// Strings and hashes have an access word, the access metadata eviction
+// policies pick keys by, like the lru field of Redis objects. Under an LFU
+// policy it holds a logarithmic access counter in its low 8 bits and when
+// the counter was last decreased, in minutes, in the 16 bits above.
+// Otherwise it holds when the key was last accessed, in seconds.
+//
+// It's updated by readers too, so it's only ever accessed atomically.
+
+func lruClock() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+func lfuMinutes() uint32 {
+	return uint32(time.Now().Unix()/60) & 0xffff
+}
+
+// LFU returns whether the eviction policy is an LFU one, in which case the
+// access frequency of keys is tracked rather than their idle time.
+func (kv *Kv) LFU() bool {
+	return kv.MaxMemoryPolicy == AllKeysLFU || kv.MaxMemoryPolicy == VolatileLFU
+}
+
+// newAccess returns the access word of a new key.
+func (kv *Kv) newAccess() uint32 {
+	if kv.LFU() {
+		return lfuMinutes()<<8 | lfuInitVal
+	}
+	return lruClock()
+}
+
+// touch records an access to a key, given its access word. Concurrent
+// accesses may be counted once, which is fine for an estimate.
+func (kv *Kv) touch(a *uint32) {
+	if !kv.LFU() {
+		atomic.StoreUint32(a, lruClock())
+		return
+	}
+
+	counter := kv.lfuDecay(atomic.LoadUint32(a))
+	if counter < 255 {
+		// The more a key was accessed, the less likely the counter is to
+		// grow.
+		base := float64(max(int(counter)-lfuInitVal, 0))
+		if rand.Float64() < 1/(base*float64(kv.LFULogFactor)+1) {
+			counter++
+		}
+	}
+	atomic.StoreUint32(a, lfuMinutes()<<8|counter)
+}
+
+// lfuDecay returns the counter held by an access word, decreased by one for
+// every LFUDecayTime minutes since it was last decreased.
+func (kv *Kv) lfuDecay(a uint32) uint32 {
+	counter := a & 0xff
+	if kv.LFUDecayTime <= 0 {
+		return counter
+	}
+
+	// The minutes wrap around every 45 days or so.
+	elapsed := (lfuMinutes() - a>>8) & 0xffff
+	periods := elapsed / uint32(kv.LFUDecayTime)
+	if periods >= counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// idle returns how long ago a key was last accessed under an LRU policy.
+func idle(a uint32) time.Duration {
+	now := lruClock()
+	if now < a {
+		return 0
+	}
+	return time.Duration(now-a) * time.Second
+}
+
+// lookupAccess returns the access word of the string or, failing that,
+// the hash at key. It locks the key's shard itself.
+func (kv *Kv) lookupAccess(key string) (uint32, bool) {
+	shard := kv.Shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	if value, ok := shard.SETs[key]; ok {
+		return atomic.LoadUint32(&value.access), true
+	}
+	if h, ok := shard.HSETs[key]; ok {
+		return atomic.LoadUint32(&h.access), true
+	}
+	return 0, false
+}
+
+// IdleTime returns how long ago the key was last accessed, as OBJECT
+// IDLETIME does. It's only tracked when the policy isn't an LFU one.
+func (kv *Kv) IdleTime(key string) (time.Duration, bool) {
+	a, ok := kv.lookupAccess(key)
+	if !ok {
+		return 0, false
+	}
+	return idle(a), true
+}
+
+// Freq returns the logarithmic access counter of the key, as OBJECT FREQ
+// does. It's only tracked under an LFU policy.
+func (kv *Kv) Freq(key string) (int, bool) {
+	a, ok := kv.lookupAccess(key)
+	if !ok {
+		return 0, false
+	}
+	return int(kv.lfuDecay(a)), true
+}
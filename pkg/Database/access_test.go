@@ -0,0 +1,73 @@
+package Database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleTime(t *testing.T) {
+	kv := NewKv()
+	kv.SetString("a", str("1"))
+	kv.SetField("h", "f", "v")
+	kv.Shard("a").SETs["a"].access = lruClock() - 100
+	kv.Shard("h").HSETs["h"].access = lruClock() - 50
+
+	idle, ok := kv.IdleTime("a")
+	require.True(t, ok)
+	assert.Equal(t, 100*time.Second, idle)
+	idle, ok = kv.IdleTime("h")
+	require.True(t, ok)
+	assert.Equal(t, 50*time.Second, idle)
+	_, ok = kv.IdleTime("missing")
+	assert.False(t, ok)
+
+	// Reading or writing a key resets it.
+	kv.GetString("a")
+	kv.SetField("h", "g", "v")
+	idle, _ = kv.IdleTime("a")
+	assert.Zero(t, idle)
+	idle, _ = kv.IdleTime("h")
+	assert.Zero(t, idle)
+}
+
+func TestFreq(t *testing.T) {
+	kv := NewKv()
+	kv.MaxMemoryPolicy = AllKeysLFU
+	kv.SetString("a", str("1"))
+
+	freq, ok := kv.Freq("a")
+	require.True(t, ok)
+	assert.Equal(t, lfuInitVal, freq)
+
+	// The counter grows logarithmically: with the default log factor, a
+	// thousand accesses only get it a few steps further.
+	for range 1000 {
+		kv.GetString("a")
+	}
+	freq, _ = kv.Freq("a")
+	assert.Greater(t, freq, lfuInitVal+2)
+	assert.Less(t, freq, lfuInitVal+30)
+
+	// It decreases by one every LFUDecayTime minutes without an access.
+	a := &kv.Shard("a").SETs["a"].access
+	*a = (lfuMinutes()-3)&0xffff<<8 | 20
+	freq, _ = kv.Freq("a")
+	assert.Equal(t, 17, freq)
+	*a = (lfuMinutes()-30)&0xffff<<8 | 20
+	freq, _ = kv.Freq("a")
+	assert.Equal(t, 0, freq)
+
+	kv.LFUDecayTime = 0
+	freq, _ = kv.Freq("a")
+	assert.Equal(t, 20, freq)
+
+	// A counter that reached 255 stays there.
+	kv.LFULogFactor = 0
+	*a = lfuMinutes()<<8 | 255
+	kv.GetString("a")
+	freq, _ = kv.Freq("a")
+	assert.Equal(t, 255, freq)
+}
@@ -0,0 +1,339 @@
+package Database
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Eviction policies, as maxmemory-policy names them. The allkeys ones pick
+// among every key and the volatile ones among strings with a TTL. Keys are
+// picked by least recent access (lru), least frequent access (lfu),
+// nearest expire time (ttl) or at random.
+const (
+	NoEviction     = "noeviction"
+	AllKeysLRU     = "allkeys-lru"
+	AllKeysLFU     = "allkeys-lfu"
+	AllKeysRandom  = "allkeys-random"
+	VolatileLRU    = "volatile-lru"
+	VolatileLFU    = "volatile-lfu"
+	VolatileRandom = "volatile-random"
+	VolatileTTL    = "volatile-ttl"
+)
+
+// ErrOOM is returned by FreeMemory when the dataset can't be brought back
+// under MaxMemory.
+var ErrOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+// poolSize is how many eviction candidates are kept between rounds.
+const poolSize = 16
+
+// volatileScanLimit is how many keys are looked at, at most, to find
+// MaxMemorySamples with a TTL.
+const volatileScanLimit = 1000
+
+// eviction is the state of FreeMemory, guarded by its own lock so a single
+// caller evicts at a time.
+type eviction struct {
+	sync.Mutex
+	// best candidates seen so far, sorted by increasing score
+	pool []candidate
+	// keys evicted
+	evicted int64
+	// when the dataset went over MaxMemory in unix nanoseconds, 0 if it
+	// isn't, and how long it was over before then. They're updated
+	// without the lock, so callers refused under noeviction don't wait on
+	// the ones evicting.
+	overSince atomic.Int64
+	overTotal atomic.Int64
+}
+
+// candidate is a key eviction may pick. The higher its score, the better
+// it is to evict, e.g. the longer it's been idle.
+type candidate struct {
+	key   string
+	hash  bool
+	score uint64
+}
+
+// EvictionStats are the counters INFO reports about eviction.
+type EvictionStats struct {
+	EvictedKeys int64
+	// How long the dataset was over MaxMemory in total, and for how long
+	// it's been now, 0 if it isn't.
+	ExceededTotal   time.Duration
+	ExceededCurrent time.Duration
+}
+
+// EvictionStats returns the eviction counters.
+func (kv *Kv) EvictionStats() EvictionStats {
+	e := &kv.eviction
+	e.Lock()
+	defer e.Unlock()
+
+	// Memory may have gone down since the last command, e.g. after a DEL.
+	if !kv.overMaxMemory() {
+		kv.endOverMaxMemory()
+	}
+
+	stats := EvictionStats{EvictedKeys: e.evicted, ExceededTotal: time.Duration(e.overTotal.Load())}
+	if since := e.overSince.Load(); since != 0 {
+		stats.ExceededCurrent = time.Since(time.Unix(0, since))
+		stats.ExceededTotal += stats.ExceededCurrent
+	}
+	return stats
+}
+
+// FreeMemory evicts keys following MaxMemoryPolicy until the dataset fits
+// in MaxMemory again, like Redis does before running a command. It returns
+// ErrOOM if it doesn't, because the policy is noeviction or there's
+// nothing left it may evict, and nil while keys are still being freed in
+// the background. Evicted keys are propagated as DEL.
+func (kv *Kv) FreeMemory() error {
+	if !kv.overMaxMemory() {
+		kv.endOverMaxMemory()
+		return nil
+	}
+
+	e := &kv.eviction
+	e.overSince.CompareAndSwap(0, time.Now().UnixNano())
+	if kv.MaxMemoryPolicy == NoEviction {
+		return ErrOOM
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	for kv.overMaxMemory() {
+		// Like Redis, commands go ahead while keys are being freed in the
+		// background, rather than evicting more than needed before memory
+		// gets accounted for.
+		if pending, _ := kv.LazyFreeStats(); pending > 0 {
+			return nil
+		}
+		if !kv.evictOne() {
+			return ErrOOM
+		}
+	}
+	kv.endOverMaxMemory()
+
+	return nil
+}
+
+// overMaxMemory returns whether the dataset is over MaxMemory.
+func (kv *Kv) overMaxMemory() bool {
+	return kv.MaxMemory > 0 && kv.used.Load() > kv.MaxMemory
+}
+
+// endOverMaxMemory records that the dataset is no longer over MaxMemory,
+// adding how long it was to the total.
+func (kv *Kv) endOverMaxMemory() {
+	e := &kv.eviction
+	if e.overSince.Load() == 0 {
+		return
+	}
+	if since := e.overSince.Swap(0); since != 0 {
+		e.overTotal.Add(int64(time.Since(time.Unix(0, since))))
+	}
+}
+
+// evictOne evicts a single key, returning false if there's none to evict.
+// Shards are locked one at a time, so other commands only wait on
+// eviction if they're on the shard it's looking at.
+func (kv *Kv) evictOne() bool {
+	switch kv.MaxMemoryPolicy {
+	case AllKeysRandom, VolatileRandom:
+		return kv.evictRandom()
+	}
+	return kv.evictFromPool()
+}
+
+// evict evicts key, with its shard locked for writing.
+func (kv *Kv) evict(key string) {
+	// Evicted keys are propagated as DEL, which deletes both types.
+	kv.DeleteString(key)
+	if kv.LazyFreeLazyEviction {
+		kv.UnlinkHash(key)
+	} else {
+		kv.DeleteHash(key)
+	}
+	kv.Propagate("DEL", key)
+	kv.eviction.evicted++
+}
+
+// evictRandom evicts a random key, or a random string with a TTL under
+// volatile-random, from the first shard starting at a random one that has
+// some.
+func (kv *Kv) evictRandom() bool {
+	start := rand.IntN(len(kv.shards))
+	for i := range kv.shards {
+		shard := kv.shards[(start+i)%len(kv.shards)]
+		shard.Lock()
+		var key string
+		var found bool
+		if kv.MaxMemoryPolicy == AllKeysRandom {
+			key, found = randomKey(shard)
+		} else if keys := sampleVolatile(shard, nil, 1); len(keys) > 0 {
+			key, found = keys[0], true
+		}
+		if found {
+			kv.evict(key)
+		}
+		shard.Unlock()
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// randomKey returns a random key of shard, picking strings or hashes in
+// proportion to how many there are. Map iteration starts at a random
+// position.
+func randomKey(shard *Shard) (string, bool) {
+	total := len(shard.SETs) + len(shard.HSETs)
+	if total == 0 {
+		return "", false
+	}
+	if rand.IntN(total) < len(shard.SETs) {
+		for key := range shard.SETs {
+			return key, true
+		}
+	}
+	for key := range shard.HSETs {
+		return key, true
+	}
+	return "", false
+}
+
+// sampleVolatile appends up to n strings of shard with a TTL to keys.
+func sampleVolatile(shard *Shard, keys []string, n int) []string {
+	scanned := 0
+	for key, value := range shard.SETs {
+		if len(keys) == n || scanned == volatileScanLimit {
+			break
+		}
+		scanned++
+		if value.Expires > 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// evictFromPool samples keys into the pool of candidates, and evicts the
+// best one out of it that still exists.
+func (kv *Kv) evictFromPool() bool {
+	e := &kv.eviction
+	samples := max(kv.MaxMemorySamples, 1)
+	volatile := kv.MaxMemoryPolicy == VolatileLRU || kv.MaxMemoryPolicy == VolatileLFU || kv.MaxMemoryPolicy == VolatileTTL
+
+	// Keys are sampled from as many shards as it takes, starting at a
+	// random one.
+	sampled := 0
+	start := rand.IntN(len(kv.shards))
+	for i := 0; i < len(kv.shards) && sampled < samples; i++ {
+		shard := kv.shards[(start+i)%len(kv.shards)]
+		shard.RLock()
+		if volatile {
+			for _, key := range sampleVolatile(shard, make([]string, 0, samples-sampled), samples-sampled) {
+				value := shard.SETs[key]
+				kv.addCandidate(candidate{key: key, score: kv.score(value.Expires, &value.access)})
+				sampled++
+			}
+		} else if total := len(shard.SETs) + len(shard.HSETs); total > 0 {
+			// Strings and hashes are sampled in proportion to how many
+			// there are, rounding at random, for samples keys in all.
+			n := min(samples-sampled, total)
+			strings := (n*len(shard.SETs) + rand.IntN(total)) / total
+			hashes := n - strings
+			for key, value := range shard.SETs {
+				if strings == 0 {
+					break
+				}
+				strings--
+				sampled++
+				kv.addCandidate(candidate{key: key, score: kv.score(0, &value.access)})
+			}
+			for key, h := range shard.HSETs {
+				if hashes == 0 {
+					break
+				}
+				hashes--
+				sampled++
+				kv.addCandidate(candidate{key: key, hash: true, score: kv.score(0, &h.access)})
+			}
+		}
+		shard.RUnlock()
+	}
+
+	for len(e.pool) > 0 {
+		best := e.pool[len(e.pool)-1]
+		e.pool = e.pool[:len(e.pool)-1]
+
+		// The pool is kept between rounds, and shards aren't locked in
+		// between, so the key may be gone.
+		shard := kv.Shard(best.key)
+		shard.Lock()
+		var found bool
+		if best.hash {
+			_, found = shard.HSETs[best.key]
+		} else {
+			value, ok := shard.SETs[best.key]
+			found = ok && (!volatile || value.Expires > 0)
+		}
+		if found {
+			kv.evict(best.key)
+		}
+		shard.Unlock()
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// score returns how good a key is to evict under the policy, given its
+// expire time and access word.
+func (kv *Kv) score(expires int64, a *uint32) uint64 {
+	if kv.MaxMemoryPolicy == VolatileTTL {
+		return math.MaxInt64 - uint64(expires)
+	}
+	if kv.LFU() {
+		return 255 - uint64(kv.lfuDecay(atomic.LoadUint32(a)))
+	}
+	return uint64(idle(atomic.LoadUint32(a)))
+}
+
+// addCandidate adds c to the pool if it's better than the worst candidate
+// in it or there's room left.
+func (kv *Kv) addCandidate(c candidate) {
+	e := &kv.eviction
+	i := slices.IndexFunc(e.pool, func(other candidate) bool {
+		return other.key == c.key && other.hash == c.hash
+	})
+	if i >= 0 {
+		e.pool = slices.Delete(e.pool, i, i+1)
+	}
+	if len(e.pool) == poolSize {
+		if c.score <= e.pool[0].score {
+			return
+		}
+		e.pool = slices.Delete(e.pool, 0, 1)
+	}
+
+	i, _ = slices.BinarySearchFunc(e.pool, c.score, func(other candidate, score uint64) int {
+		switch {
+		case other.score < score:
+			return -1
+		case other.score > score:
+			return 1
+		}
+		return 0
+	})
+	e.pool = slices.Insert(e.pool, i, c)
+}
@@ -0,0 +1,212 @@
+package Database
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsed(t *testing.T) {
+	kv := NewKv()
+	kv.SetString("a", str("12345"))
+	assert.Equal(t, stringSize("a", str("12345")), kv.Used())
+	kv.SetString("a", str("1"))
+	assert.Equal(t, stringSize("a", str("1")), kv.Used())
+
+	// Changing a hash field by field adds up to the size of the whole hash.
+	fields := map[string]string{}
+	for i := range 20 {
+		field := strconv.Itoa(i)
+		kv.SetField("h", field, "v")
+		kv.SetField("h", field, strings.Repeat("v", 100))
+		fields[field] = strings.Repeat("v", 100)
+	}
+	assert.Equal(t, stringSize("a", str("1"))+hashSize("h", newHash(fields, 128, 64)), kv.Used())
+	kv.SetHash("h", map[string]string{"x": "y"})
+	assert.Equal(t, stringSize("a", str("1"))+hashSize("h", newHash(map[string]string{"x": "y"}, 128, 64)), kv.Used())
+	kv.SetField("h", "x", "changed")
+	kv.SetField("h", "z", "y")
+	packed := newHash(map[string]string{"x": "changed", "z": "y"}, 128, 64)
+	assert.Equal(t, stringSize("a", str("1"))+hashSize("h", packed), kv.Used())
+
+	kv.DeleteString("a")
+	kv.DeleteString("a")
+	kv.DeleteHash("h")
+	assert.Zero(t, kv.Used())
+
+	kv.SetString("a", str("1"))
+	kv.Reset()
+	assert.Zero(t, kv.Used())
+	assert.Empty(t, kv.Strings())
+}
+
+// fill sets n strings named 0 to n-1, each idle for as many seconds as its
+// name says.
+func fill(kv *Kv, n int) {
+	for i := range n {
+		key := strconv.Itoa(i)
+		kv.SetString(key, str("value"))
+		kv.Shard(key).SETs[key].access = lruClock() - uint32(i)
+	}
+}
+
+func TestFreeMemory(t *testing.T) {
+	kv := NewKv()
+	require.NoError(t, kv.FreeMemory())
+
+	fill(kv, 10)
+	kv.MaxMemory = kv.Used() - 1
+	assert.Equal(t, ErrOOM, kv.FreeMemory())
+	assert.Len(t, kv.Strings(), 10)
+	stats := kv.EvictionStats()
+	assert.Zero(t, stats.EvictedKeys)
+	assert.NotZero(t, stats.ExceededCurrent)
+
+	var propagated []resp.Value
+	kv.Propagator = func(v resp.Value) {
+		propagated = append(propagated, v)
+	}
+	kv.MaxMemoryPolicy = AllKeysRandom
+	require.NoError(t, kv.FreeMemory())
+	assert.Len(t, kv.Strings(), 9)
+	assert.LessOrEqual(t, kv.Used(), kv.MaxMemory)
+	require.Len(t, propagated, 1)
+	assert.Equal(t, "DEL", propagated[0].Array[0].Bulk)
+
+	stats = kv.EvictionStats()
+	assert.Equal(t, int64(1), stats.EvictedKeys)
+	assert.Zero(t, stats.ExceededCurrent)
+	assert.NotZero(t, stats.ExceededTotal)
+}
+
+func TestFreeMemoryNoEvictionDoesntWait(t *testing.T) {
+	kv := NewKv()
+	fill(kv, 10)
+	kv.MaxMemory = kv.Used() - 1
+
+	// Commands refused under noeviction don't queue up behind one that's
+	// evicting.
+	kv.eviction.Lock()
+	defer kv.eviction.Unlock()
+	done := make(chan error)
+	go func() {
+		done <- kv.FreeMemory()
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrOOM, err)
+	case <-time.After(time.Second):
+		t.Fatal("FreeMemory waited on the eviction lock")
+	}
+}
+
+func TestFreeMemoryNoEvictionRecovers(t *testing.T) {
+	kv := NewKv()
+	fill(kv, 10)
+	kv.MaxMemory = kv.Used() - 1
+	assert.Equal(t, ErrOOM, kv.FreeMemory())
+	assert.NotZero(t, kv.EvictionStats().ExceededCurrent)
+
+	// Once keys are deleted, the dataset no longer counts as over
+	// MaxMemory, whether or not another command runs.
+	kv.DeleteString("0")
+	stats := kv.EvictionStats()
+	assert.Zero(t, stats.ExceededCurrent)
+	assert.NotZero(t, stats.ExceededTotal)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, stats.ExceededTotal, kv.EvictionStats().ExceededTotal)
+
+	require.NoError(t, kv.FreeMemory())
+	assert.Equal(t, stats.ExceededTotal, kv.EvictionStats().ExceededTotal)
+}
+
+func TestFreeMemorySamples(t *testing.T) {
+	kv := NewKv()
+	kv.MaxMemoryPolicy = AllKeysLRU
+	kv.MaxMemorySamples = 5
+	for i := range 100 {
+		kv.SetString("s"+strconv.Itoa(i), str("1"))
+		kv.SetField("h"+strconv.Itoa(i), "f", "v")
+	}
+
+	// Each round looks at MaxMemorySamples keys, strings and hashes
+	// together.
+	kv.MaxMemory = kv.Used() - 1
+	require.NoError(t, kv.FreeMemory())
+	assert.Equal(t, int64(1), kv.EvictionStats().EvictedKeys)
+	assert.Len(t, kv.eviction.pool, kv.MaxMemorySamples-1)
+}
+
+func TestFreeMemoryLRU(t *testing.T) {
+	kv := NewKv()
+	kv.MaxMemoryPolicy = AllKeysLRU
+	kv.MaxMemorySamples = 10
+	fill(kv, 100)
+	kv.MaxMemory = kv.Used() / 2
+	require.NoError(t, kv.FreeMemory())
+
+	// Sampling only approximates LRU, but the keys left are mostly the
+	// most recently used ones.
+	recent := 0
+	for key := range kv.Strings() {
+		if i, _ := strconv.Atoi(key); i < 50 {
+			recent++
+		}
+	}
+	assert.Greater(t, recent, 35)
+	assert.Equal(t, int64(len(kv.Strings())), 100-kv.EvictionStats().EvictedKeys)
+}
+
+func TestFreeMemoryLFU(t *testing.T) {
+	kv := NewKv()
+	kv.MaxMemoryPolicy = AllKeysLFU
+	kv.SetString("hot", str("1"))
+	kv.SetField("cold", "f", "v")
+	kv.Shard("hot").SETs["hot"].access = lfuMinutes()<<8 | 100
+	kv.MaxMemory = kv.Used() - 1
+
+	require.NoError(t, kv.FreeMemory())
+	assert.Contains(t, kv.Strings(), "hot")
+	assert.Empty(t, kv.Hashes())
+}
+
+func TestFreeMemoryVolatile(t *testing.T) {
+	future := time.Now().UnixMilli() + 100000
+	for _, policy := range []string{VolatileLRU, VolatileLFU, VolatileRandom, VolatileTTL} {
+		t.Run(policy, func(t *testing.T) {
+			kv := NewKv()
+			kv.MaxMemoryPolicy = policy
+			kv.SetString("persistent", str("1"))
+			kv.SetField("h", "f", "v")
+			kv.SetString("soon", NewString("1", future))
+			kv.SetString("later", NewString("1", future+1000))
+			kv.MaxMemory = kv.Used() - 1
+
+			require.NoError(t, kv.FreeMemory())
+			assert.Contains(t, kv.Strings(), "persistent")
+			assert.Contains(t, kv.Hashes(), "h")
+			if policy == VolatileTTL {
+				assert.NotContains(t, kv.Strings(), "soon")
+			}
+
+			// Only keys with a TTL are evicted.
+			kv.MaxMemory = 1
+			assert.Equal(t, ErrOOM, kv.FreeMemory())
+			assert.Equal(t, []string{"persistent"}, keys(kv.Strings()))
+			assert.Contains(t, kv.Hashes(), "h")
+		})
+	}
+}
+
+func keys(m map[string]String) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,228 @@
+package Database
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync/atomic"
+)
+
+// Hash encodings, as OBJECT ENCODING reports them.
+const (
+	EncodingListpack  = "listpack"
+	EncodingHashtable = "hashtable"
+)
+
+// Hash is a hash value. Small hashes are packed into a single string,
+// with their fields and values one after the other, each preceded by its
+// length as a uvarint, like the listpack encoding of Redis. This takes far
+// less memory than a map, at the cost of lookups that scan the hash. Once
+// a hash gets more than Kv.HashMaxListpackEntries fields, or a field or
+// value longer than Kv.HashMaxListpackValue, it's converted to a map for
+// good.
+type Hash struct {
+	packed string
+	n      int
+	// nil while packed
+	fields map[string]string
+	// readers holding the hash, which is copied rather than changed in
+	// place while there are any
+	holds atomic.Int32
+	// access word, see access.go
+	access uint32
+}
+
+// Len returns the number of fields in the hash.
+func (h *Hash) Len() int {
+	if h.fields != nil {
+		return len(h.fields)
+	}
+	return h.n
+}
+
+// Encoding returns how the hash is stored.
+func (h *Hash) Encoding() string {
+	if h.fields != nil {
+		return EncodingHashtable
+	}
+	return EncodingListpack
+}
+
+// Get returns the value of a field.
+func (h *Hash) Get(field string) (string, bool) {
+	if h.fields != nil {
+		value, ok := h.fields[field]
+		return value, ok
+	}
+
+	value, _, ok := h.find(field)
+	return value, ok
+}
+
+// Range calls fn with every field and value until it returns false.
+func (h *Hash) Range(fn func(field, value string) bool) {
+	if h.fields != nil {
+		for field, value := range h.fields {
+			if !fn(field, value) {
+				return
+			}
+		}
+		return
+	}
+
+	rest := h.packed
+	for rest != "" {
+		var field, value string
+		field, rest = unpack(rest)
+		value, rest = unpack(rest)
+		if !fn(field, value) {
+			return
+		}
+	}
+}
+
+// Map returns the fields of the hash in a new map.
+func (h *Hash) Map() map[string]string {
+	fields := make(map[string]string, h.Len())
+	h.Range(func(field, value string) bool {
+		fields[field] = value
+		return true
+	})
+	return fields
+}
+
+// clone returns a copy of the hash that can be changed without changing
+// h.
+func (h *Hash) clone() *Hash {
+	c := Hash{packed: h.packed, n: h.n}
+	if h.fields != nil {
+		c.fields = make(map[string]string, len(h.fields))
+		for field, value := range h.fields {
+			c.fields[field] = value
+		}
+	}
+	return &c
+}
+
+// find returns the value of a field of a packed hash, along with where
+// its entry starts.
+func (h *Hash) find(field string) (value string, at int, found bool) {
+	rest := h.packed
+	for rest != "" {
+		at = len(h.packed) - len(rest)
+		var f string
+		f, rest = unpack(rest)
+		value, rest = unpack(rest)
+		if f == field {
+			return value, at, true
+		}
+	}
+	return "", 0, false
+}
+
+// set sets a field, converting the hash to a map if it gets too big to be
+// packed. It returns the old value of the field, if there was one.
+func (h *Hash) set(field, value string, maxEntries, maxValue int) (string, bool) {
+	if h.fields == nil && (h.n >= maxEntries || len(field) > maxValue || len(value) > maxValue) {
+		// The field may already be there, in which case the hash doesn't
+		// grow.
+		if old, at, ok := h.find(field); ok && len(value) <= maxValue {
+			h.replace(at, field, old, value)
+			return old, true
+		}
+		h.fields = h.Map()
+		h.packed = ""
+		h.n = 0
+	}
+
+	if h.fields != nil {
+		old, ok := h.fields[field]
+		h.fields[field] = value
+		return old, ok
+	}
+
+	if old, at, ok := h.find(field); ok {
+		h.replace(at, field, old, value)
+		return old, true
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(h.packed) + entryLen(field, value))
+	sb.WriteString(h.packed)
+	pack(&sb, field)
+	pack(&sb, value)
+	h.packed = sb.String()
+	h.n++
+	return "", false
+}
+
+// replace replaces the value of the entry starting at at.
+func (h *Hash) replace(at int, field, old, value string) {
+	end := at + entryLen(field, old)
+
+	var sb strings.Builder
+	sb.Grow(len(h.packed) - (end - at) + entryLen(field, value))
+	sb.WriteString(h.packed[:at])
+	pack(&sb, field)
+	pack(&sb, value)
+	sb.WriteString(h.packed[end:])
+	h.packed = sb.String()
+}
+
+// newHash returns a hash holding fields, packed unless it's too big.
+func newHash(fields map[string]string, maxEntries, maxValue int) *Hash {
+	packable := len(fields) <= maxEntries
+	for field, value := range fields {
+		if !packable {
+			break
+		}
+		packable = len(field) <= maxValue && len(value) <= maxValue
+	}
+	if !packable {
+		return &Hash{fields: fields}
+	}
+
+	h := &Hash{}
+	for field, value := range fields {
+		h.set(field, value, maxEntries, maxValue)
+	}
+	return h
+}
+
+func pack(sb *strings.Builder, s string) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(s)))
+	sb.Write(buf[:n])
+	sb.WriteString(s)
+}
+
+// unpack returns the string at the start of packed, and what follows it.
+func unpack(packed string) (s, rest string) {
+	var n uint64
+	var shift uint
+	i := 0
+	for {
+		b := packed[i]
+		i++
+		n |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			break
+		}
+		shift += 7
+	}
+	end := i + int(n)
+	return packed[i:end], packed[end:]
+}
+
+// entryLen returns the length of the packed entry of a field.
+func entryLen(field, value string) int {
+	return uvarintLen(len(field)) + len(field) + uvarintLen(len(value)) + len(value)
+}
+
+func uvarintLen(n int) int {
+	size := 1
+	for n >= 0x80 {
+		n >>= 7
+		size++
+	}
+	return size
+}
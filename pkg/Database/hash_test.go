@@ -0,0 +1,133 @@
+package Database
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHash(t *testing.T) {
+	h := &Hash{}
+	for i := range 4 {
+		_, ok := h.set("f"+strconv.Itoa(i), strings.Repeat("v", i), 4, 8)
+		assert.False(t, ok)
+	}
+	assert.Equal(t, EncodingListpack, h.Encoding())
+	assert.Equal(t, 4, h.Len())
+
+	old, ok := h.set("f2", "changed", 4, 8)
+	assert.True(t, ok)
+	assert.Equal(t, "vv", old)
+	value, ok := h.Get("f2")
+	assert.True(t, ok)
+	assert.Equal(t, "changed", value)
+	_, ok = h.Get("f4")
+	assert.False(t, ok)
+
+	// Fields are kept in the order they were added.
+	pairs := []string{}
+	h.Range(func(field, value string) bool {
+		pairs = append(pairs, field, value)
+		return true
+	})
+	assert.Equal(t, []string{"f0", "", "f1", "v", "f2", "changed", "f3", "vvv"}, pairs)
+
+	// Changing a field of a full hash doesn't grow it, adding one does.
+	h.set("f0", "x", 4, 8)
+	assert.Equal(t, EncodingListpack, h.Encoding())
+	h.set("f4", "x", 4, 8)
+	assert.Equal(t, EncodingHashtable, h.Encoding())
+	assert.Equal(t, map[string]string{"f0": "x", "f1": "v", "f2": "changed", "f3": "vvv", "f4": "x"}, h.Map())
+
+	// So does a value that's too long.
+	h = &Hash{}
+	h.set("f", "v", 4, 8)
+	h.set("f", strings.Repeat("v", 9), 4, 8)
+	assert.Equal(t, EncodingHashtable, h.Encoding())
+	assert.Equal(t, 1, h.Len())
+
+	// Entries longer than 127 bytes have longer lengths.
+	long := strings.Repeat("l", 300)
+	h = &Hash{}
+	h.set(long, long, 4, 1000)
+	h.set("f", "v", 4, 1000)
+	h.set(long, "short", 4, 1000)
+	assert.Equal(t, map[string]string{long: "short", "f": "v"}, h.Map())
+	assert.Equal(t, EncodingListpack, h.Encoding())
+}
+
+func TestNewHash(t *testing.T) {
+	fields := map[string]string{"a": "1", "b": "2"}
+	assert.Equal(t, EncodingListpack, newHash(fields, 2, 1).Encoding())
+	assert.Equal(t, fields, newHash(fields, 2, 1).Map())
+	assert.Equal(t, EncodingHashtable, newHash(fields, 1, 1).Encoding())
+	assert.Equal(t, EncodingHashtable, newHash(map[string]string{"a": "10"}, 2, 1).Encoding())
+}
+
+func TestHashClone(t *testing.T) {
+	for _, maxEntries := range []int{0, 128} {
+		h := &Hash{}
+		h.set("f", "v", maxEntries, 64)
+		c := h.clone()
+		c.set("f", "changed", maxEntries, 64)
+		c.set("g", "added", maxEntries, 64)
+		assert.Equal(t, map[string]string{"f": "v"}, h.Map())
+		assert.Equal(t, map[string]string{"f": "changed", "g": "added"}, c.Map())
+	}
+}
+
+func TestHoldHash(t *testing.T) {
+	for _, maxEntries := range []int{0, 128} {
+		kv := NewKv()
+		kv.HashMaxListpackEntries = maxEntries
+		kv.SetField("h", "f", "v")
+
+		// Writers change a copy of a held hash, and the hash itself again
+		// once it's released.
+		held, release, ok := kv.HoldHash("h")
+		require.True(t, ok)
+		kv.SetField("h", "f", "changed")
+		assert.Equal(t, map[string]string{"f": "v"}, held.Map())
+		assert.Equal(t, map[string]map[string]string{"h": {"f": "changed"}}, kv.Hashes())
+		release()
+
+		h := kv.Shard("h").HSETs["h"]
+		kv.SetField("h", "g", "added")
+		assert.Same(t, h, kv.Shard("h").HSETs["h"])
+
+		_, _, ok = kv.HoldHash("missing")
+		assert.False(t, ok)
+	}
+}
+
+// BenchmarkHashMemory reports the memory taken by 100k hashes of 10
+// fields, packed or not, as measured on the heap and as estimated.
+func BenchmarkHashMemory(b *testing.B) {
+	for _, tc := range []struct {
+		name       string
+		maxEntries int
+	}{
+		{"listpack", 128},
+		{"hashtable", 0},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			for range b.N {
+				kv := NewKv()
+				kv.HashMaxListpackEntries = tc.maxEntries
+				before := heapAlloc()
+				for i := range 100_000 {
+					key := "hash:" + strconv.Itoa(i)
+					for f := range 10 {
+						kv.SetField(key, "field:"+strconv.Itoa(f), strconv.Itoa(i*f))
+					}
+				}
+				heap := heapAlloc() - before
+				b.ReportMetric(float64(heap)/100_000, "heap-B/key")
+				b.ReportMetric(float64(kv.Used())/100_000, "used-B/key")
+			}
+		})
+	}
+}
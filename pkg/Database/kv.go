@@ -1,24 +1,305 @@
 package Database
 
 import (
+	"github.com/maniktherana/godbase/pkg/aof"
 	"github.com/maniktherana/godbase/pkg/resp"
-	"net"
-	"sync"
+	"github.com/maniktherana/godbase/pkg/snapshot"
+	"hash/maphash"
+	"sync/atomic"
 )
 
 type Kv struct {
-	SETs                 map[string]resp.Value
-	SETsMu               sync.RWMutex
-	HSETs                map[string]map[string]string
-	HSETsMu              sync.RWMutex
 	NumCommandsProcessed int
-	Clients              map[string]net.Conn
+	// Propagator receives every effective change to the dataset as a
+	// command that reproduces it, e.g. to append it to the AOF. It's
+	// called while the lock on the changed shard is still held, so commands
+	// arrive in the order their changes were applied.
+	Propagator func(resp.Value)
+
+	// The append only file writes are logged to, and the snapshots saved
+	// of the dataset, nil when they're disabled. With
+	// StopWritesOnBgsaveError, writes are refused while the last snapshot
+	// failed, as stop-writes-on-bgsave-error. They must be set before the
+	// Kv is shared.
+	Aof                     *aof.Aof
+	Snapshots               *snapshot.Snapshots
+	StopWritesOnBgsaveError bool
+
+	// Once the dataset takes more than MaxMemory bytes, FreeMemory evicts
+	// keys following MaxMemoryPolicy, looking at MaxMemorySamples keys at a
+	// time. 0 means there's no limit. Along with the LFU settings, they
+	// must be set before the Kv is shared.
+	MaxMemory        int64
+	MaxMemoryPolicy  string
+	MaxMemorySamples int
+	// How slowly the LFU counters grow, and how many minutes it takes
+	// them to decrease by one, as lfu-log-factor and lfu-decay-time.
+	LFULogFactor int
+	LFUDecayTime int
+	// Hashes are packed while they have at most HashMaxListpackEntries
+	// fields, none longer than HashMaxListpackValue bytes. They must be
+	// set before the Kv is shared.
+	HashMaxListpackEntries int
+	HashMaxListpackValue   int
+	// Strings of at least StringCompressMinSize bytes are compressed by
+	// EncodeString, 0 means they never are.
+	StringCompressMinSize int
+	// Whether hashes deleted by eviction, or replaced by the server
+	// rather than a user, are freed in the background, as
+	// lazyfree-lazy-eviction and lazyfree-lazy-server-del.
+	LazyFreeLazyEviction  bool
+	LazyFreeLazyServerDel bool
+
+	// the keyspace, split into shards by the hash of keys with seed
+	shards []*Shard
+	seed   maphash.Seed
+	// estimated size of the dataset
+	used     atomic.Int64
+	eviction eviction
+	lazyFree lazyFree
+
+	// snapshots being read. They're only added and removed with every
+	// shard locked, so writers can check them under the lock of theirs.
+	reading []*Snapshot
 }
 
 func NewKv() *Kv {
-	return &Kv{
-		SETs:    map[string]resp.Value{},
-		HSETs:   map[string]map[string]string{},
-		Clients: map[string]net.Conn{},
+	return newKv(DefaultShards)
+}
+
+func newKv(shards int) *Kv {
+	kv := &Kv{
+		StopWritesOnBgsaveError: true,
+		MaxMemoryPolicy:         NoEviction,
+		MaxMemorySamples:        5,
+		LFULogFactor:            10,
+		LFUDecayTime:            1,
+		HashMaxListpackEntries:  128,
+		HashMaxListpackValue:    64,
+		shards:                  make([]*Shard, shards),
+		seed:                    maphash.MakeSeed(),
+	}
+	for i := range kv.shards {
+		kv.shards[i] = newShard(i)
+	}
+	return kv
+}
+
+// Propagate hands the command made of args to the Propagator, if there is
+// one. Commands call it only once they know they changed the dataset, with
+// arguments rewritten so that replaying them has the same effect later,
+// e.g. relative TTLs turned into absolute ones.
+func (kv *Kv) Propagate(args ...string) {
+	if kv.Propagator == nil {
+		return
+	}
+
+	kv.Propagator(resp.Command(args...))
+}
+
+// Used returns the estimated memory taken by the dataset in bytes.
+func (kv *Kv) Used() int64 {
+	return kv.used.Load()
+}
+
+// GetString returns the string at key, counting it as accessed. It must be
+// called with the key's shard locked, for reading at least.
+func (kv *Kv) GetString(key string) (String, bool) {
+	shard := kv.Shard(key)
+	value, ok := shard.SETs[key]
+	if !ok {
+		return String{}, false
+	}
+	kv.touch(&value.access)
+	return value.load(), true
+}
+
+// GetHash returns the hash at key, counting it as accessed. It must be
+// called with the key's shard locked, for reading at least, and the hash
+// must not be changed.
+func (kv *Kv) GetHash(key string) (*Hash, bool) {
+	shard := kv.Shard(key)
+	h, ok := shard.HSETs[key]
+	if ok {
+		kv.touch(&h.access)
+	}
+	return h, ok
+}
+
+// HoldHash returns the hash at key like GetHash, and keeps writers from
+// changing it in place until release is called, so that it can be read
+// with the shard unlocked, e.g. while a big reply is sent to a slow
+// client. It must be called with the key's shard locked, for reading at
+// least.
+func (kv *Kv) HoldHash(key string) (h *Hash, release func(), ok bool) {
+	h, ok = kv.GetHash(key)
+	if !ok {
+		return nil, nil, false
+	}
+	h.holds.Add(1)
+	return h, func() { h.holds.Add(-1) }, true
+}
+
+// The methods below change the dataset while keeping open snapshots
+// consistent, and are how it should be written to once it's shared. They
+// must be called with the shard of the key they change locked for writing.
+
+// SetString sets the string at key.
+func (kv *Kv) SetString(key string, value String) {
+	shard := kv.Shard(key)
+	kv.saveString(shard, key)
+	if old, ok := shard.SETs[key]; ok {
+		kv.used.Add(-stringSize(key, old.load()))
+	}
+	value.access = kv.newAccess()
+	shard.SETs[key] = &value
+	kv.used.Add(stringSize(key, value))
+}
+
+// DeleteString deletes the string at key, if there is one.
+func (kv *Kv) DeleteString(key string) {
+	shard := kv.Shard(key)
+	old, ok := shard.SETs[key]
+	if !ok {
+		return
+	}
+	kv.saveString(shard, key)
+	delete(shard.SETs, key)
+	kv.used.Add(-stringSize(key, old.load()))
+}
+
+// SetField sets a field of the hash at key, creating the hash if needed.
+func (kv *Kv) SetField(key, field, value string) {
+	shard := kv.Shard(key)
+	h, ok := shard.HSETs[key]
+	saved := kv.saveHash(shard, key)
+	switch {
+	case !ok:
+		h = &Hash{access: kv.newAccess()}
+		shard.HSETs[key] = h
+		kv.used.Add(hashSize(key, h))
+	case saved || h.holds.Load() > 0:
+		// Snapshots keep the hash as it was, and readers holding it read
+		// it unlocked, so it's changed in a copy.
+		old := h
+		h = h.clone()
+		h.access = atomic.LoadUint32(&old.access)
+		shard.HSETs[key] = h
+		kv.touch(&h.access)
+	default:
+		kv.touch(&h.access)
+	}
+
+	if h.fields == nil {
+		// Packed hashes are rewritten as a whole, and may be converted.
+		kv.used.Add(-h.size())
+		h.set(field, value, kv.HashMaxListpackEntries, kv.HashMaxListpackValue)
+		kv.used.Add(h.size())
+		return
+	}
+
+	n := len(h.fields)
+	if old, ok := h.set(field, value, kv.HashMaxListpackEntries, kv.HashMaxListpackValue); ok {
+		kv.used.Add(fieldSize(field, value) - fieldSize(field, old))
+	} else {
+		kv.used.Add(mapSize(n+1, fieldSlot) - mapSize(n, fieldSlot) + fieldSize(field, value))
+	}
+}
+
+// SetHash replaces the hash at key with fields, which it takes ownership
+// of. The hash is packed if it's small enough.
+func (kv *Kv) SetHash(key string, fields map[string]string) {
+	shard := kv.Shard(key)
+	kv.saveHash(shard, key)
+	if old, ok := shard.HSETs[key]; ok {
+		kv.freeHash(key, old, kv.LazyFreeLazyServerDel)
+	}
+	h := newHash(fields, kv.HashMaxListpackEntries, kv.HashMaxListpackValue)
+	h.access = kv.newAccess()
+	shard.HSETs[key] = h
+	kv.used.Add(hashSize(key, h))
+}
+
+// DeleteHash deletes the hash at key, if there is one.
+func (kv *Kv) DeleteHash(key string) {
+	kv.deleteHash(key, false)
+}
+
+// UnlinkHash deletes the hash at key, if there is one, leaving freeing it
+// to the background if it's big.
+func (kv *Kv) UnlinkHash(key string) {
+	kv.deleteHash(key, true)
+}
+
+func (kv *Kv) deleteHash(key string, lazy bool) {
+	shard := kv.Shard(key)
+	old, ok := shard.HSETs[key]
+	if !ok {
+		return
+	}
+	kv.saveHash(shard, key)
+	delete(shard.HSETs, key)
+	kv.freeHash(key, old, lazy)
+}
+
+// Reset empties the dataset. It must be called with every shard locked
+// for writing.
+func (kv *Kv) Reset() {
+	for _, shard := range kv.shards {
+		kv.reset(shard)
+	}
+	kv.resetUsed()
+}
+
+// ResetAsync empties the dataset like Reset, leaving freeing the keys to
+// the background. It must be called with every shard locked for writing.
+func (kv *Kv) ResetAsync() {
+	oldStrings := make([]map[string]*String, len(kv.shards))
+	oldHashes := make([]map[string]*Hash, len(kv.shards))
+	n := 0
+	for i, shard := range kv.shards {
+		oldStrings[i], oldHashes[i] = shard.SETs, shard.HSETs
+		n += len(shard.SETs) + len(shard.HSETs)
+		kv.reset(shard)
+	}
+	kv.resetUsed()
+	if n > 0 {
+		kv.freeLater(int64(n), func() int64 {
+			// Dropping the last references to the old keyspace is all
+			// there's left to do, its memory was already accounted for.
+			oldStrings, oldHashes = nil, nil
+			return 0
+		})
+	}
+}
+
+func (kv *Kv) reset(shard *Shard) {
+	if len(kv.reading) > 0 {
+		for key := range shard.SETs {
+			kv.saveString(shard, key)
+		}
+		for key := range shard.HSETs {
+			kv.saveHash(shard, key)
+		}
+	}
+
+	shard.SETs = map[string]*String{}
+	shard.HSETs = map[string]*Hash{}
+}
+
+// Encoding returns how the string or, failing that, the hash at key is
+// stored, as OBJECT ENCODING does. It locks the key's shard itself.
+func (kv *Kv) Encoding(key string) (string, bool) {
+	shard := kv.Shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	if value, ok := shard.SETs[key]; ok {
+		return value.load().Encoding(), true
+	}
+	h, ok := shard.HSETs[key]
+	if !ok {
+		return "", false
 	}
+	return h.Encoding(), true
 }
@@ -0,0 +1,113 @@
+package Database
+
+import "sync"
+
+// lazyfreeThreshold is how many fields a hash needs for freeing it to be
+// left to the background. Smaller values are freed right away, as
+// handing them over would take about as long.
+const lazyfreeThreshold = 64
+
+// lazyFree frees values taken out of the dataset in the background, so
+// deleting a big one doesn't stall the command that does it. The garbage
+// collector reclaims the memory of values either way, once nothing points
+// to them anymore. What freeing a value takes here is releasing it and
+// accounting for the memory it took, which means going through every
+// field of a hash.
+//
+// A single worker goroutine frees values in the order they were handed
+// over, and only runs while there are some.
+type lazyFree struct {
+	sync.Mutex
+	queue   []freeJob
+	running bool
+	// bumped when the dataset is reset, which accounts for the memory of
+	// everything that was pending at once
+	generation uint64
+	// objects handed over and not yet freed, and freed so far
+	pending int64
+	freed   int64
+}
+
+type freeJob struct {
+	objects    int64
+	generation uint64
+	// returns the memory the objects took, if it's still in used
+	free func() int64
+}
+
+// LazyFreeStats returns how many objects are waiting to be freed in the
+// background, and how many were freed so far.
+func (kv *Kv) LazyFreeStats() (pending, freed int64) {
+	lf := &kv.lazyFree
+	lf.Lock()
+	defer lf.Unlock()
+
+	return lf.pending, lf.freed
+}
+
+// freeLater hands objects over to the worker, which calls free to release
+// them and subtracts what it returns from the memory used.
+func (kv *Kv) freeLater(objects int64, free func() int64) {
+	lf := &kv.lazyFree
+	lf.Lock()
+	defer lf.Unlock()
+
+	lf.queue = append(lf.queue, freeJob{objects: objects, generation: lf.generation, free: free})
+	lf.pending += objects
+	if !lf.running {
+		lf.running = true
+		go kv.freeWorker()
+	}
+}
+
+func (kv *Kv) freeWorker() {
+	lf := &kv.lazyFree
+	for {
+		lf.Lock()
+		jobs := lf.queue
+		lf.queue = nil
+		if len(jobs) == 0 {
+			lf.running = false
+			lf.Unlock()
+			return
+		}
+		lf.Unlock()
+
+		for _, job := range jobs {
+			size := job.free()
+
+			lf.Lock()
+			// A reset since already took the memory off.
+			if job.generation == lf.generation {
+				kv.used.Add(-size)
+			}
+			lf.pending -= job.objects
+			lf.freed += job.objects
+			lf.Unlock()
+		}
+	}
+}
+
+// resetUsed sets the memory used to 0, for a dataset that was just reset,
+// including what the values still waiting to be freed took.
+func (kv *Kv) resetUsed() {
+	lf := &kv.lazyFree
+	lf.Lock()
+	defer lf.Unlock()
+
+	lf.generation++
+	kv.used.Store(0)
+}
+
+// freeHash accounts for the memory of a hash taken out of the dataset.
+// If lazy, big hashes are left to the background.
+func (kv *Kv) freeHash(key string, h *Hash, lazy bool) {
+	if lazy && h.fields != nil && len(h.fields) > lazyfreeThreshold {
+		// The hash is out of the dataset, so nothing changes it anymore.
+		kv.freeLater(1, func() int64 {
+			return hashSize(key, h)
+		})
+		return
+	}
+	kv.used.Add(-hashSize(key, h))
+}
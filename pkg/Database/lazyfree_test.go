@@ -0,0 +1,126 @@
+package Database
+
+import (
+	"maps"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// freed waits for the background frees to be done, and returns how many
+// objects were freed.
+func freed(t *testing.T, kv *Kv) int64 {
+	t.Helper()
+
+	assert.Eventually(t, func() bool {
+		pending, _ := kv.LazyFreeStats()
+		return pending == 0
+	}, time.Second, time.Millisecond)
+	_, n := kv.LazyFreeStats()
+	return n
+}
+
+// bigHash adds a hash big enough to be freed in the background.
+func bigHash(kv *Kv, key string) {
+	for i := range max(lazyfreeThreshold, kv.HashMaxListpackEntries) + 1 {
+		kv.SetField(key, strconv.Itoa(i), "v")
+	}
+}
+
+func TestUnlinkHash(t *testing.T) {
+	kv := NewKv()
+	kv.SetField("small", "f", "v")
+	bigHash(kv, "big")
+
+	kv.UnlinkHash("small")
+	kv.UnlinkHash("big")
+	kv.UnlinkHash("missing")
+	assert.Empty(t, kv.Hashes())
+
+	// Only the big hash was left to the background.
+	assert.Equal(t, int64(1), freed(t, kv))
+	assert.Zero(t, kv.Used())
+}
+
+func TestResetAsync(t *testing.T) {
+	kv := NewKv()
+	kv.SetString("a", str("1"))
+	bigHash(kv, "h")
+
+	kv.ResetAsync()
+	assert.Empty(t, kv.Strings())
+	assert.Empty(t, kv.Hashes())
+	assert.Zero(t, kv.Used())
+	assert.Equal(t, int64(2), freed(t, kv))
+
+	// A reset takes the memory of hashes still waiting to be freed off
+	// too, so it isn't taken off twice.
+	bigHash(kv, "h")
+	kv.UnlinkHash("h")
+	kv.Reset()
+	freed(t, kv)
+	assert.Zero(t, kv.Used())
+}
+
+func TestFreeMemoryWhileFreeing(t *testing.T) {
+	kv := NewKv()
+	kv.MaxMemoryPolicy = AllKeysRandom
+	kv.SetString("a", str("1"))
+	kv.MaxMemory = 1
+
+	// Nothing is evicted while memory is on its way down.
+	release := make(chan struct{})
+	kv.freeLater(1, func() int64 {
+		<-release
+		return 0
+	})
+	assert.NoError(t, kv.FreeMemory())
+	assert.Len(t, kv.Strings(), 1)
+
+	close(release)
+	freed(t, kv)
+	assert.NoError(t, kv.FreeMemory())
+	assert.Empty(t, kv.Strings())
+}
+
+func TestLazyEviction(t *testing.T) {
+	kv := NewKv()
+	kv.MaxMemoryPolicy = AllKeysRandom
+	kv.LazyFreeLazyEviction = true
+	bigHash(kv, "h")
+	kv.MaxMemory = 1
+
+	assert.NoError(t, kv.FreeMemory())
+	assert.Empty(t, kv.Hashes())
+	assert.Equal(t, int64(1), freed(t, kv))
+	assert.Zero(t, kv.Used())
+}
+
+// BenchmarkDeleteHash times deleting a hash of 100k fields, which
+// UnlinkHash leaves to the background.
+func BenchmarkDeleteHash(b *testing.B) {
+	fields := map[string]string{}
+	for i := range 100_000 {
+		fields["field:"+strconv.Itoa(i)] = strconv.Itoa(i)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		delete func(kv *Kv, key string)
+	}{
+		{"sync", (*Kv).DeleteHash},
+		{"lazy", (*Kv).UnlinkHash},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			kv := NewKv()
+			for range b.N {
+				b.StopTimer()
+				kv.SetHash("h", maps.Clone(fields))
+				b.StartTimer()
+				tc.delete(kv, "h")
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package Database
+
+import (
+	"slices"
+	"unsafe"
+)
+
+// sizeClasses are the sizes the Go allocator rounds small objects up to.
+var sizeClasses = []int{
+	8, 16, 24, 32, 48, 64, 80, 96, 112, 128, 144, 160, 176, 192, 208, 224, 240, 256,
+	288, 320, 352, 384, 416, 448, 480, 512, 576, 640, 704, 768, 896, 1024, 1152, 1280,
+	1408, 1536, 1792, 2048, 2304, 2688, 3072, 3200, 3456, 4096, 4864, 5376, 6144, 6528,
+	6784, 6912, 8192, 9472, 9728, 10240, 10880, 12288, 13568, 14336, 16384, 18432, 19072,
+	20480, 21760, 24576, 27264, 28672, 32768,
+}
+
+// pageSize is what larger objects are rounded up to.
+const pageSize = 8192
+
+// allocSize returns the memory the allocator takes for an n byte object.
+func allocSize(n int) int64 {
+	if n == 0 {
+		return 0
+	}
+	if n > sizeClasses[len(sizeClasses)-1] {
+		return int64((n + pageSize - 1) / pageSize * pageSize)
+	}
+	i, _ := slices.BinarySearch(sizeClasses, n)
+	return int64(sizeClasses[i])
+}
+
+// Maps are made of groups of 8 slots, each holding a key and value, plus a
+// control byte per slot. Their tables double in size once 7/8 full, up to
+// 1024 slots, past which tables are split in two instead, so big maps are
+// about 2/3 full on average. Every map has a header, and tables have their
+// own.
+const (
+	mapHeader        = 48
+	tableHeader      = 32
+	groupSize        = 8
+	maxTableCapacity = 1024
+)
+
+// Slot sizes of the dataset's maps, a string header for the key and the
+// value.
+var (
+	stringSlot = 16 + int(unsafe.Sizeof(&String{}))
+	hashSlot   = 16 + int(unsafe.Sizeof(&Hash{}))
+	fieldSlot  = 16 + 16
+)
+
+// mapEntrySize returns the memory an entry takes in a big map.
+func mapEntrySize(slot int) int64 {
+	return (tableHeader + allocSize(maxTableCapacity*(slot+1))) * 3 / 2 / maxTableCapacity
+}
+
+// mapSize returns the memory taken by a map of n entries, besides what the
+// entries point to.
+func mapSize(n, slot int) int64 {
+	if n <= groupSize {
+		return mapHeader + allocSize(groupSize*(slot+1))
+	}
+	if n > maxTableCapacity*7/8 {
+		return mapHeader + int64(n)*mapEntrySize(slot)
+	}
+
+	capacity := 2 * groupSize
+	for capacity*7/8 < n {
+		capacity *= 2
+	}
+	return mapHeader + tableHeader + allocSize(capacity*(slot+1))
+}
+
+// Memory taken by the structures holding a key in the keyspace, besides
+// its name and value: its entry in the map of keys, and the String or Hash
+// it points to, which holds the access word along with the TTL of strings
+// and the fields of hashes.
+var (
+	stringOverhead = mapEntrySize(stringSlot) + allocSize(int(unsafe.Sizeof(String{})))
+	hashOverhead   = mapEntrySize(hashSlot) + allocSize(int(unsafe.Sizeof(Hash{})))
+)
+
+// stringSize returns the estimated memory taken by a string key.
+func stringSize(key string, value String) int64 {
+	return stringOverhead + allocSize(len(key)) + value.size()
+}
+
+// hashSize returns the estimated memory taken by a hash key.
+func hashSize(key string, h *Hash) int64 {
+	return hashOverhead + allocSize(len(key)) + h.size()
+}
+
+// size returns the memory taken by the fields of the hash.
+func (h *Hash) size() int64 {
+	if h.fields == nil {
+		return allocSize(len(h.packed))
+	}
+
+	size := mapSize(len(h.fields), fieldSlot)
+	for field, value := range h.fields {
+		size += fieldSize(field, value)
+	}
+	return size
+}
+
+func fieldSize(field, value string) int64 {
+	return allocSize(len(field)) + allocSize(len(value))
+}
+
+// Usage returns the estimated memory taken by the key and its value, as
+// MEMORY USAGE does. The string or, failing that, the hash at key is
+// looked at. Only samples fields of a hash are, and taken to be the
+// average of all of them, unless samples is 0. It locks the key's shard
+// itself.
+func (kv *Kv) Usage(key string, samples int) (int64, bool) {
+	shard := kv.Shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	if value, ok := shard.SETs[key]; ok {
+		return stringSize(key, value.load()), true
+	}
+	h, ok := shard.HSETs[key]
+	if !ok {
+		return 0, false
+	}
+	// Packed hashes are a single allocation, there's nothing to sample.
+	if h.fields == nil || samples <= 0 || samples >= len(h.fields) {
+		return hashSize(key, h), true
+	}
+
+	var sampled int64
+	n := 0
+	for field, value := range h.fields {
+		if n == samples {
+			break
+		}
+		sampled += fieldSize(field, value)
+		n++
+	}
+	size := hashOverhead + allocSize(len(key)) + mapSize(len(h.fields), fieldSlot)
+	return size + sampled*int64(len(h.fields))/int64(n), true
+}
+
+// Overhead returns the estimated memory taken by the keyspace itself
+// rather than the keys and values in it: the entries of its maps and the
+// String and Hash structures. It's part of Used. It locks each shard in turn.
+func (kv *Kv) Overhead() int64 {
+	var overhead int64
+	for _, shard := range kv.shards {
+		shard.RLock()
+		overhead += int64(len(shard.SETs))*stringOverhead + int64(len(shard.HSETs))*hashOverhead
+		shard.RUnlock()
+	}
+	return overhead
+}
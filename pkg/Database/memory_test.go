@@ -0,0 +1,98 @@
+package Database
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllocSize(t *testing.T) {
+	assert.Equal(t, int64(0), allocSize(0))
+	assert.Equal(t, int64(8), allocSize(1))
+	assert.Equal(t, int64(16), allocSize(16))
+	assert.Equal(t, int64(288), allocSize(257))
+	assert.Equal(t, int64(32768), allocSize(30000))
+	assert.Equal(t, int64(40960), allocSize(32769))
+}
+
+func TestUsage(t *testing.T) {
+	kv := NewKv()
+	kv.SetString("a", str("value"))
+	for i := range 100 {
+		kv.SetField("h", strconv.Itoa(i), strings.Repeat("v", i))
+	}
+
+	usage, ok := kv.Usage("a", 5)
+	require.True(t, ok)
+	assert.Equal(t, stringOverhead+8+8, usage)
+
+	all, ok := kv.Usage("h", 0)
+	require.True(t, ok)
+	assert.Equal(t, hashSize("h", kv.Shard("h").HSETs["h"]), all)
+	assert.Equal(t, kv.Used(), usage+all)
+
+	// Sampled fields are a rough estimate of the rest.
+	sampled, ok := kv.Usage("h", 10)
+	require.True(t, ok)
+	assert.InEpsilon(t, all, sampled, 0.5)
+
+	_, ok = kv.Usage("missing", 0)
+	assert.False(t, ok)
+
+	assert.Equal(t, stringOverhead+hashOverhead, kv.Overhead())
+}
+
+// The estimate has to be close to what the dataset really takes, since
+// it's what maxmemory is enforced on.
+func TestUsedMatchesHeap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("allocates a large dataset")
+	}
+
+	heap := func() int64 {
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		return int64(ms.HeapAlloc)
+	}
+
+	for _, tc := range []struct {
+		name string
+		fill func(kv *Kv, i int)
+	}{
+		{"small strings", func(kv *Kv, i int) {
+			key := "key:" + strconv.Itoa(i)
+			kv.SetString(key, NewString(strings.Clone("value:"+key), 0))
+		}},
+		{"large strings", func(kv *Kv, i int) {
+			kv.SetString("key:"+strconv.Itoa(i), NewString(strings.Repeat("x", 1000), 0))
+		}},
+		{"small hashes", func(kv *Kv, i int) {
+			key := "key:" + strconv.Itoa(i)
+			for f := range 3 {
+				kv.SetField(key, "field:"+strconv.Itoa(f), strconv.Itoa(i*f+1000))
+			}
+		}},
+		{"large hashes", func(kv *Kv, i int) {
+			key := "key:" + strconv.Itoa(i/5000)
+			kv.SetField(key, "field:"+strconv.Itoa(i), strconv.Itoa(i+1000))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := heap()
+			kv := NewKv()
+			for i := range 100000 {
+				tc.fill(kv, i)
+			}
+			real := heap() - before
+
+			t.Logf("estimated %d bytes, took %d", kv.Used(), real)
+			assert.InEpsilon(t, real, kv.Used(), 0.2)
+			runtime.KeepAlive(kv)
+		})
+	}
+}
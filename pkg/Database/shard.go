@@ -0,0 +1,134 @@
+package Database
+
+import (
+	"hash/maphash"
+	"slices"
+	"sync"
+)
+
+// DefaultShards is how many shards NewKv splits the keyspace into.
+const DefaultShards = 16
+
+// Shard is a partition of the keyspace, holding the keys that hash to it,
+// with its own lock so commands on keys of different shards don't wait
+// on each other. The lock guards everything in the shard, strings and
+// hashes alike.
+//
+// Commands on a single key lock the shard Kv.Shard returns for it. Ones on
+// several keys lock all of their shards at once with Kv.LockKeys, and ones
+// on the whole dataset with Kv.LockAll, which both lock shards in order so
+// they can't deadlock with each other.
+type Shard struct {
+	sync.RWMutex
+	SETs  map[string]*String
+	HSETs map[string]*Hash
+
+	// position of the shard in Kv.shards, which is the order shards are
+	// locked in
+	index int
+}
+
+func newShard(index int) *Shard {
+	return &Shard{
+		SETs:  map[string]*String{},
+		HSETs: map[string]*Hash{},
+		index: index,
+	}
+}
+
+// Shard returns the shard holding key.
+func (kv *Kv) Shard(key string) *Shard {
+	if len(kv.shards) == 1 {
+		return kv.shards[0]
+	}
+	return kv.shards[maphash.String(kv.seed, key)%uint64(len(kv.shards))]
+}
+
+// Shards are shards locked together, in the order they were locked.
+type Shards []*Shard
+
+// Unlock unlocks the shards.
+func (shards Shards) Unlock() {
+	for i := len(shards) - 1; i >= 0; i-- {
+		shards[i].Unlock()
+	}
+}
+
+// LockKeys locks the shards holding keys for writing, each once and in
+// order, so that a command changing several keys does so atomically.
+func (kv *Kv) LockKeys(keys ...string) Shards {
+	shards := make(Shards, 0, min(len(keys), len(kv.shards)))
+	for _, key := range keys {
+		shard := kv.Shard(key)
+		if !slices.Contains(shards, shard) {
+			shards = append(shards, shard)
+		}
+	}
+	slices.SortFunc(shards, func(a, b *Shard) int {
+		return a.index - b.index
+	})
+
+	for _, shard := range shards {
+		shard.Lock()
+	}
+	return shards
+}
+
+// LockAll locks every shard for writing, in order.
+func (kv *Kv) LockAll() {
+	for _, shard := range kv.shards {
+		shard.Lock()
+	}
+}
+
+// UnlockAll unlocks every shard locked by LockAll.
+func (kv *Kv) UnlockAll() {
+	for i := len(kv.shards) - 1; i >= 0; i-- {
+		kv.shards[i].Unlock()
+	}
+}
+
+// Strings returns a copy of every string in the dataset. Each shard is
+// locked in turn, so the copy isn't a point in time view of a dataset
+// being written to, which is what Snapshot is for.
+func (kv *Kv) Strings() map[string]String {
+	strings := map[string]String{}
+	for _, shard := range kv.shards {
+		shard.RLock()
+		for key, value := range shard.SETs {
+			strings[key] = value.load()
+		}
+		shard.RUnlock()
+	}
+	return strings
+}
+
+// Hashes returns a copy of the fields of every hash in the dataset, locking
+// each shard in turn like Strings.
+func (kv *Kv) Hashes() map[string]map[string]string {
+	hashes := map[string]map[string]string{}
+	for _, shard := range kv.shards {
+		shard.RLock()
+		for key, h := range shard.HSETs {
+			hashes[key] = h.Map()
+		}
+		shard.RUnlock()
+	}
+	return hashes
+}
+
+// DBSize returns how many keys there are, and how many of them have a TTL,
+// locking each shard in turn.
+func (kv *Kv) DBSize() (keys, expires int) {
+	for _, shard := range kv.shards {
+		shard.RLock()
+		keys += len(shard.SETs) + len(shard.HSETs)
+		for _, value := range shard.SETs {
+			if value.Expires > 0 {
+				expires++
+			}
+		}
+		shard.RUnlock()
+	}
+	return keys, expires
+}
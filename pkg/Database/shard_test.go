@@ -0,0 +1,160 @@
+package Database
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShard(t *testing.T) {
+	kv := NewKv()
+	used := map[*Shard]bool{}
+	for i := range 1000 {
+		key := strconv.Itoa(i)
+		assert.Same(t, kv.Shard(key), kv.Shard(key))
+		used[kv.Shard(key)] = true
+	}
+	assert.Len(t, used, DefaultShards)
+
+	single := newKv(1)
+	assert.Same(t, single.shards[0], single.Shard("a"))
+}
+
+func TestLockKeys(t *testing.T) {
+	kv := NewKv()
+	// Enough keys to be all but certain to hit every shard, whatever the
+	// seed.
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(len(keys) - i)
+	}
+
+	// Each shard is locked once, in order, whatever the order of the keys.
+	shards := kv.LockKeys(append(keys, keys...)...)
+	assert.Len(t, shards, DefaultShards)
+	for i := 1; i < len(shards); i++ {
+		assert.Less(t, shards[i-1].index, shards[i].index)
+	}
+	shards.Unlock()
+
+	shards = kv.LockKeys("a", "a")
+	assert.Equal(t, Shards{kv.Shard("a")}, shards)
+	shards.Unlock()
+}
+
+func TestLockKeysAtomic(t *testing.T) {
+	kv := NewKv()
+	const n = 100
+
+	// Writers set pairs of keys to the same value, half of them naming
+	// the keys in the opposite order, which would deadlock if shards
+	// weren't locked in order, and check they never see a pair half set.
+	var wg sync.WaitGroup
+	var torn atomic.Int64
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range n {
+				a, b := fmt.Sprintf("a%d", i), fmt.Sprintf("b%d", i)
+				if w%2 == 1 {
+					a, b = b, a
+				}
+
+				shards := kv.LockKeys(a, b)
+				va, _ := kv.GetString(a)
+				vb, _ := kv.GetString(b)
+				if va != vb {
+					torn.Add(1)
+				}
+				value := NewString(strconv.Itoa(w*n+i), 0)
+				kv.SetString(a, value)
+				kv.SetString(b, value)
+				shards.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Zero(t, torn.Load())
+	keys, _ := kv.DBSize()
+	assert.Equal(t, 2*n, keys)
+}
+
+func TestDBSize(t *testing.T) {
+	kv := NewKv()
+	kv.SetString("a", str("1"))
+	kv.SetString("b", NewString("2", 1))
+	kv.SetField("h", "f", "v")
+
+	keys, expires := kv.DBSize()
+	assert.Equal(t, 3, keys)
+	assert.Equal(t, 1, expires)
+	assert.Equal(t, map[string]String{"a": str("1"), "b": NewString("2", 1)}, kv.Strings())
+	assert.Equal(t, map[string]map[string]string{"h": {"f": "v"}}, kv.Hashes())
+}
+
+// BenchmarkParallel measures the throughput of a mix of reads and writes
+// from parallel goroutines, with a single shard, which is as if the
+// keyspace had a single lock, and with the default number of them.
+//
+// Goroutines only contend for locks while running at the same time, so
+// with a single CPU the two score the same. The yield runs make writers
+// give up the CPU while holding their lock, as a command does when it's
+// descheduled, which shows what sharding saves even then. Compare runs
+// with benchstat, e.g. go test -bench Parallel -cpu 1,4,8.
+func BenchmarkParallel(b *testing.B) {
+	const keys = 10000
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = "key:" + strconv.Itoa(i)
+	}
+
+	for _, yield := range []bool{false, true} {
+		for _, writes := range []int{10, 50} {
+			for _, shards := range []int{1, DefaultShards} {
+				benchmarkParallel(b, names, shards, writes, yield)
+			}
+		}
+	}
+}
+
+func benchmarkParallel(b *testing.B, names []string, shards, writes int, yield bool) {
+	b.Run(fmt.Sprintf("yield=%t/writes=%d%%/shards=%d", yield, writes, shards), func(b *testing.B) {
+		kv := newKv(shards)
+		value := str("value")
+		for _, key := range names {
+			kv.SetString(key, value)
+		}
+
+		// More goroutines than CPUs, so there's someone to yield to.
+		b.SetParallelism(4)
+		var next atomic.Int64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := int(next.Add(1)) * 7919
+			for pb.Next() {
+				i++
+				key := names[i%len(names)]
+				shard := kv.Shard(key)
+				if i%100 < writes {
+					shard.Lock()
+					kv.SetString(key, value)
+					if yield {
+						runtime.Gosched()
+					}
+					shard.Unlock()
+				} else {
+					shard.RLock()
+					kv.GetString(key)
+					shard.RUnlock()
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,263 @@
+package Database
+
+import "slices"
+
+// snapshotBatch is how many keys a Snapshot looks up per hold of a lock.
+const snapshotBatch = 1024
+
+// Snapshot is a point in time view of a Kv, which stays the same while
+// writers carry on, for saving the dataset without stopping it the way
+// fork() does for Redis. Taking one only copies the names of the keys,
+// a shard at a time. Values are copied on write instead: the first time a
+// key of the snapshot changes before the snapshot has read it, the value
+// it had is saved for the snapshot, so the extra memory is bounded by how
+// much of the dataset changes ahead of the reader. Hashes, which are
+// otherwise changed in place, are copied as a whole when they first
+// change, and the snapshot keeps the original.
+//
+// A Snapshot is meant to be read by a single goroutine, and must be closed
+// once done with so writers stop saving values for it.
+type Snapshot struct {
+	kv *Kv
+	// what the snapshot holds of each shard, guarded by its lock
+	shards []snapshotShard
+}
+
+type snapshotShard struct {
+	// names of the keys the shard had, sorted, once listed is set
+	strings []string
+	hashes  []string
+	listed  bool
+	// how many of strings and hashes were read, which writers don't need
+	// to save anymore
+	stringsRead int
+	hashesRead  int
+	// values of the keys changed since, keyed by name. Until the keys are
+	// listed, every change is saved, and a key that didn't exist yet is
+	// saved as absent.
+	savedStrings map[string]savedString
+	savedHashes  map[string]*Hash
+}
+
+type savedString struct {
+	value  String
+	exists bool
+}
+
+// Snapshot returns a snapshot of the dataset. locked, if not nil, is
+// called while every shard is locked, to capture anything that has to
+// match the snapshot exactly, e.g. the AOF position.
+func (kv *Kv) Snapshot(locked func()) *Snapshot {
+	s := &Snapshot{kv: kv, shards: make([]snapshotShard, len(kv.shards))}
+	for i := range s.shards {
+		s.shards[i].savedStrings = map[string]savedString{}
+		s.shards[i].savedHashes = map[string]*Hash{}
+	}
+
+	kv.LockAll()
+	kv.reading = append(kv.reading, s)
+	if locked != nil {
+		locked()
+	}
+	kv.UnlockAll()
+
+	// Keys are listed a shard at a time, so writers only wait on the shard
+	// being listed. The ones of other shards save whatever they change
+	// until theirs is.
+	for i, shard := range kv.shards {
+		shard.Lock()
+		s.shards[i].list(shard)
+		shard.Unlock()
+	}
+
+	return s
+}
+
+// list lists the keys shard had when the snapshot was taken: the ones it
+// has now, less the ones created since, plus the ones deleted since.
+func (ss *snapshotShard) list(shard *Shard) {
+	ss.strings = make([]string, 0, len(shard.SETs))
+	for key := range shard.SETs {
+		if saved, ok := ss.savedStrings[key]; !ok || saved.exists {
+			ss.strings = append(ss.strings, key)
+		}
+	}
+	for key, saved := range ss.savedStrings {
+		if !saved.exists {
+			delete(ss.savedStrings, key)
+		} else if _, ok := shard.SETs[key]; !ok {
+			ss.strings = append(ss.strings, key)
+		}
+	}
+
+	ss.hashes = make([]string, 0, len(shard.HSETs))
+	for key := range shard.HSETs {
+		if h, ok := ss.savedHashes[key]; !ok || h != nil {
+			ss.hashes = append(ss.hashes, key)
+		}
+	}
+	for key, h := range ss.savedHashes {
+		if h == nil {
+			delete(ss.savedHashes, key)
+		} else if _, ok := shard.HSETs[key]; !ok {
+			ss.hashes = append(ss.hashes, key)
+		}
+	}
+
+	slices.Sort(ss.strings)
+	slices.Sort(ss.hashes)
+	ss.listed = true
+}
+
+// pending returns whether key is one of keys, of which the first read
+// were read already, that the snapshot has yet to read.
+func (ss *snapshotShard) pending(keys []string, read int, key string) bool {
+	if !ss.listed {
+		return true
+	}
+	i, found := slices.BinarySearch(keys, key)
+	return found && i >= read
+}
+
+// Strings calls fn with every string in the snapshot, stopping at the
+// first error. A shard is only locked while a batch of its keys is looked
+// up, not while fn runs.
+func (s *Snapshot) Strings(fn func(key string, value String) error) error {
+	keys := make([]string, 0, snapshotBatch)
+	values := make([]String, 0, snapshotBatch)
+
+	for i, shard := range s.kv.shards {
+		ss := &s.shards[i]
+		for start := 0; start < len(ss.strings); start += snapshotBatch {
+			end := min(start+snapshotBatch, len(ss.strings))
+			keys, values = keys[:0], values[:0]
+			// Reading the batch changes the snapshot, but writers of the
+			// shard are kept out all the same. Values are copied, so the
+			// batch is read as soon as they are.
+			shard.RLock()
+			for _, key := range ss.strings[start:end] {
+				var value String
+				if saved, ok := ss.savedStrings[key]; ok {
+					delete(ss.savedStrings, key)
+					if !saved.exists {
+						continue
+					}
+					value = saved.value
+				} else {
+					value = shard.SETs[key].load()
+				}
+				keys = append(keys, key)
+				values = append(values, value)
+			}
+			ss.stringsRead = end
+			shard.RUnlock()
+
+			for i, key := range keys {
+				err := fn(key, values[i])
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Hashes calls fn with every hash in the snapshot, stopping at the first
+// error. The hash must not be changed, nor kept once fn returns: writers
+// only leave it as it is until the batch it's part of is read.
+func (s *Snapshot) Hashes(fn func(key string, h *Hash) error) error {
+	keys := make([]string, 0, snapshotBatch)
+	hashes := make([]*Hash, 0, snapshotBatch)
+
+	for i, shard := range s.kv.shards {
+		ss := &s.shards[i]
+		for start := 0; start < len(ss.hashes); start += snapshotBatch {
+			end := min(start+snapshotBatch, len(ss.hashes))
+			keys, hashes = keys[:0], hashes[:0]
+			shard.RLock()
+			// fn is done with the hashes of the previous batch, which can
+			// be changed in place again.
+			ss.readHashes(start)
+			for _, key := range ss.hashes[start:end] {
+				h, ok := ss.savedHashes[key]
+				if !ok {
+					h = shard.HSETs[key]
+				}
+				if h == nil {
+					continue
+				}
+				keys = append(keys, key)
+				hashes = append(hashes, h)
+			}
+			shard.RUnlock()
+
+			for i, key := range keys {
+				err := fn(key, hashes[i])
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		shard.RLock()
+		ss.readHashes(len(ss.hashes))
+		shard.RUnlock()
+	}
+
+	return nil
+}
+
+// readHashes marks the hashes up to n as read, dropping what was saved of
+// them.
+func (ss *snapshotShard) readHashes(n int) {
+	for _, key := range ss.hashes[ss.hashesRead:n] {
+		delete(ss.savedHashes, key)
+	}
+	ss.hashesRead = n
+}
+
+// Close releases the snapshot.
+func (s *Snapshot) Close() {
+	kv := s.kv
+	kv.LockAll()
+	defer kv.UnlockAll()
+
+	kv.reading = slices.DeleteFunc(kv.reading, func(open *Snapshot) bool {
+		return open == s
+	})
+}
+
+// saveString saves the value of the string at key, in shard, for the
+// snapshots that haven't seen it change yet and have yet to read it.
+func (kv *Kv) saveString(shard *Shard, key string) {
+	for _, s := range kv.reading {
+		ss := &s.shards[shard.index]
+		if _, ok := ss.savedStrings[key]; ok || !ss.pending(ss.strings, ss.stringsRead, key) {
+			continue
+		}
+		var saved savedString
+		if value, ok := shard.SETs[key]; ok {
+			saved = savedString{value: value.load(), exists: true}
+		}
+		ss.savedStrings[key] = saved
+	}
+}
+
+// saveHash saves the hash at key, in shard, for the snapshots that haven't
+// seen it change yet and have yet to be done with it, returning whether
+// any did, in which case the hash now belongs to them and must be copied
+// rather than changed in place.
+func (kv *Kv) saveHash(shard *Shard, key string) bool {
+	saved := false
+	for _, s := range kv.reading {
+		ss := &s.shards[shard.index]
+		if _, ok := ss.savedHashes[key]; ok || !ss.pending(ss.hashes, ss.hashesRead, key) {
+			continue
+		}
+		ss.savedHashes[key] = shard.HSETs[key]
+		saved = true
+	}
+	return saved
+}
@@ -0,0 +1,255 @@
+package Database
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func str(s string) String {
+	return NewString(s, 0)
+}
+
+// read returns everything in snap.
+func read(t *testing.T, snap *Snapshot) (map[string]string, map[string]map[string]string) {
+	t.Helper()
+
+	strings := map[string]string{}
+	require.NoError(t, snap.Strings(func(key string, value String) error {
+		_, dup := strings[key]
+		require.False(t, dup, "string %q read twice", key)
+		strings[key] = value.String()
+		return nil
+	}))
+	all := map[string]map[string]string{}
+	require.NoError(t, snap.Hashes(func(key string, h *Hash) error {
+		_, dup := all[key]
+		require.False(t, dup, "hash %q read twice", key)
+		all[key] = h.Map()
+		return nil
+	}))
+	return strings, all
+}
+
+func TestSnapshot(t *testing.T) {
+	kv := NewKv()
+	kv.SetString("a", str("1"))
+	kv.SetString("b", str("2"))
+	kv.SetField("h", "f", "v")
+	kv.SetField("gone", "f", "v")
+
+	locked := false
+	snap := kv.Snapshot(func() { locked = true })
+	assert.True(t, locked)
+
+	kv.SetString("a", str("changed"))
+	kv.SetString("a", str("changed again"))
+	kv.DeleteString("b")
+	kv.SetString("b", str("back"))
+	kv.SetString("new", str("x"))
+	kv.SetField("h", "f", "changed")
+	kv.SetField("h", "g", "added")
+	kv.DeleteHash("gone")
+	kv.SetField("newhash", "f", "v")
+
+	strings, saved := read(t, snap)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, strings)
+	assert.Equal(t, map[string]map[string]string{"h": {"f": "v"}, "gone": {"f": "v"}}, saved)
+	snap.Close()
+	assert.Empty(t, kv.reading)
+
+	// The dataset itself has every change.
+	assert.Equal(t, map[string]String{"a": str("changed again"), "b": str("back"), "new": str("x")}, kv.Strings())
+	assert.Equal(t, map[string]map[string]string{"h": {"f": "changed", "g": "added"}, "newhash": {"f": "v"}}, kv.Hashes())
+
+	// Once closed, hashes are changed in place again.
+	h := kv.Shard("h").HSETs["h"]
+	kv.SetField("h", "f", "in place")
+	value, _ := h.Get("f")
+	assert.Equal(t, "in place", value)
+}
+
+func TestSnapshotHandedOut(t *testing.T) {
+	kv := NewKv()
+	kv.SetField("h", "f", "v")
+	snap := kv.Snapshot(nil)
+	defer snap.Close()
+
+	// A hash changed while it's being read is copied.
+	require.NoError(t, snap.Hashes(func(key string, h *Hash) error {
+		shard := kv.Shard(key)
+		shard.Lock()
+		kv.SetField(key, "f", "changed")
+		shard.Unlock()
+		assert.Equal(t, map[string]string{"f": "v"}, h.Map())
+		return nil
+	}))
+	assert.Equal(t, map[string]string{"f": "changed"}, kv.Shard("h").HSETs["h"].Map())
+
+	// Once read, it's changed in place again.
+	h := kv.Shard("h").HSETs["h"]
+	kv.SetField("h", "f", "in place")
+	assert.Same(t, h, kv.Shard("h").HSETs["h"])
+}
+
+func TestSnapshotSavesBounded(t *testing.T) {
+	kv := newKv(1)
+	const n = 10 * snapshotBatch
+	// Keys are read in order, which zero padding makes their numeric one.
+	name := func(i int) string {
+		return fmt.Sprintf("%05d", i)
+	}
+	for i := range n {
+		key := name(i)
+		kv.SetString(key, str("0"))
+		kv.SetField(key, "f", "0")
+	}
+
+	snap := kv.Snapshot(nil)
+	defer snap.Close()
+	ss := &snap.shards[0]
+	shard := kv.shards[0]
+
+	// For every key read, the key itself, a new key and the last key are
+	// changed. New keys aren't in the snapshot, and strings are done with
+	// once read, so only the last one is worth saving. Hashes are handed
+	// out as they are, so the ones of the batch being read are too.
+	maxStrings, maxHashes := 0, 0
+	write := func(key string, change func(key string)) {
+		shard.Lock()
+		change(key)
+		change("new-" + key)
+		change(name(n - 1))
+		maxStrings = max(maxStrings, len(ss.savedStrings))
+		maxHashes = max(maxHashes, len(ss.savedHashes))
+		shard.Unlock()
+	}
+	require.NoError(t, snap.Strings(func(key string, value String) error {
+		if key != name(n-1) {
+			assert.Equal(t, "0", value.String())
+		}
+		write(key, func(key string) {
+			kv.SetString(key, str("1"))
+		})
+		return nil
+	}))
+	require.NoError(t, snap.Hashes(func(key string, h *Hash) error {
+		assert.Equal(t, map[string]string{"f": "0"}, h.Map())
+		write(key, func(key string) {
+			kv.SetField(key, "f", "1")
+		})
+		return nil
+	}))
+
+	assert.Equal(t, 1, maxStrings)
+	assert.LessOrEqual(t, maxHashes, snapshotBatch+1)
+	assert.Empty(t, ss.savedStrings)
+	assert.Empty(t, ss.savedHashes)
+}
+
+func TestSnapshotList(t *testing.T) {
+	kv := newKv(1)
+	kv.SetString("a", str("1"))
+	kv.SetString("b", str("2"))
+	kv.SetField("h", "f", "v")
+
+	// A snapshot whose shard isn't listed yet, as while Snapshot lists
+	// the ones before it, saves every change, including to keys it won't
+	// have.
+	snap := &Snapshot{kv: kv, shards: []snapshotShard{{savedStrings: map[string]savedString{}, savedHashes: map[string]*Hash{}}}}
+	kv.reading = append(kv.reading, snap)
+	defer snap.Close()
+	kv.SetString("a", str("changed"))
+	kv.DeleteString("b")
+	kv.SetString("new", str("x"))
+	kv.SetField("h", "f", "changed")
+	kv.SetField("newhash", "f", "v")
+	ss := &snap.shards[0]
+	assert.Len(t, ss.savedStrings, 3)
+	assert.Len(t, ss.savedHashes, 2)
+
+	// Listing sorts them out, and keys created after that aren't saved.
+	ss.list(kv.shards[0])
+	assert.Equal(t, []string{"a", "b"}, ss.strings)
+	assert.Equal(t, []string{"h"}, ss.hashes)
+	assert.Len(t, ss.savedStrings, 2)
+	assert.Len(t, ss.savedHashes, 1)
+	kv.SetString("newer", str("y"))
+	kv.SetField("newerhash", "f", "v")
+	assert.Len(t, ss.savedStrings, 2)
+	assert.Len(t, ss.savedHashes, 1)
+
+	strings, hashes := read(t, snap)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, strings)
+	assert.Equal(t, map[string]map[string]string{"h": {"f": "v"}}, hashes)
+}
+
+func TestSnapshotOverlapping(t *testing.T) {
+	kv := NewKv()
+	kv.SetString("a", str("1"))
+	kv.SetField("h", "f", "1")
+
+	first := kv.Snapshot(nil)
+	kv.SetString("a", str("2"))
+	kv.SetField("h", "f", "2")
+	second := kv.Snapshot(nil)
+	kv.SetString("a", str("3"))
+	kv.SetField("h", "f", "3")
+
+	strings, hashes := read(t, first)
+	assert.Equal(t, map[string]string{"a": "1"}, strings)
+	assert.Equal(t, map[string]map[string]string{"h": {"f": "1"}}, hashes)
+	first.Close()
+
+	kv.SetField("h", "f", "4")
+	strings, hashes = read(t, second)
+	assert.Equal(t, map[string]string{"a": "2"}, strings)
+	assert.Equal(t, map[string]map[string]string{"h": {"f": "2"}}, hashes)
+	second.Close()
+}
+
+func TestSnapshotConcurrentWrites(t *testing.T) {
+	kv := NewKv()
+	const n = 5000
+	for i := range n {
+		key := strconv.Itoa(i)
+		kv.SetString(key, str("0"))
+		kv.SetField(key, "f", "0")
+	}
+
+	snap := kv.Snapshot(nil)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 1; round <= 3; round++ {
+			for i := range n {
+				key := strconv.Itoa(i)
+				shards := kv.LockKeys(key, key+"-new")
+				if i%2 == 0 {
+					kv.DeleteString(key)
+				}
+				kv.SetString(key+"-new", str("x"))
+				kv.SetString(key, str(strconv.Itoa(round)))
+				kv.SetField(key, "f", strconv.Itoa(round))
+				shards.Unlock()
+			}
+		}
+	}()
+
+	strings, saved := read(t, snap)
+	wg.Wait()
+	snap.Close()
+
+	require.Len(t, strings, n)
+	require.Len(t, saved, n)
+	for i := range n {
+		key := strconv.Itoa(i)
+		assert.Equal(t, "0", strings[key])
+		assert.Equal(t, map[string]string{"f": "0"}, saved[key])
+	}
+}
@@ -0,0 +1,191 @@
+package Database
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// String encodings, as OBJECT ENCODING reports them.
+const (
+	EncodingInt        = "int"
+	EncodingEmbstr     = "embstr"
+	EncodingRaw        = "raw"
+	EncodingCompressed = "compressed"
+)
+
+// embstrMaxLen is the longest string Redis stores as embstr. Go strings
+// always have their bytes apart, so the two encodings only differ in name.
+const embstrMaxLen = 44
+
+// How the value of a String is stored.
+const (
+	encRaw uint8 = iota
+	// in num
+	encInt
+	// in str, compressed with DEFLATE, and num is its length once
+	// decompressed
+	encDeflate
+)
+
+// String is a string value along with its expire time. Values that are
+// integers, written the way strconv.FormatInt would, are kept as one
+// rather than in a string of their own, like the int encoding of Redis.
+// Big values may be kept compressed, see Kv.EncodeString.
+//
+// Strings in the dataset are held by pointer, so readers can update their
+// access word in place. They're copied with load, as the access word
+// mustn't be read without atomics.
+type String struct {
+	str string
+	num int64
+	enc uint8
+	// access word, only set in the dataset, see access.go
+	access uint32
+	// unix time in milliseconds the key expires at, 0 if it doesn't
+	Expires int64
+}
+
+// load returns a copy of a string held in the dataset, without its access
+// word.
+func (s *String) load() String {
+	return String{str: s.str, num: s.num, enc: s.enc, Expires: s.Expires}
+}
+
+// NewString returns a String holding value, expiring at expires.
+func NewString(value string, expires int64) String {
+	if n, ok := parseCanonicalInt(value); ok {
+		return String{num: n, enc: encInt, Expires: expires}
+	}
+	return String{str: value, Expires: expires}
+}
+
+// NewDeflatedString returns a String holding the value deflated
+// decompresses to, which is size bytes long, expiring at expires. deflated
+// is kept as it is.
+func NewDeflatedString(deflated string, size int, expires int64) String {
+	return String{str: deflated, num: int64(size), enc: encDeflate, Expires: expires}
+}
+
+// EncodeString returns a String holding value, expiring at expires, and
+// compressed if it's at least StringCompressMinSize bytes long and
+// compressing it saves memory. Compressing big values takes a while, so
+// it's best done before taking a lock.
+func (kv *Kv) EncodeString(value string, expires int64) String {
+	s := NewString(value, expires)
+	if s.enc != encRaw || kv.StringCompressMinSize <= 0 || len(value) < kv.StringCompressMinSize {
+		return s
+	}
+
+	deflated := deflate(value)
+	if len(deflated) >= len(value) {
+		return s
+	}
+	return NewDeflatedString(deflated, len(value), expires)
+}
+
+// parseCanonicalInt parses s if it's an integer written without a sign
+// for positive numbers or leading zeros, so it reads the same once turned
+// back into a string.
+func parseCanonicalInt(s string) (int64, bool) {
+	// Longer strings can't fit in an int64.
+	if s == "" || len(s) > 20 {
+		return 0, false
+	}
+	digits := s
+	if s[0] == '-' {
+		digits = s[1:]
+	}
+	if digits == "" || (digits[0] == '0' && (len(digits) > 1 || len(s) > 1)) {
+		return 0, false
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return 0, false
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// String returns the value, decompressing it if needed.
+func (s String) String() string {
+	switch s.enc {
+	case encInt:
+		return strconv.FormatInt(s.num, 10)
+	case encDeflate:
+		return inflate(s.str, int(s.num))
+	}
+	return s.str
+}
+
+// Deflated returns the compressed value and its length once decompressed,
+// if the value is kept compressed.
+func (s String) Deflated() (deflated string, size int, ok bool) {
+	if s.enc != encDeflate {
+		return "", 0, false
+	}
+	return s.str, int(s.num), true
+}
+
+// Encoding returns how the value is stored.
+func (s String) Encoding() string {
+	switch {
+	case s.enc == encInt:
+		return EncodingInt
+	case s.enc == encDeflate:
+		return EncodingCompressed
+	case len(s.str) <= embstrMaxLen:
+		return EncodingEmbstr
+	}
+	return EncodingRaw
+}
+
+// size returns the memory taken by the bytes of the value.
+func (s String) size() int64 {
+	return allocSize(len(s.str))
+}
+
+// Compressors are big, so they're reused.
+var (
+	flaters = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	}}
+	inflaters = sync.Pool{New: func() any {
+		return flate.NewReader(nil)
+	}}
+)
+
+func deflate(value string) string {
+	var buf bytes.Buffer
+	w := flaters.Get().(*flate.Writer)
+	defer flaters.Put(w)
+
+	w.Reset(&buf)
+	// Writes to a bytes.Buffer don't fail.
+	io.WriteString(w, value)
+	w.Close()
+	return buf.String()
+}
+
+func inflate(deflated string, size int) string {
+	r := inflaters.Get().(io.ReadCloser)
+	defer inflaters.Put(r)
+
+	r.(flate.Resetter).Reset(strings.NewReader(deflated), nil)
+	var sb strings.Builder
+	sb.Grow(size)
+	n, err := io.Copy(&sb, r)
+	if err != nil || n != int64(size) {
+		// Values are only ever deflated here, or loaded from sections
+		// that passed their checksum.
+		panic(fmt.Sprintf("corrupt compressed string: %d of %d bytes, %v", n, size, err))
+	}
+	return sb.String()
+}
@@ -0,0 +1,103 @@
+package Database
+
+import (
+	"math/rand/v2"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestString(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		encoding string
+	}{
+		{"0", EncodingInt},
+		{"-1", EncodingInt},
+		{"9223372036854775807", EncodingInt},
+		{"-9223372036854775808", EncodingInt},
+		// Only integers that read the same once formatted again are.
+		{"9223372036854775808", EncodingEmbstr},
+		{"007", EncodingEmbstr},
+		{"-0", EncodingEmbstr},
+		{"+1", EncodingEmbstr},
+		{"1 ", EncodingEmbstr},
+		{"-", EncodingEmbstr},
+		{"", EncodingEmbstr},
+		{"12345678901234567890123456789012345678901234", EncodingEmbstr},
+		{"123456789012345678901234567890123456789012345", EncodingRaw},
+	} {
+		s := NewString(tc.value, 5)
+		assert.Equal(t, tc.value, s.String())
+		assert.Equal(t, tc.encoding, s.Encoding(), tc.value)
+		assert.Equal(t, int64(5), s.Expires)
+	}
+}
+
+func TestEncodeString(t *testing.T) {
+	kv := NewKv()
+	compressible := strings.Repeat("compressible ", 100)
+	assert.Equal(t, EncodingRaw, kv.EncodeString(compressible, 0).Encoding())
+
+	kv.StringCompressMinSize = 100
+	s := kv.EncodeString(compressible, 5)
+	assert.Equal(t, EncodingCompressed, s.Encoding())
+	assert.Equal(t, compressible, s.String())
+	assert.Equal(t, int64(5), s.Expires)
+	deflated, size, ok := s.Deflated()
+	require.True(t, ok)
+	assert.Equal(t, len(compressible), size)
+	assert.Less(t, len(deflated), 100)
+	assert.Equal(t, s, NewDeflatedString(deflated, size, 5))
+
+	// Only big values that get smaller are compressed.
+	assert.Equal(t, EncodingEmbstr, kv.EncodeString("short", 0).Encoding())
+	random := make([]byte, 1000)
+	for i := range random {
+		random[i] = byte(rand.Uint32())
+	}
+	assert.Equal(t, EncodingRaw, kv.EncodeString(string(random), 0).Encoding())
+	kv.StringCompressMinSize = 1
+	assert.Equal(t, EncodingInt, kv.EncodeString("12345", 0).Encoding())
+	_, _, ok = kv.EncodeString("12345", 0).Deflated()
+	assert.False(t, ok)
+
+	// The memory taken is that of the compressed value.
+	kv.SetString("a", s)
+	assert.Equal(t, stringOverhead+8+allocSize(len(deflated)), kv.Used())
+}
+
+// BenchmarkStringMemory reports the heap taken by a million strings
+// holding integers, stored as such or as strings.
+func BenchmarkStringMemory(b *testing.B) {
+	for _, tc := range []struct {
+		name string
+		new  func(i int) String
+	}{
+		{"int", func(i int) String { return NewString(strconv.Itoa(i*1000), 0) }},
+		{"raw", func(i int) String { return String{str: strconv.Itoa(i * 1000)} }},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			for range b.N {
+				values := make([]String, 1_000_000)
+				before := heapAlloc()
+				for i := range values {
+					values[i] = tc.new(i)
+				}
+				b.ReportMetric(float64(heapAlloc()-before)/float64(len(values)), "heap-B/value")
+				runtime.KeepAlive(values)
+			}
+		})
+	}
+}
+
+func heapAlloc() int64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapAlloc)
+}
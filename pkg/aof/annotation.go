@@ -0,0 +1,83 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+// Annotations are lines starting with '#' between the commands of an AOF.
+// Redis skips them when loading, so files that have them stay readable by
+// Redis.
+//
+//	#TS:1760796300
+//
+// marks the unix time in seconds the commands after it were written at,
+// and is added whenever the second changes when Timestamps is set.
+//
+//	#CRC:1a2b3c4d:4096
+//
+// closes a batch: it holds the CRC-32C of the 4096 bytes before it, and is
+// added before every fsync and every maxBatchSize bytes when Checksums is
+// set. Commands after the last checksum, which a crash can leave behind,
+// aren't covered by one.
+const (
+	annotationTimestamp = "#TS:"
+	annotationChecksum  = "#CRC:"
+)
+
+// maxBatchSize bounds the bytes covered by a single checksum, so batches
+// stay small under appendfsync no, which hardly ever syncs.
+const maxBatchSize = 1 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChecksum is returned when a batch doesn't match its checksum.
+var ErrChecksum = errors.New("checksum mismatch")
+
+// batch tracks the bytes written since the last checksum.
+type batch struct {
+	crc uint32
+	n   int64
+}
+
+func (b *batch) add(p []byte) {
+	b.crc = crc32.Update(b.crc, crcTable, p)
+	b.n += int64(len(p))
+}
+
+// close appends the checksum annotation for the batch to buf, if it has
+// anything in it, and starts a new one.
+func (b *batch) close(buf []byte) []byte {
+	if b.n == 0 {
+		return buf
+	}
+	buf = fmt.Appendf(buf, "%s%08x:%d\r\n", annotationChecksum, b.crc, b.n)
+	*b = batch{}
+	return buf
+}
+
+func appendTimestamp(buf []byte, ts int64) []byte {
+	buf = append(buf, annotationTimestamp...)
+	buf = strconv.AppendInt(buf, ts, 10)
+	return append(buf, '\r', '\n')
+}
+
+// parseChecksum parses the body of a checksum annotation.
+func parseChecksum(s string) (crc uint32, n int64, err error) {
+	crcStr, nStr, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, errors.New("invalid checksum annotation")
+	}
+	c, err := strconv.ParseUint(crcStr, 16, 32)
+	if err != nil {
+		return 0, 0, errors.New("invalid checksum annotation")
+	}
+	n, err = strconv.ParseInt(nStr, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, 0, errors.New("invalid checksum annotation")
+	}
+	return uint32(c), n, nil
+}
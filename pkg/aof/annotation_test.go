@@ -0,0 +1,157 @@
+package aof
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/maniktherana/godbase/pkg/snapshot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAnnotatedAof(t *testing.T, dir string) *Aof {
+	t.Helper()
+
+	aof, err := NewAof(dir, "test.aof", FsyncAlways)
+	require.NoError(t, err)
+	aof.Timestamps = true
+	aof.Checksums = true
+	return aof
+}
+
+func TestAnnotations(t *testing.T) {
+	dir := t.TempDir()
+	aof := newAnnotatedAof(t, dir)
+
+	require.NoError(t, aof.Write(command("SET", "a", "1")))
+	require.NoError(t, aof.Write(command("SET", "b", "2")))
+	require.NoError(t, aof.WaitSync())
+	require.NoError(t, aof.Write(command("SET", "c", "3")))
+	require.NoError(t, aof.Close())
+
+	data, err := os.ReadFile(filepath.Join(dir, "test.aof.1.incr.aof"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "#TS:"), string(data))
+	// One checksum for the batch synced by WaitSync and one for the rest,
+	// synced by Close.
+	assert.Equal(t, 2, strings.Count(string(data), "#CRC:"), string(data))
+
+	aof = newAnnotatedAof(t, dir)
+	defer aof.Close()
+	assert.Equal(t, []resp.Value{command("SET", "a", "1"), command("SET", "b", "2"), command("SET", "c", "3")}, readAll(t, aof))
+
+	timestamps := 0
+	require.NoError(t, CheckFile(filepath.Join(dir, "test.aof.1.incr.aof"), snapshot.Handler{}, func(record Record) error {
+		if record.Timestamp != 0 {
+			timestamps++
+		}
+		return nil
+	}))
+	assert.Positive(t, timestamps)
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	aof := newAnnotatedAof(t, dir)
+	require.NoError(t, aof.Write(command("SET", "key", "value")))
+	require.NoError(t, aof.Close())
+
+	// Flip a byte in the value, which still parses fine.
+	path := filepath.Join(dir, "test.aof.1.incr.aof")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data = bytes.Replace(data, []byte("value"), []byte("valuf"), 1)
+	require.NoError(t, os.WriteFile(path, data, 0666))
+
+	aof = newAnnotatedAof(t, dir)
+	defer aof.Close()
+	aof.LoadTruncated = true
+
+	var corrupt *CorruptError
+	require.ErrorAs(t, aof.Read(func(resp.Value) {}), &corrupt)
+	assert.ErrorIs(t, corrupt, ErrChecksum)
+	assert.False(t, corrupt.Truncated)
+	assert.Zero(t, corrupt.Offset)
+}
+
+func TestChecksumAfterUnverifiedTail(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := NewAof(dir, "test.aof", FsyncNo)
+	require.NoError(t, err)
+	require.NoError(t, aof.Write(command("SET", "a", "1")))
+	require.NoError(t, aof.Close())
+
+	// Checksums only cover the bytes written after them, so turning them
+	// on for an existing file, or appending after a crash, works.
+	aof = newAnnotatedAof(t, dir)
+	require.NoError(t, aof.Write(command("SET", "b", "2")))
+	require.NoError(t, aof.Close())
+
+	aof = newAnnotatedAof(t, dir)
+	defer aof.Close()
+	assert.Equal(t, []resp.Value{command("SET", "a", "1"), command("SET", "b", "2")}, readAll(t, aof))
+}
+
+func TestRewriteAnnotations(t *testing.T) {
+	dir := t.TempDir()
+	aof := newAnnotatedAof(t, dir)
+	defer aof.Close()
+
+	aof.Snapshot = func(emit func(resp.Value) error) error {
+		return emit(command("SET", "key", "value"))
+	}
+	require.NoError(t, aof.BgRewrite())
+	aof.rewriteWg.Wait()
+	require.Contains(t, aof.Info(), "aof_last_bgrewrite_status:ok")
+
+	data, err := os.ReadFile(filepath.Join(dir, "test.aof.1.base.aof"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "#TS:"), string(data))
+	assert.Contains(t, string(data), "#CRC:")
+	assert.Equal(t, []resp.Value{command("SET", "key", "value")}, readAll(t, aof))
+}
+
+func TestFindTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"test.aof.1.base.aof": "#TS:100\r\n" + string(command("SET", "key", "base").Marshal()),
+		"test.aof.1.incr.aof": "#TS:200\r\n" + string(command("SET", "key", "200").Marshal()) +
+			"#TS:300\r\n" + string(command("SET", "key", "300").Marshal()),
+		"test.aof.2.incr.aof": "#TS:400\r\n" + string(command("SET", "key", "400").Marshal()),
+	}
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0666))
+	}
+	manifest := filepath.Join(dir, "test.aof.manifest")
+	require.NoError(t, os.WriteFile(manifest, []byte("file test.aof.1.base.aof seq 1 type b\n"+
+		"file test.aof.1.incr.aof seq 1 type i\n"+
+		"file test.aof.2.incr.aof seq 2 type i\n"), 0666))
+
+	cut, err := FindTimestamp(manifest, 400)
+	require.NoError(t, err)
+	assert.Nil(t, cut)
+
+	_, err = FindTimestamp(manifest, 50)
+	assert.ErrorIs(t, err, ErrBeforeBase)
+
+	cut, err = FindTimestamp(manifest, 250)
+	require.NoError(t, err)
+	size := int64(len("#TS:200\r\n") + len(command("SET", "key", "200").Marshal()))
+	assert.Equal(t, &Cut{
+		Manifest: manifest,
+		File:     filepath.Join(dir, "test.aof.1.incr.aof"),
+		Size:     size,
+		Dropped:  []string{filepath.Join(dir, "test.aof.2.incr.aof")},
+	}, cut)
+	require.NoError(t, cut.Apply())
+
+	aof, err := NewAof(dir, "test.aof", FsyncNo)
+	require.NoError(t, err)
+	defer aof.Close()
+	assert.Equal(t, []resp.Value{command("SET", "key", "base"), command("SET", "key", "200")}, readAll(t, aof))
+	assert.ElementsMatch(t, []string{"test.aof.1.base.aof", "test.aof.1.incr.aof", "test.aof.manifest"}, dirNames(t, dir))
+}
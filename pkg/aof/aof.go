@@ -2,70 +2,689 @@ package aof
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/maniktherana/godbase/pkg/snapshot"
 )
 
+// FsyncPolicy decides when data written to the AOF is fsynced, like
+// appendfsync in redis.conf.
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs before replies to writes are sent. Concurrent
+	// writers share fsyncs through WaitSync.
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncEverysec syncs in the background once a second.
+	FsyncEverysec FsyncPolicy = "everysec"
+	// FsyncNo leaves it to the operating system.
+	FsyncNo FsyncPolicy = "no"
+)
+
+// Aof is a multi part append only file, laid out like in Redis 7. Dir
+// holds a base file with the dataset as of the last rewrite, incremental
+// files with the writes made since, and a manifest listing them in order.
+// Writes are appended to the last incremental file.
 type Aof struct {
-	File *os.File
-	Rd   *bufio.Reader
-	Mu   sync.Mutex
+	// incremental file writes go to
+	File  *os.File
+	Mu    sync.Mutex
+	Fsync FsyncPolicy
+	// Dir holds the files, which are all named after Filename.
+	Dir      string
+	Filename string
+
+	// Snapshot emits commands that recreate the current dataset, for
+	// rewrites. Commands emitted may already include writes made after
+	// the rewrite started, so they must be safe to apply twice.
+	Snapshot func(emit func(resp.Value) error) error
+	// Preamble writes the dataset to w as a binary snapshot, like
+	// aof-use-rdb-preamble. When set, rewrites write the base file with it
+	// instead of Snapshot. A base file starting with a snapshot is loaded
+	// whether it's set or not, passing its entries to LoadPreamble.
+	Preamble     func(w io.Writer) error
+	LoadPreamble snapshot.Handler
+	// A rewrite starts by itself once the AOF is AutoRewritePercentage
+	// percent bigger than its base file, and at least AutoRewriteMinSize
+	// bytes. A zero percentage turns this off.
+	AutoRewritePercentage int
+	AutoRewriteMinSize    int64
+	// Progress, when set, is called every now and then while reading,
+	// with how many bytes of the files being read were read so far.
+	Progress func(loaded, total int64)
+	// LoadTruncated makes Read cut off a truncated record at the end of
+	// the AOF instead of failing, like aof-load-truncated.
+	LoadTruncated bool
+	// Timestamps and Checksums add timestamp and checksum annotations to
+	// the files written, see annotation.go.
+	Timestamps bool
+	Checksums  bool
+
+	manifest *manifest
+
+	// signalled whenever a sync finishes
+	synced *sync.Cond
+	// bytes written so far across all files, and how many of them are
+	// known to be on disk
+	writtenOffset int64
+	syncedOffset  int64
+	// whether a goroutine is fsyncing right now, without holding Mu
+	syncing bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+	// Close only closes the AOF once, and reports what it did each time
+	closeOnce sync.Once
+	closeErr  error
+
+	// reused to marshal commands in Write
+	buf []byte
+	// second of the last timestamp annotation in the current file
+	lastTimestamp int64
+	batch         batch
+
+	baseSize int64
+	incrSize int64
+	// size of File
+	fileSize int64
+	// bytes that couldn't be written because of a write error, kept until
+	// the disk takes them
+	pending []byte
+
+	rewriting bool
+	// first incremental file opened for the running rewrite, the ones
+	// before it are replaced by the new base
+	rewriteIncrSeq  int
+	rewriteStart    time.Time
+	lastRewriteErr  error
+	lastRewriteTime time.Duration
+	rewrites        int64
+	rewriteWg       sync.WaitGroup
+
+	lastWriteErr  error
+	lastFsyncErr  error
+	lastFsyncTime time.Time
+	fsyncs        int64
+	delayedFsyncs int64
 }
 
-func NewAof(path string) (*Aof, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+// NewAof opens the AOF in dir, creating it if needed. A single file AOF
+// named filename next to dir, as written by older versions, is moved into
+// dir and becomes the base file.
+func NewAof(dir, filename string, fsync FsyncPolicy) (*Aof, error) {
+	err := os.MkdirAll(dir, 0755)
 	if err != nil {
 		return nil, err
 	}
 
 	aof := &Aof{
-		File: f,
-		Rd:   bufio.NewReader(f),
+		Fsync:    fsync,
+		Dir:      dir,
+		Filename: filename,
+		done:     make(chan struct{}),
 	}
+	aof.synced = sync.NewCond(&aof.Mu)
 
-	// Start a goroutine to sync AOF to disk every 1 second
-	go func() {
-		for {
-			aof.Mu.Lock()
-			aof.File.Sync()
-			aof.Mu.Unlock()
+	aof.manifest, err = parseManifest(aof.manifestPath())
+	if os.IsNotExist(err) {
+		aof.manifest, err = aof.upgrade()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = aof.deleteHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	aof.baseSize, aof.incrSize, err = aof.sizes(aof.manifest)
+	if err != nil {
+		return nil, err
+	}
 
-			time.Sleep(time.Second)
+	// Keep appending to the last incremental file, or start the first one.
+	if last := aof.manifest.lastIncr(); last != nil {
+		aof.File, err = os.OpenFile(aof.path(*last), os.O_WRONLY|os.O_APPEND, 0666)
+		if err == nil {
+			aof.fileSize, err = aof.File.Seek(0, io.SeekEnd)
 		}
-	}()
+	} else {
+		err = aof.openIncr()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	aof.wg.Add(1)
+	go aof.background()
 
 	return aof, nil
 }
 
+func (aof *Aof) manifestPath() string {
+	return filepath.Join(aof.Dir, aof.Filename+".manifest")
+}
+
+func (aof *Aof) path(entry manifestEntry) string {
+	return filepath.Join(aof.Dir, entry.name)
+}
+
+// upgrade builds the first manifest, taking over a single file AOF from
+// older versions as the base if there is one. The file is moved before
+// the manifest is written, and is picked up from either place, so a crash
+// in between loses nothing.
+func (aof *Aof) upgrade() (*manifest, error) {
+	m := &manifest{}
+
+	legacy := filepath.Join(filepath.Dir(aof.Dir), aof.Filename)
+	moved := filepath.Join(aof.Dir, aof.Filename)
+
+	_, err := os.Stat(legacy)
+	if err == nil {
+		err = os.Rename(legacy, moved)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = os.Stat(moved)
+	if err == nil {
+		m.base = &manifestEntry{name: aof.Filename, seq: 1, typ: typeBase}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return m, m.save(aof.manifestPath())
+}
+
+// deleteHistory removes the files a rewrite replaced.
+func (aof *Aof) deleteHistory() error {
+	if len(aof.manifest.history) == 0 {
+		return nil
+	}
+
+	for _, entry := range aof.manifest.history {
+		err := os.Remove(aof.path(entry))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	aof.manifest.history = nil
+
+	return aof.manifest.save(aof.manifestPath())
+}
+
+// openIncr starts a new incremental file and makes it the one writes go
+// to. It must be called with Mu held and no sync running.
+func (aof *Aof) openIncr() error {
+	if aof.File != nil {
+		// Bytes still pending belong at the end of the current file.
+		err := aof.closeBatch()
+		if err == nil {
+			err = aof.flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	seq := aof.manifest.nextIncrSeq()
+	entry := manifestEntry{name: aof.Filename + "." + strconv.Itoa(seq) + ".incr.aof", seq: seq, typ: typeIncr}
+
+	f, err := os.OpenFile(aof.path(entry), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	aof.manifest.incrs = append(aof.manifest.incrs, entry)
+	err = aof.manifest.save(aof.manifestPath())
+	if err != nil {
+		aof.manifest.incrs = aof.manifest.incrs[:len(aof.manifest.incrs)-1]
+		f.Close()
+		os.Remove(aof.path(entry))
+		return err
+	}
+
+	if aof.File != nil {
+		// Everything written to the old file is synced before moving on,
+		// since WaitSync only ever syncs the current one.
+		err = aof.File.Sync()
+		if err != nil {
+			fmt.Println("Error syncing AOF:", err)
+		}
+		aof.File.Close()
+		if err == nil {
+			aof.syncedOffset = aof.writtenOffset
+		}
+	}
+	aof.File = f
+	aof.fileSize = 0
+	aof.lastTimestamp = 0
+
+	return nil
+}
+
+// background runs once a second until Close. It retries writes and
+// fsyncs that failed, and syncs the AOF to disk with FsyncEverysec.
+func (aof *Aof) background() {
+	defer aof.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-aof.done:
+			return
+		case <-ticker.C:
+		}
+
+		aof.Mu.Lock()
+		if aof.syncing {
+			// The previous fsync is still running, the disk can't keep up.
+			if aof.Fsync == FsyncEverysec {
+				aof.delayedFsyncs++
+			}
+			aof.Mu.Unlock()
+			continue
+		}
+
+		failed := aof.lastWriteErr != nil || aof.lastFsyncErr != nil
+		err := aof.flush()
+		if err == nil && (aof.Fsync == FsyncEverysec || aof.lastFsyncErr != nil) {
+			err = aof.sync()
+		}
+		aof.Mu.Unlock()
+
+		if err != nil && !failed {
+			fmt.Println("Error syncing AOF:", err)
+		}
+		if err == nil && failed {
+			fmt.Println("AOF write error looks solved, writes are accepted again")
+		}
+	}
+}
+
+// sync fsyncs everything written so far. It must be called with Mu held
+// and no other sync running, and releases Mu during the fsync itself so
+// writers aren't blocked behind the disk.
+func (aof *Aof) sync() error {
+	// Everything synced is covered by a checksum.
+	err := aof.closeBatch()
+	if err != nil {
+		return err
+	}
+
+	target := aof.writtenOffset
+	if aof.syncedOffset >= target {
+		// Whatever failed to sync before is on disk by now.
+		aof.lastFsyncErr = nil
+		return nil
+	}
+
+	aof.syncing = true
+	f := aof.File
+	aof.Mu.Unlock()
+	err = f.Sync()
+	aof.Mu.Lock()
+	aof.syncing = false
+
+	aof.lastFsyncErr = err
+	if err == nil {
+		aof.syncedOffset = max(aof.syncedOffset, target)
+		aof.lastFsyncTime = time.Now()
+		aof.fsyncs++
+	}
+	aof.synced.Broadcast()
+
+	return err
+}
+
+// waitForSync waits for a running sync to finish. It must be called with
+// Mu held.
+func (aof *Aof) waitForSync() {
+	for aof.syncing {
+		aof.synced.Wait()
+	}
+}
+
+// WaitSync returns once everything written to the AOF so far is on disk,
+// when the policy is FsyncAlways. Callers waiting at the same time share a
+// single fsync: one of them syncs on behalf of everyone else, and writes
+// that land while it runs are picked up by the next one. It fails while
+// writes are pending after a write error, as they aren't on disk yet.
+func (aof *Aof) WaitSync() error {
+	if aof.Fsync != FsyncAlways {
+		return nil
+	}
+
+	aof.Mu.Lock()
+	defer aof.Mu.Unlock()
+
+	if len(aof.pending) > 0 {
+		return aof.lastWriteErr
+	}
+
+	target := aof.writtenOffset
+	for aof.syncedOffset < target {
+		if aof.syncing {
+			aof.synced.Wait()
+			continue
+		}
+
+		err := aof.sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close stops the AOF's goroutines and syncs and closes the file. It can
+// be called more than once: later calls return what the first one did.
 func (aof *Aof) Close() error {
+	aof.closeOnce.Do(func() {
+		aof.closeErr = aof.close()
+	})
+	return aof.closeErr
+}
+
+func (aof *Aof) close() error {
+	close(aof.done)
+	aof.wg.Wait()
+	aof.rewriteWg.Wait()
+
 	aof.Mu.Lock()
 	defer aof.Mu.Unlock()
 
+	aof.waitForSync()
+
+	// Whatever the policy, don't leave anything behind in the page cache
+	// on a clean shutdown.
+	err := aof.flush()
+	if err == nil {
+		err = aof.sync()
+	}
+	if err != nil {
+		aof.File.Close()
+		return err
+	}
+
 	return aof.File.Close()
 }
 
-func (aof *Aof) Read(fn func(value resp.Value)) error {
+// Size returns the size of all files in the AOF.
+func (aof *Aof) Size() int64 {
 	aof.Mu.Lock()
 	defer aof.Mu.Unlock()
 
-	aof.File.Seek(0, io.SeekStart)
+	return aof.baseSize + aof.incrSize
+}
 
-	reader := resp.NewResp(aof.File)
+// Position is a point in the AOF. Snapshots record the position the AOF
+// was at when they were taken, so loading them only needs to replay the
+// AOF from there.
+type Position struct {
+	// Base is the base file, or empty if there is none.
+	Base string
+	// Incr is the incremental file being written to, and Offset the
+	// number of bytes in it.
+	Incr   string
+	Offset int64
+}
 
-	for {
-		value, err := reader.Read()
+// ErrPositionGone is returned by ReadFrom when the AOF was rewritten since
+// the position was taken.
+var ErrPositionGone = errors.New("AOF position is gone")
+
+// Position returns the current end of the AOF. Nothing is written to the
+// AOF in between a change to the dataset and its propagation, so holding
+// the locks on the dataset while calling it gives the position matching
+// the dataset.
+func (aof *Aof) Position() Position {
+	aof.Mu.Lock()
+	defer aof.Mu.Unlock()
+
+	pos := Position{Incr: aof.manifest.lastIncr().name, Offset: aof.fileSize}
+	if aof.manifest.base != nil {
+		pos.Base = aof.manifest.base.name
+	}
+	return pos
+}
+
+// Read calls fn with every command in the AOF, in the order the files are
+// listed in the manifest. A last file that ends in a truncated record, as
+// left behind by a crash in the middle of a write, is cut back to its last
+// complete record when LoadTruncated is set. Any other bad record is
+// returned as a *CorruptError.
+func (aof *Aof) Read(fn func(value resp.Value)) error {
+	return aof.ReadFrom(Position{}, fn)
+}
+
+// ReadFrom is like Read, but skips the commands before pos. The zero
+// Position is the start of the AOF.
+func (aof *Aof) ReadFrom(pos Position, fn func(value resp.Value)) error {
+	return aof.read(pos, nil, func(value resp.Value) error {
+		fn(value)
+		return nil
+	})
+}
+
+// replayBatchSize is how many commands Replay hands over at a time, and
+// replayQueue how many batches can wait to be applied.
+const (
+	replayBatchSize = 1024
+	replayQueue     = 4
+)
+
+var errReplayStopped = errors.New("replay stopped")
+
+// Replay is like ReadFrom, but hands the commands to apply in batches, and
+// parses them in a goroutine of its own so the files are read while apply
+// runs. apply is called from the calling goroutine, one batch at a time,
+// and can keep the commands in a batch but not the batch itself, which is
+// reused. An error returned by apply stops the replay and is returned.
+func (aof *Aof) Replay(pos Position, apply func(batch []resp.Value) error) error {
+	full := make(chan []resp.Value, replayQueue)
+	free := make(chan []resp.Value, replayQueue+1)
+	for range replayQueue + 1 {
+		free <- make([]resp.Value, 0, replayBatchSize)
+	}
+	stop := make(chan struct{})
+	// batches sent and not applied yet
+	var pending sync.WaitGroup
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(full)
+
+		batch := <-free
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			pending.Add(1)
+			select {
+			case full <- batch:
+			case <-stop:
+				pending.Done()
+				return errReplayStopped
+			}
+			batch = <-free
+			return nil
+		}
+
+		// A file is only read once everything before it is applied, since
+		// the snapshot a base file can start with is loaded straight into
+		// the dataset from this goroutine.
+		before := func() error {
+			err := flush()
+			pending.Wait()
+			return err
+		}
+
+		err := aof.read(pos, before, func(value resp.Value) error {
+			batch = append(batch, value)
+			if len(batch) < cap(batch) {
+				return nil
+			}
+			return flush()
+		})
+		if err == nil {
+			err = flush()
+		}
+		readErr <- err
+	}()
+
+	var err error
+	for batch := range full {
+		if err == nil {
+			err = apply(batch)
+			if err != nil {
+				close(stop)
+			}
+		}
+		free <- batch[:0]
+		pending.Done()
+	}
+
+	if err != nil {
+		<-readErr
+		return err
+	}
+	return <-readErr
+}
+
+// read calls fn with the commands from pos on, calling before ahead of
+// each file when it's set.
+func (aof *Aof) read(pos Position, before func() error, fn func(value resp.Value) error) error {
+	aof.Mu.Lock()
+	files := aof.manifest.files()
+	aof.Mu.Unlock()
+
+	if pos != (Position{}) {
+		i := slices.IndexFunc(files, func(entry manifestEntry) bool {
+			return entry.typ == typeIncr && entry.name == pos.Incr
+		})
+		base := ""
+		if files[0].typ == typeBase {
+			base = files[0].name
+		}
+		if i < 0 || base != pos.Base {
+			return ErrPositionGone
+		}
+		// A crash can lose writes the snapshot already has.
+		info, err := os.Stat(aof.path(files[i]))
 		if err != nil {
-			if err == io.EOF {
-				break
+			return err
+		}
+		if info.Size() < pos.Offset {
+			return ErrPositionGone
+		}
+		files = files[i:]
+	}
+
+	// bytes in all the files, and in the ones read so far
+	var total, done int64
+	if aof.Progress != nil {
+		for _, entry := range files {
+			info, err := os.Stat(aof.path(entry))
+			if err != nil {
+				return err
 			}
+			total += info.Size()
+		}
+		aof.Progress(0, total)
+	}
+	reported := int64(0)
 
+	for i, entry := range files {
+		skip := int64(0)
+		if i == 0 && entry.name == pos.Incr {
+			skip = pos.Offset
+		}
+
+		if before != nil {
+			err := before()
+			if err != nil {
+				return err
+			}
+		}
+
+		err := CheckFile(aof.path(entry), aof.LoadPreamble, func(record Record) error {
+			if record.Timestamp == 0 && !record.Preamble && record.Offset >= skip {
+				err := fn(record.Value)
+				if err != nil {
+					return err
+				}
+			}
+			if aof.Progress != nil && done+record.Offset-reported >= progressInterval {
+				reported = done + record.Offset
+				aof.Progress(reported, total)
+			}
+			return nil
+		})
+
+		var corrupt *CorruptError
+		if errors.As(err, &corrupt) && corrupt.Truncated && aof.LoadTruncated && i == len(files)-1 {
+			err = aof.truncate(entry, corrupt.Offset)
+		}
+		if err != nil {
 			return err
 		}
-		fn(value)
+
+		if aof.Progress != nil {
+			info, err := os.Stat(aof.path(entry))
+			if err != nil {
+				return err
+			}
+			done += info.Size()
+			aof.Progress(done, total)
+		}
+	}
+
+	return nil
+}
+
+// progressInterval is how many bytes Read reads in between calls to
+// Progress.
+const progressInterval = 1 << 20
+
+// truncate cuts a file back to size after a crash left a partial record at
+// its end.
+func (aof *Aof) truncate(entry manifestEntry, size int64) error {
+	aof.Mu.Lock()
+	defer aof.Mu.Unlock()
+
+	info, err := os.Stat(aof.path(entry))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("AOF %s ends in a truncated record, losing the last %d bytes and truncating it to %d bytes\n", entry.name, info.Size()-size, size)
+	err = os.Truncate(aof.path(entry), size)
+	if err != nil {
+		return err
+	}
+
+	if entry.typ == typeBase {
+		aof.baseSize = size
+	} else {
+		aof.incrSize -= info.Size() - size
+	}
+	if last := aof.manifest.lastIncr(); last != nil && last.name == entry.name {
+		aof.fileSize = size
 	}
 
 	return nil
@@ -75,10 +694,392 @@ func (aof *Aof) Write(value resp.Value) error {
 	aof.Mu.Lock()
 	defer aof.Mu.Unlock()
 
-	_, err := aof.File.Write(value.Marshal())
+	buf := aof.buf[:0]
+	if aof.Timestamps {
+		now := time.Now().Unix()
+		if now != aof.lastTimestamp {
+			buf = appendTimestamp(buf, now)
+			aof.lastTimestamp = now
+		}
+	}
+	buf = value.AppendMarshal(buf)
+	if cap(buf) <= maxReusedBuf {
+		aof.buf = buf
+	}
+
+	err := aof.write(buf, true)
+	if err != nil {
+		return err
+	}
+	if aof.batch.n >= maxBatchSize {
+		err := aof.closeBatch()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !aof.rewriting && len(aof.pending) == 0 && aof.shouldRewrite() {
+		err := aof.startRewrite()
+		if err != nil {
+			fmt.Println("Error starting AOF rewrite:", err)
+		}
+	}
+
+	return nil
+}
+
+// maxReusedBuf is the largest buffer Write keeps around for the next
+// command, so a single huge value doesn't pin its memory.
+const maxReusedBuf = 64 << 10
+
+// write appends p to the current incremental file, after any bytes still
+// pending from earlier writes, and adds it to the checksum batch if
+// checksummed is set. What the disk doesn't take is kept and retried by
+// the next write or the background goroutine, so a full disk doesn't lose
+// writes or leave holes in the AOF. It must be called with Mu held.
+func (aof *Aof) write(p []byte, checksummed bool) error {
+	if checksummed && aof.Checksums {
+		aof.batch.add(p)
+	}
+
+	if len(aof.pending) > 0 {
+		aof.pending = append(aof.pending, p...)
+		return aof.flush()
+	}
+
+	n, err := aof.writeFile(p)
+	if err != nil {
+		aof.pending = append(aof.pending, p[n:]...)
+	}
+	return err
+}
+
+// flush writes the pending bytes. It must be called with Mu held.
+func (aof *Aof) flush() error {
+	if len(aof.pending) == 0 {
+		return nil
+	}
+
+	n, err := aof.writeFile(aof.pending)
+	if err != nil {
+		aof.pending = append(aof.pending[:0], aof.pending[n:]...)
+		return err
+	}
+	aof.pending = nil
+	return nil
+}
+
+// writeFile writes p to File and returns how much of it made it there. A
+// partial write is undone if possible, so a crash before the rest is
+// written doesn't leave a truncated record behind. It must be called with
+// Mu held.
+func (aof *Aof) writeFile(p []byte) (int, error) {
+	n, err := aof.File.Write(p)
+	if err != nil && n > 0 && aof.File.Truncate(aof.fileSize) == nil {
+		n = 0
+	}
+
+	aof.writtenOffset += int64(n)
+	aof.incrSize += int64(n)
+	aof.fileSize += int64(n)
+	aof.lastWriteErr = err
+	return n, err
+}
+
+// closeBatch writes the checksum of the bytes written since the last one.
+// It must be called with Mu held.
+func (aof *Aof) closeBatch() error {
+	line := aof.batch.close(nil)
+	if len(line) == 0 {
+		return nil
+	}
+
+	return aof.write(line, false)
+}
+
+// Err returns why the AOF can't persist writes right now, or nil if it
+// can: the last write error while bytes are still pending, or the last
+// fsync error until a sync succeeds.
+func (aof *Aof) Err() error {
+	aof.Mu.Lock()
+	defer aof.Mu.Unlock()
+
+	if aof.lastWriteErr != nil {
+		return aof.lastWriteErr
+	}
+	return aof.lastFsyncErr
+}
+
+// ErrRewriteInProgress is returned when a rewrite is requested while one
+// is already running.
+var ErrRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// BgRewrite starts rewriting the AOF in the background. The new base file
+// holds the smallest set of commands that recreate the dataset, and
+// replaces the current base and incremental files once it's complete.
+func (aof *Aof) BgRewrite() error {
+	aof.Mu.Lock()
+	defer aof.Mu.Unlock()
+
+	if aof.rewriting {
+		return ErrRewriteInProgress
+	}
+
+	return aof.startRewrite()
+}
+
+func (aof *Aof) shouldRewrite() bool {
+	size := aof.baseSize + aof.incrSize
+	if aof.AutoRewritePercentage <= 0 || (aof.Snapshot == nil && aof.Preamble == nil) || size < aof.AutoRewriteMinSize {
+		return false
+	}
+	// Every attempt starts a new incremental file, so don't retry a failed
+	// rewrite on every write.
+	if aof.lastRewriteErr != nil && time.Since(aof.rewriteStart) < time.Minute {
+		return false
+	}
+
+	base := max(aof.baseSize, 1)
+	growth := (size - base) * 100 / base
+	return growth >= int64(aof.AutoRewritePercentage)
+}
+
+// startRewrite must be called with Mu held. Writes move to a new
+// incremental file first, so everything before it is what the new base
+// file replaces.
+func (aof *Aof) startRewrite() error {
+	aof.waitForSync()
+
+	err := aof.openIncr()
+	if err != nil {
+		return err
+	}
+
+	aof.rewriting = true
+	aof.rewriteIncrSeq = aof.manifest.lastIncr().seq
+	aof.rewriteStart = time.Now()
+
+	aof.rewriteWg.Add(1)
+	go func() {
+		defer aof.rewriteWg.Done()
+
+		err := aof.rewrite()
+		if err != nil {
+			fmt.Println("Error rewriting AOF:", err)
+		}
+	}()
+
+	return nil
+}
+
+// rewrite writes a new base file from Snapshot while writes keep going to
+// the incremental file opened by startRewrite. That file is opened before
+// the snapshot is taken, so the snapshot can't miss any write; the ones it
+// already contains are harmless to replay again since propagated commands
+// are absolute.
+func (aof *Aof) rewrite() (err error) {
+	defer func() {
+		aof.Mu.Lock()
+		aof.rewriting = false
+		aof.lastRewriteErr = err
+		aof.lastRewriteTime = time.Since(aof.rewriteStart)
+		aof.Mu.Unlock()
+	}()
+
+	if aof.Snapshot == nil && aof.Preamble == nil {
+		return errors.New("no snapshot function set")
+	}
+
+	tmp := filepath.Join(aof.Dir, "temp-rewriteaof-bg.aof")
+	err = aof.writeSnapshot(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	aof.Mu.Lock()
+	defer aof.Mu.Unlock()
+
+	m := aof.manifest
+	seq := m.nextBaseSeq()
+	base := manifestEntry{name: aof.Filename + "." + strconv.Itoa(seq) + ".base.aof", seq: seq, typ: typeBase}
+	err = os.Rename(tmp, aof.path(base))
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// The old base and the incremental files written before the rewrite
+	// started become history, to be deleted once the new manifest is safe
+	// on disk.
+	next := &manifest{base: &base}
+	if m.base != nil {
+		next.history = append(next.history, manifestEntry{name: m.base.name, seq: m.base.seq, typ: typeHistory})
+	}
+	for _, entry := range m.incrs {
+		if entry.seq < aof.rewriteIncrSeq {
+			next.history = append(next.history, manifestEntry{name: entry.name, seq: entry.seq, typ: typeHistory})
+		} else {
+			next.incrs = append(next.incrs, entry)
+		}
+	}
+
+	err = next.save(aof.manifestPath())
 	if err != nil {
+		os.Remove(aof.path(base))
 		return err
 	}
+	aof.manifest = next
+
+	err = aof.deleteHistory()
+	if err != nil {
+		fmt.Println("Error deleting AOF history files:", err)
+	}
+
+	// The rewrite is done once the manifest is switched, so failing to
+	// measure the files only leaves the sizes the next automatic rewrite
+	// is based on as they were.
+	baseSize, incrSize, statErr := aof.sizes(next)
+	if statErr != nil {
+		fmt.Println("Error measuring AOF files:", statErr)
+	} else {
+		aof.baseSize, aof.incrSize = baseSize, incrSize
+	}
+	aof.rewrites++
 
 	return nil
 }
+
+// sizes returns the size of the base file of m, and the total size of its
+// incremental files.
+func (aof *Aof) sizes(m *manifest) (base, incr int64, err error) {
+	for _, entry := range m.files() {
+		info, err := os.Stat(aof.path(entry))
+		if err != nil {
+			return 0, 0, err
+		}
+		if entry.typ == typeBase {
+			base = info.Size()
+		} else {
+			incr += info.Size()
+		}
+	}
+	return base, incr, nil
+}
+
+// writeSnapshot writes the commands emitted by Snapshot to a new file at
+// path, with the same annotations as incremental files, and syncs it. With
+// Preamble set, the file holds a binary snapshot instead, which has
+// checksums of its own.
+func (aof *Aof) writeSnapshot(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	if aof.Preamble != nil {
+		if aof.Timestamps {
+			bw.Write(appendTimestamp(nil, time.Now().Unix()))
+		}
+		err = aof.Preamble(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+
+	b := batch{}
+	write := func(p []byte) error {
+		_, err := bw.Write(p)
+		if aof.Checksums {
+			b.add(p)
+		}
+		return err
+	}
+
+	var buf []byte
+	if aof.Timestamps {
+		buf = appendTimestamp(buf, time.Now().Unix())
+	}
+	err = aof.Snapshot(func(value resp.Value) error {
+		buf = value.AppendMarshal(buf)
+		err := write(buf)
+		buf = buf[:0]
+		if err != nil || b.n < maxBatchSize {
+			return err
+		}
+		_, err = bw.Write(b.close(buf))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = bw.Write(b.close(buf))
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// Info returns the AOF fields of the persistence section of INFO.
+func (aof *Aof) Info() []string {
+	aof.Mu.Lock()
+	defer aof.Mu.Unlock()
+
+	lastFsync := int64(-1)
+	if !aof.lastFsyncTime.IsZero() {
+		lastFsync = aof.lastFsyncTime.Unix()
+	}
+
+	pending := 0
+	if aof.syncing {
+		pending = 1
+	}
+
+	rewriting, currentRewrite := 0, -1
+	if aof.rewriting {
+		rewriting = 1
+		currentRewrite = int(time.Since(aof.rewriteStart).Seconds())
+	}
+
+	lastRewrite := -1
+	if aof.rewrites > 0 || aof.lastRewriteErr != nil {
+		lastRewrite = int(aof.lastRewriteTime.Seconds())
+	}
+
+	return []string{
+		"aof_enabled:1",
+		fmt.Sprintf("aof_rewrite_in_progress:%d", rewriting),
+		fmt.Sprintf("aof_last_rewrite_time_sec:%d", lastRewrite),
+		fmt.Sprintf("aof_current_rewrite_time_sec:%d", currentRewrite),
+		"aof_last_bgrewrite_status:" + status(aof.lastRewriteErr),
+		fmt.Sprintf("aof_rewrites:%d", aof.rewrites),
+		fmt.Sprintf("aof_base_size:%d", aof.baseSize),
+		"aof_fsync:" + string(aof.Fsync),
+		"aof_last_write_status:" + status(aof.lastWriteErr),
+		"aof_last_fsync_status:" + status(aof.lastFsyncErr),
+		fmt.Sprintf("aof_last_fsync_time:%d", lastFsync),
+		fmt.Sprintf("aof_fsyncs:%d", aof.fsyncs),
+		fmt.Sprintf("aof_current_size:%d", aof.baseSize+aof.incrSize),
+		fmt.Sprintf("aof_unsynced_bytes:%d", aof.writtenOffset-aof.syncedOffset),
+		fmt.Sprintf("aof_pending_bio_fsync:%d", pending),
+		fmt.Sprintf("aof_delayed_fsync:%d", aof.delayedFsyncs),
+	}
+}
+
+func status(err error) string {
+	if err != nil {
+		return "err"
+	}
+	return "ok"
+}
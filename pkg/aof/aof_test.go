@@ -0,0 +1,520 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func command(args ...string) resp.Value {
+	v := resp.Value{Typ: "array"}
+	for _, arg := range args {
+		v.Array = append(v.Array, resp.Value{Typ: "bulk", Bulk: arg})
+	}
+	return v
+}
+
+func newTestAof(t *testing.T, fsync FsyncPolicy) *Aof {
+	t.Helper()
+
+	aof, err := NewAof(t.TempDir(), "test.aof", fsync)
+	require.NoError(t, err)
+	return aof
+}
+
+func TestWriteAndRead(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := NewAof(dir, "test.aof", FsyncEverysec)
+	require.NoError(t, err)
+
+	require.NoError(t, aof.Write(command("SET", "a", "1")))
+	require.NoError(t, aof.Write(command("SET", "b", "2")))
+	require.NoError(t, aof.Close())
+
+	aof, err = NewAof(dir, "test.aof", FsyncEverysec)
+	require.NoError(t, err)
+	defer aof.Close()
+
+	// Appends after reopening go to the end of the last incremental file.
+	require.NoError(t, aof.Write(command("SET", "c", "3")))
+
+	values := []resp.Value{}
+	require.NoError(t, aof.Read(func(value resp.Value) {
+		values = append(values, value)
+	}))
+	assert.Equal(t, []resp.Value{command("SET", "a", "1"), command("SET", "b", "2"), command("SET", "c", "3")}, values)
+}
+
+func TestReadProgress(t *testing.T) {
+	aof := newTestAof(t, FsyncNo)
+	defer aof.Close()
+
+	for range 10 {
+		require.NoError(t, aof.Write(command("SET", "key", "value")))
+	}
+
+	var loaded, total []int64
+	aof.Progress = func(l, t int64) {
+		loaded = append(loaded, l)
+		total = append(total, t)
+	}
+	readAll(t, aof)
+
+	size := aof.Size()
+	assert.Equal(t, []int64{0, size}, loaded)
+	assert.Equal(t, []int64{size, size}, total)
+}
+
+func TestReplay(t *testing.T) {
+	aof := newTestAof(t, FsyncNo)
+	defer aof.Close()
+
+	// Enough for a few batches, spread over two files.
+	const n = 3*replayBatchSize + 10
+	for i := range n {
+		if i == n/2 {
+			aof.Mu.Lock()
+			require.NoError(t, aof.openIncr())
+			aof.Mu.Unlock()
+		}
+		require.NoError(t, aof.Write(command("SET", fmt.Sprint(i), "v")))
+	}
+
+	replayed := []resp.Value{}
+	require.NoError(t, aof.Replay(Position{}, func(batch []resp.Value) error {
+		assert.LessOrEqual(t, len(batch), replayBatchSize)
+		replayed = append(replayed, batch...)
+		return nil
+	}))
+	assert.Equal(t, readAll(t, aof), replayed)
+	assert.Len(t, replayed, n)
+
+	// An error from apply stops the replay.
+	failed := errors.New("apply failed")
+	batches := 0
+	err := aof.Replay(Position{}, func(batch []resp.Value) error {
+		batches++
+		return failed
+	})
+	assert.ErrorIs(t, err, failed)
+	assert.Equal(t, 1, batches)
+}
+
+func TestWaitSyncAlways(t *testing.T) {
+	aof := newTestAof(t, FsyncAlways)
+	defer aof.Close()
+
+	const writers = 50
+
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, aof.Write(command("SET", "key", "value")))
+			assert.NoError(t, aof.WaitSync())
+		}()
+	}
+	wg.Wait()
+
+	aof.Mu.Lock()
+	defer aof.Mu.Unlock()
+	assert.Equal(t, aof.writtenOffset, aof.syncedOffset)
+	// Writers share fsyncs, so there can't be more fsyncs than writers.
+	assert.LessOrEqual(t, aof.fsyncs, int64(writers))
+	assert.Positive(t, aof.fsyncs)
+}
+
+func TestWaitSyncOtherPolicies(t *testing.T) {
+	for _, fsync := range []FsyncPolicy{FsyncEverysec, FsyncNo} {
+		t.Run(string(fsync), func(t *testing.T) {
+			aof := newTestAof(t, fsync)
+			defer aof.Close()
+
+			require.NoError(t, aof.Write(command("SET", "key", "value")))
+			require.NoError(t, aof.WaitSync())
+
+			aof.Mu.Lock()
+			defer aof.Mu.Unlock()
+			assert.Zero(t, aof.fsyncs)
+			assert.Less(t, aof.syncedOffset, aof.writtenOffset)
+		})
+	}
+}
+
+func TestCloseSyncs(t *testing.T) {
+	aof := newTestAof(t, FsyncNo)
+	require.NoError(t, aof.Write(command("SET", "key", "value")))
+	require.NoError(t, aof.Close())
+
+	assert.Equal(t, int64(1), aof.fsyncs)
+	assert.Equal(t, aof.writtenOffset, aof.syncedOffset)
+}
+
+func TestCloseStopsSyncGoroutine(t *testing.T) {
+	aof := newTestAof(t, FsyncEverysec)
+
+	done := make(chan struct{})
+	go func() {
+		aof.wg.Wait()
+		close(done)
+	}()
+
+	require.NoError(t, aof.Close())
+	<-done
+}
+
+func TestCloseTwice(t *testing.T) {
+	aof := newTestAof(t, FsyncEverysec)
+	require.NoError(t, aof.Write(command("SET", "key", "value")))
+
+	require.NoError(t, aof.Close())
+	require.NoError(t, aof.Close())
+	assert.Equal(t, int64(1), aof.fsyncs)
+}
+
+func TestSyncError(t *testing.T) {
+	aof := newTestAof(t, FsyncAlways)
+
+	require.NoError(t, aof.Write(command("SET", "key", "value")))
+	// Closing the file underneath the AOF makes the fsync fail.
+	aof.File.Close()
+
+	assert.Error(t, aof.WaitSync())
+	assert.Contains(t, aof.Info(), "aof_last_fsync_status:err")
+
+	assert.Error(t, aof.Write(command("SET", "key", "value")))
+	assert.Contains(t, aof.Info(), "aof_last_write_status:err")
+}
+
+func TestWriteErrorRecovery(t *testing.T) {
+	for _, fsync := range []FsyncPolicy{FsyncAlways, FsyncEverysec} {
+		t.Run(string(fsync), func(t *testing.T) {
+			aof := newTestAof(t, fsync)
+			defer aof.Close()
+			aof.Checksums = true
+
+			require.NoError(t, aof.Write(command("SET", "a", "1")))
+			require.NoError(t, aof.WaitSync())
+
+			// Writes to /dev/full fail like they do on a full disk.
+			full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+			if err != nil {
+				t.Skip("no /dev/full:", err)
+			}
+			aof.Mu.Lock()
+			file := aof.File
+			aof.File = full
+			aof.Mu.Unlock()
+
+			assert.Error(t, aof.Write(command("SET", "b", "2")))
+			assert.Error(t, aof.Write(command("SET", "c", "3")))
+			assert.Error(t, aof.Err())
+			assert.Contains(t, aof.Info(), "aof_last_write_status:err")
+			if fsync == FsyncAlways {
+				assert.Error(t, aof.WaitSync())
+			}
+
+			// The disk has room again, and the writes kept back make it
+			// there in the background.
+			aof.Mu.Lock()
+			aof.File = file
+			aof.Mu.Unlock()
+			full.Close()
+			assert.Eventually(t, func() bool {
+				return aof.Err() == nil
+			}, 3*time.Second, 10*time.Millisecond)
+			require.NoError(t, aof.WaitSync())
+			assert.Contains(t, aof.Info(), "aof_last_write_status:ok")
+
+			assert.Equal(t, []resp.Value{command("SET", "a", "1"), command("SET", "b", "2"), command("SET", "c", "3")}, readAll(t, aof))
+		})
+	}
+}
+
+func TestInfo(t *testing.T) {
+	aof := newTestAof(t, FsyncAlways)
+	defer aof.Close()
+
+	value := command("SET", "key", "value")
+	require.NoError(t, aof.Write(value))
+	require.NoError(t, aof.WaitSync())
+
+	info := aof.Info()
+	assert.Contains(t, info, "aof_enabled:1")
+	assert.Contains(t, info, "aof_fsync:always")
+	assert.Contains(t, info, "aof_last_write_status:ok")
+	assert.Contains(t, info, "aof_fsyncs:1")
+	assert.Contains(t, info, "aof_unsynced_bytes:0")
+	assert.Contains(t, info, fmt.Sprintf("aof_current_size:%d", len(value.Marshal())))
+}
+
+func readAll(t *testing.T, aof *Aof) []resp.Value {
+	t.Helper()
+
+	values := []resp.Value{}
+	require.NoError(t, aof.Read(func(value resp.Value) {
+		values = append(values, value)
+	}))
+	return values
+}
+
+func TestBgRewrite(t *testing.T) {
+	aof := newTestAof(t, FsyncEverysec)
+	defer aof.Close()
+
+	for range 100 {
+		require.NoError(t, aof.Write(command("SET", "key", "old")))
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	aof.Snapshot = func(emit func(resp.Value) error) error {
+		close(started)
+		<-release
+		return emit(command("SET", "key", "old"))
+	}
+
+	require.NoError(t, aof.BgRewrite())
+	<-started
+	assert.ErrorIs(t, aof.BgRewrite(), ErrRewriteInProgress)
+	assert.Contains(t, aof.Info(), "aof_rewrite_in_progress:1")
+
+	// Writes made during the rewrite go to a new incremental file that is
+	// kept after it.
+	require.NoError(t, aof.Write(command("SET", "key", "new")))
+	close(release)
+	aof.rewriteWg.Wait()
+
+	assert.Equal(t, []resp.Value{command("SET", "key", "old"), command("SET", "key", "new")}, readAll(t, aof))
+
+	// Writes after the rewrite are appended to the new file.
+	require.NoError(t, aof.Write(command("SET", "other", "value")))
+	assert.Len(t, readAll(t, aof), 3)
+
+	info := aof.Info()
+	assert.Contains(t, info, "aof_rewrite_in_progress:0")
+	assert.Contains(t, info, "aof_last_bgrewrite_status:ok")
+	assert.Contains(t, info, "aof_rewrites:1")
+
+	// Only the new base and the incremental file opened for the rewrite
+	// are left.
+	assert.Equal(t, "file test.aof.1.base.aof seq 1 type b\nfile test.aof.2.incr.aof seq 2 type i\n", readManifest(t, aof))
+	assert.ElementsMatch(t, []string{"test.aof.1.base.aof", "test.aof.2.incr.aof", "test.aof.manifest"}, dirNames(t, aof.Dir))
+}
+
+func TestBgRewriteError(t *testing.T) {
+	aof := newTestAof(t, FsyncEverysec)
+	defer aof.Close()
+
+	require.NoError(t, aof.Write(command("SET", "key", "value")))
+
+	aof.Snapshot = func(emit func(resp.Value) error) error {
+		return errors.New("snapshot failed")
+	}
+	require.NoError(t, aof.BgRewrite())
+	aof.rewriteWg.Wait()
+
+	assert.Contains(t, aof.Info(), "aof_last_bgrewrite_status:err")
+	_, err := os.Stat(filepath.Join(aof.Dir, "temp-rewriteaof-bg.aof"))
+	assert.True(t, os.IsNotExist(err))
+	// The old files are left alone.
+	assert.Equal(t, []resp.Value{command("SET", "key", "value")}, readAll(t, aof))
+}
+
+func TestBgRewriteStatError(t *testing.T) {
+	aof := newTestAof(t, FsyncEverysec)
+	defer aof.Close()
+
+	require.NoError(t, aof.Write(command("SET", "key", "value")))
+	size := aof.Size()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	aof.Snapshot = func(emit func(resp.Value) error) error {
+		close(started)
+		<-release
+		return emit(command("SET", "key", "value"))
+	}
+	require.NoError(t, aof.BgRewrite())
+	<-started
+
+	// A file of the new manifest can't be measured once the rewrite is
+	// done, which doesn't undo it.
+	require.NoError(t, os.Remove(filepath.Join(aof.Dir, "test.aof.2.incr.aof")))
+	close(release)
+	aof.rewriteWg.Wait()
+
+	info := aof.Info()
+	assert.Contains(t, info, "aof_last_bgrewrite_status:ok")
+	assert.Contains(t, info, "aof_rewrites:1")
+	assert.Equal(t, size, aof.Size())
+	assert.Equal(t, "file test.aof.1.base.aof seq 1 type b\nfile test.aof.2.incr.aof seq 2 type i\n", readManifest(t, aof))
+}
+
+func TestAutoRewrite(t *testing.T) {
+	aof := newTestAof(t, FsyncEverysec)
+	defer aof.Close()
+
+	aof.AutoRewritePercentage = 100
+	aof.AutoRewriteMinSize = 1024
+	aof.Snapshot = func(emit func(resp.Value) error) error {
+		return emit(command("SET", "key", "value"))
+	}
+
+	value := command("SET", "key", "value")
+	for range 1024/len(value.Marshal()) + 1 {
+		require.NoError(t, aof.Write(value))
+	}
+	aof.rewriteWg.Wait()
+
+	assert.Contains(t, aof.Info(), "aof_rewrites:1")
+	assert.Len(t, readAll(t, aof), 1)
+
+	// The next rewrite waits for the file to double in size again.
+	require.NoError(t, aof.Write(value))
+	aof.rewriteWg.Wait()
+	assert.Contains(t, aof.Info(), "aof_rewrites:1")
+}
+
+func readManifest(t *testing.T, aof *Aof) string {
+	t.Helper()
+
+	data, err := os.ReadFile(aof.manifestPath())
+	require.NoError(t, err)
+	return string(data)
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.aof.manifest")
+	data := "file test.aof.2.base.aof seq 2 type b\n" +
+		"file test.aof.1.base.aof seq 1 type h\n" +
+		"file test.aof.3.incr.aof seq 3 type i\n" +
+		"file test.aof.4.incr.aof seq 4 type i\n"
+	require.NoError(t, os.WriteFile(path, []byte(data), 0666))
+
+	m, err := parseManifest(path)
+	require.NoError(t, err)
+	assert.Equal(t, data, m.String())
+	assert.Equal(t, []manifestEntry{
+		{name: "test.aof.2.base.aof", seq: 2, typ: typeBase},
+		{name: "test.aof.3.incr.aof", seq: 3, typ: typeIncr},
+		{name: "test.aof.4.incr.aof", seq: 4, typ: typeIncr},
+	}, m.files())
+	assert.Equal(t, 5, m.nextIncrSeq())
+	assert.Equal(t, 3, m.nextBaseSeq())
+}
+
+func TestManifestInvalid(t *testing.T) {
+	tests := []string{
+		"file a seq 1 type b\nfile b seq 2 type b\n",
+		"file a seq 2 type i\nfile b seq 1 type i\n",
+		"file a seq 1 type x\n",
+		"file a seq 0 type i\n",
+		"file a seq 1\n",
+		"file ../a seq 1 type i\n",
+		"file a seq\n",
+	}
+
+	for _, data := range tests {
+		path := filepath.Join(t.TempDir(), "test.aof.manifest")
+		require.NoError(t, os.WriteFile(path, []byte(data), 0666))
+		_, err := parseManifest(path)
+		assert.Error(t, err, data)
+	}
+}
+
+func TestLoadOrder(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]resp.Value{
+		"test.aof.3.base.aof": command("SET", "key", "base"),
+		"test.aof.5.incr.aof": command("SET", "key", "first"),
+		"test.aof.6.incr.aof": command("SET", "key", "second"),
+	}
+	for name, value := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), value.Marshal(), 0666))
+	}
+	manifest := "file test.aof.3.base.aof seq 3 type b\n" +
+		"file test.aof.5.incr.aof seq 5 type i\n" +
+		"file test.aof.6.incr.aof seq 6 type i\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test.aof.manifest"), []byte(manifest), 0666))
+
+	aof, err := NewAof(dir, "test.aof", FsyncNo)
+	require.NoError(t, err)
+	defer aof.Close()
+
+	require.NoError(t, aof.Write(command("SET", "key", "third")))
+	assert.Equal(t, []resp.Value{
+		command("SET", "key", "base"),
+		command("SET", "key", "first"),
+		command("SET", "key", "second"),
+		command("SET", "key", "third"),
+	}, readAll(t, aof))
+	assert.Equal(t, manifest, readManifest(t, aof))
+}
+
+func TestHistoryDeletedOnStartup(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"test.aof.1.base.aof", "test.aof.2.base.aof", "test.aof.1.incr.aof"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0666))
+	}
+	manifest := "file test.aof.2.base.aof seq 2 type b\n" +
+		"file test.aof.1.base.aof seq 1 type h\n" +
+		"file test.aof.1.incr.aof seq 1 type h\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test.aof.manifest"), []byte(manifest), 0666))
+
+	aof, err := NewAof(dir, "test.aof", FsyncNo)
+	require.NoError(t, err)
+	defer aof.Close()
+
+	assert.Equal(t, "file test.aof.2.base.aof seq 2 type b\nfile test.aof.1.incr.aof seq 1 type i\n", readManifest(t, aof))
+	assert.Equal(t, []resp.Value{}, readAll(t, aof))
+}
+
+func TestUpgradeSingleFile(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "appendonlydir")
+	legacy := command("SET", "key", "legacy")
+	require.NoError(t, os.WriteFile(filepath.Join(parent, "test.aof"), legacy.Marshal(), 0666))
+
+	aof, err := NewAof(dir, "test.aof", FsyncNo)
+	require.NoError(t, err)
+	defer aof.Close()
+
+	_, err = os.Stat(filepath.Join(parent, "test.aof"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "file test.aof seq 1 type b\nfile test.aof.1.incr.aof seq 1 type i\n", readManifest(t, aof))
+	assert.Contains(t, aof.Info(), fmt.Sprintf("aof_base_size:%d", len(legacy.Marshal())))
+
+	require.NoError(t, aof.Write(command("SET", "key", "new")))
+	assert.Equal(t, []resp.Value{legacy, command("SET", "key", "new")}, readAll(t, aof))
+
+	// The legacy file is replaced like any other base file by a rewrite.
+	aof.Snapshot = func(emit func(resp.Value) error) error {
+		return emit(command("SET", "key", "new"))
+	}
+	require.NoError(t, aof.BgRewrite())
+	aof.rewriteWg.Wait()
+	assert.Equal(t, []resp.Value{command("SET", "key", "new")}, readAll(t, aof))
+	assert.ElementsMatch(t, []string{"test.aof.2.base.aof", "test.aof.2.incr.aof", "test.aof.manifest"}, dirNames(t, dir))
+}
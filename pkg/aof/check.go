@@ -0,0 +1,303 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/maniktherana/godbase/pkg/snapshot"
+)
+
+// CorruptError describes the first bad record found in an AOF file.
+type CorruptError struct {
+	Path string
+	// Offset is where the bad record starts, which is also the size of
+	// the valid part of the file.
+	Offset int64
+	// Truncated is set when the file ends in the middle of a record, as
+	// left behind by a crash during a write. Anything else is corruption
+	// that can't be explained by a crash.
+	Truncated bool
+	Err       error
+}
+
+func (e *CorruptError) Error() string {
+	if e.Truncated {
+		return fmt.Sprintf("%s: truncated record at offset %d", e.Path, e.Offset)
+	}
+	return fmt.Sprintf("%s: bad record at offset %d: %v", e.Path, e.Offset, e.Err)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+// countingReader counts the bytes read from r, so offsets in the file can
+// be worked out from what the buffered reader on top of it has consumed.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Record is a command, timestamp annotation or snapshot preamble read from
+// an AOF file.
+type Record struct {
+	// Offset is where the record starts in the file.
+	Offset int64
+	// Value is the command, unless this is a timestamp or a preamble.
+	Value resp.Value
+	// Timestamp is the unix time of a timestamp annotation, or 0 for a
+	// command.
+	Timestamp int64
+	// Preamble is set for a snapshot at the start of a base file, whose
+	// entries went to the preamble handler given to CheckFile.
+	Preamble bool
+}
+
+// CheckFile calls fn with every record in a single AOF file, and returns a
+// *CorruptError for the first record that isn't well formed or the first
+// batch that doesn't match its checksum. Records of a batch are passed to
+// fn before its checksum is read. Errors returned by fn stop the scan and
+// are returned as they are.
+//
+// A file starting with a snapshot, as written by rewrites with Preamble
+// set, has its entries passed to preamble before the commands after it
+// are read.
+func CheckFile(path string, preamble snapshot.Handler, fn func(record Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	counter := &countingReader{r: f}
+	// Annotations are peeked at and read from br directly, in between the
+	// commands reader reads from it.
+	br := bufio.NewReader(counter)
+	reader := &commandReader{br: br}
+	offset := func() int64 { return counter.n - int64(br.Buffered()) }
+
+	// where the current batch started, right after the last checksum
+	var batchStart int64
+	// whether a command was read yet, after which a preamble can't come
+	commands := false
+
+	for {
+		start := offset()
+		next, err := br.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if next[0] == '#' {
+			line, err := br.ReadSlice('\n')
+			if err == io.EOF {
+				return &CorruptError{Path: path, Offset: start, Truncated: true, Err: io.ErrUnexpectedEOF}
+			}
+			if err != nil || len(line) < 2 || line[len(line)-2] != '\r' {
+				return &CorruptError{Path: path, Offset: start, Err: errors.New("invalid annotation")}
+			}
+			annotation := string(line[:len(line)-2])
+
+			switch {
+			case strings.HasPrefix(annotation, annotationTimestamp):
+				ts, err := strconv.ParseInt(annotation[len(annotationTimestamp):], 10, 64)
+				if err != nil {
+					return &CorruptError{Path: path, Offset: start, Err: errors.New("invalid timestamp annotation")}
+				}
+				err = fn(Record{Offset: start, Timestamp: ts})
+				if err != nil {
+					return err
+				}
+			case strings.HasPrefix(annotation, annotationChecksum):
+				crc, n, err := parseChecksum(annotation[len(annotationChecksum):])
+				if err != nil || n > start-batchStart {
+					return &CorruptError{Path: path, Offset: start, Err: errors.New("invalid checksum annotation")}
+				}
+				// The batch is read again straight from the file, since
+				// the parser has no access to the raw bytes.
+				b := batch{}
+				_, err = io.Copy(crcWriter{&b}, io.NewSectionReader(f, start-n, n))
+				if err != nil {
+					return err
+				}
+				if b.crc != crc {
+					return &CorruptError{Path: path, Offset: start - n, Err: ErrChecksum}
+				}
+				batchStart = offset()
+			}
+			// Other annotations are skipped, like Redis does.
+			continue
+		}
+
+		if !commands && next[0] == snapshot.Magic[0] {
+			header, _ := br.Peek(len(snapshot.Magic))
+			if string(header) == snapshot.Magic {
+				// snapshot.Read reuses br, so reading carries on right
+				// after the snapshot.
+				err := snapshot.Read(br, preamble)
+				if err != nil {
+					return &CorruptError{Path: path, Offset: start, Err: fmt.Errorf("snapshot preamble: %w", err)}
+				}
+				commands = true
+				batchStart = offset()
+
+				err = fn(Record{Offset: start, Preamble: true})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		commands = true
+
+		value, err := reader.read()
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return &CorruptError{Path: path, Offset: start, Truncated: true, Err: io.ErrUnexpectedEOF}
+		}
+		if err != nil {
+			return &CorruptError{Path: path, Offset: start, Err: err}
+		}
+
+		err = fn(Record{Offset: start, Value: value})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type crcWriter struct {
+	b *batch
+}
+
+func (w crcWriter) Write(p []byte) (int, error) {
+	w.b.add(p)
+	return len(p), nil
+}
+
+// Files returns the paths of the files listed in the manifest at path, in
+// the order they're loaded.
+func Files(path string) ([]string, error) {
+	m, err := parseManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, entry := range m.files() {
+		paths = append(paths, filepath.Join(filepath.Dir(path), entry.name))
+	}
+	return paths, nil
+}
+
+// ErrBeforeBase is returned by FindTimestamp when the time asked for is
+// before the base file of a multi part AOF was written, since the writes
+// from before then are gone.
+var ErrBeforeBase = errors.New("the AOF has no writes from before its base file was written")
+
+var errFound = errors.New("found")
+
+// Cut is where an AOF is truncated to get back the dataset as of a point
+// in time.
+type Cut struct {
+	// Manifest is the path of the manifest, for multi part AOFs.
+	Manifest string
+	// File is cut down to Size bytes.
+	File string
+	Size int64
+	// Dropped lists the incremental files after File, which are removed.
+	Dropped []string
+}
+
+// FindTimestamp returns where to cut the AOF at path, a single file or a
+// manifest, so that loading it gives the dataset as of the unix time ts:
+// at the first timestamp annotation later than ts. It returns nil if
+// nothing in the AOF was written after ts.
+func FindTimestamp(path string, ts int64) (*Cut, error) {
+	files := []string{path}
+	manifest := ""
+	if strings.HasSuffix(path, ".manifest") {
+		var err error
+		files, err = Files(path)
+		if err != nil {
+			return nil, err
+		}
+		manifest = path
+	}
+
+	for i, file := range files {
+		var offset int64
+		err := CheckFile(file, snapshot.Handler{}, func(record Record) error {
+			if record.Timestamp > ts {
+				offset = record.Offset
+				return errFound
+			}
+			return nil
+		})
+		if err == nil {
+			continue
+		}
+		if err != errFound {
+			return nil, err
+		}
+
+		if manifest != "" && i == 0 && offset == 0 {
+			if m, err := parseManifest(manifest); err == nil && m.base != nil {
+				return nil, ErrBeforeBase
+			}
+		}
+		return &Cut{Manifest: manifest, File: file, Size: offset, Dropped: files[i+1:]}, nil
+	}
+
+	return nil, nil
+}
+
+// Apply cuts the AOF. The manifest is saved without the dropped files
+// first, so a crash halfway leaves an AOF that loads, at worst with writes
+// after the point in time still in File.
+func (c *Cut) Apply() error {
+	if c.Manifest != "" && len(c.Dropped) > 0 {
+		m, err := parseManifest(c.Manifest)
+		if err != nil {
+			return err
+		}
+		keep := len(m.incrs) - len(c.Dropped)
+		if keep < 0 {
+			return errors.New("the manifest changed")
+		}
+		m.incrs = m.incrs[:keep]
+		err = m.save(c.Manifest)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.Truncate(c.File, c.Size)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range c.Dropped {
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package aof
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/maniktherana/godbase/pkg/snapshot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFile(t *testing.T) {
+	valid := string(command("SET", "a", "1").Marshal()) + string(command("SET", "b", "2").Marshal())
+
+	tests := []struct {
+		name      string
+		data      string
+		records   int
+		offset    int64
+		truncated bool
+		ok        bool
+	}{
+		{name: "valid", data: valid, records: 2, ok: true},
+		{name: "empty", data: "", ok: true},
+		{name: "truncated payload", data: valid + "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n", records: 2, offset: int64(len(valid)), truncated: true},
+		{name: "truncated length", data: valid + "*3\r\n$3", records: 2, offset: int64(len(valid)), truncated: true},
+		{name: "truncated header", data: valid + "*", records: 2, offset: int64(len(valid)), truncated: true},
+		{name: "garbage", data: valid + "garbage\r\n" + valid, records: 2, offset: int64(len(valid))},
+		{name: "bad length", data: "*1\r\n$x\r\n" + valid, records: 0, offset: 0},
+		{name: "not an array", data: valid + "$3\r\nSET\r\n", records: 2, offset: int64(len(valid))},
+		{name: "empty array", data: "*0\r\n", records: 0, offset: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.aof")
+			require.NoError(t, os.WriteFile(path, []byte(tc.data), 0666))
+
+			offsets := []int64{}
+			err := CheckFile(path, snapshot.Handler{}, func(record Record) error {
+				offsets = append(offsets, record.Offset)
+				return nil
+			})
+			assert.Len(t, offsets, tc.records)
+			if tc.records == 2 {
+				assert.Equal(t, []int64{0, int64(len(command("SET", "a", "1").Marshal()))}, offsets)
+			}
+
+			if tc.ok {
+				assert.NoError(t, err)
+				return
+			}
+			var corrupt *CorruptError
+			require.ErrorAs(t, err, &corrupt)
+			assert.Equal(t, tc.offset, corrupt.Offset)
+			assert.Equal(t, tc.truncated, corrupt.Truncated)
+			assert.Equal(t, path, corrupt.Path)
+		})
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := NewAof(dir, "test.aof", FsyncNo)
+	require.NoError(t, err)
+	require.NoError(t, aof.Write(command("SET", "a", "1")))
+	// A crash in the middle of a write leaves part of a record behind.
+	_, err = aof.File.WriteString("*3\r\n$3\r\nSET\r\n$1")
+	require.NoError(t, err)
+	require.NoError(t, aof.Close())
+
+	aof, err = NewAof(dir, "test.aof", FsyncNo)
+	require.NoError(t, err)
+	defer aof.Close()
+
+	var corrupt *CorruptError
+	require.ErrorAs(t, aof.Read(func(resp.Value) {}), &corrupt)
+	assert.True(t, corrupt.Truncated)
+
+	aof.LoadTruncated = true
+	assert.Equal(t, []resp.Value{command("SET", "a", "1")}, readAll(t, aof))
+
+	// Writes carry on right after the last complete record.
+	require.NoError(t, aof.Write(command("SET", "b", "2")))
+	assert.Equal(t, []resp.Value{command("SET", "a", "1"), command("SET", "b", "2")}, readAll(t, aof))
+	size := len(command("SET", "a", "1").Marshal()) + len(command("SET", "b", "2").Marshal())
+	assert.Contains(t, aof.Info(), fmt.Sprintf("aof_current_size:%d", size))
+}
+
+func TestReadCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	aof, err := NewAof(dir, "test.aof", FsyncNo)
+	require.NoError(t, err)
+	require.NoError(t, aof.Write(command("SET", "a", "1")))
+	_, err = aof.File.WriteString("garbage\r\n")
+	require.NoError(t, err)
+	require.NoError(t, aof.Write(command("SET", "b", "2")))
+	aof.LoadTruncated = true
+
+	// Corruption in the middle of the file can't be explained by a crash,
+	// so it's never cut off.
+	var corrupt *CorruptError
+	require.ErrorAs(t, aof.Read(func(resp.Value) {}), &corrupt)
+	assert.False(t, corrupt.Truncated)
+	assert.Equal(t, int64(len(command("SET", "a", "1").Marshal())), corrupt.Offset)
+	require.NoError(t, aof.Close())
+}
+
+func TestReadTruncatedBeforeLastFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test.aof.1.base.aof"), []byte("*3\r\n$3\r\nSET"), 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test.aof.manifest"), []byte("file test.aof.1.base.aof seq 1 type b\n"), 0666))
+
+	aof, err := NewAof(dir, "test.aof", FsyncNo)
+	require.NoError(t, err)
+	defer aof.Close()
+	aof.LoadTruncated = true
+
+	// Only the file being appended to can be cut short by a crash.
+	var corrupt *CorruptError
+	require.ErrorAs(t, aof.Read(func(resp.Value) {}), &corrupt)
+	assert.True(t, corrupt.Truncated)
+}
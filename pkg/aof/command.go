@@ -0,0 +1,170 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"slices"
+
+	"github.com/maniktherana/godbase/pkg/resp"
+)
+
+// slabSize is how many argument Values are allocated at once for the
+// commands commandReader reads.
+const slabSize = 4096
+
+// maxBulkChunk is how much of a bulk string is read at a time, so a
+// corrupt length doesn't get allocated up front.
+const maxBulkChunk = 1 << 20
+
+var (
+	errNotCommand   = errors.New("expected a command")
+	errNotBulk      = errors.New("expected a bulk string argument")
+	errArrayLength  = errors.New("invalid multibulk length")
+	errBulkLength   = errors.New("invalid bulk length")
+	errExpectedCRLF = errors.New("expected CRLF")
+)
+
+// commandReader reads the commands an AOF is made of, arrays of bulk
+// strings, with far fewer allocations than the general resp parser. The
+// arguments of a command share a single string, and the arrays holding
+// them are cut out of slabs shared by many commands. Nothing handed out is
+// ever reused, so commands can be kept for as long as needed.
+type commandReader struct {
+	br *bufio.Reader
+	// payload of the command being read, and where each argument ends
+	scratch []byte
+	ends    []int
+	slab    []resp.Value
+}
+
+// read reads the next command. A file that ends in the middle of one
+// gives io.ErrUnexpectedEOF.
+func (r *commandReader) read() (resp.Value, error) {
+	typ, err := r.br.ReadByte()
+	if err != nil {
+		return resp.Value{}, unexpectedEOF(err)
+	}
+	if typ != resp.ARRAY {
+		return resp.Value{}, errNotCommand
+	}
+	n, err := r.readLength(errArrayLength)
+	if err != nil {
+		return resp.Value{}, err
+	}
+	if n <= 0 {
+		return resp.Value{}, errNotCommand
+	}
+
+	r.scratch = r.scratch[:0]
+	r.ends = r.ends[:0]
+	for range n {
+		typ, err := r.br.ReadByte()
+		if err != nil {
+			return resp.Value{}, unexpectedEOF(err)
+		}
+		if typ != resp.BULK {
+			return resp.Value{}, errNotBulk
+		}
+		size, err := r.readLength(errBulkLength)
+		if err != nil {
+			return resp.Value{}, err
+		}
+		if size < 0 {
+			return resp.Value{}, errNotBulk
+		}
+
+		err = r.readBulk(size)
+		if err != nil {
+			return resp.Value{}, err
+		}
+		r.ends = append(r.ends, len(r.scratch))
+	}
+
+	if len(r.slab) < n {
+		r.slab = make([]resp.Value, max(n, slabSize))
+	}
+	args := r.slab[:n:n]
+	r.slab = r.slab[n:]
+
+	payload := string(r.scratch)
+	start := 0
+	for i, end := range r.ends {
+		args[i] = resp.Value{Typ: "bulk", Bulk: payload[start:end]}
+		start = end
+	}
+
+	// A huge value doesn't keep its buffer pinned for the rest of the file.
+	if cap(r.scratch) > maxReusedBuf {
+		r.scratch = nil
+	}
+
+	return resp.Value{Typ: "array", Array: args}, nil
+}
+
+// readLength reads the length following a type byte, returning invalid if
+// it isn't a number.
+func (r *commandReader) readLength(invalid error) (int, error) {
+	line, err := r.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return 0, invalid
+	}
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return 0, invalid
+	}
+	line = line[:len(line)-2]
+
+	neg := line[0] == '-'
+	if neg {
+		line = line[1:]
+	}
+	n := 0
+	for _, c := range line {
+		if c < '0' || c > '9' || n > (1<<62)/10 {
+			return 0, invalid
+		}
+		n = n*10 + int(c-'0')
+	}
+	if neg {
+		return -n, nil
+	}
+	return n, nil
+}
+
+// readBulk appends the size bytes of a bulk string to scratch, and checks
+// the CRLF after them.
+func (r *commandReader) readBulk(size int) error {
+	for size > 0 {
+		chunk := min(size, maxBulkChunk)
+		r.scratch = slices.Grow(r.scratch, chunk)
+		start := len(r.scratch)
+		r.scratch = r.scratch[:start+chunk]
+		_, err := io.ReadFull(r.br, r.scratch[start:])
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		size -= chunk
+	}
+
+	crlf, err := r.br.Peek(2)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return errExpectedCRLF
+	}
+	r.br.Discard(2)
+	return nil
+}
+
+// unexpectedEOF turns the end of the file into io.ErrUnexpectedEOF, since
+// it's only ever reached here in the middle of a command.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
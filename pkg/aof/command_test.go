@@ -0,0 +1,73 @@
+package aof
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandReader(t *testing.T) {
+	input := command("SET", "key", "value").Marshal()
+	input = append(input, command("DEL", "").Marshal()...)
+	input = append(input, command("HSET", "h", "f", strings.Repeat("v", 3*maxBulkChunk/2)).Marshal()...)
+
+	r := &commandReader{br: bufio.NewReader(strings.NewReader(string(input)))}
+	for _, expected := range []resp.Value{command("SET", "key", "value"), command("DEL", ""), command("HSET", "h", "f", strings.Repeat("v", 3*maxBulkChunk/2))} {
+		value, err := r.read()
+		require.NoError(t, err)
+		assert.Equal(t, expected, value)
+	}
+	_, err := r.read()
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestCommandReaderErrors(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected error
+	}{
+		{"+OK\r\n", errNotCommand},
+		{"*0\r\n", errNotCommand},
+		{"*-1\r\n", errNotCommand},
+		{"*x\r\n", errArrayLength},
+		{"*1\n", errArrayLength},
+		{"*1\r\n:1\r\n", errNotBulk},
+		{"*1\r\n$-1\r\n", errNotBulk},
+		{"*1\r\n$1x\r\n", errBulkLength},
+		{"*1\r\n$3\r\nSETxx", errExpectedCRLF},
+		{"*2\r\n$3\r\nSET\r\n", io.ErrUnexpectedEOF},
+		{"*1\r\n$3\r\nSE", io.ErrUnexpectedEOF},
+		{"*1\r\n$3", io.ErrUnexpectedEOF},
+		{"*1\r\n$99999999999\r\nx", io.ErrUnexpectedEOF},
+	} {
+		r := &commandReader{br: bufio.NewReader(strings.NewReader(tc.input))}
+		_, err := r.read()
+		assert.ErrorIs(t, err, tc.expected, "%q", tc.input)
+	}
+}
+
+func BenchmarkCommandReader(b *testing.B) {
+	input := []byte(strings.Repeat(string(command("SET", "user:123", "some-value-12345").Marshal()), 1000))
+	reader := strings.NewReader("")
+	r := &commandReader{br: bufio.NewReader(reader)}
+
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		reader.Reset(string(input))
+		r.br.Reset(reader)
+		for range 1000 {
+			_, err := r.read()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// File types in the manifest, as used by Redis 7.
+const (
+	// The base file holds the dataset as of the last rewrite.
+	typeBase = "b"
+	// Incremental files hold the writes made since, in order.
+	typeIncr = "i"
+	// History files were replaced by a rewrite and are waiting to be
+	// deleted.
+	typeHistory = "h"
+)
+
+type manifestEntry struct {
+	name string
+	seq  int
+	typ  string
+}
+
+// manifest lists the files making up the AOF, in the same format Redis
+// uses:
+//
+//	file appendonly.aof.1.base.aof seq 1 type b
+//	file appendonly.aof.1.incr.aof seq 1 type i
+type manifest struct {
+	base    *manifestEntry
+	incrs   []manifestEntry
+	history []manifestEntry
+}
+
+func parseManifest(path string) (*manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &manifest{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		entry, err := parseManifestLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AOF manifest %s line %d: %w", path, line, err)
+		}
+
+		switch entry.typ {
+		case typeBase:
+			if m.base != nil {
+				return nil, fmt.Errorf("invalid AOF manifest %s line %d: more than one base file", path, line)
+			}
+			m.base = &entry
+		case typeIncr:
+			if len(m.incrs) > 0 && entry.seq <= m.incrs[len(m.incrs)-1].seq {
+				return nil, fmt.Errorf("invalid AOF manifest %s line %d: incremental files out of order", path, line)
+			}
+			m.incrs = append(m.incrs, entry)
+		case typeHistory:
+			m.history = append(m.history, entry)
+		}
+	}
+
+	return m, scanner.Err()
+}
+
+func parseManifestLine(line string) (manifestEntry, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return manifestEntry{}, fmt.Errorf("odd number of fields")
+	}
+
+	entry := manifestEntry{}
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fields[i], fields[i+1]
+		switch key {
+		case "file":
+			if strings.ContainsRune(value, filepath.Separator) {
+				return entry, fmt.Errorf("file name %q has a path", value)
+			}
+			entry.name = value
+		case "seq":
+			seq, err := strconv.Atoi(value)
+			if err != nil || seq < 1 {
+				return entry, fmt.Errorf("invalid seq %q", value)
+			}
+			entry.seq = seq
+		case "type":
+			if value != typeBase && value != typeIncr && value != typeHistory {
+				return entry, fmt.Errorf("unknown type %q", value)
+			}
+			entry.typ = value
+		}
+		// Unknown keys are skipped, so manifests written by newer
+		// versions still load.
+	}
+
+	if entry.name == "" || entry.seq == 0 || entry.typ == "" {
+		return entry, fmt.Errorf("missing file, seq or type")
+	}
+
+	return entry, nil
+}
+
+func (m *manifest) String() string {
+	var sb strings.Builder
+	write := func(e manifestEntry) {
+		fmt.Fprintf(&sb, "file %s seq %d type %s\n", e.name, e.seq, e.typ)
+	}
+
+	if m.base != nil {
+		write(*m.base)
+	}
+	for _, e := range m.history {
+		write(e)
+	}
+	for _, e := range m.incrs {
+		write(e)
+	}
+
+	return sb.String()
+}
+
+// files returns the files holding data in the order they're loaded.
+func (m *manifest) files() []manifestEntry {
+	files := []manifestEntry{}
+	if m.base != nil {
+		files = append(files, *m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+func (m *manifest) lastIncr() *manifestEntry {
+	if len(m.incrs) == 0 {
+		return nil
+	}
+	return &m.incrs[len(m.incrs)-1]
+}
+
+func (m *manifest) nextIncrSeq() int {
+	if last := m.lastIncr(); last != nil {
+		return last.seq + 1
+	}
+	return 1
+}
+
+func (m *manifest) nextBaseSeq() int {
+	if m.base != nil {
+		return m.base.seq + 1
+	}
+	return 1
+}
+
+// save atomically replaces the manifest at path: the new one is written
+// and synced under a temporary name and renamed over the old one, so a
+// crash leaves either the old or the new manifest behind, never a mix.
+func (m *manifest) save(path string) error {
+	dir, name := filepath.Split(path)
+	tmp := filepath.Join(dir, "temp-"+name)
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(m.String())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes renames and new files in dir durable.
+func syncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,111 @@
+package aof
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/maniktherana/godbase/pkg/snapshot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePreamble(keys map[string]string) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		sw := snapshot.NewWriter(w, false)
+		for key, value := range keys {
+			err := sw.String(key, value, 0)
+			if err != nil {
+				return err
+			}
+		}
+		return sw.Close()
+	}
+}
+
+func TestRewritePreamble(t *testing.T) {
+	dir := t.TempDir()
+	aof := newAnnotatedAof(t, dir)
+	defer aof.Close()
+
+	aof.Preamble = writePreamble(map[string]string{"a": "1", "b": "2"})
+	require.NoError(t, aof.BgRewrite())
+	aof.rewriteWg.Wait()
+	require.Contains(t, aof.Info(), "aof_last_bgrewrite_status:ok")
+	require.NoError(t, aof.Write(command("SET", "c", "3")))
+
+	data, err := os.ReadFile(filepath.Join(dir, "test.aof.1.base.aof"))
+	require.NoError(t, err)
+	ts, rest, ok := strings.Cut(string(data), "\r\n")
+	require.True(t, ok)
+	assert.True(t, strings.HasPrefix(ts, "#TS:"), ts)
+	assert.True(t, strings.HasPrefix(rest, snapshot.Magic), rest)
+
+	loaded := map[string]string{}
+	aof.LoadPreamble = snapshot.Handler{
+		String: func(key, value string, expires int64) error {
+			loaded[key] = value
+			return nil
+		},
+	}
+	assert.Equal(t, []resp.Value{command("SET", "c", "3")}, readAll(t, aof))
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, loaded)
+}
+
+func TestPreambleWithCommandTail(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "appendonlydir")
+	var buf strings.Builder
+	require.NoError(t, writePreamble(map[string]string{"a": "1"})(&buf))
+	tail := string(command("SET", "b", "2").Marshal())
+	require.NoError(t, os.WriteFile(filepath.Join(parent, "test.aof"), []byte(buf.String()+tail), 0666))
+
+	// A single file from an older version can start with a preamble too.
+	aof, err := NewAof(dir, "test.aof", FsyncNo)
+	require.NoError(t, err)
+	defer aof.Close()
+
+	loaded := []string{}
+	aof.LoadPreamble = snapshot.Handler{
+		String: func(key, value string, expires int64) error {
+			loaded = append(loaded, key)
+			return nil
+		},
+	}
+	assert.Equal(t, []resp.Value{command("SET", "b", "2")}, readAll(t, aof))
+	assert.Equal(t, []string{"a"}, loaded)
+
+	records := []Record{}
+	require.NoError(t, CheckFile(filepath.Join(dir, "test.aof"), snapshot.Handler{}, func(record Record) error {
+		records = append(records, record)
+		return nil
+	}))
+	assert.Equal(t, []Record{
+		{Offset: 0, Preamble: true},
+		{Offset: int64(buf.Len()), Value: command("SET", "b", "2")},
+	}, records)
+}
+
+func TestPreambleCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	var buf strings.Builder
+	require.NoError(t, writePreamble(map[string]string{"key": "value"})(&buf))
+	data := []byte(buf.String())
+	data[len(data)/2] ^= 0xff
+	path := filepath.Join(dir, "test.aof")
+	require.NoError(t, os.WriteFile(path, data, 0666))
+
+	var corrupt *CorruptError
+	require.ErrorAs(t, CheckFile(path, snapshot.Handler{}, func(Record) error { return nil }), &corrupt)
+	assert.False(t, corrupt.Truncated)
+	assert.Equal(t, int64(0), corrupt.Offset)
+
+	// Commands before it make it an ordinary bad record.
+	tail := string(command("SET", "a", "1").Marshal())
+	require.NoError(t, os.WriteFile(path, []byte(tail+buf.String()), 0666))
+	require.ErrorAs(t, CheckFile(path, snapshot.Handler{}, func(Record) error { return nil }), &corrupt)
+	assert.Equal(t, int64(len(tail)), corrupt.Offset)
+}
@@ -0,0 +1,317 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/maniktherana/godbase/pkg/snapshot"
+)
+
+// Config holds the server settings. Options use the same names as their
+// redis.conf counterparts and are set on the command line, e.g.
+//
+//	server -proto-max-bulk-len 64mb
+type Config struct {
+	// Largest bulk string a client may send.
+	ProtoMaxBulkLen int
+	// Largest number of elements in a single request.
+	MaxMultiBulkLen int
+	// Largest amount of memory a single pending request may take.
+	ClientQueryBufferLimit int
+
+	// Once the dataset takes more than Maxmemory bytes, keys are evicted
+	// following MaxmemoryPolicy, sampling MaxmemorySamples keys at a time.
+	// 0 means there's no limit.
+	Maxmemory        int
+	MaxmemoryPolicy  string
+	MaxmemorySamples int
+	// How slowly the access counters of LFU policies grow, and how many
+	// minutes it takes them to decrease by one.
+	LfuLogFactor int
+	LfuDecayTime int
+	// Hashes are kept packed while they have at most
+	// HashMaxListpackEntries fields, none longer than HashMaxListpackValue
+	// bytes.
+	HashMaxListpackEntries int
+	HashMaxListpackValue   int
+	// Strings of at least StringCompressMinSize bytes are kept compressed
+	// in memory, 0 means they never are.
+	StringCompressMinSize int
+	// Whether keys deleted by eviction, expiry, or the server replacing
+	// them are freed in the background. Only strings expire, and they're
+	// always freed right away, so LazyfreeLazyExpire is only accepted for
+	// compatibility.
+	LazyfreeLazyEviction  bool
+	LazyfreeLazyExpire    bool
+	LazyfreeLazyServerDel bool
+
+	// Snapshots are saved to Dbfilename, compressed if Rdbcompression is
+	// set, whenever one of the Save rules matches. Save is empty to only
+	// save on request.
+	Dbfilename     string
+	Rdbcompression bool
+	Save           []snapshot.Rule
+	// Refuse writes while the last snapshot failed and Save rules are
+	// set, so a failing disk is noticed.
+	StopWritesOnBgsaveError bool
+	// Format snapshots are saved in: godbase, or rdb for files Redis can
+	// load. Both are loaded whatever it's set to.
+	SnapshotFormat string
+
+	// The AOF is kept in AppendDirname, in files named after
+	// AppendFilename.
+	AppendDirname  string
+	AppendFilename string
+	// When to fsync the AOF: always, everysec or no.
+	Appendfsync string
+	// Rewrite the AOF once it grew by this many percent since the last
+	// rewrite and is at least AutoAofRewriteMinSize bytes. 0 disables it.
+	AutoAofRewritePercentage int
+	AutoAofRewriteMinSize    int
+	// Load an AOF that ends in a truncated record by cutting it off,
+	// instead of refusing to start.
+	AofLoadTruncated bool
+	// Annotate the AOF with the time commands were written at, for point
+	// in time recovery, and with checksums that catch corruption on load.
+	AofTimestampEnabled bool
+	AofChecksumEnabled  bool
+	// Write the base file of an AOF rewrite as a binary snapshot rather
+	// than as commands, which is smaller and faster to load.
+	AofUseRdbPreamble bool
+}
+
+func Default() *Config {
+	return &Config{
+		ProtoMaxBulkLen:          512 << 20,
+		MaxMultiBulkLen:          1 << 20,
+		ClientQueryBufferLimit:   1 << 30,
+		MaxmemoryPolicy:          "noeviction",
+		MaxmemorySamples:         5,
+		LfuLogFactor:             10,
+		LfuDecayTime:             1,
+		HashMaxListpackEntries:   128,
+		HashMaxListpackValue:     64,
+		Dbfilename:               "dump.gdb",
+		Rdbcompression:           true,
+		SnapshotFormat:           "godbase",
+		Save:                     []snapshot.Rule{{Seconds: 3600, Changes: 1}, {Seconds: 300, Changes: 100}, {Seconds: 60, Changes: 10000}},
+		StopWritesOnBgsaveError:  true,
+		AppendDirname:            "appendonlydir",
+		AppendFilename:           "database.aof",
+		Appendfsync:              "everysec",
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    64 << 20,
+		AofLoadTruncated:         true,
+		AofUseRdbPreamble:        true,
+	}
+}
+
+// Parse returns the default config overridden by the given command line
+// arguments.
+func Parse(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("godbase", flag.ContinueOnError)
+	fs.Var((*memory)(&cfg.ProtoMaxBulkLen), "proto-max-bulk-len", "maximum size of a single bulk string")
+	fs.IntVar(&cfg.MaxMultiBulkLen, "max-multibulk-len", cfg.MaxMultiBulkLen, "maximum number of elements in a request")
+	fs.Var((*memory)(&cfg.ClientQueryBufferLimit), "client-query-buffer-limit", "maximum size of a pending request")
+
+	fs.Var((*memory)(&cfg.Maxmemory), "maxmemory", "size of the dataset past which keys are evicted, 0 for no limit")
+	fs.Func("maxmemory-policy", "how keys are evicted: noeviction, allkeys-lru, allkeys-lfu, allkeys-random, volatile-lru, volatile-lfu, volatile-random or volatile-ttl",
+		oneOf(&cfg.MaxmemoryPolicy, "noeviction", "allkeys-lru", "allkeys-lfu", "allkeys-random", "volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl"))
+	fs.Func("maxmemory-samples", "number of keys eviction samples at a time", positive(&cfg.MaxmemorySamples))
+	fs.Func("lfu-log-factor", "how slowly LFU counters grow", nonNegative(&cfg.LfuLogFactor))
+	fs.Func("lfu-decay-time", "minutes for LFU counters to decrease by one, 0 to never", nonNegative(&cfg.LfuDecayTime))
+	fs.Func("hash-max-listpack-entries", "most fields a hash is kept packed with", nonNegative(&cfg.HashMaxListpackEntries))
+	fs.Func("hash-max-listpack-value", "longest field or value a hash is kept packed with", nonNegative(&cfg.HashMaxListpackValue))
+	fs.Var((*memory)(&cfg.StringCompressMinSize), "string-compress-min-size", "size from which strings are kept compressed in memory, 0 to never")
+	fs.Var((*yesNo)(&cfg.LazyfreeLazyEviction), "lazyfree-lazy-eviction", "free evicted keys in the background: yes or no")
+	fs.Var((*yesNo)(&cfg.LazyfreeLazyExpire), "lazyfree-lazy-expire", "free expired keys in the background: yes or no")
+	fs.Var((*yesNo)(&cfg.LazyfreeLazyServerDel), "lazyfree-lazy-server-del", "free keys the server replaces in the background: yes or no")
+
+	fs.Func("dbfilename", "file snapshots are saved to", func(s string) error {
+		if s == "" || strings.ContainsAny(s, `/\`) {
+			return fmt.Errorf("must be a file name without a path")
+		}
+		cfg.Dbfilename = s
+		return nil
+	})
+	fs.Var((*yesNo)(&cfg.Rdbcompression), "rdbcompression", "compress snapshots: yes or no")
+	fs.Var((*yesNo)(&cfg.StopWritesOnBgsaveError), "stop-writes-on-bgsave-error", "refuse writes while snapshots fail: yes or no")
+	fs.Func("snapshot-format", "format snapshots are saved in: godbase or rdb", oneOf(&cfg.SnapshotFormat, "godbase", "rdb"))
+	fs.Var((*saveRules)(&cfg.Save), "save", `save rules as "<seconds> <changes>" pairs, "" to disable`)
+	fs.StringVar(&cfg.AppendDirname, "appenddirname", cfg.AppendDirname, "directory holding the AOF files")
+	fs.Func("appendfilename", "base name of the AOF files", func(s string) error {
+		if s == "" || strings.ContainsAny(s, `/\`) {
+			return fmt.Errorf("must be a file name without a path")
+		}
+		cfg.AppendFilename = s
+		return nil
+	})
+	fs.Func("appendfsync", "when to fsync the AOF: always, everysec or no", oneOf(&cfg.Appendfsync, "always", "everysec", "no"))
+	fs.IntVar(&cfg.AutoAofRewritePercentage, "auto-aof-rewrite-percentage", cfg.AutoAofRewritePercentage, "growth of the AOF that triggers a rewrite, 0 to disable")
+	fs.Var((*memory)(&cfg.AutoAofRewriteMinSize), "auto-aof-rewrite-min-size", "smallest AOF size that triggers a rewrite")
+	fs.Var((*yesNo)(&cfg.AofLoadTruncated), "aof-load-truncated", "load an AOF with a truncated last record: yes or no")
+	fs.Var((*yesNo)(&cfg.AofTimestampEnabled), "aof-timestamp-enabled", "annotate the AOF with timestamps: yes or no")
+	fs.Var((*yesNo)(&cfg.AofChecksumEnabled), "aof-checksum-enabled", "annotate the AOF with checksums: yes or no")
+	fs.Var((*yesNo)(&cfg.AofUseRdbPreamble), "aof-use-rdb-preamble", "write AOF base files as snapshots: yes or no")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// oneOf returns a flag setter that only accepts the given values.
+func oneOf(dst *string, values ...string) func(string) error {
+	return func(s string) error {
+		for _, v := range values {
+			if strings.EqualFold(s, v) {
+				*dst = v
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(values, ", "))
+	}
+}
+
+// positive returns a flag setter that only accepts integers above 0.
+func positive(dst *int) func(string) error {
+	return func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("must be a positive integer")
+		}
+		*dst = n
+		return nil
+	}
+}
+
+// nonNegative returns a flag setter that only accepts integers of 0 and
+// above.
+func nonNegative(dst *int) func(string) error {
+	return func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("must be an integer of 0 or more")
+		}
+		*dst = n
+		return nil
+	}
+}
+
+// yesNo is a boolean flag spelled yes or no, as in redis.conf.
+type yesNo bool
+
+func (b *yesNo) String() string {
+	if *b {
+		return "yes"
+	}
+	return "no"
+}
+
+func (b *yesNo) Set(s string) error {
+	switch strings.ToLower(s) {
+	case "yes":
+		*b = true
+	case "no":
+		*b = false
+	default:
+		return fmt.Errorf("must be yes or no")
+	}
+	return nil
+}
+
+// saveRules is a flag holding save rules.
+type saveRules []snapshot.Rule
+
+func (r *saveRules) String() string {
+	pairs := make([]string, 0, 2*len(*r))
+	for _, rule := range *r {
+		pairs = append(pairs, strconv.Itoa(rule.Seconds), strconv.FormatInt(rule.Changes, 10))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (r *saveRules) Set(s string) error {
+	rules, err := ParseSave(s)
+	if err != nil {
+		return err
+	}
+	*r = rules
+	return nil
+}
+
+// ParseSave parses save rules written as "<seconds> <changes>" pairs, as
+// in "3600 1 300 100". An empty string means no rules.
+func ParseSave(s string) ([]snapshot.Rule, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save rules %q", s)
+	}
+
+	rules := []snapshot.Rule{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid save rules %q", s)
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save rules %q", s)
+		}
+		rules = append(rules, snapshot.Rule{Seconds: seconds, Changes: changes})
+	}
+	return rules, nil
+}
+
+// memory is a flag holding a byte count that accepts the same units as
+// redis.conf: 1k, 5gb, 4m and so on.
+type memory int
+
+func (m *memory) String() string {
+	return strconv.Itoa(int(*m))
+}
+
+func (m *memory) Set(s string) error {
+	n, err := ParseMemory(s)
+	if err != nil {
+		return err
+	}
+	*m = memory(n)
+	return nil
+}
+
+// ParseMemory parses a memory size such as "100mb". k, m and g are powers
+// of 1000 while kb, mb and gb are powers of 1024.
+func ParseMemory(s string) (int, error) {
+	units := []struct {
+		suffix string
+		mul    int
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	}
+
+	lower := strings.ToLower(s)
+	mul := 1
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower = strings.TrimSuffix(lower, u.suffix)
+			mul = u.mul
+			break
+		}
+	}
+
+	n, err := strconv.Atoi(lower)
+	if err != nil || n < 0 || n > math.MaxInt/mul {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+
+	return n * mul, nil
+}
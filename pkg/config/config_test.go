@@ -0,0 +1,155 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/maniktherana/godbase/pkg/snapshot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMemory(t *testing.T) {
+	tt := []struct {
+		input    string
+		expected int
+	}{
+		{"100", 100},
+		{"100b", 100},
+		{"1k", 1000},
+		{"1kb", 1024},
+		{"5M", 5000000},
+		{"512mb", 512 << 20},
+		{"1gb", 1 << 30},
+	}
+
+	for _, tc := range tt {
+		n, err := ParseMemory(tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, n)
+	}
+
+	for _, input := range []string{"", "mb", "-1", "1tb", "99999999999gb", "9223372036854775807k"} {
+		_, err := ParseMemory(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestParseSave(t *testing.T) {
+	rules, err := ParseSave("3600 1 300 100")
+	require.NoError(t, err)
+	assert.Equal(t, []snapshot.Rule{{Seconds: 3600, Changes: 1}, {Seconds: 300, Changes: 100}}, rules)
+	assert.Equal(t, "3600 1 300 100", (*saveRules)(&rules).String())
+
+	rules, err = ParseSave("")
+	require.NoError(t, err)
+	assert.Empty(t, rules)
+
+	for _, s := range []string{"60", "a 1", "60 b", "0 1", "60 -1"} {
+		_, err := ParseSave(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]string{"-proto-max-bulk-len", "1mb", "-max-multibulk-len", "10"})
+	require.NoError(t, err)
+	assert.Equal(t, 1<<20, cfg.ProtoMaxBulkLen)
+	assert.Equal(t, 10, cfg.MaxMultiBulkLen)
+	assert.Equal(t, Default().ClientQueryBufferLimit, cfg.ClientQueryBufferLimit)
+
+	_, err = Parse([]string{"-proto-max-bulk-len", "lots"})
+	assert.Error(t, err)
+
+	cfg, err = Parse([]string{"-appendfsync", "ALWAYS"})
+	require.NoError(t, err)
+	assert.Equal(t, "always", cfg.Appendfsync)
+
+	_, err = Parse([]string{"-appendfsync", "sometimes"})
+	assert.Error(t, err)
+
+	cfg, err = Parse([]string{"-appenddirname", "aof", "-appendfilename", "app.aof"})
+	require.NoError(t, err)
+	assert.Equal(t, "aof", cfg.AppendDirname)
+	assert.Equal(t, "app.aof", cfg.AppendFilename)
+
+	_, err = Parse([]string{"-appendfilename", "dir/app.aof"})
+	assert.Error(t, err)
+
+	assert.True(t, Default().AofLoadTruncated)
+	cfg, err = Parse([]string{"-aof-load-truncated", "no"})
+	require.NoError(t, err)
+	assert.False(t, cfg.AofLoadTruncated)
+
+	_, err = Parse([]string{"-aof-load-truncated", "maybe"})
+	assert.Error(t, err)
+
+	cfg, err = Parse([]string{"-save", "", "-dbfilename", "snap.gdb", "-rdbcompression", "no"})
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Save)
+	assert.Equal(t, "snap.gdb", cfg.Dbfilename)
+	assert.False(t, cfg.Rdbcompression)
+
+	_, err = Parse([]string{"-save", "60"})
+	assert.Error(t, err)
+
+	cfg, err = Parse([]string{"-aof-timestamp-enabled", "yes", "-aof-checksum-enabled", "yes"})
+	require.NoError(t, err)
+	assert.True(t, cfg.AofTimestampEnabled)
+	assert.True(t, cfg.AofChecksumEnabled)
+
+	cfg, err = Parse([]string{"-snapshot-format", "rdb"})
+	require.NoError(t, err)
+	assert.Equal(t, "rdb", cfg.SnapshotFormat)
+
+	_, err = Parse([]string{"-snapshot-format", "json"})
+	assert.Error(t, err)
+
+	assert.True(t, Default().StopWritesOnBgsaveError)
+	cfg, err = Parse([]string{"-stop-writes-on-bgsave-error", "no"})
+	require.NoError(t, err)
+	assert.False(t, cfg.StopWritesOnBgsaveError)
+
+	assert.True(t, Default().AofUseRdbPreamble)
+	cfg, err = Parse([]string{"-aof-use-rdb-preamble", "no"})
+	require.NoError(t, err)
+	assert.False(t, cfg.AofUseRdbPreamble)
+
+	cfg, err = Parse([]string{"-maxmemory", "100mb", "-maxmemory-policy", "allkeys-lfu", "-maxmemory-samples", "10", "-lfu-log-factor", "0", "-lfu-decay-time", "5"})
+	require.NoError(t, err)
+	assert.Equal(t, 100<<20, cfg.Maxmemory)
+	assert.Equal(t, "allkeys-lfu", cfg.MaxmemoryPolicy)
+	assert.Equal(t, 10, cfg.MaxmemorySamples)
+	assert.Equal(t, 0, cfg.LfuLogFactor)
+	assert.Equal(t, 5, cfg.LfuDecayTime)
+	assert.Equal(t, "noeviction", Default().MaxmemoryPolicy)
+
+	cfg, err = Parse([]string{"-hash-max-listpack-entries", "512", "-hash-max-listpack-value", "0"})
+	require.NoError(t, err)
+	assert.Equal(t, 512, cfg.HashMaxListpackEntries)
+	assert.Equal(t, 0, cfg.HashMaxListpackValue)
+	assert.Equal(t, 128, Default().HashMaxListpackEntries)
+
+	cfg, err = Parse([]string{"-string-compress-min-size", "4kb"})
+	require.NoError(t, err)
+	assert.Equal(t, 4<<10, cfg.StringCompressMinSize)
+	assert.Zero(t, Default().StringCompressMinSize)
+
+	cfg, err = Parse([]string{"-lazyfree-lazy-eviction", "yes", "-lazyfree-lazy-expire", "yes", "-lazyfree-lazy-server-del", "yes"})
+	require.NoError(t, err)
+	assert.True(t, cfg.LazyfreeLazyEviction)
+	assert.True(t, cfg.LazyfreeLazyExpire)
+	assert.True(t, cfg.LazyfreeLazyServerDel)
+	assert.False(t, Default().LazyfreeLazyEviction)
+
+	for _, args := range [][]string{
+		{"-maxmemory-policy", "lru"},
+		{"-maxmemory-samples", "0"},
+		{"-lfu-log-factor", "-1"},
+		{"-lfu-decay-time", "soon"},
+		{"-hash-max-listpack-entries", "-1"},
+		{"-lazyfree-lazy-eviction", "maybe"},
+	} {
+		_, err = Parse(args)
+		assert.Error(t, err, args)
+	}
+}
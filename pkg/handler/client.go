@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/maniktherana/godbase/pkg/writer"
+)
+
+// ClientFlag describes the state of a connection rather than settings
+// chosen by its commands.
+type ClientFlag uint
+
+const (
+	// ClientCloseAfterReply closes the connection once the replies buffered
+	// so far are sent.
+	ClientCloseAfterReply ClientFlag = 1 << iota
+)
+
+// Defaults of the settings commands can change on a client, which RESET
+// restores.
+const (
+	defaultUser     = "default"
+	defaultProtocol = 2
+)
+
+// Client is the state of a connection, created when it's accepted and
+// passed to every command it runs.
+//
+// Replies are buffered in the client's writer and sent when the connection
+// flushes them. The connection holds the client's lock while it runs a
+// command and sends replies, so Push, which other goroutines use to send
+// messages out of band, never ends up in the middle of a reply.
+type Client struct {
+	sync.Mutex
+
+	ID   int64
+	Addr string
+	// When the connection was accepted, and when it last ran a command.
+	// They're only changed by the connection's goroutine.
+	Created         time.Time
+	LastInteraction time.Time
+	Flags           ClientFlag
+
+	// Settings changed by commands, which RESET restores. They're only
+	// used by the connection's goroutine.
+	Name     string
+	DB       int
+	User     string
+	Protocol int
+
+	w *writer.Writer
+}
+
+// clients are the connected clients, keyed by ID.
+var (
+	clients      = map[int64]*Client{}
+	clientsMu    sync.Mutex
+	lastClientID atomic.Int64
+)
+
+func init() {
+	RegisterInfo("clients", clientsInfo)
+	Commands["RESET"] = &Command{
+		Name:          "reset",
+		Handler:       reset,
+		Arity:         1,
+		Flags:         FlagNoScript | FlagLoading | FlagStale | FlagFast | FlagNoAuth,
+		ACLCategories: []string{"@connection"},
+		Summary:       "Resets the connection.",
+		Since:         "6.2.0",
+		Group:         "connection",
+		Complexity:    "O(1)",
+	}
+}
+
+// NewClient returns the client of a connection from addr, whose replies
+// are written to w. It counts as connected until it's closed.
+func NewClient(addr string, w io.Writer) *Client {
+	c := newClient(addr, w)
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	clients[c.ID] = c
+	return c
+}
+
+// newClient returns a client that isn't counted as connected, for running
+// commands that don't come from a connection.
+func newClient(addr string, w io.Writer) *Client {
+	now := time.Now()
+	c := &Client{
+		ID:              lastClientID.Add(1),
+		Addr:            addr,
+		Created:         now,
+		LastInteraction: now,
+		w:               writer.NewWriter(w),
+	}
+	c.Reset()
+	return c
+}
+
+// Close marks the client as disconnected.
+func (c *Client) Close() {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	delete(clients, c.ID)
+}
+
+// Reset restores the settings commands can change to their defaults.
+func (c *Client) Reset() {
+	c.Name = ""
+	c.DB = 0
+	c.User = defaultUser
+	c.Protocol = defaultProtocol
+}
+
+// Writer returns the writer replies are buffered in, for commands that
+// stream them. It must be used with the client locked.
+func (c *Client) Writer() *writer.Writer {
+	return c.w
+}
+
+// Reply buffers v as a reply. It must be called with the client locked.
+func (c *Client) Reply(v resp.Value) error {
+	return c.w.Buffer(v)
+}
+
+// Flush sends the replies buffered so far. It must be called with the
+// client locked.
+func (c *Client) Flush() error {
+	return c.w.Flush()
+}
+
+// Push sends v to the client right away, out of band, e.g. a message
+// published to a channel it's subscribed to. It's safe to call from any
+// goroutine, and waits for the command being run to be done. Replies
+// buffered before it are sent along with it, so a connection holding them
+// back until writes are on disk has to do so in the writer it gave
+// NewClient. RESP2 has no push type, so it's sent as is, as an array
+// usually.
+func (c *Client) Push(v resp.Value) error {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.w.Write(v)
+}
+
+func clientsInfo() []string {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	return []string{fmt.Sprintf("connected_clients:%d", len(clients))}
+}
+
+func reset(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	client.Reset()
+	return resp.Value{Typ: "string", Str: "RESET"}
+}
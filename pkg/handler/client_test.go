@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient returns a client whose replies are discarded.
+func testClient() *Client {
+	return newClient("test", io.Discard)
+}
+
+func TestNewClient(t *testing.T) {
+	before := clientsInfo()
+
+	a := NewClient("127.0.0.1:1234", io.Discard)
+	b := NewClient("127.0.0.1:1235", io.Discard)
+	assert.Greater(t, b.ID, a.ID)
+	assert.Equal(t, "127.0.0.1:1234", a.Addr)
+	assert.False(t, a.Created.IsZero())
+	assert.Equal(t, a.Created, a.LastInteraction)
+	assert.Equal(t, defaultUser, a.User)
+	assert.Equal(t, defaultProtocol, a.Protocol)
+	assert.Contains(t, call(t, Database.NewKv(), "INFO", "clients").Bulk, "connected_clients:")
+
+	a.Close()
+	b.Close()
+	assert.Equal(t, before, clientsInfo())
+}
+
+func TestReset(t *testing.T) {
+	client := testClient()
+	client.Name = "conn"
+	client.DB = 3
+	client.User = "alice"
+	client.Protocol = 3
+	client.Flags = ClientCloseAfterReply
+
+	assert.Equal(t, resp.Value{Typ: "string", Str: "RESET"}, reset(nil, Database.NewKv(), client))
+	assert.Equal(t, "", client.Name)
+	assert.Equal(t, 0, client.DB)
+	assert.Equal(t, defaultUser, client.User)
+	assert.Equal(t, defaultProtocol, client.Protocol)
+	// Flags describe the connection, which RESET doesn't change.
+	assert.Equal(t, ClientCloseAfterReply, client.Flags)
+}
+
+func TestPush(t *testing.T) {
+	var buf bytes.Buffer
+	client := newClient("test", &buf)
+
+	// A push waits for the reply being built to be done and flushed.
+	client.Lock()
+	require.NoError(t, client.Reply(resp.Value{Typ: "string", Str: "OK"}))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, client.Push(resp.Value{Typ: "array", Array: bulks("message", "ch", "hi")}))
+	}()
+	require.NoError(t, client.Reply(resp.Value{Typ: "integer", Num: 1}))
+	require.NoError(t, client.Flush())
+	client.Unlock()
+	wg.Wait()
+
+	assert.Equal(t, "+OK\r\n:1\r\n*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", buf.String())
+}
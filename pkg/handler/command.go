@@ -0,0 +1,548 @@
+package handler
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+)
+
+// Flag describes how a command behaves, e.g. whether it writes to the
+// dataset. Flags are reported by COMMAND INFO under their Redis names.
+type Flag uint
+
+const (
+	FlagWrite Flag = 1 << iota
+	FlagReadonly
+	FlagDenyOOM
+	FlagAdmin
+	FlagPubSub
+	FlagNoScript
+	FlagBlocking
+	FlagLoading
+	FlagStale
+	FlagFast
+	FlagNoAuth
+)
+
+var flagNames = []struct {
+	flag Flag
+	name string
+}{
+	{FlagWrite, "write"},
+	{FlagReadonly, "readonly"},
+	{FlagDenyOOM, "denyoom"},
+	{FlagAdmin, "admin"},
+	{FlagPubSub, "pubsub"},
+	{FlagNoScript, "noscript"},
+	{FlagBlocking, "blocking"},
+	{FlagLoading, "loading"},
+	{FlagStale, "stale"},
+	{FlagFast, "fast"},
+	{FlagNoAuth, "no_auth"},
+}
+
+// Command is an entry of the command table. Exactly one of Handler and
+// Stream is set, except for containers that only have Subcommands.
+type Command struct {
+	// Lower case name, "parent|sub" for subcommands.
+	Name    string
+	Handler func([]resp.Value, *Database.Kv, *Client) resp.Value
+	// Stream writes the reply straight to the client's writer instead of
+	// returning it, for commands whose replies can get too large to build
+	// in memory first.
+	Stream func([]resp.Value, *Database.Kv, *Client) error
+
+	// Number of arguments including the command name. A negative arity
+	// means at least -Arity arguments.
+	Arity int
+	Flags Flag
+	// Positions of the first and last key and the step between keys. A
+	// negative LastKey counts from the end, 0s mean there are no keys.
+	FirstKey int
+	LastKey  int
+	Step     int
+	// ACL categories besides the ones implied by Flags.
+	ACLCategories []string
+	Subcommands   map[string]*Command
+
+	// Documentation reported by COMMAND DOCS.
+	Summary    string
+	Since      string
+	Group      string
+	Complexity string
+}
+
+func (c *Command) Has(flag Flag) bool {
+	return c.Flags&flag != 0
+}
+
+// Call runs the command for client and buffers its reply. args are the
+// arguments following the command name. It must be called with the client
+// locked.
+func (c *Command) Call(args []resp.Value, kv *Database.Kv, client *Client) error {
+	if c.Stream != nil {
+		return c.Stream(args, kv, client)
+	}
+
+	return client.Reply(c.Handler(args, kv, client))
+}
+
+// Lookup finds the command a request is for and checks its arity. It
+// returns the command along with the arguments following its name, or an
+// error meant to be sent back to the client.
+func Lookup(request []resp.Value) (*Command, []resp.Value, error) {
+	name := request[0].Bulk
+	cmd, ok := Commands[strings.ToUpper(name)]
+	if !ok {
+		return nil, nil, unknownCommand(name, request[1:])
+	}
+
+	args := request[1:]
+	if cmd.Subcommands != nil && len(request) >= 2 {
+		sub, ok := cmd.Subcommands[strings.ToUpper(request[1].Bulk)]
+		if !ok {
+			return nil, nil, fmt.Errorf("ERR unknown subcommand '%.128s'. Try %s HELP.", request[1].Bulk, strings.ToUpper(cmd.Name))
+		}
+		cmd = sub
+		args = request[2:]
+	}
+
+	if !cmd.arityOk(len(request)) || (cmd.Handler == nil && cmd.Stream == nil) {
+		return nil, nil, fmt.Errorf("ERR wrong number of arguments for '%s' command", cmd.Name)
+	}
+
+	return cmd, args, nil
+}
+
+func (c *Command) arityOk(n int) bool {
+	return (c.Arity > 0 && n == c.Arity) || (c.Arity < 0 && n >= -c.Arity)
+}
+
+func unknownCommand(name string, args []resp.Value) error {
+	var sb strings.Builder
+	for _, arg := range args {
+		if sb.Len() >= 128 {
+			break
+		}
+		fmt.Fprintf(&sb, "'%.*s' ", 128-sb.Len(), arg.Bulk)
+	}
+
+	return fmt.Errorf("ERR unknown command '%.128s', with args beginning with: %s", name, sb.String())
+}
+
+// keys returns the key arguments of a request for c, where request
+// includes the command name.
+func (c *Command) keys(request []resp.Value) []resp.Value {
+	if c.FirstKey <= 0 {
+		return nil
+	}
+
+	last := c.LastKey
+	if last < 0 {
+		last = len(request) + last
+	}
+
+	keys := []resp.Value{}
+	for i := c.FirstKey; i <= last && i < len(request); i += c.Step {
+		keys = append(keys, request[i])
+	}
+
+	return keys
+}
+
+func (c *Command) flagNames() []string {
+	names := []string{}
+	for _, f := range flagNames {
+		if c.Has(f.flag) {
+			names = append(names, f.name)
+		}
+	}
+
+	return names
+}
+
+// aclCategories returns the explicit categories of c along with the ones
+// Redis derives from its flags.
+func (c *Command) aclCategories() []string {
+	categories := []string{}
+	if c.Has(FlagWrite) {
+		categories = append(categories, "@write")
+	}
+	if c.Has(FlagReadonly) && !c.Has(FlagAdmin) {
+		categories = append(categories, "@read")
+	}
+	if c.Has(FlagAdmin) {
+		categories = append(categories, "@admin", "@dangerous")
+	}
+	if c.Has(FlagPubSub) {
+		categories = append(categories, "@pubsub")
+	}
+	if c.Has(FlagBlocking) {
+		categories = append(categories, "@blocking")
+	}
+	if c.Has(FlagFast) {
+		categories = append(categories, "@fast")
+	} else {
+		categories = append(categories, "@slow")
+	}
+
+	return append(categories, c.ACLCategories...)
+}
+
+func (c *Command) info() resp.Value {
+	flags := []resp.Value{}
+	for _, name := range c.flagNames() {
+		flags = append(flags, resp.Value{Typ: "string", Str: name})
+	}
+
+	categories := []resp.Value{}
+	for _, name := range c.aclCategories() {
+		categories = append(categories, resp.Value{Typ: "string", Str: name})
+	}
+
+	keySpecs := []resp.Value{}
+	if c.FirstKey > 0 {
+		keySpecs = append(keySpecs, c.keySpec())
+	}
+
+	subcommands := []resp.Value{}
+	for _, sub := range sortedCommands(c.Subcommands) {
+		subcommands = append(subcommands, sub.info())
+	}
+
+	return resp.Value{Typ: "array", Array: []resp.Value{
+		{Typ: "bulk", Bulk: c.Name},
+		{Typ: "integer", Num: c.Arity},
+		{Typ: "array", Array: flags},
+		{Typ: "integer", Num: c.FirstKey},
+		{Typ: "integer", Num: c.LastKey},
+		{Typ: "integer", Num: c.Step},
+		{Typ: "array", Array: categories},
+		{Typ: "array", Array: []resp.Value{}},
+		{Typ: "array", Array: keySpecs},
+		{Typ: "array", Array: subcommands},
+	}}
+}
+
+// keySpec describes the keys of c in the Redis 7 key specification
+// format, derived from FirstKey, LastKey and Step.
+func (c *Command) keySpec() resp.Value {
+	flags := []resp.Value{{Typ: "string", Str: "RO"}, {Typ: "string", Str: "ACCESS"}}
+	if c.Has(FlagWrite) {
+		flags = []resp.Value{{Typ: "string", Str: "RW"}, {Typ: "string", Str: "UPDATE"}}
+	}
+
+	lastKey := c.LastKey
+	if lastKey > 0 {
+		lastKey -= c.FirstKey
+	}
+
+	return resp.Value{Typ: "array", Array: []resp.Value{
+		{Typ: "bulk", Bulk: "flags"},
+		{Typ: "array", Array: flags},
+		{Typ: "bulk", Bulk: "begin_search"},
+		{Typ: "array", Array: []resp.Value{
+			{Typ: "bulk", Bulk: "type"},
+			{Typ: "bulk", Bulk: "index"},
+			{Typ: "bulk", Bulk: "spec"},
+			{Typ: "array", Array: []resp.Value{
+				{Typ: "bulk", Bulk: "index"},
+				{Typ: "integer", Num: c.FirstKey},
+			}},
+		}},
+		{Typ: "bulk", Bulk: "find_keys"},
+		{Typ: "array", Array: []resp.Value{
+			{Typ: "bulk", Bulk: "type"},
+			{Typ: "bulk", Bulk: "range"},
+			{Typ: "bulk", Bulk: "spec"},
+			{Typ: "array", Array: []resp.Value{
+				{Typ: "bulk", Bulk: "lastkey"},
+				{Typ: "integer", Num: lastKey},
+				{Typ: "bulk", Bulk: "keystep"},
+				{Typ: "integer", Num: c.Step},
+				{Typ: "bulk", Bulk: "limit"},
+				{Typ: "integer", Num: 0},
+			}},
+		}},
+	}}
+}
+
+func (c *Command) docs() resp.Value {
+	docs := []resp.Value{
+		{Typ: "bulk", Bulk: "summary"},
+		{Typ: "bulk", Bulk: c.Summary},
+		{Typ: "bulk", Bulk: "since"},
+		{Typ: "bulk", Bulk: c.Since},
+		{Typ: "bulk", Bulk: "group"},
+		{Typ: "bulk", Bulk: c.Group},
+		{Typ: "bulk", Bulk: "complexity"},
+		{Typ: "bulk", Bulk: c.Complexity},
+	}
+
+	if len(c.Subcommands) > 0 {
+		subcommands := []resp.Value{}
+		for _, sub := range sortedCommands(c.Subcommands) {
+			subcommands = append(subcommands, resp.Value{Typ: "bulk", Bulk: sub.Name}, sub.docs())
+		}
+		docs = append(docs, resp.Value{Typ: "bulk", Bulk: "subcommands"}, resp.Value{Typ: "array", Array: subcommands})
+	}
+
+	return resp.Value{Typ: "array", Array: docs}
+}
+
+func sortedCommands(commands map[string]*Command) []*Command {
+	sorted := make([]*Command, 0, len(commands))
+	for _, c := range commands {
+		sorted = append(sorted, c)
+	}
+	slices.SortFunc(sorted, func(a, b *Command) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return sorted
+}
+
+func init() {
+	Commands["COMMAND"] = &Command{
+		Name:          "command",
+		Handler:       command,
+		Arity:         -1,
+		Flags:         FlagLoading | FlagStale,
+		ACLCategories: []string{"@connection"},
+		Summary:       "Returns detailed information about all commands.",
+		Since:         "2.8.13",
+		Group:         "server",
+		Complexity:    "O(N) where N is the total number of Redis commands",
+		Subcommands: map[string]*Command{
+			"COUNT": {
+				Name:          "command|count",
+				Handler:       commandCount,
+				Arity:         2,
+				Flags:         FlagLoading | FlagStale,
+				ACLCategories: []string{"@connection"},
+				Summary:       "Returns a count of commands.",
+				Since:         "2.8.13",
+				Group:         "server",
+				Complexity:    "O(1)",
+			},
+			"INFO": {
+				Name:          "command|info",
+				Handler:       commandInfo,
+				Arity:         -2,
+				Flags:         FlagLoading | FlagStale,
+				ACLCategories: []string{"@connection"},
+				Summary:       "Returns information about one, multiple or all commands.",
+				Since:         "2.8.13",
+				Group:         "server",
+				Complexity:    "O(N) where N is the number of commands to look up",
+			},
+			"DOCS": {
+				Name:          "command|docs",
+				Handler:       commandDocs,
+				Arity:         -2,
+				Flags:         FlagLoading | FlagStale,
+				ACLCategories: []string{"@connection"},
+				Summary:       "Returns documentary information about one, multiple or all commands.",
+				Since:         "7.0.0",
+				Group:         "server",
+				Complexity:    "O(N) where N is the number of commands to look up",
+			},
+			"LIST": {
+				Name:          "command|list",
+				Handler:       commandList,
+				Arity:         -2,
+				Flags:         FlagLoading | FlagStale,
+				ACLCategories: []string{"@connection"},
+				Summary:       "Returns a list of command names.",
+				Since:         "7.0.0",
+				Group:         "server",
+				Complexity:    "O(N) where N is the total number of Redis commands",
+			},
+			"GETKEYS": {
+				Name:          "command|getkeys",
+				Handler:       commandGetKeys,
+				Arity:         -3,
+				Flags:         FlagLoading | FlagStale,
+				ACLCategories: []string{"@connection"},
+				Summary:       "Extracts the key names from an arbitrary command.",
+				Since:         "2.8.13",
+				Group:         "server",
+				Complexity:    "O(N) where N is the number of arguments to the command",
+			},
+			"HELP": {
+				Name:          "command|help",
+				Handler:       commandHelp,
+				Arity:         2,
+				Flags:         FlagLoading | FlagStale,
+				ACLCategories: []string{"@connection"},
+				Summary:       "Returns helpful text about the different subcommands.",
+				Since:         "5.0.0",
+				Group:         "server",
+				Complexity:    "O(1)",
+			},
+		},
+	}
+}
+
+func command(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	values := []resp.Value{}
+	for _, c := range sortedCommands(Commands) {
+		values = append(values, c.info())
+	}
+
+	return resp.Value{Typ: "array", Array: values}
+}
+
+func commandCount(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	return resp.Value{Typ: "integer", Num: len(Commands)}
+}
+
+// findCommand looks up a command by name, including subcommands named
+// "parent|sub".
+func findCommand(name string) (*Command, bool) {
+	parent, sub, found := strings.Cut(strings.ToUpper(name), "|")
+	c, ok := Commands[parent]
+	if !ok || !found {
+		return c, ok
+	}
+
+	c, ok = c.Subcommands[sub]
+	return c, ok
+}
+
+func commandInfo(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	if len(args) == 0 {
+		return command(args, kv, client)
+	}
+
+	values := []resp.Value{}
+	for _, arg := range args {
+		c, ok := findCommand(arg.Bulk)
+		if !ok {
+			values = append(values, resp.Value{Typ: "null"})
+			continue
+		}
+		values = append(values, c.info())
+	}
+
+	return resp.Value{Typ: "array", Array: values}
+}
+
+func commandDocs(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	commands := []*Command{}
+	if len(args) == 0 {
+		commands = sortedCommands(Commands)
+	}
+	for _, arg := range args {
+		// Unknown commands are left out of the reply.
+		if c, ok := findCommand(arg.Bulk); ok {
+			commands = append(commands, c)
+		}
+	}
+
+	values := []resp.Value{}
+	for _, c := range commands {
+		values = append(values, resp.Value{Typ: "bulk", Bulk: c.Name}, c.docs())
+	}
+
+	return resp.Value{Typ: "array", Array: values}
+}
+
+func commandList(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	filter := func(c *Command) bool { return true }
+
+	if len(args) > 0 {
+		if len(args) != 3 || strings.ToUpper(args[0].Bulk) != "FILTERBY" {
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+
+		value := args[2].Bulk
+		switch strings.ToUpper(args[1].Bulk) {
+		case "MODULE":
+			// There are no modules, so nothing matches.
+			filter = func(c *Command) bool { return false }
+		case "ACLCAT":
+			filter = func(c *Command) bool {
+				return slices.ContainsFunc(c.aclCategories(), func(category string) bool {
+					return strings.EqualFold(category, "@"+value)
+				})
+			}
+		case "PATTERN":
+			filter = func(c *Command) bool {
+				ok, _ := path.Match(strings.ToLower(value), c.Name)
+				return ok
+			}
+		default:
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+	}
+
+	values := []resp.Value{}
+	for _, c := range sortedCommands(Commands) {
+		if filter(c) {
+			values = append(values, resp.Value{Typ: "bulk", Bulk: c.Name})
+		}
+		for _, sub := range sortedCommands(c.Subcommands) {
+			if filter(sub) {
+				values = append(values, resp.Value{Typ: "bulk", Bulk: sub.Name})
+			}
+		}
+	}
+
+	return resp.Value{Typ: "array", Array: values}
+}
+
+func commandGetKeys(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	c, ok := findCommand(args[0].Bulk)
+	if ok && c.Subcommands != nil && len(args) >= 2 {
+		c, ok = c.Subcommands[strings.ToUpper(args[1].Bulk)]
+	}
+	if !ok {
+		return resp.Value{Typ: "error", Str: "ERR Invalid command specified"}
+	}
+	if !c.arityOk(len(args)) {
+		return resp.Value{Typ: "error", Str: "ERR Invalid number of arguments specified for command"}
+	}
+
+	keys := c.keys(args)
+	if len(keys) == 0 {
+		return resp.Value{Typ: "error", Str: "ERR The command has no key arguments"}
+	}
+
+	return resp.Value{Typ: "array", Array: keys}
+}
+
+func commandHelp(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	lines := []string{
+		"COMMAND <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"(no subcommand)",
+		"    Return details about all commands.",
+		"COUNT",
+		"    Return the total number of commands in this server.",
+		"LIST",
+		"    Return a list of all commands in this server.",
+		"INFO [<command-name> ...]",
+		"    Return details about multiple commands.",
+		"    If no command names are given, documentation details for all",
+		"    commands are returned.",
+		"DOCS [<command-name> ...]",
+		"    Return documentation details about multiple commands.",
+		"    If no command names are given, documentation details for all",
+		"    commands are returned.",
+		"GETKEYS <full-command>",
+		"    Return the keys from a full command.",
+		"HELP",
+		"    Print this help.",
+	}
+
+	values := []resp.Value{}
+	for _, line := range lines {
+		values = append(values, resp.Value{Typ: "string", Str: line})
+	}
+
+	return resp.Value{Typ: "array", Array: values}
+}
@@ -0,0 +1,264 @@
+package handler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/maniktherana/godbase/pkg/writer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bulks(args ...string) []resp.Value {
+	values := []resp.Value{}
+	for _, arg := range args {
+		values = append(values, resp.Value{Typ: "bulk", Bulk: arg})
+	}
+	return values
+}
+
+func TestLookup(t *testing.T) {
+	tt := []struct {
+		name     string
+		request  []resp.Value
+		command  string
+		args     []resp.Value
+		expected string
+	}{
+		{
+			name:    "Command",
+			request: bulks("get", "key"),
+			command: "get",
+			args:    bulks("key"),
+		},
+		{
+			name:    "Subcommand",
+			request: bulks("command", "info", "get"),
+			command: "command|info",
+			args:    bulks("get"),
+		},
+		{
+			name:    "ContainerWithoutSubcommand",
+			request: bulks("COMMAND"),
+			command: "command",
+			args:    bulks(),
+		},
+		{
+			name:     "UnknownCommand",
+			request:  bulks("foo", "bar", "baz"),
+			expected: "ERR unknown command 'foo', with args beginning with: 'bar' 'baz' ",
+		},
+		{
+			name:     "UnknownCommandLongArgs",
+			request:  bulks("foo", strings.Repeat("a", 200)),
+			expected: "ERR unknown command 'foo', with args beginning with: '" + strings.Repeat("a", 128) + "' ",
+		},
+		{
+			name:     "UnknownSubcommand",
+			request:  bulks("command", "foo"),
+			expected: "ERR unknown subcommand 'foo'. Try COMMAND HELP.",
+		},
+		{
+			name:     "GetArity",
+			request:  bulks("get"),
+			expected: "ERR wrong number of arguments for 'get' command",
+		},
+		{
+			name:     "SetArity",
+			request:  bulks("set", "key"),
+			expected: "ERR wrong number of arguments for 'set' command",
+		},
+		{
+			name:     "HsetArity",
+			request:  bulks("hset", "hash", "key"),
+			expected: "ERR wrong number of arguments for 'hset' command",
+		},
+		{
+			name:     "HgetArity",
+			request:  bulks("hget", "hash"),
+			expected: "ERR wrong number of arguments for 'hget' command",
+		},
+		{
+			name:     "HgetallArity",
+			request:  bulks("hgetall", "hash", "this"),
+			expected: "ERR wrong number of arguments for 'hgetall' command",
+		},
+		{
+			name:     "SubcommandArity",
+			request:  bulks("command", "getkeys"),
+			expected: "ERR wrong number of arguments for 'command|getkeys' command",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd, args, err := Lookup(tc.request)
+			if tc.expected != "" {
+				assert.EqualError(t, err, tc.expected)
+				assert.Nil(t, cmd)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.command, cmd.Name)
+			assert.Equal(t, tc.args, args)
+		})
+	}
+}
+
+func TestCommandTable(t *testing.T) {
+	for name, c := range Commands {
+		assert.Equal(t, strings.ToLower(name), c.Name)
+		assert.NotZero(t, c.Arity, name)
+		container := c.Handler == nil && c.Stream == nil && c.Subcommands != nil
+		assert.True(t, container || (c.Handler == nil) != (c.Stream == nil), name)
+		assert.False(t, c.Has(FlagWrite) && c.Has(FlagReadonly), name)
+
+		for subname, sub := range c.Subcommands {
+			assert.Equal(t, c.Name+"|"+strings.ToLower(subname), sub.Name)
+		}
+	}
+}
+
+func call(t *testing.T, kv *Database.Kv, args ...string) resp.Value {
+	t.Helper()
+
+	cmd, rest, err := Lookup(bulks(args...))
+	if err != nil {
+		return resp.Value{Typ: "error", Str: err.Error()}
+	}
+	require.NotNil(t, cmd.Handler)
+
+	return cmd.Handler(rest, kv, testClient())
+}
+
+func TestCommandCount(t *testing.T) {
+	kv := Database.NewKv()
+	assert.Equal(t, resp.Value{Typ: "integer", Num: len(Commands)}, call(t, kv, "COMMAND", "COUNT"))
+}
+
+func TestCommandInfo(t *testing.T) {
+	kv := Database.NewKv()
+
+	reply := call(t, kv, "COMMAND", "INFO", "get", "nonexistent", "command|count")
+	require.Len(t, reply.Array, 3)
+
+	get := reply.Array[0].Array
+	require.Len(t, get, 10)
+	assert.Equal(t, resp.Value{Typ: "bulk", Bulk: "get"}, get[0])
+	assert.Equal(t, resp.Value{Typ: "integer", Num: 2}, get[1])
+	assert.Equal(t, []resp.Value{{Typ: "string", Str: "readonly"}, {Typ: "string", Str: "fast"}}, get[2].Array)
+	assert.Equal(t, []resp.Value{{Typ: "integer", Num: 1}, {Typ: "integer", Num: 1}, {Typ: "integer", Num: 1}}, get[3:6])
+	assert.Equal(t, []resp.Value{
+		{Typ: "string", Str: "@read"},
+		{Typ: "string", Str: "@fast"},
+		{Typ: "string", Str: "@string"},
+	}, get[6].Array)
+	assert.Len(t, get[8].Array, 1)
+
+	assert.Equal(t, resp.Value{Typ: "null"}, reply.Array[1])
+	assert.Equal(t, resp.Value{Typ: "bulk", Bulk: "command|count"}, reply.Array[2].Array[0])
+
+	all := call(t, kv, "COMMAND")
+	assert.Len(t, all.Array, len(Commands))
+	assert.Equal(t, all, call(t, kv, "COMMAND", "INFO"))
+
+	// The reply has to be valid RESP all the way down.
+	var buf bytes.Buffer
+	assert.NoError(t, writer.NewWriter(&buf).Write(all))
+	assert.True(t, strings.HasPrefix(buf.String(), "*"))
+}
+
+func TestCommandDocs(t *testing.T) {
+	kv := Database.NewKv()
+
+	reply := call(t, kv, "COMMAND", "DOCS", "set", "nonexistent")
+	require.Len(t, reply.Array, 2)
+	assert.Equal(t, resp.Value{Typ: "bulk", Bulk: "set"}, reply.Array[0])
+	assert.Equal(t, bulks("summary", Commands["SET"].Summary, "since", "1.0.0", "group", "string", "complexity", "O(1)"), reply.Array[1].Array)
+
+	reply = call(t, kv, "COMMAND", "DOCS", "command")
+	docs := reply.Array[1].Array
+	assert.Equal(t, resp.Value{Typ: "bulk", Bulk: "subcommands"}, docs[8])
+	assert.Len(t, docs[9].Array, 2*len(Commands["COMMAND"].Subcommands))
+}
+
+func TestCommandList(t *testing.T) {
+	kv := Database.NewKv()
+
+	tt := []struct {
+		name     string
+		args     []string
+		expected resp.Value
+	}{
+		{
+			name:     "Pattern",
+			args:     []string{"FILTERBY", "PATTERN", "h*"},
+			expected: resp.Value{Typ: "array", Array: bulks("hget", "hgetall", "hset")},
+		},
+		{
+			name:     "AclCategory",
+			args:     []string{"FILTERBY", "ACLCAT", "write"},
+			expected: resp.Value{Typ: "array", Array: bulks("del", "flushall", "flushdb", "hset", "set", "unlink")},
+		},
+		{
+			name:     "Module",
+			args:     []string{"FILTERBY", "MODULE", "json"},
+			expected: resp.Value{Typ: "array", Array: []resp.Value{}},
+		},
+		{
+			name:     "SyntaxError",
+			args:     []string{"FILTERBY", "COLOR", "red"},
+			expected: resp.Value{Typ: "error", Str: "ERR syntax error"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, call(t, kv, append([]string{"COMMAND", "LIST"}, tc.args...)...))
+		})
+	}
+
+	all := call(t, kv, "COMMAND", "LIST")
+	assert.Contains(t, all.Array, resp.Value{Typ: "bulk", Bulk: "command|getkeys"})
+}
+
+func TestCommandGetKeys(t *testing.T) {
+	kv := Database.NewKv()
+
+	tt := []struct {
+		name     string
+		args     []string
+		expected resp.Value
+	}{
+		{
+			name:     "Set",
+			args:     []string{"SET", "key", "value", "EX", "10"},
+			expected: resp.Value{Typ: "array", Array: bulks("key")},
+		},
+		{
+			name:     "NoKeys",
+			args:     []string{"PING"},
+			expected: resp.Value{Typ: "error", Str: "ERR The command has no key arguments"},
+		},
+		{
+			name:     "UnknownCommand",
+			args:     []string{"FOO", "key"},
+			expected: resp.Value{Typ: "error", Str: "ERR Invalid command specified"},
+		},
+		{
+			name:     "WrongArity",
+			args:     []string{"GET", "a", "b"},
+			expected: resp.Value{Typ: "error", Str: "ERR Invalid number of arguments specified for command"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, call(t, kv, append([]string{"COMMAND", "GETKEYS"}, tc.args...)...))
+		})
+	}
+}
@@ -9,19 +9,106 @@ import (
 	"github.com/maniktherana/godbase/pkg/resp"
 )
 
-var Handlers = map[string]func(
-	[]resp.Value,
-	*Database.Kv,
-) resp.Value{
-	"PING":    ping,
-	"SET":     set,
-	"GET":     get,
-	"HSET":    hset,
-	"HGET":    hget,
-	"HGETALL": hgetall,
+// Commands is the command table, keyed by upper case command name.
+var Commands = map[string]*Command{
+	"PING": {
+		Name:          "ping",
+		Handler:       ping,
+		Arity:         -1,
+		Flags:         FlagLoading | FlagFast,
+		ACLCategories: []string{"@connection"},
+		Summary:       "Returns the server's liveliness response.",
+		Since:         "1.0.0",
+		Group:         "connection",
+		Complexity:    "O(1)",
+	},
+	"SET": {
+		Name:          "set",
+		Handler:       set,
+		Arity:         -3,
+		Flags:         FlagWrite | FlagDenyOOM,
+		FirstKey:      1,
+		LastKey:       1,
+		Step:          1,
+		ACLCategories: []string{"@string"},
+		Summary:       "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.",
+		Since:         "1.0.0",
+		Group:         "string",
+		Complexity:    "O(1)",
+	},
+	"GET": {
+		Name:          "get",
+		Handler:       get,
+		Arity:         2,
+		Flags:         FlagReadonly | FlagFast,
+		FirstKey:      1,
+		LastKey:       1,
+		Step:          1,
+		ACLCategories: []string{"@string"},
+		Summary:       "Returns the string value of a key.",
+		Since:         "1.0.0",
+		Group:         "string",
+		Complexity:    "O(1)",
+	},
+	"DEL": {
+		Name:          "del",
+		Handler:       del,
+		Arity:         -2,
+		Flags:         FlagWrite,
+		FirstKey:      1,
+		LastKey:       -1,
+		Step:          1,
+		ACLCategories: []string{"@keyspace"},
+		Summary:       "Deletes one or more keys.",
+		Since:         "1.0.0",
+		Group:         "generic",
+		Complexity:    "O(N) where N is the number of keys that will be removed.",
+	},
+	"HSET": {
+		Name:          "hset",
+		Handler:       hset,
+		Arity:         4,
+		Flags:         FlagWrite | FlagDenyOOM | FlagFast,
+		FirstKey:      1,
+		LastKey:       1,
+		Step:          1,
+		ACLCategories: []string{"@hash"},
+		Summary:       "Creates or modifies the value of a field in a hash.",
+		Since:         "2.0.0",
+		Group:         "hash",
+		Complexity:    "O(1)",
+	},
+	"HGET": {
+		Name:          "hget",
+		Handler:       hget,
+		Arity:         3,
+		Flags:         FlagReadonly | FlagFast,
+		FirstKey:      1,
+		LastKey:       1,
+		Step:          1,
+		ACLCategories: []string{"@hash"},
+		Summary:       "Returns the value of a field in a hash.",
+		Since:         "2.0.0",
+		Group:         "hash",
+		Complexity:    "O(1)",
+	},
+	"HGETALL": {
+		Name:          "hgetall",
+		Stream:        hgetall,
+		Arity:         2,
+		Flags:         FlagReadonly,
+		FirstKey:      1,
+		LastKey:       1,
+		Step:          1,
+		ACLCategories: []string{"@hash"},
+		Summary:       "Returns all fields and values in a hash.",
+		Since:         "2.0.0",
+		Group:         "hash",
+		Complexity:    "O(N) where N is the size of the hash.",
+	},
 }
 
-func ping(args []resp.Value, kv *Database.Kv) resp.Value {
+func ping(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
 	if len(args) == 0 {
 		return resp.Value{Typ: "string", Str: "PONG"}
 	}
@@ -29,161 +116,199 @@ func ping(args []resp.Value, kv *Database.Kv) resp.Value {
 	return resp.Value{Typ: "string", Str: args[0].Bulk}
 }
 
-func set(args []resp.Value, kv *Database.Kv) resp.Value {
-	if len(args) < 2 {
-		return resp.Value{Typ: "error", Str: "ERR syntax error"}
-	}
-
+func set(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
 	key := args[0].Bulk
 	value := args[1].Bulk
 	var setter string
-	keepttl := false
+	var expire string
 	var get bool
-	var ex, px int
+	var when int64
 
 	// Parsing command options
 	for i := 2; i < len(args); i++ {
-		switch strings.ToUpper(args[i].Bulk) {
+		option := strings.ToUpper(args[i].Bulk)
+		switch option {
 		case "NX", "XX":
-			setter = strings.ToUpper(args[i].Bulk)
-		case "KEEPTTL":
-			keepttl = true
-		case "GET":
-			get = true
-		case "EX":
-			if keepttl {
+			if setter != "" && setter != option {
 				return resp.Value{Typ: "error", Str: "ERR syntax error"}
 			}
-			if i+1 < len(args) {
-				ex, _ = strconv.Atoi(args[i+1].Bulk)
-				i++
-			} else {
+			setter = option
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			if expire != "" && expire != option {
 				return resp.Value{Typ: "error", Str: "ERR syntax error"}
 			}
-		case "PX":
-			if keepttl {
+			expire = option
+		case "EX", "PX", "EXAT", "PXAT":
+			if (expire != "" && expire != option) || i+1 >= len(args) {
 				return resp.Value{Typ: "error", Str: "ERR syntax error"}
 			}
-			if i+1 < len(args) {
-				px, _ = strconv.Atoi(args[i+1].Bulk)
-				i++
-			} else {
-				return resp.Value{Typ: "error", Str: "ERR syntax error"}
+			expire = option
+
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil || n <= 0 {
+				return resp.Value{Typ: "error", Str: "ERR invalid expire time in 'set' command"}
 			}
+			when = n
+			i++
 		default:
 			return resp.Value{Typ: "error", Str: "ERR syntax error"}
 		}
 	}
 
+	// Turn relative expire times into absolute unix milliseconds, which is
+	// also what gets propagated so replaying the AOF later doesn't extend
+	// the TTL.
+	now := time.Now().UnixMilli()
+	switch expire {
+	case "EX":
+		when = now + when*1000
+	case "PX":
+		when = now + when
+	case "EXAT":
+		when = when * 1000
+	}
+
+	// Compressing a big value takes a while, so it's done before locking.
+	val := kv.EncodeString(value, when)
+
+	// Checking and setting happen under a single lock so NX and XX can't
+	// race with other writers.
+	shard := kv.Shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	old, exists := shard.SETs[key]
+	if exists && old.Expires > 0 && old.Expires <= now {
+		exists = false
+	}
+
 	// Handling SETTER (XX/NX) options
 	switch setter {
 	case "NX":
-		kv.SETsMu.RLock()
-		_, ok := kv.SETs[key]
-		kv.SETsMu.RUnlock()
-		if ok {
+		if exists {
 			return resp.Value{Typ: "null"}
 		}
 	case "XX":
-		kv.SETsMu.RLock()
-		_, ok := kv.SETs[key]
-		kv.SETsMu.RUnlock()
-		if !ok {
+		if !exists {
 			return resp.Value{Typ: "null"}
 		}
 	}
 
 	// Handling expiration
-	expiration := time.Now()
-	if keepttl {
-		kv.SETsMu.RLock()
-		v, ok := kv.SETs[key]
-		kv.SETsMu.RUnlock()
-		if !ok {
+	if expire == "KEEPTTL" {
+		if !exists {
 			return resp.Value{Typ: "null"}
 		}
-		expiration = time.Unix(v.Expires, 0)
-	} else {
-		if ex > 0 {
-			expiration = expiration.Add(time.Duration(ex) * time.Second)
-		} else if px > 0 {
-			expiration = expiration.Add(time.Duration(px) * time.Millisecond)
-		}
+		when = old.Expires
+		val.Expires = when
 	}
 
-	// Setting the value
-	var val resp.Value
-	if expiration.UnixMilli() > time.Now().UnixMilli() {
-		val = resp.Value{Typ: "string", Str: value, Expires: expiration.UnixMilli()}
+	if when > 0 && when <= now {
+		// An expire time in the past deletes the key right away.
+		if _, ok := shard.SETs[key]; ok {
+			kv.DeleteString(key)
+			kv.Propagate("DEL", key)
+		}
 	} else {
-		val = resp.Value{Typ: "string", Str: value}
+		kv.SetString(key, val)
+		if when > 0 {
+			kv.Propagate("SET", key, value, "PXAT", strconv.FormatInt(when, 10))
+		} else {
+			kv.Propagate("SET", key, value)
+		}
 	}
-	kv.SETsMu.Lock()
-	kv.SETs[key] = val
-	kv.SETsMu.Unlock()
 
 	if get {
-		return val
+		return resp.Value{Typ: "string", Str: value}
 	} else {
 		return resp.Value{Typ: "string", Str: "OK"}
 	}
 }
 
-func get(args []resp.Value, kv *Database.Kv) resp.Value {
-	if len(args) != 1 {
-		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'get' command"}
-	}
-
+func get(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
 	key := args[0].Bulk
 
-	kv.SETsMu.RLock()
-	value, ok := kv.SETs[key]
-	kv.SETsMu.RUnlock()
+	shard := kv.Shard(key)
+	shard.RLock()
+	value, ok := kv.GetString(key)
+	shard.RUnlock()
 
 	if !ok {
 		return resp.Value{Typ: "null"}
 	}
 
 	if value.Expires > 0 && value.Expires < time.Now().UnixMilli() {
-		kv.SETsMu.Lock()
-		delete(kv.SETs, key)
-		kv.SETsMu.Unlock()
+		shard.Lock()
+		// The key may have been set again since the read lock was
+		// released, so check it is still the expired value.
+		value, ok := shard.SETs[key]
+		if ok && value.Expires > 0 && value.Expires < time.Now().UnixMilli() {
+			kv.DeleteString(key)
+			kv.Propagate("DEL", key)
+		}
+		shard.Unlock()
 		return resp.Value{Typ: "null"}
 	}
 
-	return value
+	return resp.Value{Typ: "string", Str: value.String()}
 }
 
-func hset(args []resp.Value, kv *Database.Kv) resp.Value {
-	if len(args) != 3 {
-		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'hset' command"}
+func del(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	deleted := 0
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = arg.Bulk
+	}
+
+	// Every shard involved is locked at once, so the keys are deleted
+	// atomically.
+	shards := kv.LockKeys(keys...)
+	for _, key := range keys {
+		shard := kv.Shard(key)
+		_, isString := shard.SETs[key]
+		_, isHash := shard.HSETs[key]
+		if !isString && !isHash {
+			continue
+		}
+
+		kv.DeleteString(key)
+		kv.DeleteHash(key)
+		kv.Propagate("DEL", key)
+		deleted++
 	}
+	shards.Unlock()
+
+	return resp.Value{Typ: "integer", Num: deleted}
+}
 
+func hset(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
 	hash := args[0].Bulk
 	key := args[1].Bulk
 	value := args[2].Bulk
 
-	kv.HSETsMu.Lock()
-	if _, ok := kv.HSETs[hash]; !ok {
-		kv.HSETs[hash] = map[string]string{}
-	}
-	kv.HSETs[hash][key] = value
-	kv.HSETsMu.Unlock()
+	shard := kv.Shard(hash)
+	shard.Lock()
+	kv.SetField(hash, key, value)
+	kv.Propagate("HSET", hash, key, value)
+	shard.Unlock()
 
 	return resp.Value{Typ: "string", Str: "OK"}
 }
 
-func hget(args []resp.Value, kv *Database.Kv) resp.Value {
-	if len(args) != 2 {
-		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'hget' command"}
-	}
-
+func hget(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
 	hash := args[0].Bulk
 	key := args[1].Bulk
 
-	kv.HSETsMu.RLock()
-	value, ok := kv.HSETs[hash][key]
-	kv.HSETsMu.RUnlock()
+	shard := kv.Shard(hash)
+	shard.RLock()
+	var value string
+	h, ok := kv.GetHash(hash)
+	if ok {
+		value, ok = h.Get(key)
+	}
+	shard.RUnlock()
 
 	if !ok {
 		return resp.Value{Typ: "null"}
@@ -192,26 +317,36 @@ func hget(args []resp.Value, kv *Database.Kv) resp.Value {
 	return resp.Value{Typ: "bulk", Bulk: value}
 }
 
-func hgetall(args []resp.Value, kv *Database.Kv) resp.Value {
-	if len(args) != 1 {
-		return resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'hget' command"}
-	}
-
+func hgetall(args []resp.Value, kv *Database.Kv, client *Client) error {
 	hash := args[0].Bulk
+	w := client.Writer()
 
-	kv.HSETsMu.RLock()
-	value, ok := kv.HSETs[hash]
-	kv.HSETsMu.RUnlock()
+	// The lock can't be held while waiting on a slow client, so the hash is
+	// held instead, which makes writers change a copy of it meanwhile.
+	shard := kv.Shard(hash)
+	shard.RLock()
+	h, release, ok := kv.HoldHash(hash)
+	shard.RUnlock()
 
 	if !ok {
-		return resp.Value{Typ: "null"}
+		return w.Buffer(resp.Value{Typ: "null"})
 	}
+	defer release()
 
-	values := []resp.Value{}
-	for key, value := range value {
-		values = append(values, resp.Value{Typ: "bulk", Bulk: key})
-		values = append(values, resp.Value{Typ: "bulk", Bulk: value})
+	err := w.WriteArrayHeader(h.Len() * 2)
+	if err != nil {
+		return err
+	}
+	h.Range(func(field, value string) bool {
+		err = w.WriteBulk(field)
+		if err == nil {
+			err = w.WriteBulk(value)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
 	}
 
-	return resp.Value{Typ: "bulk", Array: values}
+	return nil
 }
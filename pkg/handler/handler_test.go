@@ -1,12 +1,18 @@
 package handler
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/maniktherana/godbase/pkg/Database"
+	"maps"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/maniktherana/godbase/pkg/resp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPingHandler(t *testing.T) {
@@ -30,7 +36,7 @@ func TestPingHandler(t *testing.T) {
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			result := ping(tc.args, kv)
+			result := ping(tc.args, kv, testClient())
 			assert.Equal(t, tc.expected, result)
 		})
 	}
@@ -83,11 +89,31 @@ func TestSetHandler(t *testing.T) {
 			args:     []resp.Value{{Typ: "bulk", Bulk: "key8"}, {Typ: "bulk", Bulk: "value8"}, {Typ: "bulk", Bulk: "INVALID"}},
 			expected: resp.Value{Typ: "error", Str: "ERR syntax error"},
 		},
+		{
+			name:     "NX and XX",
+			args:     bulks("key9", "value9", "NX", "XX"),
+			expected: resp.Value{Typ: "error", Str: "ERR syntax error"},
+		},
+		{
+			name:     "EX and PX",
+			args:     bulks("key9", "value9", "EX", "10", "PX", "10000"),
+			expected: resp.Value{Typ: "error", Str: "ERR syntax error"},
+		},
+		{
+			name:     "Invalid expire time",
+			args:     bulks("key9", "value9", "EX", "0"),
+			expected: resp.Value{Typ: "error", Str: "ERR invalid expire time in 'set' command"},
+		},
+		{
+			name:     "EXAT",
+			args:     bulks("key9", "value9", "EXAT", strconv.FormatInt(time.Now().Unix()+100, 10)),
+			expected: resp.Value{Typ: "string", Str: "OK"},
+		},
 	}
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			result := set(tc.args, kv)
+			result := set(tc.args, kv, testClient())
 			assert.Equal(t, tc.expected, result)
 		})
 	}
@@ -124,10 +150,10 @@ func TestSetTimers(t *testing.T) {
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			setted := set(tc.setArgs, kv)
+			setted := set(tc.setArgs, kv, testClient())
 			assert.Equal(t, resp.Value{Typ: "string", Str: "OK"}, setted)
 			time.Sleep(tc.sleepFor)
-			got := get(tc.getArgs, kv)
+			got := get(tc.getArgs, kv, testClient())
 			assert.Equal(t, tc.expected, got)
 		})
 	}
@@ -146,9 +172,10 @@ func TestGetHandler(t *testing.T) {
 			name: "Existing Key",
 			args: []resp.Value{{Typ: "bulk", Bulk: "mykey"}},
 			setup: func() {
-				kv.SETsMu.Lock()
-				kv.SETs["mykey"] = resp.Value{Typ: "string", Str: "myvalue"}
-				kv.SETsMu.Unlock()
+				shard := kv.Shard("mykey")
+				shard.Lock()
+				kv.SetString("mykey", Database.NewString("myvalue", 0))
+				shard.Unlock()
 			},
 			expected: resp.Value{Typ: "string", Str: "myvalue"},
 		},
@@ -157,7 +184,7 @@ func TestGetHandler(t *testing.T) {
 			args: []resp.Value{{Typ: "bulk", Bulk: "mykey"}},
 			setup: func() {
 				// Set up initial value with expiry time
-				set([]resp.Value{{Typ: "bulk", Bulk: "mykey"}, {Typ: "bulk", Bulk: "dummyvalue"}, {Typ: "bulk", Bulk: "EX"}, {Typ: "bulk", Bulk: "1"}}, kv)
+				set([]resp.Value{{Typ: "bulk", Bulk: "mykey"}, {Typ: "bulk", Bulk: "dummyvalue"}, {Typ: "bulk", Bulk: "EX"}, {Typ: "bulk", Bulk: "1"}}, kv, testClient())
 				time.Sleep(2 * time.Second)
 			},
 			expected: resp.Value{Typ: "null"},
@@ -174,7 +201,7 @@ func TestGetHandler(t *testing.T) {
 			if test.setup != nil {
 				test.setup()
 			}
-			result := get(test.args, kv)
+			result := get(test.args, kv, testClient())
 			assert.Equal(t, test.expected, result)
 		})
 	}
@@ -192,16 +219,11 @@ func TestHsetHandler(tt *testing.T) {
 			args:     []resp.Value{{Typ: "bulk", Bulk: "hash"}, {Typ: "bulk", Bulk: "key"}, {Typ: "bulk", Bulk: "value"}},
 			expected: resp.Value{Typ: "string", Str: "OK"},
 		},
-		{
-			name:     "WrongNumberOfArguments",
-			args:     []resp.Value{{Typ: "bulk", Bulk: "hash"}, {Typ: "bulk", Bulk: "key"}},
-			expected: resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'hset' command"},
-		},
 	}
 
 	for _, tc := range tests {
 		tt.Run(tc.name, func(t *testing.T) {
-			result := hset(tc.args, kv)
+			result := hset(tc.args, kv, testClient())
 			assert.Equal(t, tc.expected, result)
 		})
 	}
@@ -220,9 +242,10 @@ func TestHgetHandler(tt *testing.T) {
 			args: []resp.Value{{Typ: "bulk", Bulk: "hash"}, {Typ: "bulk", Bulk: "key"}},
 			setup: func() {
 				// Set up the initial key-value pair
-				kv.HSETsMu.Lock()
-				kv.HSETs["hash"] = map[string]string{"key": "value"}
-				kv.HSETsMu.Unlock()
+				shard := kv.Shard("hash")
+				shard.Lock()
+				kv.SetHash("hash", map[string]string{"key": "value"})
+				shard.Unlock()
 			},
 			expected: resp.Value{Typ: "bulk", Bulk: "value"},
 		},
@@ -231,11 +254,6 @@ func TestHgetHandler(tt *testing.T) {
 			args:     []resp.Value{{Typ: "bulk", Bulk: "hash"}, {Typ: "bulk", Bulk: "nonexistent"}},
 			expected: resp.Value{Typ: "null"},
 		},
-		{
-			name:     "WrongNumberOfArguments",
-			args:     []resp.Value{{Typ: "bulk", Bulk: "hash"}},
-			expected: resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'hget' command"},
-		},
 	}
 
 	for _, tc := range tests {
@@ -243,7 +261,7 @@ func TestHgetHandler(tt *testing.T) {
 			if tc.setup != nil {
 				tc.setup()
 			}
-			result := hget(tc.args, kv)
+			result := hget(tc.args, kv, testClient())
 			assert.Equal(t, tc.expected, result)
 		})
 	}
@@ -255,33 +273,24 @@ func TestHgetallHandler(tt *testing.T) {
 		name     string
 		args     []resp.Value
 		setup    func()
-		expected resp.Value
+		expected string
 	}{
 		{
 			name: "ExistingHash",
 			args: []resp.Value{{Typ: "bulk", Bulk: "hash"}},
 			setup: func() {
 				// Set up the initial key-value pairs
-				kv.HSETsMu.Lock()
-				kv.HSETs["hash"] = map[string]string{"key1": "value1", "key2": "value2"}
-				kv.HSETsMu.Unlock()
+				shard := kv.Shard("hash")
+				shard.Lock()
+				kv.SetHash("hash", map[string]string{"key1": "value1"})
+				shard.Unlock()
 			},
-			expected: resp.Value{Typ: "bulk", Array: []resp.Value{
-				{Typ: "bulk", Bulk: "key1"},
-				{Typ: "bulk", Bulk: "value1"},
-				{Typ: "bulk", Bulk: "key2"},
-				{Typ: "bulk", Bulk: "value2"},
-			}},
+			expected: "*2\r\n$4\r\nkey1\r\n$6\r\nvalue1\r\n",
 		},
 		{
 			name:     "NonExistingHash",
 			args:     []resp.Value{{Typ: "bulk", Bulk: "nonexistent"}},
-			expected: resp.Value{Typ: "null"},
-		},
-		{
-			name:     "WrongNumberOfArguments",
-			args:     []resp.Value{{Typ: "bulk", Bulk: "hash"}, {Typ: "bulk", Bulk: "this"}},
-			expected: resp.Value{Typ: "error", Str: "ERR wrong number of arguments for 'hget' command"},
+			expected: "$-1\r\n",
 		},
 	}
 
@@ -290,8 +299,220 @@ func TestHgetallHandler(tt *testing.T) {
 			if tc.setup != nil {
 				tc.setup()
 			}
-			result := hgetall(tc.args, kv)
-			assert.Equal(t, tc.expected, result)
+			var buf bytes.Buffer
+			client := newClient("test", &buf)
+			err := hgetall(tc.args, kv, client)
+			assert.NoError(t, err)
+			assert.NoError(t, client.Flush())
+			assert.Equal(t, tc.expected, buf.String())
 		})
 	}
 }
+
+func TestHgetallLargeHash(t *testing.T) {
+	kv := Database.NewKv()
+	hash := map[string]string{}
+	for i := range 10000 {
+		hash[fmt.Sprintf("field:%d", i)] = strings.Repeat("v", i%100)
+	}
+	kv.SetHash("hash", maps.Clone(hash))
+
+	var buf bytes.Buffer
+	client := newClient("test", &buf)
+	err := hgetall([]resp.Value{{Typ: "bulk", Bulk: "hash"}}, kv, client)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Flush())
+
+	reply, err := resp.NewResp(&buf).Read()
+	assert.NoError(t, err)
+	assert.Len(t, reply.Array, len(hash)*2)
+
+	got := map[string]string{}
+	for i := 0; i < len(reply.Array); i += 2 {
+		got[reply.Array[i].Bulk] = reply.Array[i+1].Bulk
+	}
+	assert.Equal(t, hash, got)
+}
+
+// Before replies were streamed, a 100k field HGETALL built the whole reply
+// in memory: about 113 MB and 220k allocations per call. Streaming copied
+// the field and value headers first, 3.2 MB per call, until the hash was
+// held and read in place instead, which allocates next to nothing.
+func BenchmarkHgetall(b *testing.B) {
+	kv := Database.NewKv()
+	hash := map[string]string{}
+	for i := range 100000 {
+		hash[fmt.Sprintf("field:%d", i)] = fmt.Sprintf("value:%d", i)
+	}
+	kv.SetHash("hash", hash)
+
+	args := []resp.Value{{Typ: "bulk", Bulk: "hash"}}
+	client := testClient()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		err := hgetall(args, kv, client)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// propagated records the commands kv propagates.
+func propagated(kv *Database.Kv) *[][]string {
+	commands := [][]string{}
+	kv.Propagator = func(v resp.Value) {
+		args := []string{}
+		for _, arg := range v.Array {
+			args = append(args, arg.Bulk)
+		}
+		commands = append(commands, args)
+	}
+	return &commands
+}
+
+func TestSetPropagation(t *testing.T) {
+	now := time.Now().UnixMilli()
+	future := strconv.FormatInt(now+100000, 10)
+	past := strconv.FormatInt(now-100000, 10)
+
+	tests := []struct {
+		name     string
+		setup    []string
+		args     []string
+		expected [][]string
+	}{
+		{
+			name:     "Plain",
+			args:     []string{"key", "value"},
+			expected: [][]string{{"SET", "key", "value"}},
+		},
+		{
+			name:     "DropsOptions",
+			args:     []string{"key", "value", "NX", "GET"},
+			expected: [][]string{{"SET", "key", "value"}},
+		},
+		{
+			name:     "NXFailed",
+			setup:    []string{"key", "old"},
+			args:     []string{"key", "value", "NX"},
+			expected: [][]string{},
+		},
+		{
+			name:     "XXFailed",
+			args:     []string{"key", "value", "XX"},
+			expected: [][]string{},
+		},
+		{
+			name:     "SyntaxError",
+			args:     []string{"key", "value", "EX"},
+			expected: [][]string{},
+		},
+		{
+			name:     "InvalidExpire",
+			args:     []string{"key", "value", "EX", "soon"},
+			expected: [][]string{},
+		},
+		{
+			name:     "PXAT",
+			args:     []string{"key", "value", "PXAT", future},
+			expected: [][]string{{"SET", "key", "value", "PXAT", future}},
+		},
+		{
+			name:     "KEEPTTL",
+			setup:    []string{"key", "old", "PXAT", future},
+			args:     []string{"key", "value", "KEEPTTL"},
+			expected: [][]string{{"SET", "key", "value", "PXAT", future}},
+		},
+		{
+			name:     "PastExpireDeletes",
+			setup:    []string{"key", "old"},
+			args:     []string{"key", "value", "PXAT", past},
+			expected: [][]string{{"DEL", "key"}},
+		},
+		{
+			name:     "PastExpireOnMissingKey",
+			args:     []string{"key", "value", "PXAT", past},
+			expected: [][]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			kv := Database.NewKv()
+			if tc.setup != nil {
+				set(bulks(tc.setup...), kv, testClient())
+			}
+
+			commands := propagated(kv)
+			set(bulks(tc.args...), kv, testClient())
+			assert.Equal(t, tc.expected, *commands)
+		})
+	}
+}
+
+func TestSetRelativeExpirePropagatesAbsoluteTime(t *testing.T) {
+	kv := Database.NewKv()
+	commands := propagated(kv)
+
+	before := time.Now().UnixMilli()
+	set(bulks("key", "value", "EX", "100"), kv, testClient())
+	after := time.Now().UnixMilli()
+
+	require.Len(t, *commands, 1)
+	command := (*commands)[0]
+	assert.Equal(t, []string{"SET", "key", "value", "PXAT"}, command[:4])
+
+	when, err := strconv.ParseInt(command[4], 10, 64)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, when, before+100000)
+	assert.LessOrEqual(t, when, after+100000)
+}
+
+func TestSetKeepTTL(t *testing.T) {
+	kv := Database.NewKv()
+	future := time.Now().UnixMilli() + 100000
+	set(bulks("key", "old", "PXAT", strconv.FormatInt(future, 10)), kv, testClient())
+
+	commands := propagated(kv)
+	set(bulks("key", "value", "KEEPTTL"), kv, testClient())
+
+	value, ok := kv.GetString("key")
+	require.True(t, ok)
+	assert.Equal(t, "value", value.String())
+	assert.Equal(t, future, value.Expires)
+	assert.Equal(t, [][]string{{"SET", "key", "value", "PXAT", strconv.FormatInt(future, 10)}}, *commands)
+}
+
+func TestExpiredKeyPropagatesDel(t *testing.T) {
+	kv := Database.NewKv()
+	set(bulks("key", "value", "PX", "10"), kv, testClient())
+	time.Sleep(20 * time.Millisecond)
+
+	commands := propagated(kv)
+	assert.Equal(t, resp.Value{Typ: "null"}, get(bulks("key"), kv, testClient()))
+	assert.Equal(t, resp.Value{Typ: "null"}, get(bulks("key"), kv, testClient()))
+	assert.Equal(t, [][]string{{"DEL", "key"}}, *commands)
+}
+
+func TestDelHandler(t *testing.T) {
+	kv := Database.NewKv()
+	set(bulks("string", "value"), kv, testClient())
+	hset(bulks("hash", "field", "value"), kv, testClient())
+
+	commands := propagated(kv)
+	assert.Equal(t, resp.Value{Typ: "integer", Num: 2}, del(bulks("string", "missing", "hash"), kv, testClient()))
+	assert.Equal(t, [][]string{{"DEL", "string"}, {"DEL", "hash"}}, *commands)
+	assert.Equal(t, resp.Value{Typ: "null"}, get(bulks("string"), kv, testClient()))
+	assert.Equal(t, resp.Value{Typ: "null"}, hget(bulks("hash", "field"), kv, testClient()))
+}
+
+func TestHsetPropagation(t *testing.T) {
+	kv := Database.NewKv()
+	commands := propagated(kv)
+
+	hset(bulks("hash", "field", "value"), kv, testClient())
+	assert.Equal(t, [][]string{{"HSET", "hash", "field", "value"}}, *commands)
+}
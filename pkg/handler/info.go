@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+)
+
+// infoSections lists the sections of INFO in the order they're printed.
+// Each section is built from the fields of every function registered for
+// it, in "name:value" form.
+var (
+	infoSections = []string{"server", "clients", "memory", "persistence", "stats", "keyspace"}
+	infoFields   = map[string][]func() []string{}
+	infoMu       sync.RWMutex
+)
+
+var startTime = time.Now()
+
+// RegisterInfo adds fields to a section of INFO, for parts of the server
+// this package doesn't know about such as the AOF.
+func RegisterInfo(section string, fields func() []string) {
+	infoMu.Lock()
+	defer infoMu.Unlock()
+
+	if !slices.Contains(infoSections, section) {
+		infoSections = append(infoSections, section)
+	}
+	infoFields[section] = append(infoFields[section], fields)
+}
+
+func init() {
+	Commands["INFO"] = &Command{
+		Name:          "info",
+		Handler:       info,
+		Arity:         -1,
+		Flags:         FlagLoading | FlagStale,
+		ACLCategories: []string{"@dangerous"},
+		Summary:       "Returns information and statistics about the server.",
+		Since:         "1.0.0",
+		Group:         "server",
+		Complexity:    "O(1)",
+	}
+}
+
+func info(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	infoMu.RLock()
+	defer infoMu.RUnlock()
+
+	wanted := map[string]bool{}
+	for _, arg := range args {
+		wanted[strings.ToLower(arg.Bulk)] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["default"] || wanted["everything"]
+
+	var sb strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section] {
+			continue
+		}
+
+		if sb.Len() > 0 {
+			sb.WriteString("\r\n")
+		}
+		fmt.Fprintf(&sb, "# %s%s\r\n", strings.ToUpper(section[:1]), section[1:])
+		for _, field := range sectionFields(section, kv) {
+			sb.WriteString(field)
+			sb.WriteString("\r\n")
+		}
+	}
+
+	return resp.Value{Typ: "bulk", Bulk: sb.String()}
+}
+
+func sectionFields(section string, kv *Database.Kv) []string {
+	var fields []string
+	switch section {
+	case "server":
+		fields = []string{
+			"redis_version:7.2.0",
+			"redis_mode:standalone",
+			"arch_bits:64",
+			"go_version:" + runtime.Version(),
+			fmt.Sprintf("process_id:%d", os.Getpid()),
+			fmt.Sprintf("uptime_in_seconds:%d", int(time.Since(startTime).Seconds())),
+		}
+	case "memory":
+		pending, _ := kv.LazyFreeStats()
+		fields = []string{
+			fmt.Sprintf("used_memory:%d", kv.Used()),
+			"used_memory_human:" + bytesToHuman(kv.Used()),
+			fmt.Sprintf("maxmemory:%d", kv.MaxMemory),
+			"maxmemory_human:" + bytesToHuman(kv.MaxMemory),
+			"maxmemory_policy:" + kv.MaxMemoryPolicy,
+			fmt.Sprintf("lazyfree_pending_objects:%d", pending),
+		}
+	case "stats":
+		stats := kv.EvictionStats()
+		_, freed := kv.LazyFreeStats()
+		fields = []string{
+			fmt.Sprintf("evicted_keys:%d", stats.EvictedKeys),
+			fmt.Sprintf("total_eviction_exceeded_time:%d", stats.ExceededTotal.Milliseconds()),
+			fmt.Sprintf("current_eviction_exceeded_time:%d", stats.ExceededCurrent.Milliseconds()),
+			fmt.Sprintf("lazyfreed_objects:%d", freed),
+		}
+	case "keyspace":
+		keys, expires := kv.DBSize()
+
+		if keys > 0 {
+			fields = append(fields, fmt.Sprintf("db0:keys=%d,expires=%d,avg_ttl=0", keys, expires))
+		}
+	}
+
+	for _, fn := range infoFields[section] {
+		fields = append(fields, fn()...)
+	}
+
+	return fields
+}
+
+// bytesToHuman formats a number of bytes the way INFO does, e.g. 1.50M.
+func bytesToHuman(n int64) string {
+	units := []string{"B", "K", "M", "G", "T", "P"}
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%s", size, units[unit])
+}
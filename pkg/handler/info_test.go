@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInfo(t *testing.T) {
+	kv := Database.NewKv()
+	set(bulks("a", "1"), kv, testClient())
+	set(bulks("b", "1", "EX", "100"), kv, testClient())
+	hset(bulks("h", "f", "v"), kv, testClient())
+
+	RegisterInfo("persistence", func() []string {
+		return []string{"test_field:1"}
+	})
+
+	all := call(t, kv, "INFO").Bulk
+	assert.True(t, strings.HasPrefix(all, "# Server\r\nredis_version:"), all)
+	assert.Contains(t, all, "\r\n\r\n# Persistence\r\n")
+	assert.Contains(t, all, "test_field:1\r\n")
+	assert.Contains(t, all, "# Keyspace\r\ndb0:keys=3,expires=1,avg_ttl=0\r\n")
+
+	assert.Contains(t, all, "# Memory\r\nused_memory:")
+	assert.Contains(t, all, "maxmemory:0\r\nmaxmemory_human:0B\r\nmaxmemory_policy:noeviction\r\nlazyfree_pending_objects:0\r\n")
+	assert.Contains(t, all, "# Stats\r\nevicted_keys:0\r\n")
+
+	persistence := call(t, kv, "INFO", "PERSISTENCE").Bulk
+	assert.True(t, strings.HasPrefix(persistence, "# Persistence\r\n"), persistence)
+	assert.NotContains(t, persistence, "# Server")
+	assert.NotContains(t, persistence, "# Keyspace")
+}
+
+func TestBytesToHuman(t *testing.T) {
+	assert.Equal(t, "0B", bytesToHuman(0))
+	assert.Equal(t, "1023B", bytesToHuman(1023))
+	assert.Equal(t, "1.50K", bytesToHuman(1536))
+	assert.Equal(t, "100.00M", bytesToHuman(100<<20))
+	assert.Equal(t, "2.00G", bytesToHuman(2<<30))
+}
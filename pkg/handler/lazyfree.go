@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+)
+
+func init() {
+	Commands["UNLINK"] = &Command{
+		Name:          "unlink",
+		Handler:       unlink,
+		Arity:         -2,
+		Flags:         FlagWrite | FlagFast,
+		FirstKey:      1,
+		LastKey:       -1,
+		Step:          1,
+		ACLCategories: []string{"@keyspace"},
+		Summary:       "Asynchronously deletes one or more keys.",
+		Since:         "4.0.0",
+		Group:         "generic",
+		Complexity:    "O(1) for each key removed regardless of its size. Then the command does O(N) work in a different thread in order to reclaim memory, where N is the number of allocations the deleted objects where composed of.",
+	}
+	Commands["FLUSHDB"] = &Command{
+		Name:          "flushdb",
+		Handler:       flush("FLUSHDB"),
+		Arity:         -1,
+		Flags:         FlagWrite,
+		ACLCategories: []string{"@keyspace", "@dangerous"},
+		Summary:       "Remove all keys from the current database.",
+		Since:         "1.0.0",
+		Group:         "server",
+		Complexity:    "O(N) where N is the number of keys in the selected database",
+	}
+	Commands["FLUSHALL"] = &Command{
+		Name:          "flushall",
+		Handler:       flush("FLUSHALL"),
+		Arity:         -1,
+		Flags:         FlagWrite,
+		ACLCategories: []string{"@keyspace", "@dangerous"},
+		Summary:       "Removes all keys from all databases.",
+		Since:         "1.0.0",
+		Group:         "server",
+		Complexity:    "O(N) where N is the total number of keys in all databases",
+	}
+}
+
+// unlink deletes keys like DEL, but leaves freeing big values to the
+// background.
+func unlink(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	deleted := 0
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = arg.Bulk
+	}
+
+	shards := kv.LockKeys(keys...)
+	for _, key := range keys {
+		shard := kv.Shard(key)
+		_, isString := shard.SETs[key]
+		_, isHash := shard.HSETs[key]
+		if !isString && !isHash {
+			continue
+		}
+
+		kv.DeleteString(key)
+		kv.UnlinkHash(key)
+		kv.Propagate("DEL", key)
+		deleted++
+	}
+	shards.Unlock()
+
+	return resp.Value{Typ: "integer", Num: deleted}
+}
+
+// flush returns the handler of FLUSHDB or FLUSHALL, which are the same
+// with a single database.
+func flush(name string) func([]resp.Value, *Database.Kv, *Client) resp.Value {
+	return func(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+		async := false
+		switch {
+		case len(args) == 0:
+		case len(args) == 1 && strings.EqualFold(args[0].Bulk, "ASYNC"):
+			async = true
+		case len(args) == 1 && strings.EqualFold(args[0].Bulk, "SYNC"):
+		default:
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+
+		kv.LockAll()
+		if async {
+			kv.ResetAsync()
+		} else {
+			kv.Reset()
+		}
+		kv.Propagate(name)
+		kv.UnlockAll()
+
+		return resp.Value{Typ: "string", Str: "OK"}
+	}
+}
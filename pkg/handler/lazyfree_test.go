@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnlink(t *testing.T) {
+	kv := Database.NewKv()
+	commands := propagated(kv)
+	set(bulks("a", "1"), kv, testClient())
+	for i := range 200 {
+		hset(bulks("h", strconv.Itoa(i), "v"), kv, testClient())
+	}
+	*commands = nil
+
+	assert.Equal(t, resp.Value{Typ: "integer", Num: 2}, call(t, kv, "UNLINK", "a", "h", "missing"))
+	assert.Empty(t, kv.Strings())
+	assert.Empty(t, kv.Hashes())
+	assert.Equal(t, [][]string{{"DEL", "a"}, {"DEL", "h"}}, *commands)
+
+	assert.Eventually(t, func() bool {
+		_, freed := kv.LazyFreeStats()
+		return freed == 1
+	}, time.Second, time.Millisecond)
+	assert.Zero(t, kv.Used())
+	assert.Contains(t, call(t, kv, "INFO").Bulk, "lazyfreed_objects:1\r\n")
+}
+
+func TestFlush(t *testing.T) {
+	kv := Database.NewKv()
+	commands := propagated(kv)
+
+	for _, args := range [][]string{{"FLUSHALL"}, {"FLUSHALL", "async"}, {"FLUSHDB", "SYNC"}, {"FLUSHDB", "ASYNC"}} {
+		set(bulks("a", "1"), kv, testClient())
+		hset(bulks("h", "f", "v"), kv, testClient())
+		*commands = nil
+
+		assert.Equal(t, resp.Value{Typ: "string", Str: "OK"}, call(t, kv, args...), args)
+		assert.Empty(t, kv.Strings())
+		assert.Empty(t, kv.Hashes())
+		assert.Zero(t, kv.Used())
+		assert.Equal(t, [][]string{{args[0]}}, *commands)
+	}
+
+	assert.Equal(t, resp.Value{Typ: "error", Str: "ERR syntax error"}, call(t, kv, "FLUSHALL", "LATER"))
+	assert.Equal(t, resp.Value{Typ: "error", Str: "ERR syntax error"}, call(t, kv, "FLUSHDB", "ASYNC", "SYNC"))
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrLoading is the error commands without FlagLoading get while the
+// dataset is being loaded.
+var ErrLoading = errors.New("LOADING Redis is loading the dataset in memory")
+
+// loading tracks the dataset being loaded on startup. It goes through the
+// snapshot and then the AOF, one file at a time.
+var loading struct {
+	sync.Mutex
+	// checked for every command, so it's read without the lock
+	active atomic.Bool
+	start  time.Time
+	// when the file being loaded was started, how big it is and how much
+	// of it was read
+	fileStart time.Time
+	total     int64
+	loaded    int64
+}
+
+func init() {
+	RegisterInfo("persistence", loadingInfo)
+}
+
+// StartLoading marks the dataset as being loaded. Until StopLoading is
+// called, commands without FlagLoading get ErrLoading.
+func StartLoading() {
+	loading.Lock()
+	defer loading.Unlock()
+
+	loading.active.Store(true)
+	loading.start = time.Now()
+	loading.fileStart = loading.start
+	loading.total = 0
+	loading.loaded = 0
+}
+
+// LoadingProgress records that loaded out of total bytes of the file being
+// loaded were read. A new file is taken to start when total changes or
+// loaded goes back.
+func LoadingProgress(loaded, total int64) {
+	loading.Lock()
+	defer loading.Unlock()
+
+	if total != loading.total || loaded < loading.loaded {
+		loading.fileStart = time.Now()
+	}
+	loading.total = total
+	loading.loaded = loaded
+}
+
+// StopLoading marks the dataset as loaded.
+func StopLoading() {
+	loading.active.Store(false)
+}
+
+// Loading returns whether the dataset is being loaded.
+func Loading() bool {
+	return loading.active.Load()
+}
+
+func loadingInfo() []string {
+	loading.Lock()
+	defer loading.Unlock()
+
+	if !loading.active.Load() {
+		return []string{"loading:0", "async_loading:0"}
+	}
+
+	perc := 0.0
+	eta := 1
+	if loading.total > 0 {
+		perc = float64(loading.loaded) / float64(loading.total) * 100
+	}
+	if loading.loaded > 0 {
+		// The rest is assumed to load as fast as what was loaded so far.
+		elapsed := time.Since(loading.fileStart)
+		rest := time.Duration(float64(elapsed) * float64(loading.total-loading.loaded) / float64(loading.loaded))
+		eta = int(rest.Seconds())
+	}
+
+	return []string{
+		"loading:1",
+		"async_loading:0",
+		fmt.Sprintf("loading_start_time:%d", loading.start.Unix()),
+		fmt.Sprintf("loading_total_bytes:%d", loading.total),
+		fmt.Sprintf("loading_loaded_bytes:%d", loading.loaded),
+		fmt.Sprintf("loading_loaded_perc:%.2f", perc),
+		fmt.Sprintf("loading_eta_seconds:%d", eta),
+	}
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadingInfo(t *testing.T) {
+	kv := Database.NewKv()
+	assert.Contains(t, call(t, kv, "INFO", "PERSISTENCE").Bulk, "loading:0\r\n")
+
+	StartLoading()
+	defer StopLoading()
+	assert.True(t, Loading())
+
+	LoadingProgress(50, 200)
+	persistence := call(t, kv, "INFO", "PERSISTENCE").Bulk
+	assert.Contains(t, persistence, "loading:1\r\n")
+	assert.Contains(t, persistence, "loading_total_bytes:200\r\n")
+	assert.Contains(t, persistence, "loading_loaded_bytes:50\r\n")
+	assert.Contains(t, persistence, "loading_loaded_perc:25.00\r\n")
+	assert.Contains(t, persistence, "loading_eta_seconds:")
+
+	StopLoading()
+	assert.False(t, Loading())
+	assert.Contains(t, call(t, kv, "INFO", "PERSISTENCE").Bulk, "loading:0\r\n")
+}
@@ -0,0 +1,318 @@
+package handler
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+)
+
+// defaultUsageSamples is how many fields of a hash MEMORY USAGE looks at
+// unless told otherwise.
+const defaultUsageSamples = 5
+
+var (
+	// heap in use when the server started, and the most it ever was
+	startupAllocated uint64
+	peakAllocated    atomic.Uint64
+)
+
+func init() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	startupAllocated = ms.HeapAlloc
+	peakAllocated.Store(ms.HeapAlloc)
+
+	Commands["MEMORY"] = &Command{
+		Name:       "memory",
+		Arity:      -2,
+		Summary:    "A container for memory diagnostics commands.",
+		Since:      "4.0.0",
+		Group:      "server",
+		Complexity: "Depends on subcommand.",
+		Subcommands: map[string]*Command{
+			"USAGE": {
+				Name:       "memory|usage",
+				Handler:    memoryUsage,
+				Arity:      -3,
+				Flags:      FlagReadonly,
+				FirstKey:   2,
+				LastKey:    2,
+				Step:       1,
+				Summary:    "Estimates the memory usage of a key.",
+				Since:      "4.0.0",
+				Group:      "server",
+				Complexity: "O(N) where N is the number of samples.",
+			},
+			"STATS": {
+				Name:       "memory|stats",
+				Handler:    memoryStats,
+				Arity:      2,
+				Summary:    "Returns details about memory usage.",
+				Since:      "4.0.0",
+				Group:      "server",
+				Complexity: "O(1)",
+			},
+			"DOCTOR": {
+				Name:       "memory|doctor",
+				Handler:    memoryDoctor,
+				Arity:      2,
+				Summary:    "Outputs a memory problems report.",
+				Since:      "4.0.0",
+				Group:      "server",
+				Complexity: "O(1)",
+			},
+			"PURGE": {
+				Name:       "memory|purge",
+				Handler:    memoryPurge,
+				Arity:      2,
+				Summary:    "Asks the allocator to release memory.",
+				Since:      "4.0.0",
+				Group:      "server",
+				Complexity: "Depends on how much memory is allocated, could be slow",
+			},
+			"HELP": {
+				Name:       "memory|help",
+				Handler:    memoryHelp,
+				Arity:      2,
+				Flags:      FlagLoading | FlagStale,
+				Summary:    "Returns helpful text about the different subcommands.",
+				Since:      "4.0.0",
+				Group:      "server",
+				Complexity: "O(1)",
+			},
+		},
+	}
+}
+
+// SampleMemory records the peak of the heap every interval, for as long as
+// the server runs, like the server cron of Redis does. It reads runtime
+// metrics, which doesn't stop the world the way runtime.ReadMemStats does.
+func SampleMemory(interval time.Duration) {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	for range time.Tick(interval) {
+		metrics.Read(sample)
+		updatePeak(sample[0].Value.Uint64())
+	}
+}
+
+func updatePeak(allocated uint64) {
+	for {
+		peak := peakAllocated.Load()
+		if allocated <= peak || peakAllocated.CompareAndSwap(peak, allocated) {
+			return
+		}
+	}
+}
+
+// memoryReport is a breakdown of the memory the server takes. Go has no
+// allocator stats of its own, so they're mapped from the runtime: the heap
+// objects are what's allocated, the spans holding them what's active, and
+// the heap memory not returned to the OS what's resident.
+type memoryReport struct {
+	peak, total, startup  uint64
+	dataset, overhead     uint64
+	keys                  int
+	keyspaceOverhead      int64
+	active, resident, rss uint64
+}
+
+func readMemory(kv *Database.Kv) memoryReport {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	updatePeak(ms.HeapAlloc)
+
+	keys, _ := kv.DBSize()
+
+	// The dataset is the keys and values themselves. Everything else, from
+	// the keyspace's own structures to garbage not collected yet, is
+	// overhead.
+	keyspaceOverhead := kv.Overhead()
+	dataset := uint64(max(kv.Used()-keyspaceOverhead, 0))
+
+	return memoryReport{
+		peak:             peakAllocated.Load(),
+		total:            ms.HeapAlloc,
+		startup:          startupAllocated,
+		dataset:          dataset,
+		overhead:         ms.HeapAlloc - min(dataset, ms.HeapAlloc),
+		keys:             keys,
+		keyspaceOverhead: keyspaceOverhead,
+		active:           ms.HeapInuse,
+		resident:         ms.HeapSys - ms.HeapReleased,
+		rss:              ms.Sys - ms.HeapReleased,
+	}
+}
+
+// ratio returns a / b, or 0 if b is 0.
+func ratio(a, b uint64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+func memoryUsage(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	samples := defaultUsageSamples
+	for i := 1; i < len(args); i += 2 {
+		if !strings.EqualFold(args[i].Bulk, "SAMPLES") || i+1 >= len(args) {
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+		n, err := strconv.Atoi(args[i+1].Bulk)
+		if err != nil {
+			return resp.Value{Typ: "error", Str: "ERR value is not an integer or out of range"}
+		}
+		if n < 0 {
+			return resp.Value{Typ: "error", Str: "ERR syntax error"}
+		}
+		samples = n
+	}
+
+	usage, ok := kv.Usage(args[0].Bulk, samples)
+	if !ok {
+		return resp.Value{Typ: "null"}
+	}
+
+	return resp.Value{Typ: "integer", Num: int(usage)}
+}
+
+func memoryStats(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	m := readMemory(kv)
+
+	var values []resp.Value
+	add := func(name string, value resp.Value) {
+		values = append(values, resp.Value{Typ: "bulk", Bulk: name}, value)
+	}
+	integer := func(n uint64) resp.Value {
+		return resp.Value{Typ: "integer", Num: int(n)}
+	}
+	double := func(f float64) resp.Value {
+		return resp.Value{Typ: "bulk", Bulk: strconv.FormatFloat(f, 'g', 17, 64)}
+	}
+
+	used := m.total - min(m.startup, m.total)
+	bytesPerKey := uint64(0)
+	if m.keys > 0 {
+		bytesPerKey = used / uint64(m.keys)
+	}
+
+	add("peak.allocated", integer(m.peak))
+	add("total.allocated", integer(m.total))
+	add("startup.allocated", integer(m.startup))
+	add("overhead.total", integer(m.overhead))
+	add("keys.count", integer(uint64(m.keys)))
+	add("keys.bytes-per-key", integer(bytesPerKey))
+	add("dataset.bytes", integer(m.dataset))
+	add("dataset.percentage", double(ratio(m.dataset, used)*100))
+	add("peak.percentage", double(ratio(m.total, m.peak)*100))
+	add("allocator.allocated", integer(m.total))
+	add("allocator.active", integer(m.active))
+	add("allocator.resident", integer(m.resident))
+	add("allocator-fragmentation.ratio", double(ratio(m.active, m.total)))
+	add("allocator-fragmentation.bytes", integer(m.active-min(m.total, m.active)))
+	add("allocator.rss-ratio", double(ratio(m.resident, m.active)))
+	add("allocator.rss-bytes", integer(m.resident-min(m.active, m.resident)))
+	add("rss-overhead.ratio", double(ratio(m.rss, m.resident)))
+	add("rss-overhead.bytes", integer(m.rss-min(m.resident, m.rss)))
+	add("fragmentation", double(ratio(m.rss, m.total)))
+	add("fragmentation.bytes", integer(m.rss-min(m.total, m.rss)))
+	add("db.0", resp.Value{Typ: "array", Array: []resp.Value{
+		{Typ: "bulk", Bulk: "overhead.hashtable.main"},
+		{Typ: "integer", Num: int(m.keyspaceOverhead)},
+		// TTLs are kept along with string values, not in a table of their
+		// own.
+		{Typ: "bulk", Bulk: "overhead.hashtable.expires"},
+		{Typ: "integer", Num: 0},
+	}})
+
+	return resp.Value{Typ: "array", Array: values}
+}
+
+func memoryDoctor(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	return resp.Value{Typ: "bulk", Bulk: doctorReport(readMemory(kv))}
+}
+
+// Thresholds past which MEMORY DOCTOR reports an issue, the same as Redis.
+const (
+	doctorMinAllocated = 5 << 20
+	doctorMinBytes     = 10 << 20
+)
+
+func doctorReport(m memoryReport) string {
+	if m.total < doctorMinAllocated {
+		return "Hi Sam, this instance is empty or is using very little memory, my issues detector can't be used in these conditions. " +
+			"Please, leave for your mission on Earth and fill it with some data. " +
+			"The new Sam and I will be back to our programming as soon as I finished rebooting."
+	}
+
+	var issues []string
+	if ratio(m.peak, m.total) > 1.5 {
+		issues = append(issues, "Peak memory: In the past this instance used more than 150% the memory that is currently using. "+
+			"The Go runtime returns memory it no longer needs to the OS gradually, so the process may hold on to more memory than it uses for a while after a peak. "+
+			"If the peak was only occasional and you want to reclaim memory right away, please try the MEMORY PURGE command.")
+	}
+	if ratio(m.rss, m.total) > 1.4 && m.rss-m.total > doctorMinBytes {
+		issues = append(issues, "High total RSS: This instance has a memory fragmentation and RSS overhead greater than 1.4 "+
+			"(this means that the Resident Set Size of the process is much larger than the memory it has allocated). "+
+			"This is usually due either to a large peak memory (check if there is a peak memory entry above in the report), or to garbage the Go garbage collector didn't reclaim yet. "+
+			"The heap is let to grow by GOGC percent of what's live before it's collected, so lowering GOGC or setting GOMEMLIMIT keeps it smaller, at the cost of more CPU.")
+	}
+	if ratio(m.active, m.total) > 1.1 && m.active-m.total > doctorMinBytes {
+		issues = append(issues, fmt.Sprintf("High allocator fragmentation: This instance has an allocator fragmentation greater than 1.1 "+
+			"(the spans of the heap are %s bigger than the objects allocated in them). "+
+			"This happens after many objects of the same size are freed, and goes away as the spans are reused.", bytesToHuman(int64(m.active-m.total))))
+	}
+	if ratio(m.resident, m.active) > 1.1 && m.resident-m.active > doctorMinBytes {
+		issues = append(issues, fmt.Sprintf("High allocator RSS overhead: This instance has an RSS memory overhead greater than 1.1 "+
+			"(the heap holds %s it doesn't use and hasn't returned to the OS yet). "+
+			"It's returned in the background, or right away with MEMORY PURGE.", bytesToHuman(int64(m.resident-m.active))))
+	}
+
+	if len(issues) == 0 {
+		return "Hi Sam, I can't find any memory issue in your instance. I can only account for what occurs on this base."
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Sam, I detected a few issues in this Redis instance memory implants:\n\n")
+	for _, issue := range issues {
+		fmt.Fprintf(&sb, " * %s\n\n", issue)
+	}
+	sb.WriteString("I'm here to keep you safe, Sam. I want to help you.\n")
+	return sb.String()
+}
+
+func memoryPurge(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	debug.FreeOSMemory()
+	return resp.Value{Typ: "string", Str: "OK"}
+}
+
+func memoryHelp(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	lines := []string{
+		"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"DOCTOR",
+		"    Return memory problems reports.",
+		"PURGE",
+		"    Attempt to purge dirty pages for reclamation by the allocator.",
+		"STATS",
+		"    Return information about the memory usage of the server.",
+		"USAGE <key> [SAMPLES <count>]",
+		"    Return memory in bytes used by <key> and its value. Nested values are",
+		"    sampled up to <count> times (default: 5, 0 means sample all).",
+		"HELP",
+		"    Print this help.",
+	}
+
+	values := []resp.Value{}
+	for _, line := range lines {
+		values = append(values, resp.Value{Typ: "string", Str: line})
+	}
+
+	return resp.Value{Typ: "array", Array: values}
+}
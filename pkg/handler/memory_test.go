@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryUsage(t *testing.T) {
+	kv := Database.NewKv()
+	set(bulks("a", "value"), kv, testClient())
+	for _, field := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		hset(bulks("h", field, strings.Repeat(field, 10)), kv, testClient())
+	}
+
+	usage := call(t, kv, "MEMORY", "USAGE", "a")
+	require.Equal(t, "integer", usage.Typ)
+	assert.Greater(t, usage.Num, len("a")+len("value"))
+
+	all := call(t, kv, "MEMORY", "USAGE", "h", "SAMPLES", "0")
+	assert.Equal(t, int(kv.Used())-usage.Num, all.Num)
+	assert.Equal(t, "integer", call(t, kv, "MEMORY", "USAGE", "h").Typ)
+
+	assert.Equal(t, resp.Value{Typ: "null"}, call(t, kv, "MEMORY", "USAGE", "missing"))
+	assert.Equal(t, "ERR syntax error", call(t, kv, "MEMORY", "USAGE", "a", "SAMPLES").Str)
+	assert.Equal(t, "ERR syntax error", call(t, kv, "MEMORY", "USAGE", "a", "SAMPLES", "-1").Str)
+	assert.Equal(t, "ERR syntax error", call(t, kv, "MEMORY", "USAGE", "a", "BOGUS", "1").Str)
+	assert.Equal(t, "ERR value is not an integer or out of range", call(t, kv, "MEMORY", "USAGE", "a", "SAMPLES", "x").Str)
+}
+
+func TestMemoryStats(t *testing.T) {
+	kv := Database.NewKv()
+	set(bulks("a", "value"), kv, testClient())
+	hset(bulks("h", "f", "v"), kv, testClient())
+
+	stats := call(t, kv, "MEMORY", "STATS")
+	require.Equal(t, "array", stats.Typ)
+	fields := map[string]resp.Value{}
+	for i := 0; i < len(stats.Array); i += 2 {
+		fields[stats.Array[i].Bulk] = stats.Array[i+1]
+	}
+
+	assert.Equal(t, 2, fields["keys.count"].Num)
+	assert.Equal(t, int(kv.Used()-kv.Overhead()), fields["dataset.bytes"].Num)
+	assert.GreaterOrEqual(t, fields["peak.allocated"].Num, fields["total.allocated"].Num)
+	assert.Equal(t, fields["total.allocated"].Num, fields["overhead.total"].Num+fields["dataset.bytes"].Num)
+	assert.Equal(t, []resp.Value{
+		{Typ: "bulk", Bulk: "overhead.hashtable.main"},
+		{Typ: "integer", Num: int(kv.Overhead())},
+		{Typ: "bulk", Bulk: "overhead.hashtable.expires"},
+		{Typ: "integer", Num: 0},
+	}, fields["db.0"].Array)
+}
+
+func TestMemoryDoctor(t *testing.T) {
+	kv := Database.NewKv()
+	assert.Equal(t, "bulk", call(t, kv, "MEMORY", "DOCTOR").Typ)
+
+	report := doctorReport(memoryReport{total: 1 << 20, peak: 100 << 20})
+	assert.Contains(t, report, "this instance is empty")
+
+	healthy := memoryReport{peak: 100 << 20, total: 100 << 20, active: 101 << 20, resident: 102 << 20, rss: 110 << 20}
+	assert.Contains(t, doctorReport(healthy), "I can't find any memory issue")
+
+	issues := healthy
+	issues.peak = 200 << 20
+	issues.rss = 200 << 20
+	report = doctorReport(issues)
+	assert.True(t, strings.HasPrefix(report, "Sam, I detected a few issues"), report)
+	assert.Contains(t, report, " * Peak memory:")
+	assert.Contains(t, report, " * High total RSS:")
+	assert.NotContains(t, report, "High allocator")
+
+	issues = healthy
+	issues.active = 150 << 20
+	issues.resident = 200 << 20
+	report = doctorReport(issues)
+	assert.Contains(t, report, " * High allocator fragmentation: ")
+	assert.Contains(t, report, "(the spans of the heap are 50.00M bigger")
+	assert.Contains(t, report, " * High allocator RSS overhead: ")
+}
+
+func TestMemoryPeak(t *testing.T) {
+	peak := peakAllocated.Load()
+	updatePeak(peak - 1)
+	assert.Equal(t, peak, peakAllocated.Load())
+	updatePeak(peak + 1)
+	assert.Equal(t, peak+1, peakAllocated.Load())
+}
+
+func TestMemoryHelp(t *testing.T) {
+	kv := Database.NewKv()
+	assert.Equal(t, resp.Value{Typ: "string", Str: "OK"}, call(t, kv, "MEMORY", "PURGE"))
+	help := call(t, kv, "MEMORY", "HELP")
+	assert.Contains(t, help.Array[0].Str, "MEMORY <subcommand>")
+}
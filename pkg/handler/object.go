@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+)
+
+func init() {
+	Commands["OBJECT"] = &Command{
+		Name:       "object",
+		Arity:      -2,
+		Summary:    "A container for object introspection commands.",
+		Since:      "2.2.3",
+		Group:      "generic",
+		Complexity: "Depends on subcommand.",
+		Subcommands: map[string]*Command{
+			"IDLETIME": {
+				Name:          "object|idletime",
+				Handler:       objectIdletime,
+				Arity:         3,
+				Flags:         FlagReadonly,
+				FirstKey:      2,
+				LastKey:       2,
+				Step:          1,
+				ACLCategories: []string{"@keyspace"},
+				Summary:       "Returns the time since the last access to a Redis object.",
+				Since:         "2.2.3",
+				Group:         "generic",
+				Complexity:    "O(1)",
+			},
+			"ENCODING": {
+				Name:          "object|encoding",
+				Handler:       objectEncoding,
+				Arity:         3,
+				Flags:         FlagReadonly,
+				FirstKey:      2,
+				LastKey:       2,
+				Step:          1,
+				ACLCategories: []string{"@keyspace"},
+				Summary:       "Returns the internal encoding of a Redis object.",
+				Since:         "2.2.3",
+				Group:         "generic",
+				Complexity:    "O(1)",
+			},
+			"FREQ": {
+				Name:          "object|freq",
+				Handler:       objectFreq,
+				Arity:         3,
+				Flags:         FlagReadonly,
+				FirstKey:      2,
+				LastKey:       2,
+				Step:          1,
+				ACLCategories: []string{"@keyspace"},
+				Summary:       "Returns the logarithmic access frequency counter of a Redis object.",
+				Since:         "4.0.0",
+				Group:         "generic",
+				Complexity:    "O(1)",
+			},
+			"HELP": {
+				Name:          "object|help",
+				Handler:       objectHelp,
+				Arity:         2,
+				Flags:         FlagLoading | FlagStale,
+				ACLCategories: []string{"@keyspace"},
+				Summary:       "Returns helpful text about the different subcommands.",
+				Since:         "6.2.0",
+				Group:         "generic",
+				Complexity:    "O(1)",
+			},
+		},
+	}
+}
+
+func objectEncoding(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	encoding, ok := kv.Encoding(args[0].Bulk)
+	if !ok {
+		return resp.Value{Typ: "null"}
+	}
+
+	return resp.Value{Typ: "bulk", Bulk: encoding}
+}
+
+func objectIdletime(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	if kv.LFU() {
+		return resp.Value{Typ: "error", Str: "ERR An LFU maxmemory policy is selected, idle time not tracked. " +
+			"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."}
+	}
+
+	idle, ok := kv.IdleTime(args[0].Bulk)
+	if !ok {
+		return resp.Value{Typ: "null"}
+	}
+
+	return resp.Value{Typ: "integer", Num: int(idle.Seconds())}
+}
+
+func objectFreq(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	if !kv.LFU() {
+		return resp.Value{Typ: "error", Str: "ERR An LFU maxmemory policy is not selected, access frequency not tracked. " +
+			"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."}
+	}
+
+	freq, ok := kv.Freq(args[0].Bulk)
+	if !ok {
+		return resp.Value{Typ: "null"}
+	}
+
+	return resp.Value{Typ: "integer", Num: freq}
+}
+
+func objectHelp(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	lines := []string{
+		"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"ENCODING <key>",
+		"    Return the kind of internal representation used in order to store the value",
+		"    associated with a <key>.",
+		"FREQ <key>",
+		"    Return the access frequency index of the <key>. The returned integer is",
+		"    proportional to the logarithm of the recent access frequency of the key.",
+		"IDLETIME <key>",
+		"    Return the idle time of the <key>, that is the approximated number of",
+		"    seconds elapsed since the last access to the key.",
+		"HELP",
+		"    Print this help.",
+	}
+
+	values := []resp.Value{}
+	for _, line := range lines {
+		values = append(values, resp.Value{Typ: "string", Str: line})
+	}
+
+	return resp.Value{Typ: "array", Array: values}
+}
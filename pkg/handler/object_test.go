@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectEncoding(t *testing.T) {
+	kv := Database.NewKv()
+	kv.HashMaxListpackEntries = 2
+	set(bulks("int", "-12345"), kv, testClient())
+	set(bulks("padded", "012"), kv, testClient())
+	set(bulks("long", strings.Repeat("x", 45)), kv, testClient())
+	hset(bulks("h", "f", "v"), kv, testClient())
+
+	encoding := func(key string) resp.Value {
+		return call(t, kv, "OBJECT", "ENCODING", key)
+	}
+	assert.Equal(t, resp.Value{Typ: "bulk", Bulk: "int"}, encoding("int"))
+	assert.Equal(t, resp.Value{Typ: "bulk", Bulk: "embstr"}, encoding("padded"))
+	assert.Equal(t, resp.Value{Typ: "bulk", Bulk: "raw"}, encoding("long"))
+	assert.Equal(t, resp.Value{Typ: "bulk", Bulk: "listpack"}, encoding("h"))
+	assert.Equal(t, resp.Value{Typ: "null"}, encoding("missing"))
+
+	// Values read back the same whatever their encoding.
+	assert.Equal(t, resp.Value{Typ: "string", Str: "-12345"}, get(bulks("int"), kv, testClient()))
+	assert.Equal(t, resp.Value{Typ: "string", Str: "012"}, get(bulks("padded"), kv, testClient()))
+
+	hset(bulks("h", "g", "w"), kv, testClient())
+	assert.Equal(t, resp.Value{Typ: "bulk", Bulk: "listpack"}, encoding("h"))
+	hset(bulks("h", "i", "x"), kv, testClient())
+	assert.Equal(t, resp.Value{Typ: "bulk", Bulk: "hashtable"}, encoding("h"))
+	assert.Equal(t, resp.Value{Typ: "bulk", Bulk: "w"}, hget(bulks("h", "g"), kv, testClient()))
+
+	kv.StringCompressMinSize = 100
+	big := strings.Repeat("compressible ", 100)
+	set(bulks("big", big), kv, testClient())
+	assert.Equal(t, resp.Value{Typ: "bulk", Bulk: "compressed"}, encoding("big"))
+	assert.Equal(t, resp.Value{Typ: "string", Str: big}, get(bulks("big"), kv, testClient()))
+}
+
+func TestObjectIdletime(t *testing.T) {
+	kv := Database.NewKv()
+	set(bulks("a", "1"), kv, testClient())
+
+	assert.Equal(t, resp.Value{Typ: "integer", Num: 0}, call(t, kv, "OBJECT", "IDLETIME", "a"))
+	assert.Equal(t, resp.Value{Typ: "null"}, call(t, kv, "OBJECT", "IDLETIME", "missing"))
+	assert.Contains(t, call(t, kv, "OBJECT", "FREQ", "a").Str, "ERR An LFU maxmemory policy is not selected")
+}
+
+func TestObjectFreq(t *testing.T) {
+	kv := Database.NewKv()
+	kv.MaxMemoryPolicy = Database.AllKeysLFU
+	hset(bulks("h", "f", "v"), kv, testClient())
+
+	assert.Equal(t, resp.Value{Typ: "integer", Num: 5}, call(t, kv, "OBJECT", "FREQ", "h"))
+	assert.Equal(t, resp.Value{Typ: "null"}, call(t, kv, "OBJECT", "FREQ", "missing"))
+	assert.Contains(t, call(t, kv, "OBJECT", "IDLETIME", "h").Str, "ERR An LFU maxmemory policy is selected")
+}
+
+func TestObjectHelp(t *testing.T) {
+	kv := Database.NewKv()
+	help := call(t, kv, "OBJECT", "HELP")
+	assert.Equal(t, "array", help.Typ)
+	assert.Contains(t, help.Array[0].Str, "OBJECT <subcommand>")
+
+	assert.Equal(t, "ERR wrong number of arguments for 'object' command", call(t, kv, "OBJECT").Str)
+	assert.Contains(t, call(t, kv, "OBJECT", "BOGUS", "a").Str, "ERR unknown subcommand 'BOGUS'")
+}
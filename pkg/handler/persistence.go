@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/aof"
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/maniktherana/godbase/pkg/snapshot"
+)
+
+// DiskError returns the error write commands get while the dataset in kv
+// can't be persisted, or nil when they can go ahead. Writes are refused
+// until the AOF or snapshots, which keep retrying in the background,
+// succeed again, so a full disk doesn't silently lose them. Reads still
+// work.
+func DiskError(kv *Database.Kv) error {
+	if kv.StopWritesOnBgsaveError && kv.Snapshots != nil && len(kv.Snapshots.Rules) > 0 && kv.Snapshots.Err() != nil {
+		return errors.New("MISCONF Errors trying to SAVE the DB, check the logs for details. " +
+			"Commands that may modify the data set are disabled, because this instance is configured to report errors during writes if snapshotting fails (stop-writes-on-bgsave-error option).")
+	}
+	if kv.Aof == nil {
+		return nil
+	}
+	err := kv.Aof.Err()
+	if err != nil {
+		return fmt.Errorf("MISCONF Errors writing to the AOF file: %v", err)
+	}
+	return nil
+}
+
+func init() {
+	Commands["BGREWRITEAOF"] = &Command{
+		Name:       "bgrewriteaof",
+		Handler:    bgrewriteaof,
+		Arity:      1,
+		Flags:      FlagAdmin | FlagNoScript,
+		Summary:    "Asynchronously rewrites the append-only file to disk.",
+		Since:      "1.0.0",
+		Group:      "server",
+		Complexity: "O(1)",
+	}
+	Commands["SAVE"] = &Command{
+		Name:       "save",
+		Handler:    save,
+		Arity:      1,
+		Flags:      FlagAdmin | FlagNoScript,
+		Summary:    "Synchronously saves the database(s) to disk.",
+		Since:      "1.0.0",
+		Group:      "server",
+		Complexity: "O(N) where N is the total number of keys in all databases",
+	}
+	Commands["BGSAVE"] = &Command{
+		Name:       "bgsave",
+		Handler:    bgsave,
+		Arity:      -1,
+		Flags:      FlagAdmin | FlagNoScript,
+		Summary:    "Asynchronously saves the database(s) to disk.",
+		Since:      "1.0.0",
+		Group:      "server",
+		Complexity: "O(1)",
+	}
+	Commands["LASTSAVE"] = &Command{
+		Name:          "lastsave",
+		Handler:       lastsave,
+		Arity:         1,
+		Flags:         FlagLoading | FlagStale | FlagFast,
+		ACLCategories: []string{"@admin", "@dangerous"},
+		Summary:       "Returns the Unix timestamp of the last successful save to disk.",
+		Since:         "1.0.0",
+		Group:         "server",
+		Complexity:    "O(1)",
+	}
+}
+
+func bgrewriteaof(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	if kv.Aof == nil {
+		return resp.Value{Typ: "error", Str: "ERR Append only file is disabled"}
+	}
+
+	err := kv.Aof.BgRewrite()
+	if err != nil {
+		return resp.Value{Typ: "error", Str: err.Error()}
+	}
+
+	return resp.Value{Typ: "string", Str: "Background append only file rewriting started"}
+}
+
+func save(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	if kv.Snapshots == nil {
+		return resp.Value{Typ: "error", Str: "ERR Snapshots are disabled"}
+	}
+
+	err := kv.Snapshots.Save()
+	if err == snapshot.ErrSaveInProgress {
+		return resp.Value{Typ: "error", Str: err.Error()}
+	}
+	if err != nil {
+		return resp.Value{Typ: "error", Str: "ERR " + err.Error()}
+	}
+
+	return resp.Value{Typ: "string", Str: "OK"}
+}
+
+func bgsave(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	// SCHEDULE is accepted for compatibility. Saves don't fork, so there's
+	// never a rewrite to wait for.
+	if len(args) > 1 || (len(args) == 1 && !strings.EqualFold(args[0].Bulk, "SCHEDULE")) {
+		return resp.Value{Typ: "error", Str: "ERR syntax error"}
+	}
+	if kv.Snapshots == nil {
+		return resp.Value{Typ: "error", Str: "ERR Snapshots are disabled"}
+	}
+
+	err := kv.Snapshots.BgSave()
+	if err != nil {
+		return resp.Value{Typ: "error", Str: err.Error()}
+	}
+
+	return resp.Value{Typ: "string", Str: "Background saving started"}
+}
+
+func lastsave(args []resp.Value, kv *Database.Kv, client *Client) resp.Value {
+	if kv.Snapshots == nil {
+		return resp.Value{Typ: "integer", Num: int(startTime.Unix())}
+	}
+
+	return resp.Value{Typ: "integer", Num: int(kv.Snapshots.LastSave().Unix())}
+}
+
+// Dump emits the commands that recreate the dataset in kv, the way an AOF
+// rewrite stores it. It reads a snapshot of the dataset, so writers carry
+// on meanwhile.
+func Dump(kv *Database.Kv, emit func(resp.Value) error) error {
+	snap := kv.Snapshot(nil)
+	defer snap.Close()
+
+	now := time.Now().UnixMilli()
+	err := snap.Strings(func(key string, value Database.String) error {
+		switch {
+		case value.Expires == 0:
+			return emit(resp.Command("SET", key, value.String()))
+		case value.Expires > now:
+			return emit(resp.Command("SET", key, value.String(), "PXAT", strconv.FormatInt(value.Expires, 10)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return snap.Hashes(func(hash string, h *Database.Hash) error {
+		var err error
+		h.Range(func(field, value string) bool {
+			err = emit(resp.Command("HSET", hash, field, value))
+			return err == nil
+		})
+		return err
+	})
+}
+
+// Snapshot aux fields recording the AOF position the snapshot was taken
+// at.
+const (
+	auxAofBase   = "aof-base"
+	auxAofIncr   = "aof-incr"
+	auxAofOffset = "aof-offset"
+)
+
+// WriteSnapshot writes the dataset in kv to w, along with the AOF position
+// it matches. It reads a snapshot of the dataset, taken at the same time
+// as the position, so writers carry on meanwhile.
+func WriteSnapshot(kv *Database.Kv, w snapshot.Encoder) error {
+	return writeSnapshot(kv, w, kv.Aof != nil)
+}
+
+// WritePreamble writes the dataset in kv to w for the base file of an AOF
+// rewrite, which has no use for an AOF position.
+func WritePreamble(kv *Database.Kv, w snapshot.Encoder) error {
+	return writeSnapshot(kv, w, false)
+}
+
+func writeSnapshot(kv *Database.Kv, w snapshot.Encoder, withPosition bool) error {
+	var pos aof.Position
+	snap := kv.Snapshot(func() {
+		if withPosition {
+			pos = kv.Aof.Position()
+		}
+	})
+	defer snap.Close()
+
+	aux := [][2]string{
+		{"redis-ver", "7.2.0"},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+	}
+	if withPosition {
+		aux = append(aux,
+			[2]string{auxAofBase, pos.Base},
+			[2]string{auxAofIncr, pos.Incr},
+			[2]string{auxAofOffset, strconv.FormatInt(pos.Offset, 10)})
+	}
+	for _, field := range aux {
+		err := w.Aux(field[0], field[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	// Compressed values are stored as they are when the format allows it.
+	dw, _ := w.(snapshot.DeflatedEncoder)
+	now := time.Now().UnixMilli()
+	err := snap.Strings(func(key string, value Database.String) error {
+		if value.Expires > 0 && value.Expires <= now {
+			return nil
+		}
+		if deflated, size, ok := value.Deflated(); ok && dw != nil {
+			return dw.DeflatedString(key, deflated, size, value.Expires)
+		}
+		return w.String(key, value.String(), value.Expires)
+	})
+	if err != nil {
+		return err
+	}
+
+	return snap.Hashes(func(key string, h *Database.Hash) error {
+		return w.Hash(key, h.Len(), h.Range)
+	})
+}
+
+// LoadSnapshot loads the snapshot saved by kv.Snapshots into kv, and returns
+// the AOF position it was taken at. Keys that expired since are skipped.
+func LoadSnapshot(kv *Database.Kv) (pos aof.Position, loaded bool, err error) {
+	h := SnapshotLoader(kv)
+	h.Aux = func(key, value string) error {
+		switch key {
+		case auxAofBase:
+			pos.Base = value
+		case auxAofIncr:
+			pos.Incr = value
+		case auxAofOffset:
+			pos.Offset, _ = strconv.ParseInt(value, 10, 64)
+		}
+		return nil
+	}
+	loaded, err = kv.Snapshots.Load(h)
+
+	return pos, loaded, err
+}
+
+// SnapshotLoader returns a snapshot handler that loads the keys into kv,
+// skipping those that expired since. Each key is written with its shard
+// locked, as commands like INFO may read the dataset while it loads.
+func SnapshotLoader(kv *Database.Kv) snapshot.Handler {
+	now := time.Now().UnixMilli()
+	setString := func(key string, value Database.String) {
+		shard := kv.Shard(key)
+		shard.Lock()
+		kv.SetString(key, value)
+		shard.Unlock()
+	}
+	return snapshot.Handler{
+		String: func(key, value string, expires int64) error {
+			if expires > 0 && expires <= now {
+				return nil
+			}
+			setString(key, kv.EncodeString(value, expires))
+			return nil
+		},
+		DeflatedString: func(key, deflated string, size int, expires int64) error {
+			if expires > 0 && expires <= now {
+				return nil
+			}
+			value := Database.NewDeflatedString(deflated, size, expires)
+			// Values too small to be compressed anymore are decompressed.
+			if kv.StringCompressMinSize <= 0 || size < kv.StringCompressMinSize {
+				value = Database.NewString(value.String(), expires)
+			}
+			setString(key, value)
+			return nil
+		},
+		Hash: func(key string, fields map[string]string) error {
+			shard := kv.Shard(key)
+			shard.Lock()
+			kv.SetHash(key, fields)
+			shard.Unlock()
+			return nil
+		},
+	}
+}
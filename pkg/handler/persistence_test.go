@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/aof"
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/maniktherana/godbase/pkg/snapshot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDump(t *testing.T) {
+	kv := Database.NewKv()
+	future := strconv.FormatInt(time.Now().UnixMilli()+100000, 10)
+
+	set(bulks("plain", "value"), kv, testClient())
+	set(bulks("expiring", "value", "PXAT", future), kv, testClient())
+	kv.SetString("expired", Database.NewString("value", 1))
+	hset(bulks("hash", "a", "1"), kv, testClient())
+	hset(bulks("hash", "b", "2"), kv, testClient())
+
+	commands := []resp.Value{}
+	require.NoError(t, Dump(kv, func(v resp.Value) error {
+		commands = append(commands, v)
+		return nil
+	}))
+
+	assert.ElementsMatch(t, []resp.Value{
+		resp.Command("SET", "plain", "value"),
+		resp.Command("SET", "expiring", "value", "PXAT", future),
+		resp.Command("HSET", "hash", "a", "1"),
+		resp.Command("HSET", "hash", "b", "2"),
+	}, commands)
+
+	// Replaying the dump recreates the dataset.
+	replayed := Database.NewKv()
+	for _, c := range commands {
+		cmd, args, err := Lookup(c.Array)
+		require.NoError(t, err)
+		cmd.Handler(args, replayed, testClient())
+	}
+	kv.DeleteString("expired")
+	assert.Equal(t, kv.Strings(), replayed.Strings())
+	assert.Equal(t, kv.Hashes(), replayed.Hashes())
+}
+
+func TestBgrewriteaof(t *testing.T) {
+	kv := Database.NewKv()
+	assert.Equal(t, resp.Value{Typ: "error", Str: "ERR Append only file is disabled"}, call(t, kv, "BGREWRITEAOF"))
+
+	a, err := aof.NewAof(t.TempDir(), "test.aof", aof.FsyncNo)
+	require.NoError(t, err)
+	a.Snapshot = func(emit func(resp.Value) error) error {
+		return Dump(kv, emit)
+	}
+	kv.Aof = a
+	defer a.Close()
+
+	assert.Equal(t, resp.Value{Typ: "string", Str: "Background append only file rewriting started"}, call(t, kv, "BGREWRITEAOF"))
+}
+
+func TestSnapshot(t *testing.T) {
+	kv := Database.NewKv()
+	future := time.Now().UnixMilli() + 100000
+
+	set(bulks("plain", "value"), kv, testClient())
+	set(bulks("expiring", "value", "PXAT", strconv.FormatInt(future, 10)), kv, testClient())
+	kv.SetString("expired", Database.NewString("value", 1))
+	hset(bulks("hash", "a", "1"), kv, testClient())
+
+	a, err := aof.NewAof(t.TempDir(), "test.aof", aof.FsyncNo)
+	require.NoError(t, err)
+	require.NoError(t, a.Write(resp.Command("SET", "plain", "value")))
+	defer a.Close()
+	kv.Aof = a
+	kv.Snapshots = snapshot.New(filepath.Join(t.TempDir(), "dump.gdb"), nil)
+	kv.Snapshots.Dump = func(w snapshot.Encoder) error {
+		return WriteSnapshot(kv, w)
+	}
+	defer kv.Snapshots.Close()
+
+	require.NoError(t, kv.Snapshots.Save())
+
+	loaded := Database.NewKv()
+	loaded.Snapshots = kv.Snapshots
+	pos, ok, err := LoadSnapshot(loaded)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, a.Position(), pos)
+	assert.Equal(t, map[string]Database.String{
+		"plain":    Database.NewString("value", 0),
+		"expiring": Database.NewString("value", future),
+	}, loaded.Strings())
+	assert.Equal(t, kv.Hashes(), loaded.Hashes())
+}
+
+func TestSnapshotCompressedStrings(t *testing.T) {
+	kv := Database.NewKv()
+	kv.StringCompressMinSize = 100
+	big := strings.Repeat("compressible ", 100)
+	set(bulks("big", big), kv, testClient())
+
+	var buf bytes.Buffer
+	w := snapshot.NewWriter(&buf, false)
+	require.NoError(t, WriteSnapshot(kv, w))
+	require.NoError(t, w.Close())
+
+	// The value is stored and loaded back without being recompressed.
+	deflated, _, _ := kv.Strings()["big"].Deflated()
+	assert.Contains(t, buf.String(), deflated)
+	loaded := Database.NewKv()
+	loaded.StringCompressMinSize = 100
+	require.NoError(t, snapshot.Read(bytes.NewReader(buf.Bytes()), SnapshotLoader(loaded)))
+	assert.Equal(t, kv.Strings(), loaded.Strings())
+
+	// unless compression is now off.
+	loaded = Database.NewKv()
+	require.NoError(t, snapshot.Read(bytes.NewReader(buf.Bytes()), SnapshotLoader(loaded)))
+	assert.Equal(t, Database.NewString(big, 0), loaded.Strings()["big"])
+
+	// Commands have the value decompressed.
+	commands := []resp.Value{}
+	require.NoError(t, Dump(kv, func(v resp.Value) error {
+		commands = append(commands, v)
+		return nil
+	}))
+	assert.Equal(t, []resp.Value{resp.Command("SET", "big", big)}, commands)
+}
+
+func TestSaveCommands(t *testing.T) {
+	kv := Database.NewKv()
+	assert.Equal(t, resp.Value{Typ: "error", Str: "ERR Snapshots are disabled"}, call(t, kv, "SAVE"))
+	assert.Equal(t, resp.Value{Typ: "error", Str: "ERR Snapshots are disabled"}, call(t, kv, "BGSAVE"))
+	assert.Equal(t, "integer", call(t, kv, "LASTSAVE").Typ)
+
+	kv.Snapshots = snapshot.New(filepath.Join(t.TempDir(), "dump.gdb"), nil)
+	kv.Snapshots.Dump = func(w snapshot.Encoder) error {
+		return WriteSnapshot(kv, w)
+	}
+	defer kv.Snapshots.Close()
+
+	assert.Equal(t, resp.Value{Typ: "string", Str: "OK"}, call(t, kv, "SAVE"))
+	assert.Equal(t, resp.Value{Typ: "integer", Num: int(kv.Snapshots.LastSave().Unix())}, call(t, kv, "LASTSAVE"))
+	assert.Equal(t, resp.Value{Typ: "error", Str: "ERR syntax error"}, call(t, kv, "BGSAVE", "NOW"))
+	assert.Equal(t, resp.Value{Typ: "string", Str: "Background saving started"}, call(t, kv, "BGSAVE", "schedule"))
+}
+
+func TestDiskError(t *testing.T) {
+	kv := Database.NewKv()
+	kv.Snapshots = snapshot.New(filepath.Join(t.TempDir(), "dump.gdb"), []snapshot.Rule{{Seconds: 3600, Changes: 1000}})
+	kv.Snapshots.Dump = func(w snapshot.Encoder) error {
+		return errors.New("disk full")
+	}
+	defer kv.Snapshots.Close()
+
+	assert.NoError(t, DiskError(kv))
+	require.Error(t, kv.Snapshots.Save())
+	err := DiskError(kv)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "MISCONF "), err)
+
+	kv.StopWritesOnBgsaveError = false
+	assert.NoError(t, DiskError(kv))
+
+	// Without save rules, nothing saves by itself, so a failed SAVE
+	// doesn't stop writes.
+	kv.StopWritesOnBgsaveError = true
+	kv.Snapshots.Mu.Lock()
+	kv.Snapshots.Rules = nil
+	kv.Snapshots.Mu.Unlock()
+	assert.NoError(t, DiskError(kv))
+}
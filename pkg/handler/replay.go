@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+)
+
+// Replayer applies the write commands logged in an AOF to a dataset, as
+// fast as it can for loading big AOFs on startup. The commands an AOF is
+// made of, SET, DEL and HSET in the form commands propagate them, go
+// straight to the dataset without a trip through the command table and
+// their handlers. Anything else is run by its handler as usual.
+//
+// Only the shard of the key being written is locked, and it's kept locked
+// while the following commands are on the same shard, at most until the
+// end of the batch. Clients served while loading only wait on the replay
+// if they read that shard.
+//
+// Commands applied directly aren't propagated, as they're already logged.
+type Replayer struct {
+	kv *Database.Kv
+	// client commands are run for, whose replies are discarded
+	client *Client
+	// shard locked for the commands applied directly, nil if none is
+	locked *Database.Shard
+}
+
+// NewReplayer returns a Replayer applying commands to kv.
+func NewReplayer(kv *Database.Kv) *Replayer {
+	return &Replayer{kv: kv, client: newClient("", io.Discard)}
+}
+
+// Apply applies a batch of commands, in order. It's meant to be passed to
+// aof.Replay.
+func (r *Replayer) Apply(batch []resp.Value) error {
+	kv := r.kv
+	// Keys that expired by the time they're loaded are dropped, like SET
+	// does with expire times in the past.
+	now := time.Now().UnixMilli()
+
+	// Values are encoded before the shards are locked, as compressing big
+	// ones takes a while.
+	values := make([]Database.String, len(batch))
+	for i, value := range batch {
+		s, expires, ok := parseSet(value.Array)
+		if ok && (expires == 0 || expires > now) {
+			values[i] = kv.EncodeString(s, expires)
+		}
+	}
+
+	for i, value := range batch {
+		if r.apply(value.Array, values[i], now) {
+			continue
+		}
+
+		r.unlock()
+		r.call(value)
+	}
+	r.unlock()
+
+	return nil
+}
+
+// apply applies the command made of args if it's one of the forms
+// commands are propagated in, returning false for anything else. value is
+// what a SET sets, encoded by Apply.
+func (r *Replayer) apply(args []resp.Value, value Database.String, now int64) bool {
+	kv := r.kv
+	name := args[0].Bulk
+
+	if _, expires, ok := parseSet(args); ok {
+		r.lock(args[1].Bulk)
+		if expires > 0 && expires <= now {
+			kv.DeleteString(args[1].Bulk)
+		} else {
+			kv.SetString(args[1].Bulk, value)
+		}
+		return true
+	}
+
+	switch {
+	case len(args) >= 2 && strings.EqualFold(name, "DEL"):
+		for _, arg := range args[1:] {
+			r.lock(arg.Bulk)
+			kv.DeleteString(arg.Bulk)
+			kv.DeleteHash(arg.Bulk)
+		}
+	case len(args) == 4 && strings.EqualFold(name, "HSET"):
+		r.lock(args[1].Bulk)
+		kv.SetField(args[1].Bulk, args[2].Bulk, args[3].Bulk)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// lock locks the shard of key, unless it's the one already locked.
+func (r *Replayer) lock(key string) {
+	shard := r.kv.Shard(key)
+	if shard == r.locked {
+		return
+	}
+	r.unlock()
+	shard.Lock()
+	r.locked = shard
+}
+
+// unlock unlocks the shard locked by lock, if any.
+func (r *Replayer) unlock() {
+	if r.locked != nil {
+		r.locked.Unlock()
+		r.locked = nil
+	}
+}
+
+// parseSet returns the value and expire time, 0 for none, of a SET in one
+// of the forms it's propagated in: without options, or with PXAT.
+func parseSet(args []resp.Value) (value string, expires int64, ok bool) {
+	if len(args) < 3 || !strings.EqualFold(args[0].Bulk, "SET") {
+		return "", 0, false
+	}
+
+	switch {
+	case len(args) == 3:
+		return args[2].Bulk, 0, true
+	case len(args) == 5 && strings.EqualFold(args[3].Bulk, "PXAT"):
+		when, err := strconv.ParseInt(args[4].Bulk, 10, 64)
+		if err != nil || when <= 0 {
+			return "", 0, false
+		}
+		return args[2].Bulk, when, true
+	}
+	return "", 0, false
+}
+
+// call runs a command through its handler, skipping anything that isn't a
+// valid write command.
+func (r *Replayer) call(value resp.Value) {
+	cmd, args, err := Lookup(value.Array)
+	if err != nil {
+		fmt.Println("Invalid command in AOF:", err)
+		return
+	}
+	if !cmd.Has(FlagWrite) {
+		fmt.Println("Skipping non-write command in AOF:", cmd.Name)
+		return
+	}
+
+	r.client.Lock()
+	cmd.Call(args, r.kv, r.client)
+	r.client.Unlock()
+}
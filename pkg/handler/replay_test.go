@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/Database"
+	"github.com/maniktherana/godbase/pkg/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayer(t *testing.T) {
+	future := strconv.FormatInt(time.Now().UnixMilli()+100000, 10)
+	past := strconv.FormatInt(time.Now().UnixMilli()-1000, 10)
+	compressible := strings.Repeat("compressible ", 20)
+
+	batch := []resp.Value{
+		resp.Command("SET", "a", "1"),
+		resp.Command("set", "b", "2"),
+		resp.Command("SET", "c", "3", "PXAT", future),
+		resp.Command("SET", "big", compressible),
+		resp.Command("SET", "bigger", compressible+compressible, "PXAT", future),
+		resp.Command("SET", "b", "3", "PXAT", past),
+		resp.Command("HSET", "h", "f", "v"),
+		resp.Command("HSET", "h", "g", "w"),
+		resp.Command("HSET", "gone", "f", "v"),
+		resp.Command("DEL", "gone", "missing"),
+		// Forms commands aren't propagated in go through their handler.
+		resp.Command("SET", "a", "2", "NX"),
+		resp.Command("SET", "d", "4", "EX", "100"),
+		resp.Command("SET", "e", "5", "PXAT", "0"),
+		// Anything that isn't a write is skipped.
+		resp.Command("GET", "a"),
+		resp.Command("BOGUS"),
+	}
+
+	replayed := Database.NewKv()
+	replayed.StringCompressMinSize = 64
+	commands := propagated(replayed)
+	require.NoError(t, NewReplayer(replayed).Apply(batch))
+	// Only commands run by their handler are propagated.
+	require.Len(t, *commands, 1)
+	assert.Equal(t, []string{"SET", "d", "4", "PXAT"}, (*commands)[0][:4])
+
+	// Running the commands one by one gives the same dataset.
+	kv := Database.NewKv()
+	kv.StringCompressMinSize = 64
+	for _, value := range batch {
+		cmd, args, err := Lookup(value.Array)
+		if err != nil || !cmd.Has(FlagWrite) {
+			continue
+		}
+		cmd.Handler(args, kv, testClient())
+	}
+
+	assert.Equal(t, Database.EncodingCompressed, replayed.Strings()["big"].Encoding())
+	assert.Equal(t, Database.EncodingCompressed, replayed.Strings()["bigger"].Encoding())
+	assert.Equal(t, kv.Hashes(), replayed.Hashes())
+	assert.Equal(t, len(kv.Strings()), len(replayed.Strings()))
+	for key, value := range kv.Strings() {
+		if key == "d" {
+			// Relative expire times depend on when they're applied.
+			assert.InDelta(t, value.Expires, replayed.Strings()[key].Expires, 1000)
+			value.Expires = replayed.Strings()[key].Expires
+		}
+		assert.Equal(t, value, replayed.Strings()[key], key)
+	}
+}
+
+func TestReplayerLocksOneShard(t *testing.T) {
+	kv := Database.NewKv()
+	held := kv.Shard("held")
+
+	var batch []resp.Value
+	for i := range 100 {
+		key := strconv.Itoa(i)
+		if kv.Shard(key) != held && kv.Shard("h"+key) != held {
+			batch = append(batch, resp.Command("SET", key, "v"), resp.Command("HSET", "h"+key, "f", "v"))
+		}
+	}
+
+	// A client reading a shard doesn't hold up loading keys of the others.
+	held.RLock()
+	defer held.RUnlock()
+	done := make(chan error)
+	go func() {
+		done <- NewReplayer(kv).Apply(batch)
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Apply waited on a shard it doesn't write to")
+	}
+	assert.Len(t, kv.Strings(), len(batch)/2)
+}
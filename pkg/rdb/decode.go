@@ -0,0 +1,73 @@
+package rdb
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/snapshot"
+)
+
+// Decode reads the RDB file in r into h, which is how a Redis dump is
+// loaded as a snapshot. Keys that already expired are skipped, like Redis
+// does when loading. Anything godbase can't hold, such as other types than
+// strings and hashes or keys in other databases than 0, fails with
+// ErrUnsupported rather than being dropped.
+func Decode(r io.Reader, h snapshot.Handler) error {
+	now := time.Now().UnixMilli()
+
+	// check returns whether to skip a key of type typ, and an error if it
+	// can't be loaded.
+	check := func(key Key, typ string, supported bool) (bool, error) {
+		if key.Expires != 0 && key.Expires <= now {
+			return true, nil
+		}
+		if !supported {
+			return true, fmt.Errorf("%w: %s %q, godbase only has strings and hashes", ErrUnsupported, typ, key.Name)
+		}
+		if key.DB != 0 {
+			return true, fmt.Errorf("%w: %s %q is in database %d, godbase only has database 0", ErrUnsupported, typ, key.Name, key.DB)
+		}
+		return false, nil
+	}
+	unsupported := func(typ string) func(Key) error {
+		return func(key Key) error {
+			_, err := check(key, typ, false)
+			return err
+		}
+	}
+	list, set, zset, stream := unsupported("list"), unsupported("set"), unsupported("sorted set"), unsupported("stream")
+
+	return Read(r, Handler{
+		Aux: func(key, value string) error {
+			if h.Aux == nil {
+				return nil
+			}
+			return h.Aux(key, value)
+		},
+		String: func(key Key, value string) error {
+			skip, err := check(key, "string", true)
+			if skip || h.String == nil {
+				return err
+			}
+			return h.String(key.Name, value, key.Expires)
+		},
+		Hash: func(key Key, fields map[string]string) error {
+			skip, err := check(key, "hash", true)
+			if skip || h.Hash == nil {
+				return err
+			}
+			if key.Expires != 0 {
+				return fmt.Errorf("%w: hash %q has an expire time, which godbase hashes can't have", ErrUnsupported, key.Name)
+			}
+			return h.Hash(key.Name, fields)
+		},
+		List:   func(key Key, _ []string) error { return list(key) },
+		Set:    func(key Key, _ []string) error { return set(key) },
+		ZSet:   func(key Key, _ []ZMember) error { return zset(key) },
+		Stream: func(key Key, _ *Stream) error { return stream(key) },
+		Function: func(string) error {
+			return fmt.Errorf("%w: function library, godbase has no functions", ErrUnsupported)
+		},
+	})
+}
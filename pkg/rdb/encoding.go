@@ -0,0 +1,295 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// The compact encodings Redis stores small values in, which RDB files hold
+// as strings. Each decoder returns the entries in order, with integers
+// formatted as strings.
+
+// cursor reads through an encoded value. The first read past its end sets
+// err and makes every later read return nil.
+type cursor struct {
+	b   []byte
+	err error
+}
+
+func (c *cursor) take(n int) []byte {
+	if c.err != nil || n < 0 || n > len(c.b) {
+		c.err = fmt.Errorf("%w: value runs past its end", ErrFormat)
+		return nil
+	}
+	p := c.b[:n]
+	c.b = c.b[n:]
+	return p
+}
+
+// peek returns the next byte, or the end marker 0xff once past the end.
+func (c *cursor) peek() byte {
+	if c.err != nil || len(c.b) == 0 {
+		if c.err == nil {
+			c.err = fmt.Errorf("%w: missing end marker", ErrFormat)
+		}
+		return 0xff
+	}
+	return c.b[0]
+}
+
+// littleEndian decodes a little endian signed integer of len(b) bytes.
+func littleEndian(b []byte) int64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*len(b)
+	return int64(v<<shift) >> shift
+}
+
+// ziplistEntries decodes a ziplist, the encoding of small lists, hashes and
+// sorted sets before version 10:
+//
+//	zlbytes(4) zltail(4) zllen(2) (prevlen encoding data)* 0xff
+func ziplistEntries(b []byte) ([]string, error) {
+	if len(b) < 11 || int(binary.LittleEndian.Uint32(b)) != len(b) {
+		return nil, fmt.Errorf("%w: bad ziplist", ErrFormat)
+	}
+
+	c := &cursor{b: b[10:]}
+	entries := []string{}
+	for c.peek() != 0xff {
+		if c.take(1)[0] == 254 {
+			c.take(4)
+		}
+
+		enc := c.take(1)
+		if c.err != nil {
+			break
+		}
+		switch e := enc[0]; {
+		case e>>6 == 0:
+			entries = append(entries, string(c.take(int(e&0x3f))))
+		case e>>6 == 1:
+			n := int(e&0x3f)<<8 | int(c.peek())
+			c.take(1)
+			entries = append(entries, string(c.take(n)))
+		case e == 0x80:
+			n := c.take(4)
+			if n != nil {
+				entries = append(entries, string(c.take(int(binary.BigEndian.Uint32(n)))))
+			}
+		case e == 0xc0:
+			entries = appendInt(entries, c.take(2))
+		case e == 0xd0:
+			entries = appendInt(entries, c.take(4))
+		case e == 0xe0:
+			entries = appendInt(entries, c.take(8))
+		case e == 0xf0:
+			entries = appendInt(entries, c.take(3))
+		case e == 0xfe:
+			entries = appendInt(entries, c.take(1))
+		case e >= 0xf1 && e <= 0xfd:
+			entries = append(entries, strconv.Itoa(int(e&0x0f)-1))
+		default:
+			return nil, fmt.Errorf("%w: bad ziplist entry encoding %#x", ErrFormat, e)
+		}
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return entries, nil
+}
+
+func appendInt(entries []string, b []byte) []string {
+	if b == nil {
+		return entries
+	}
+	return append(entries, strconv.FormatInt(littleEndian(b), 10))
+}
+
+// listpackEntries decodes a listpack, which replaced ziplists in version
+// 10:
+//
+//	total bytes(4) count(2) (encoding data backlen)* 0xff
+func listpackEntries(b []byte) ([]string, error) {
+	if len(b) < 7 || int(binary.LittleEndian.Uint32(b)) != len(b) {
+		return nil, fmt.Errorf("%w: bad listpack", ErrFormat)
+	}
+
+	c := &cursor{b: b[6:]}
+	entries := []string{}
+	for c.peek() != 0xff {
+		before := len(c.b)
+		e := c.take(1)[0]
+		switch {
+		case e&0x80 == 0:
+			entries = append(entries, strconv.Itoa(int(e&0x7f)))
+		case e&0xc0 == 0x80:
+			entries = append(entries, string(c.take(int(e&0x3f))))
+		case e&0xe0 == 0xc0:
+			v := int(e&0x1f)<<8 | int(c.peek())
+			c.take(1)
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			entries = append(entries, strconv.Itoa(v))
+		case e&0xf0 == 0xe0:
+			n := int(e&0x0f)<<8 | int(c.peek())
+			c.take(1)
+			entries = append(entries, string(c.take(n)))
+		case e == 0xf0:
+			n := c.take(4)
+			if n != nil {
+				entries = append(entries, string(c.take(int(binary.LittleEndian.Uint32(n)))))
+			}
+		case e == 0xf1:
+			entries = appendInt(entries, c.take(2))
+		case e == 0xf2:
+			entries = appendInt(entries, c.take(3))
+		case e == 0xf3:
+			entries = appendInt(entries, c.take(4))
+		case e == 0xf4:
+			entries = appendInt(entries, c.take(8))
+		default:
+			return nil, fmt.Errorf("%w: bad listpack entry encoding %#x", ErrFormat, e)
+		}
+
+		// Every entry ends with its size, for walking the listpack back to
+		// front.
+		c.take(backlenSize(before - len(c.b)))
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return entries, nil
+}
+
+// backlenSize returns how many bytes the size of a listpack entry of n
+// bytes takes, at 7 bits a byte.
+func backlenSize(n int) int {
+	switch {
+	case n < 1<<7:
+		return 1
+	case n < 1<<14:
+		return 2
+	case n < 1<<21:
+		return 3
+	case n < 1<<28:
+		return 4
+	}
+	return 5
+}
+
+// intsetEntries decodes an intset, the encoding of small sets of integers:
+//
+//	encoding(4) length(4) (integer of encoding bytes)*
+func intsetEntries(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("%w: bad intset", ErrFormat)
+	}
+	size := int(binary.LittleEndian.Uint32(b))
+	n := int(binary.LittleEndian.Uint32(b[4:]))
+	if (size != 2 && size != 4 && size != 8) || len(b)-8 != size*n {
+		return nil, fmt.Errorf("%w: bad intset", ErrFormat)
+	}
+
+	entries := make([]string, 0, n)
+	for i := range n {
+		entries = appendInt(entries, b[8+i*size:8+(i+1)*size])
+	}
+	return entries, nil
+}
+
+// zipmapEntries decodes a zipmap, the encoding of small hashes before
+// Redis 2.6:
+//
+//	zmlen(1) (len key len free value padding)* 0xff
+//
+// with lengths of 254 and up taking 4 more bytes.
+func zipmapEntries(b []byte) ([]string, error) {
+	c := &cursor{b: b}
+	c.take(1)
+
+	length := func() int {
+		n := c.take(1)
+		if n == nil {
+			return 0
+		}
+		if n[0] < 254 {
+			return int(n[0])
+		}
+		b := c.take(4)
+		if b == nil {
+			return 0
+		}
+		return int(binary.LittleEndian.Uint32(b))
+	}
+
+	entries := []string{}
+	for c.peek() != 0xff {
+		key := string(c.take(length()))
+		n := length()
+		free := c.take(1)
+		value := string(c.take(n))
+		if free != nil {
+			c.take(int(free[0]))
+		}
+		entries = append(entries, key, value)
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return entries, nil
+}
+
+// lzfDecompress decompresses LZF data, which is a series of literal runs
+// and back references into the output, into size bytes.
+func lzfDecompress(in []byte, size uint64) ([]byte, error) {
+	out := make([]byte, 0, min(size, 1<<20))
+	bad := fmt.Errorf("%w: bad LZF data", ErrFormat)
+
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 1<<5 {
+			n := ctrl + 1
+			if i+n > len(in) || uint64(len(out)+n) > size {
+				return nil, bad
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, bad
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, bad
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		n += 2
+		if ref < 0 || uint64(len(out)+n) > size {
+			return nil, bad
+		}
+		// The reference can overlap what it's copied to, so it's copied a
+		// byte at a time.
+		for j := range n {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if uint64(len(out)) != size {
+		return nil, bad
+	}
+	return out, nil
+}
@@ -0,0 +1,103 @@
+// Package rdb reads and writes Redis RDB files, so data can be moved
+// between Redis and godbase.
+//
+// Read understands RDB versions up to 11, as written by Redis 7.2, with
+// every type and encoding those versions have except module types: strings,
+// lists, sets, sorted sets, hashes and streams, stored as plain values,
+// ziplists, listpacks, intsets, zipmaps or quicklists, with LZF compressed
+// strings. Writer only writes strings and hashes, the types godbase has,
+// in encodings every Redis since 5.0 loads.
+//
+// A file is laid out as
+//
+//	"REDIS" version(4 digits)
+//	(opcode | type key value)*
+//	0xff crc64(8 bytes, little endian)
+//
+// where opcodes add metadata, like aux fields or the expire time of the
+// next key, and the checksum covers everything before it. A zero checksum
+// means the file was written without one.
+package rdb
+
+import (
+	"errors"
+	"hash/crc64"
+)
+
+const (
+	magic = "REDIS"
+	// MaxVersion is the newest RDB version Read understands.
+	MaxVersion = 11
+	// version is the RDB version Writer writes.
+	version = 9
+)
+
+// Opcodes.
+const (
+	opFunction2     byte = 245
+	opFunctionPreGA byte = 246
+	opModuleAux     byte = 247
+	opIdle          byte = 248
+	opFreq          byte = 249
+	opAux           byte = 250
+	opResizeDB      byte = 251
+	opExpireTimeMs  byte = 252
+	opExpireTime    byte = 253
+	opSelectDB      byte = 254
+	opEOF           byte = 255
+)
+
+// Value types.
+const (
+	typeString           byte = 0
+	typeList             byte = 1
+	typeSet              byte = 2
+	typeZSet             byte = 3
+	typeHash             byte = 4
+	typeZSet2            byte = 5
+	typeModulePreGA      byte = 6
+	typeModule2          byte = 7
+	typeHashZipmap       byte = 9
+	typeListZiplist      byte = 10
+	typeSetIntset        byte = 11
+	typeZSetZiplist      byte = 12
+	typeHashZiplist      byte = 13
+	typeListQuicklist    byte = 14
+	typeStreamListpacks  byte = 15
+	typeHashListpack     byte = 16
+	typeZSetListpack     byte = 17
+	typeListQuicklist2   byte = 18
+	typeStreamListpacks2 byte = 19
+	typeSetListpack      byte = 20
+	typeStreamListpacks3 byte = 21
+)
+
+// Special string encodings, in the low bits of a length whose top two bits
+// are set.
+const (
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+var (
+	// ErrFormat is returned for files that aren't RDB files, or that are
+	// malformed.
+	ErrFormat = errors.New("invalid RDB file")
+	// ErrChecksum is returned when a file doesn't match its checksum.
+	ErrChecksum = errors.New("RDB checksum mismatch")
+	// ErrUnsupported is returned for data that can't be read, such as
+	// module types, or that godbase can't hold.
+	ErrUnsupported = errors.New("unsupported RDB data")
+)
+
+// crcTable is for the Jones polynomial Redis checksums with, reflected as
+// hash/crc64 expects.
+var crcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// updateCRC is like crc64.Update, but without the inversion before and
+// after that Redis's CRC-64 doesn't have.
+func updateCRC(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
@@ -0,0 +1,566 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Key is the key a value read from an RDB file is stored at.
+type Key struct {
+	// DB is the database number the key is in.
+	DB   int
+	Name string
+	// Expires is the expire time in unix milliseconds, or 0 for none.
+	Expires int64
+}
+
+// ZMember is a member of a sorted set.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// Handler receives the contents of an RDB file as it's read. Nil functions
+// skip their entries.
+type Handler struct {
+	Aux    func(key, value string) error
+	String func(key Key, value string) error
+	List   func(key Key, elements []string) error
+	Set    func(key Key, members []string) error
+	ZSet   func(key Key, members []ZMember) error
+	Hash   func(key Key, fields map[string]string) error
+	Stream func(key Key, stream *Stream) error
+	// Function receives the code of a function library.
+	Function func(code string) error
+}
+
+// maxPrealloc bounds what a count read from the file preallocates, so a
+// corrupt count can't make the reader allocate all memory up front.
+const maxPrealloc = 1024
+
+// Read reads an RDB file from r, passing its contents to h. The checksum
+// at the end is only verified once everything was passed on, so h should
+// only make its changes visible once Read returns without an error.
+func Read(r io.Reader, h Handler) error {
+	rd := &reader{br: bufio.NewReader(r)}
+
+	header, err := rd.readFull(uint64(len(magic) + 4))
+	if err != nil || string(header[:len(magic)]) != magic {
+		return fmt.Errorf("%w: bad header", ErrFormat)
+	}
+	v, err := strconv.Atoi(string(header[len(magic):]))
+	if err != nil || v < 1 {
+		return fmt.Errorf("%w: bad version", ErrFormat)
+	}
+	if v > MaxVersion {
+		return fmt.Errorf("%w: RDB version %d, only versions up to %d are supported", ErrUnsupported, v, MaxVersion)
+	}
+
+	db := 0
+	expires := int64(0)
+	for {
+		op, err := rd.readByte()
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case opEOF:
+			return rd.checksum(v)
+		case opSelectDB:
+			n, err := rd.readLength()
+			if err != nil {
+				return err
+			}
+			db = int(n)
+		case opResizeDB:
+			_, err := rd.readLength()
+			if err == nil {
+				_, err = rd.readLength()
+			}
+			if err != nil {
+				return err
+			}
+		case opExpireTimeMs:
+			b, err := rd.readFull(8)
+			if err != nil {
+				return err
+			}
+			expires = int64(binary.LittleEndian.Uint64(b))
+		case opExpireTime:
+			b, err := rd.readFull(4)
+			if err != nil {
+				return err
+			}
+			expires = int64(binary.LittleEndian.Uint32(b)) * 1000
+		case opIdle:
+			_, err := rd.readLength()
+			if err != nil {
+				return err
+			}
+		case opFreq:
+			_, err := rd.readByte()
+			if err != nil {
+				return err
+			}
+		case opAux:
+			key, err := rd.readString()
+			if err != nil {
+				return err
+			}
+			value, err := rd.readString()
+			if err != nil {
+				return err
+			}
+			if h.Aux != nil {
+				err = h.Aux(key, value)
+				if err != nil {
+					return err
+				}
+			}
+		case opFunction2:
+			code, err := rd.readString()
+			if err != nil {
+				return err
+			}
+			if h.Function != nil {
+				err = h.Function(code)
+				if err != nil {
+					return err
+				}
+			}
+		case opFunctionPreGA:
+			return fmt.Errorf("%w: functions from a Redis 7.0 release candidate", ErrUnsupported)
+		case opModuleAux:
+			return fmt.Errorf("%w: module data", ErrUnsupported)
+		default:
+			name, err := rd.readString()
+			if err != nil {
+				return err
+			}
+			key := Key{DB: db, Name: name, Expires: expires}
+			expires = 0
+
+			err = rd.readValue(op, key, h)
+			if err != nil {
+				return fmt.Errorf("key %q: %w", name, err)
+			}
+		}
+	}
+}
+
+// reader reads an RDB file, keeping a checksum of everything read.
+type reader struct {
+	br  *bufio.Reader
+	crc uint64
+}
+
+func (r *reader) readByte() (byte, error) {
+	b, err := r.br.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	r.crc = updateCRC(r.crc, []byte{b})
+	return b, nil
+}
+
+// readFull reads n bytes. Big reads grow the buffer as the data comes in,
+// so a corrupt length fails on the end of the file instead of allocating.
+func (r *reader) readFull(n uint64) ([]byte, error) {
+	b := make([]byte, 0, min(n, 1<<20))
+	for uint64(len(b)) < n {
+		chunk := min(n-uint64(len(b)), 1<<20)
+		start := len(b)
+		b = append(b, make([]byte, chunk)...)
+		_, err := io.ReadFull(r.br, b[start:])
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+	r.crc = updateCRC(r.crc, b)
+	return b, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// checksum checks the checksum after the end of file opcode, which covers
+// everything read so far. Files from before version 5 have none.
+func (r *reader) checksum(v int) error {
+	if v < 5 {
+		return nil
+	}
+
+	crc := r.crc
+	b, err := r.readFull(8)
+	if err != nil {
+		return err
+	}
+	expected := binary.LittleEndian.Uint64(b)
+	if expected != 0 && expected != crc {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// readLengthOrEncoding reads a length, or the special encoding of a string
+// when encoded is set.
+func (r *reader) readLengthOrEncoding() (n uint64, encoded bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			p, err := r.readFull(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(p)), false, nil
+		case 0x81:
+			p, err := r.readFull(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(p), false, nil
+		}
+		return 0, false, fmt.Errorf("%w: bad length", ErrFormat)
+	default:
+		return uint64(b & 0x3f), true, nil
+	}
+}
+
+func (r *reader) readLength() (uint64, error) {
+	n, encoded, err := r.readLengthOrEncoding()
+	if err == nil && encoded {
+		err = fmt.Errorf("%w: bad length", ErrFormat)
+	}
+	return n, err
+}
+
+func (r *reader) readBytes() ([]byte, error) {
+	n, encoded, err := r.readLengthOrEncoding()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return r.readFull(n)
+	}
+
+	switch n {
+	case encInt8:
+		b, err := r.readFull(1)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int8(b[0])), 10), nil
+	case encInt16:
+		b, err := r.readFull(2)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(b))), 10), nil
+	case encInt32:
+		b, err := r.readFull(4)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(b))), 10), nil
+	case encLZF:
+		compressed, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		size, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.readFull(compressed)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(b, size)
+	}
+	return nil, fmt.Errorf("%w: unknown string encoding %d", ErrFormat, n)
+}
+
+func (r *reader) readString() (string, error) {
+	b, err := r.readBytes()
+	return string(b), err
+}
+
+func (r *reader) readStrings(n uint64) ([]string, error) {
+	strs := make([]string, 0, min(n, maxPrealloc))
+	for range n {
+		s, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+// readScore reads a sorted set score stored as a string, from before
+// version 8.
+func (r *reader) readScore() (float64, error) {
+	n, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+
+	b, err := r.readFull(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	score, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad score", ErrFormat)
+	}
+	return score, nil
+}
+
+func (r *reader) readValue(typ byte, key Key, h Handler) error {
+	switch typ {
+	case typeString:
+		value, err := r.readString()
+		if err != nil || h.String == nil {
+			return err
+		}
+		return h.String(key, value)
+
+	case typeList, typeListZiplist, typeListQuicklist, typeListQuicklist2:
+		elements, err := r.readList(typ)
+		if err != nil || h.List == nil {
+			return err
+		}
+		return h.List(key, elements)
+
+	case typeSet, typeSetIntset, typeSetListpack:
+		var members []string
+		var err error
+		switch typ {
+		case typeSet:
+			var n uint64
+			n, err = r.readLength()
+			if err == nil {
+				members, err = r.readStrings(n)
+			}
+		case typeSetIntset:
+			members, err = r.readEncoded(intsetEntries)
+		default:
+			members, err = r.readEncoded(listpackEntries)
+		}
+		if err != nil || h.Set == nil {
+			return err
+		}
+		return h.Set(key, members)
+
+	case typeZSet, typeZSet2, typeZSetZiplist, typeZSetListpack:
+		members, err := r.readZSet(typ)
+		if err != nil || h.ZSet == nil {
+			return err
+		}
+		return h.ZSet(key, members)
+
+	case typeHash, typeHashZipmap, typeHashZiplist, typeHashListpack:
+		fields, err := r.readHash(typ)
+		if err != nil || h.Hash == nil {
+			return err
+		}
+		return h.Hash(key, fields)
+
+	case typeStreamListpacks, typeStreamListpacks2, typeStreamListpacks3:
+		stream, err := r.readStream(typ)
+		if err != nil || h.Stream == nil {
+			return err
+		}
+		return h.Stream(key, stream)
+
+	case typeModulePreGA, typeModule2:
+		return fmt.Errorf("%w: module type", ErrUnsupported)
+	}
+	return fmt.Errorf("%w: unknown type %d", ErrFormat, typ)
+}
+
+// readEncoded reads a string holding a ziplist, listpack or other encoding
+// and decodes it.
+func (r *reader) readEncoded(decode func([]byte) ([]string, error)) ([]string, error) {
+	b, err := r.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	return decode(b)
+}
+
+// Containers of the nodes of a quicklist from version 10 on.
+const (
+	containerPlain  = 1
+	containerPacked = 2
+)
+
+func (r *reader) readList(typ byte) ([]string, error) {
+	switch typ {
+	case typeListZiplist:
+		return r.readEncoded(ziplistEntries)
+	}
+
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if typ == typeList {
+		return r.readStrings(n)
+	}
+
+	// quicklists are lists of nodes, each a ziplist or, from version 10
+	// on, a listpack or a single big element
+	elements := []string{}
+	for range n {
+		container := uint64(containerPacked)
+		if typ == typeListQuicklist2 {
+			container, err = r.readLength()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		b, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+
+		var node []string
+		switch {
+		case typ == typeListQuicklist:
+			node, err = ziplistEntries(b)
+		case container == containerPlain:
+			node = []string{string(b)}
+		case container == containerPacked:
+			node, err = listpackEntries(b)
+		default:
+			err = fmt.Errorf("%w: unknown quicklist container %d", ErrFormat, container)
+		}
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, node...)
+	}
+	return elements, nil
+}
+
+func (r *reader) readZSet(typ byte) ([]ZMember, error) {
+	if typ == typeZSetZiplist || typ == typeZSetListpack {
+		decode := ziplistEntries
+		if typ == typeZSetListpack {
+			decode = listpackEntries
+		}
+		entries, err := r.readEncoded(decode)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries)%2 != 0 {
+			return nil, fmt.Errorf("%w: odd number of sorted set entries", ErrFormat)
+		}
+
+		members := make([]ZMember, 0, len(entries)/2)
+		for i := 0; i < len(entries); i += 2 {
+			score, err := strconv.ParseFloat(entries[i+1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad score", ErrFormat)
+			}
+			members = append(members, ZMember{Member: entries[i], Score: score})
+		}
+		return members, nil
+	}
+
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	members := make([]ZMember, 0, min(n, maxPrealloc))
+	for range n {
+		member, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		var score float64
+		if typ == typeZSet2 {
+			b, err := r.readFull(8)
+			if err != nil {
+				return nil, err
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		} else {
+			score, err = r.readScore()
+			if err != nil {
+				return nil, err
+			}
+		}
+		members = append(members, ZMember{Member: member, Score: score})
+	}
+	return members, nil
+}
+
+func (r *reader) readHash(typ byte) (map[string]string, error) {
+	var entries []string
+	var err error
+	switch typ {
+	case typeHash:
+		var n uint64
+		n, err = r.readLength()
+		if err == nil && n > math.MaxUint64/2 {
+			err = fmt.Errorf("%w: bad length", ErrFormat)
+		}
+		if err == nil {
+			entries, err = r.readStrings(n * 2)
+		}
+	case typeHashZipmap:
+		entries, err = r.readEncoded(zipmapEntries)
+	case typeHashZiplist:
+		entries, err = r.readEncoded(ziplistEntries)
+	default:
+		entries, err = r.readEncoded(listpackEntries)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(entries)%2 != 0 {
+		return nil, fmt.Errorf("%w: odd number of hash entries", ErrFormat)
+	}
+
+	fields := make(map[string]string, len(entries)/2)
+	for i := 0; i < len(entries); i += 2 {
+		fields[entries[i]] = entries[i+1]
+	}
+	return fields, nil
+}
@@ -0,0 +1,254 @@
+package rdb
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dump is everything read from an RDB file.
+type dump struct {
+	aux       map[string]string
+	strings   map[string]string
+	expires   map[string]int64
+	dbs       map[string]int
+	lists     map[string][]string
+	sets      map[string][]string
+	zsets     map[string][]ZMember
+	hashes    map[string]map[string]string
+	streams   map[string]*Stream
+	functions []string
+}
+
+func read(t *testing.T, data []byte) (*dump, error) {
+	t.Helper()
+
+	d := &dump{
+		aux:     map[string]string{},
+		strings: map[string]string{},
+		expires: map[string]int64{},
+		dbs:     map[string]int{},
+		lists:   map[string][]string{},
+		sets:    map[string][]string{},
+		zsets:   map[string][]ZMember{},
+		hashes:  map[string]map[string]string{},
+		streams: map[string]*Stream{},
+	}
+	key := func(key Key) {
+		if key.Expires != 0 {
+			d.expires[key.Name] = key.Expires
+		}
+		if key.DB != 0 {
+			d.dbs[key.Name] = key.DB
+		}
+	}
+
+	err := Read(bytes.NewReader(data), Handler{
+		Aux: func(k, v string) error {
+			d.aux[k] = v
+			return nil
+		},
+		String: func(k Key, v string) error {
+			key(k)
+			d.strings[k.Name] = v
+			return nil
+		},
+		List: func(k Key, v []string) error {
+			key(k)
+			d.lists[k.Name] = v
+			return nil
+		},
+		Set: func(k Key, v []string) error {
+			key(k)
+			d.sets[k.Name] = v
+			return nil
+		},
+		ZSet: func(k Key, v []ZMember) error {
+			key(k)
+			d.zsets[k.Name] = v
+			return nil
+		},
+		Hash: func(k Key, v map[string]string) error {
+			key(k)
+			d.hashes[k.Name] = v
+			return nil
+		},
+		Stream: func(k Key, v *Stream) error {
+			key(k)
+			d.streams[k.Name] = v
+			return nil
+		},
+		Function: func(code string) error {
+			d.functions = append(d.functions, code)
+			return nil
+		},
+	})
+	return d, err
+}
+
+func readFixture(t *testing.T, name string) *dump {
+	t.Helper()
+
+	data, err := os.ReadFile("testdata/" + name)
+	require.NoError(t, err)
+	d, err := read(t, data)
+	require.NoError(t, err)
+	return d
+}
+
+func TestCRC(t *testing.T) {
+	// The check value of CRC-64/Jones as Redis computes it.
+	assert.Equal(t, uint64(0xe9c6d914c4b8d9ca), updateCRC(0, []byte("123456789")))
+}
+
+func TestReadRedis(t *testing.T) {
+	d := readFixture(t, "empty-7.2.rdb")
+	assert.Equal(t, map[string]string{
+		"redis-ver":  "7.2.0",
+		"redis-bits": "64",
+		"ctime":      "1706821741",
+		"used-mem":   "1098928",
+		"aof-base":   "0",
+	}, d.aux)
+	assert.Empty(t, d.strings)
+}
+
+func TestReadV9(t *testing.T) {
+	d := readFixture(t, "encodings-v9.rdb")
+
+	assert.Equal(t, map[string]string{"redis-ver": "6.2.14", "redis-bits": "64", "ctime": "1700000000"}, d.aux)
+	assert.Equal(t, map[string]string{
+		"string":     "hello",
+		"int8":       "-5",
+		"int16":      "1000",
+		"int32":      "100000",
+		"lzf":        strings.Repeat("abc", 8),
+		"expires-ms": "v",
+		"expires-s":  "v",
+		"idle":       "v",
+		"freq":       "v",
+		"db1":        "x",
+	}, d.strings)
+	assert.Equal(t, map[string]int64{"expires-ms": 4102444800000, "expires-s": 4102444800000}, d.expires)
+	assert.Equal(t, map[string]int{"db1": 1}, d.dbs)
+
+	assert.Equal(t, map[string][]string{
+		"list":         {"a", "b"},
+		"list-ziplist": {"a", strings.Repeat("x", 64), "1000", "100000", "10000000000", "-100000", "-100", "7"},
+		"quicklist":    {"x", "y", "z"},
+	}, d.lists)
+	assert.Equal(t, map[string][]string{
+		"set":    {"a", "b"},
+		"intset": {"-3", "1", "2"},
+	}, d.sets)
+	assert.Equal(t, map[string][]ZMember{
+		"zset":         {{"a", 1.5}, {"b", math.Inf(1)}},
+		"zset2":        {{"a", 2.5}},
+		"zset-ziplist": {{"a", 1}, {"b", 2.5}},
+	}, d.zsets)
+	assert.Equal(t, map[string]map[string]string{
+		"hash":         {"f": "v"},
+		"zipmap":       {"f": "v", "g": "wv"},
+		"hash-ziplist": {"f": "v", "n": "12"},
+	}, d.hashes)
+
+	master := uint64(1700000000000)
+	assert.Equal(t, &Stream{
+		Entries: []StreamEntry{
+			{ID: StreamID{master, 0}, Fields: []string{"name", "alice", "age", "30"}},
+			{ID: StreamID{master + 1, 0}, Fields: []string{"x", "1"}},
+		},
+		Length: 2,
+		LastID: StreamID{master + 2, 0},
+		Groups: []StreamGroup{{
+			Name:        "g",
+			LastID:      StreamID{master + 1, 0},
+			EntriesRead: -1,
+			Pending:     []StreamPending{{ID: StreamID{master, 0}, Consumer: "c", DeliveryTime: int64(master) + 500, DeliveryCount: 1}},
+			Consumers:   []StreamConsumer{{Name: "c", SeenTime: int64(master) + 600, ActiveTime: int64(master) + 600}},
+		}},
+	}, d.streams["stream"])
+}
+
+func TestReadV10(t *testing.T) {
+	d := readFixture(t, "encodings-v10.rdb")
+
+	assert.Equal(t, map[string]map[string]string{"hash-listpack": {"f": "v", "n": "-1000"}}, d.hashes)
+	assert.Equal(t, map[string][]ZMember{"zset-listpack": {{"a", 1}, {"b", -2.5}}}, d.zsets)
+	assert.Equal(t, map[string][]string{"quicklist2": {
+		"a",
+		strings.Repeat("m", 100),
+		strings.Repeat("y", 5000),
+		"-20000",
+		"-1000000",
+		"100000000",
+		"-10000000000",
+		"plain",
+	}}, d.lists)
+	assert.Equal(t, []string{"#!lua name=lib\nredis.register_function('f', function() return 1 end)"}, d.functions)
+
+	master := uint64(1700000000000)
+	assert.Equal(t, &Stream{
+		Entries:      []StreamEntry{{ID: StreamID{master, 5}, Fields: []string{"k", "v"}}},
+		Length:       1,
+		LastID:       StreamID{master, 5},
+		FirstID:      StreamID{master, 5},
+		EntriesAdded: 1,
+		Groups:       []StreamGroup{{Name: "g", LastID: StreamID{master, 5}, EntriesRead: -1}},
+	}, d.streams["stream2"])
+}
+
+func TestReadV11(t *testing.T) {
+	d := readFixture(t, "encodings-v11.rdb")
+
+	assert.Equal(t, map[string][]string{"set-listpack": {"a", "1"}}, d.sets)
+
+	master := uint64(1700000000000)
+	assert.Equal(t, &Stream{
+		Entries:      []StreamEntry{{ID: StreamID{master, 1}, Fields: []string{"a", "1", "b", "2"}}},
+		Length:       1,
+		LastID:       StreamID{master, 1},
+		FirstID:      StreamID{master, 1},
+		EntriesAdded: 1,
+		Groups: []StreamGroup{{
+			Name:        "g",
+			LastID:      StreamID{master, 1},
+			EntriesRead: 1,
+			Pending:     []StreamPending{{ID: StreamID{master, 1}, Consumer: "c", DeliveryTime: int64(master) + 100, DeliveryCount: 2}},
+			Consumers:   []StreamConsumer{{Name: "c", SeenTime: int64(master) + 200, ActiveTime: int64(master) + 150}},
+		}},
+	}, d.streams["stream3"])
+}
+
+func TestReadCorrupt(t *testing.T) {
+	data, err := os.ReadFile("testdata/encodings-v9.rdb")
+	require.NoError(t, err)
+
+	// A flipped bit in a value is only caught by the checksum.
+	flipped := bytes.Clone(data)
+	i := bytes.Index(flipped, []byte("hello"))
+	flipped[i] ^= 1
+	_, err = read(t, flipped)
+	assert.ErrorIs(t, err, ErrChecksum)
+
+	// A zero checksum means there is none.
+	unchecked := bytes.Clone(flipped)
+	copy(unchecked[len(unchecked)-8:], make([]byte, 8))
+	_, err = read(t, unchecked)
+	assert.NoError(t, err)
+
+	for n := range len(data) - 1 {
+		_, err = read(t, data[:n])
+		assert.Error(t, err, "truncated to %d bytes", n)
+	}
+
+	_, err = read(t, []byte("REDIS0012\xff"))
+	assert.ErrorIs(t, err, ErrUnsupported)
+	_, err = read(t, []byte("GODBSNAP\x01\xff"))
+	assert.ErrorIs(t, err, ErrFormat)
+}
@@ -0,0 +1,350 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// StreamID is the ID of a stream entry.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// StreamEntry is an entry of a stream, with its fields and values in the
+// order they were added.
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string
+}
+
+// Stream is a stream with its consumer groups. The fields only found in
+// later versions are left zero in streams from earlier ones.
+type Stream struct {
+	Entries []StreamEntry
+	// Length is the number of entries, which doesn't count deleted ones.
+	Length uint64
+	LastID StreamID
+	// Added from version 10 on.
+	FirstID      StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+	Groups       []StreamGroup
+}
+
+// StreamGroup is a consumer group.
+type StreamGroup struct {
+	Name   string
+	LastID StreamID
+	// EntriesRead is -1 when unknown, and in streams from before version
+	// 10.
+	EntriesRead int64
+	// Pending holds the entries delivered but not acknowledged yet.
+	Pending   []StreamPending
+	Consumers []StreamConsumer
+}
+
+// StreamPending is an entry delivered to a consumer that hasn't
+// acknowledged it yet.
+type StreamPending struct {
+	ID            StreamID
+	Consumer      string
+	DeliveryTime  int64
+	DeliveryCount uint64
+}
+
+// StreamConsumer is a consumer in a consumer group.
+type StreamConsumer struct {
+	Name string
+	// SeenTime is when the consumer was last seen, and ActiveTime when it
+	// last read or claimed entries, in unix milliseconds. ActiveTime is
+	// only stored from version 11 on, and is SeenTime before.
+	SeenTime   int64
+	ActiveTime int64
+}
+
+// Stream item flags.
+const (
+	streamDeleted    = 1
+	streamSameFields = 2
+)
+
+// readStream reads a stream, stored as a tree of listpacks keyed by the
+// ID their entries are relative to, followed by its metadata and consumer
+// groups.
+func (r *reader) readStream(typ byte) (*Stream, error) {
+	s := &Stream{}
+
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for range n {
+		nodeKey, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		if len(nodeKey) != 16 {
+			return nil, fmt.Errorf("%w: bad stream node key", ErrFormat)
+		}
+		master := streamID(nodeKey)
+
+		lp, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		entries, err := listpackEntries(lp)
+		if err != nil {
+			return nil, err
+		}
+		s.Entries, err = appendStreamEntries(s.Entries, master, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.Length, err = r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	s.LastID, err = r.readStreamID()
+	if err != nil {
+		return nil, err
+	}
+	if typ >= typeStreamListpacks2 {
+		s.FirstID, err = r.readStreamID()
+		if err != nil {
+			return nil, err
+		}
+		s.MaxDeletedID, err = r.readStreamID()
+		if err != nil {
+			return nil, err
+		}
+		s.EntriesAdded, err = r.readLength()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n, err = r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for range n {
+		group, err := r.readStreamGroup(typ)
+		if err != nil {
+			return nil, err
+		}
+		s.Groups = append(s.Groups, group)
+	}
+
+	return s, nil
+}
+
+func streamID(b []byte) StreamID {
+	return StreamID{Ms: binary.BigEndian.Uint64(b), Seq: binary.BigEndian.Uint64(b[8:])}
+}
+
+func (r *reader) readStreamID() (StreamID, error) {
+	ms, err := r.readLength()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, err := r.readLength()
+	return StreamID{Ms: ms, Seq: seq}, err
+}
+
+func (r *reader) readRawStreamID() (StreamID, error) {
+	b, err := r.readFull(16)
+	if err != nil {
+		return StreamID{}, err
+	}
+	return streamID(b), nil
+}
+
+func (r *reader) readMillis() (int64, error) {
+	b, err := r.readFull(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b)), nil
+}
+
+func (r *reader) readStreamGroup(typ byte) (StreamGroup, error) {
+	g := StreamGroup{EntriesRead: -1}
+
+	var err error
+	g.Name, err = r.readString()
+	if err != nil {
+		return g, err
+	}
+	g.LastID, err = r.readStreamID()
+	if err != nil {
+		return g, err
+	}
+	if typ >= typeStreamListpacks2 {
+		read, err := r.readLength()
+		if err != nil {
+			return g, err
+		}
+		// -1 is stored as a 64 bit length.
+		g.EntriesRead = int64(read)
+	}
+
+	n, err := r.readLength()
+	if err != nil {
+		return g, err
+	}
+	pending := map[StreamID]int{}
+	for range n {
+		p := StreamPending{}
+		p.ID, err = r.readRawStreamID()
+		if err != nil {
+			return g, err
+		}
+		p.DeliveryTime, err = r.readMillis()
+		if err != nil {
+			return g, err
+		}
+		p.DeliveryCount, err = r.readLength()
+		if err != nil {
+			return g, err
+		}
+		pending[p.ID] = len(g.Pending)
+		g.Pending = append(g.Pending, p)
+	}
+
+	n, err = r.readLength()
+	if err != nil {
+		return g, err
+	}
+	for range n {
+		c := StreamConsumer{}
+		c.Name, err = r.readString()
+		if err != nil {
+			return g, err
+		}
+		c.SeenTime, err = r.readMillis()
+		if err != nil {
+			return g, err
+		}
+		c.ActiveTime = c.SeenTime
+		if typ >= typeStreamListpacks3 {
+			c.ActiveTime, err = r.readMillis()
+			if err != nil {
+				return g, err
+			}
+		}
+
+		// A consumer's pending entries are the group's, by ID.
+		owned, err := r.readLength()
+		if err != nil {
+			return g, err
+		}
+		for range owned {
+			id, err := r.readRawStreamID()
+			if err != nil {
+				return g, err
+			}
+			i, ok := pending[id]
+			if !ok {
+				return g, fmt.Errorf("%w: consumer %q has entry %s the group hasn't delivered", ErrFormat, c.Name, id)
+			}
+			g.Pending[i].Consumer = c.Name
+		}
+		g.Consumers = append(g.Consumers, c)
+	}
+
+	return g, nil
+}
+
+// appendStreamEntries decodes the entries of a stream listpack, which
+// starts with a master entry
+//
+//	count deleted field-count field* 0
+//
+// followed by the entries, with IDs relative to master:
+//
+//	flags ms-diff seq-diff (value* | field-count (field value)*) lp-count
+//
+// where entries flagged streamSameFields have the master entry's fields.
+// Deleted entries are skipped.
+func appendStreamEntries(entries []StreamEntry, master StreamID, lp []string) ([]StreamEntry, error) {
+	p := &streamParser{entries: lp}
+
+	p.int()
+	p.int()
+	n := p.int()
+	if n < 0 || n > int64(len(lp)) {
+		return nil, fmt.Errorf("%w: bad stream master entry", ErrFormat)
+	}
+	fields := p.take(int(n))
+	if p.int() != 0 {
+		return nil, fmt.Errorf("%w: bad stream master entry", ErrFormat)
+	}
+
+	for p.err == nil && len(p.entries) > 0 {
+		flags := p.int()
+		ms := p.int()
+		seq := p.int()
+		e := StreamEntry{ID: StreamID{Ms: master.Ms + uint64(ms), Seq: master.Seq + uint64(seq)}}
+
+		if flags&streamSameFields != 0 {
+			values := p.take(len(fields))
+			if values != nil {
+				for i, field := range fields {
+					e.Fields = append(e.Fields, field, values[i])
+				}
+			}
+		} else {
+			n := p.int()
+			if n < 0 || n > int64(len(p.entries)) {
+				return nil, fmt.Errorf("%w: bad stream entry", ErrFormat)
+			}
+			e.Fields = p.take(int(n) * 2)
+		}
+		p.int()
+
+		if p.err == nil && flags&streamDeleted == 0 {
+			entries = append(entries, e)
+		}
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return entries, nil
+}
+
+// streamParser reads through the entries of a stream listpack. The first
+// error sticks.
+type streamParser struct {
+	entries []string
+	err     error
+}
+
+func (p *streamParser) take(n int) []string {
+	if p.err != nil || n > len(p.entries) {
+		p.err = fmt.Errorf("%w: stream listpack runs past its end", ErrFormat)
+		return nil
+	}
+	taken := p.entries[:n]
+	p.entries = p.entries[n:]
+	return taken
+}
+
+func (p *streamParser) int() int64 {
+	s := p.take(1)
+	if s == nil {
+		return 0
+	}
+	v, err := strconv.ParseInt(s[0], 10, 64)
+	if err != nil {
+		p.err = fmt.Errorf("%w: expected an integer in a stream listpack", ErrFormat)
+	}
+	return v
+}
@@ -0,0 +1,365 @@
+//go:build ignore
+
+// generate writes the encodings-v*.rdb fixtures. They're put together by
+// hand from the RDB format, byte by byte, without using package rdb, so the
+// reader is tested against files it didn't write. empty-7.2.rdb was saved
+// by Redis 7.2.0 and isn't generated.
+//
+//	go run testdata/generate.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"math"
+	"os"
+	"strings"
+)
+
+func main() {
+	write("testdata/encodings-v9.rdb", v9())
+	write("testdata/encodings-v10.rdb", v10())
+	write("testdata/encodings-v11.rdb", v11())
+}
+
+var crcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func write(path string, body []byte) {
+	crc := ^crc64.Update(^uint64(0), crcTable, body)
+	body = binary.LittleEndian.AppendUint64(body, crc)
+	err := os.WriteFile(path, body, 0666)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func length(n int) []byte {
+	switch {
+	case n < 64:
+		return []byte{byte(n)}
+	case n < 16384:
+		return []byte{0x40 | byte(n>>8), byte(n)}
+	}
+	return binary.BigEndian.AppendUint32([]byte{0x80}, uint32(n))
+}
+
+func str(s string) []byte {
+	return append(length(len(s)), s...)
+}
+
+func blob(b []byte) []byte {
+	return append(length(len(b)), b...)
+}
+
+func cat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func le16(v int) []byte    { return binary.LittleEndian.AppendUint16(nil, uint16(v)) }
+func le32(v int) []byte    { return binary.LittleEndian.AppendUint32(nil, uint32(v)) }
+func le64(v int64) []byte  { return binary.LittleEndian.AppendUint64(nil, uint64(v)) }
+func be64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// ziplist builds a ziplist from encoded entries, each the encoding byte
+// and data, adding the prevlen bytes.
+func ziplist(entries ...[]byte) []byte {
+	var body []byte
+	prev, tail := 0, 0
+	for _, e := range entries {
+		var entry []byte
+		if prev < 254 {
+			entry = []byte{byte(prev)}
+		} else {
+			entry = append([]byte{254}, le32(prev)...)
+		}
+		entry = append(entry, e...)
+		tail = len(body)
+		body = append(body, entry...)
+		prev = len(entry)
+	}
+	total := 10 + len(body) + 1
+	return cat(le32(total), le32(10+tail), le16(len(entries)), body, []byte{0xff})
+}
+
+func zlStr(s string) []byte {
+	switch {
+	case len(s) < 64:
+		return append([]byte{byte(len(s))}, s...)
+	case len(s) < 16384:
+		return append([]byte{0x40 | byte(len(s)>>8), byte(len(s))}, s...)
+	}
+	return append(binary.BigEndian.AppendUint32([]byte{0x80}, uint32(len(s))), s...)
+}
+
+// listpack builds a listpack from encoded entries, adding the backlen
+// bytes.
+func listpack(entries ...[]byte) []byte {
+	var body []byte
+	for _, e := range entries {
+		body = append(body, e...)
+		body = append(body, backlen(len(e))...)
+	}
+	total := 6 + len(body) + 1
+	return cat(le32(total), le16(len(entries)), body, []byte{0xff})
+}
+
+func backlen(n int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(n & 0x7f)}, b...)
+		n >>= 7
+		if n == 0 {
+			break
+		}
+	}
+	// all but the last byte, read first when walking backwards, have the
+	// top bit set
+	for i := 1; i < len(b); i++ {
+		b[i] |= 0x80
+	}
+	return b
+}
+
+func lpStr(s string) []byte {
+	switch {
+	case len(s) < 64:
+		return append([]byte{0x80 | byte(len(s))}, s...)
+	case len(s) < 4096:
+		return append([]byte{0xe0 | byte(len(s)>>8), byte(len(s))}, s...)
+	}
+	return append(append([]byte{0xf0}, le32(len(s))...), s...)
+}
+
+func lpInt(v int64) []byte {
+	switch {
+	case v >= 0 && v < 128:
+		return []byte{byte(v)}
+	case v >= -4096 && v < 4096:
+		u := uint16(v) & 0x1fff
+		return []byte{0xc0 | byte(u>>8), byte(u)}
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return append([]byte{0xf1}, le16(int(v))...)
+	case v >= -1<<23 && v < 1<<23:
+		return append([]byte{0xf2}, le32(int(v))[:3]...)
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return append([]byte{0xf3}, le32(int(v))...)
+	}
+	return append([]byte{0xf4}, le64(v)...)
+}
+
+func aux(key string, value []byte) []byte {
+	return cat([]byte{0xfa}, str(key), value)
+}
+
+// streamEntry is an entry of a stream node: flags, ms and seq diffs, and
+// either the values of the master fields or field value pairs.
+type streamEntry struct {
+	flags   int64
+	ms, seq int64
+	values  []string
+	fields  []string
+}
+
+// streamNode builds the listpack of a stream node with the given fields
+// in its master entry.
+func streamNode(count, deleted int64, fields []string, entries []streamEntry) []byte {
+	lp := [][]byte{lpInt(count), lpInt(deleted), lpInt(int64(len(fields)))}
+	for _, f := range fields {
+		lp = append(lp, lpStr(f))
+	}
+	lp = append(lp, lpInt(0))
+
+	for _, e := range entries {
+		lp = append(lp, lpInt(e.flags), lpInt(e.ms), lpInt(e.seq))
+		if e.flags&2 != 0 {
+			for _, v := range e.values {
+				lp = append(lp, lpStr(v))
+			}
+			lp = append(lp, lpInt(int64(len(e.values)+3)))
+		} else {
+			lp = append(lp, lpInt(int64(len(e.fields)/2)))
+			for _, f := range e.fields {
+				lp = append(lp, lpStr(f))
+			}
+			lp = append(lp, lpInt(int64(len(e.fields)/2*2+4)))
+		}
+	}
+	return listpack(lp...)
+}
+
+const master = 1700000000000
+
+func v9() []byte {
+	lzf := cat(
+		[]byte{2}, []byte("abc"), // literal run of 3
+		[]byte{0xe0, 12, 2}, // back reference of 7+12+2 bytes, 3 back
+	)
+
+	stream := cat(
+		length(1),
+		blob(cat(be64(master), be64(0))),
+		blob(streamNode(2, 1, []string{"name", "age"}, []streamEntry{
+			{flags: 2, ms: 0, seq: 0, values: []string{"alice", "30"}},
+			{flags: 0, ms: 1, seq: 0, fields: []string{"x", "1"}},
+			{flags: 3, ms: 2, seq: 0, values: []string{"bob", "40"}},
+		})),
+		length(2),       // length
+		id(master+2, 0), // last ID
+		length(1),       // groups
+		str("g"), id(master+1, 0),
+		length(1), // PEL
+		be64(master), be64(0), le64(master+500), length(1),
+		length(1), // consumers
+		str("c"), le64(master+600),
+		length(1), be64(master), be64(0),
+	)
+
+	return cat(
+		[]byte("REDIS0009"),
+		aux("redis-ver", str("6.2.14")),
+		aux("redis-bits", []byte{0xc0, 64}),
+		aux("ctime", cat([]byte{0xc2}, le32(1700000000))),
+		[]byte{0xfe}, length(0),
+		[]byte{0xfb}, length(20), length(2),
+
+		[]byte{0}, str("string"), str("hello"),
+		[]byte{0}, str("int8"), []byte{0xc0, 0xfb},
+		[]byte{0}, str("int16"), cat([]byte{0xc1}, le16(1000)),
+		[]byte{0}, str("int32"), cat([]byte{0xc2}, le32(100000)),
+		[]byte{0}, str("lzf"), []byte{0xc3}, length(len(lzf)), length(24), lzf,
+
+		[]byte{0xfc}, le64(4102444800000),
+		[]byte{0}, str("expires-ms"), str("v"),
+		[]byte{0xfd}, le32(4102444800),
+		[]byte{0}, str("expires-s"), str("v"),
+		[]byte{0xf8}, length(10),
+		[]byte{0}, str("idle"), str("v"),
+		[]byte{0xf9}, []byte{5},
+		[]byte{0}, str("freq"), str("v"),
+
+		[]byte{1}, str("list"), length(2), str("a"), str("b"),
+		[]byte{10}, str("list-ziplist"), blob(ziplist(
+			zlStr("a"),
+			zlStr(strings.Repeat("x", 64)),
+			cat([]byte{0xc0}, le16(1000)),
+			cat([]byte{0xd0}, le32(100000)),
+			cat([]byte{0xe0}, le64(10000000000)),
+			cat([]byte{0xf0}, le32(-100000)[:3]),
+			[]byte{0xfe, 0x9c}, // -100
+			[]byte{0xf8},       // 7
+		)),
+		[]byte{14}, str("quicklist"), length(2),
+		blob(ziplist(zlStr("x"), zlStr("y"))),
+		blob(ziplist(zlStr("z"))),
+
+		[]byte{2}, str("set"), length(2), str("a"), str("b"),
+		[]byte{11}, str("intset"), blob(cat(le32(2), le32(3), le16(-3), le16(1), le16(2))),
+
+		[]byte{3}, str("zset"), length(2),
+		str("a"), []byte{3}, []byte("1.5"),
+		str("b"), []byte{254},
+		[]byte{5}, str("zset2"), length(1),
+		str("a"), le64(int64(math.Float64bits(2.5))),
+		[]byte{12}, str("zset-ziplist"), blob(ziplist(zlStr("a"), []byte{0xf2}, zlStr("b"), zlStr("2.5"))),
+
+		[]byte{4}, str("hash"), length(1), str("f"), str("v"),
+		[]byte{9}, str("zipmap"), blob(cat(
+			[]byte{2},
+			[]byte{1}, []byte("f"), []byte{1}, []byte{0}, []byte("v"),
+			[]byte{1}, []byte("g"), []byte{2}, []byte{1}, []byte("wv"), []byte{0},
+			[]byte{0xff},
+		)),
+		[]byte{13}, str("hash-ziplist"), blob(ziplist(zlStr("f"), zlStr("v"), zlStr("n"), []byte{0xfd})),
+
+		[]byte{15}, str("stream"), stream,
+
+		[]byte{0xfe}, length(1),
+		[]byte{0}, str("db1"), str("x"),
+		[]byte{0xff},
+	)
+}
+
+// id writes a stream ID as two lengths, the first too big for anything but
+// a 64 bit one.
+func id(ms uint64, seq int) []byte {
+	return cat([]byte{0x81}, be64(ms), length(seq))
+}
+
+func v10() []byte {
+	big := strings.Repeat("y", 5000)
+	medium := strings.Repeat("m", 100)
+
+	return cat(
+		[]byte("REDIS0010"),
+		aux("redis-ver", str("7.0.15")),
+		[]byte{0xfe}, length(0),
+
+		[]byte{16}, str("hash-listpack"), blob(listpack(lpStr("f"), lpStr("v"), lpStr("n"), lpInt(-1000))),
+		[]byte{17}, str("zset-listpack"), blob(listpack(lpStr("a"), lpInt(1), lpStr("b"), lpStr("-2.5"))),
+		[]byte{18}, str("quicklist2"), length(2),
+		length(2), blob(listpack(
+			lpStr("a"),
+			lpStr(medium),
+			lpStr(big),
+			lpInt(-20000),
+			lpInt(-1000000),
+			lpInt(100000000),
+			lpInt(-10000000000),
+		)),
+		length(1), str("plain"),
+
+		[]byte{19}, str("stream2"),
+		length(1),
+		blob(cat(be64(master), be64(5))),
+		blob(streamNode(1, 0, []string{"k"}, []streamEntry{
+			{flags: 2, ms: 0, seq: 0, values: []string{"v"}},
+		})),
+		length(1),
+		id(master, 5),        // last ID
+		id(master, 5),        // first ID
+		length(0), length(0), // max deleted ID
+		length(1), // entries added
+		length(1),
+		str("g"), id(master, 5),
+		cat([]byte{0x81}, be64(math.MaxUint64)), // entries read, -1
+		length(0),
+		length(0),
+
+		[]byte{0xf5}, str("#!lua name=lib\nredis.register_function('f', function() return 1 end)"),
+		[]byte{0xff},
+	)
+}
+
+func v11() []byte {
+	return cat(
+		[]byte("REDIS0011"),
+		aux("redis-ver", str("7.2.4")),
+		[]byte{0xfe}, length(0),
+
+		[]byte{20}, str("set-listpack"), blob(listpack(lpStr("a"), lpInt(1))),
+
+		[]byte{21}, str("stream3"),
+		length(1),
+		blob(cat(be64(master), be64(0))),
+		blob(streamNode(1, 0, []string{"k"}, []streamEntry{
+			{flags: 0, ms: 0, seq: 1, fields: []string{"a", "1", "b", "2"}},
+		})),
+		length(1),
+		id(master, 1),
+		id(master, 1),
+		length(0), length(0),
+		length(1),
+		length(1),
+		str("g"), id(master, 1),
+		length(1), // entries read
+		length(1),
+		be64(master), be64(1), le64(master+100), length(2),
+		length(1),
+		str("c"), le64(master+200), le64(master+150),
+		length(1), be64(master), be64(1),
+		[]byte{0xff},
+	)
+}
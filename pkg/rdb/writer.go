@@ -0,0 +1,127 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Writer writes an RDB file. It writes version 9, as nothing it writes
+// needs a later one, so every Redis since 5.0 can load it. Keys are all
+// written to database 0.
+type Writer struct {
+	w        *bufio.Writer
+	crc      uint64
+	selected bool
+	err      error
+}
+
+// NewWriter writes the RDB header to w and returns a Writer for the rest.
+// Close must be called to finish the file.
+func NewWriter(w io.Writer) *Writer {
+	rw := &Writer{w: bufio.NewWriter(w)}
+	rw.write(fmt.Appendf(nil, "%s%04d", magic, version))
+	return rw
+}
+
+// Aux writes an aux field, metadata about the file.
+func (w *Writer) Aux(key, value string) error {
+	b := []byte{opAux}
+	b = appendString(b, key)
+	b = appendString(b, value)
+	w.write(b)
+	return w.err
+}
+
+// String writes a string key, with its expire time in unix milliseconds
+// or 0 if it has none.
+func (w *Writer) String(key, value string, expires int64) error {
+	b := w.appendKey(nil, typeString, key, expires)
+	b = appendString(b, value)
+	w.write(b)
+	return w.err
+}
+
+// Hash writes a hash key with all of its n fields, which each calls
+// yield with.
+func (w *Writer) Hash(key string, n int, each func(yield func(field, value string) bool)) error {
+	b := w.appendKey(nil, typeHash, key, 0)
+	b = appendLength(b, uint64(n))
+	written := 0
+	each(func(field, value string) bool {
+		b = appendString(b, field)
+		b = appendString(b, value)
+		written++
+		// Big hashes are written out as they go.
+		if len(b) >= 1<<16 {
+			w.write(b)
+			b = b[:0]
+		}
+		return w.err == nil
+	})
+	w.write(b)
+	if written != n && w.err == nil {
+		w.err = fmt.Errorf("hash %q has %d fields, not %d", key, written, n)
+	}
+	return w.err
+}
+
+// Close writes the end of file opcode and the checksum. It doesn't close
+// the underlying writer.
+func (w *Writer) Close() error {
+	w.write([]byte{opEOF})
+	if w.err != nil {
+		return w.err
+	}
+	_, err := w.w.Write(binary.LittleEndian.AppendUint64(nil, w.crc))
+	if err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+func (w *Writer) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc = updateCRC(w.crc, p)
+	_, w.err = w.w.Write(p)
+}
+
+// appendKey appends the opcodes for the key's metadata, its type and its
+// name.
+func (w *Writer) appendKey(b []byte, typ byte, key string, expires int64) []byte {
+	if !w.selected {
+		b = append(b, opSelectDB)
+		b = appendLength(b, 0)
+		w.selected = true
+	}
+	if expires != 0 {
+		b = append(b, opExpireTimeMs)
+		b = binary.LittleEndian.AppendUint64(b, uint64(expires))
+	}
+	b = append(b, typ)
+	return appendString(b, key)
+}
+
+// appendLength appends n in 1, 2, 5 or 9 bytes.
+func appendLength(b []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(b, byte(n))
+	case n < 1<<14:
+		return append(b, 0x40|byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		b = append(b, 0x80)
+		return binary.BigEndian.AppendUint32(b, uint32(n))
+	}
+	b = append(b, 0x81)
+	return binary.BigEndian.AppendUint64(b, n)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendLength(b, uint64(len(s)))
+	return append(b, s...)
+}
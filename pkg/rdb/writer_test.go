@@ -0,0 +1,107 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maniktherana/godbase/pkg/snapshot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.Aux("redis-ver", "7.2.0"))
+	require.NoError(t, w.String("key", "value", 0))
+	require.NoError(t, w.String("ttl", "v", 4102444800000))
+	require.NoError(t, w.Hash("hash", 1, each(map[string]string{"f": "v"})))
+	require.NoError(t, w.Close())
+
+	body := "REDIS0009" +
+		"\xfa\x09redis-ver\x057.2.0" +
+		"\xfe\x00" +
+		"\x00\x03key\x05value" +
+		"\xfc\x00\xd8\xc3\x2c\xbb\x03\x00\x00\x00\x03ttl\x01v" +
+		"\x04\x04hash\x01\x01f\x01v" +
+		"\xff"
+	assert.Equal(t, body, buf.String()[:buf.Len()-8])
+	assert.Equal(t, updateCRC(0, []byte(body)), binary.LittleEndian.Uint64(buf.Bytes()[buf.Len()-8:]))
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	big := map[string]string{}
+	for i := range 10000 {
+		big[strings.Repeat("f", i%100)+string(rune('a'+i%26))+strings.Repeat("x", i/26)] = strings.Repeat("v", i)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.String(strings.Repeat("k", 70000), "long key", 0))
+	require.NoError(t, w.Hash("big", len(big), each(big)))
+	require.NoError(t, w.Close())
+
+	d, err := read(t, buf.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{strings.Repeat("k", 70000): "long key"}, d.strings)
+	assert.Equal(t, big, d.hashes["big"])
+}
+
+func decode(t *testing.T, data []byte) (map[string]string, map[string]map[string]string, error) {
+	t.Helper()
+
+	strs := map[string]string{}
+	hashes := map[string]map[string]string{}
+	err := Decode(bytes.NewReader(data), snapshot.Handler{
+		String: func(key, value string, expires int64) error {
+			strs[key] = value
+			return nil
+		},
+		Hash: func(key string, fields map[string]string) error {
+			hashes[key] = fields
+			return nil
+		},
+	})
+	return strs, hashes, err
+}
+
+func TestDecode(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.String("a", "1", 0))
+	require.NoError(t, w.String("expired", "1", time.Now().Add(-time.Second).UnixMilli()))
+	require.NoError(t, w.Hash("h", 1, each(map[string]string{"f": "v"})))
+	require.NoError(t, w.Close())
+
+	strs, hashes, err := decode(t, buf.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1"}, strs)
+	assert.Equal(t, map[string]map[string]string{"h": {"f": "v"}}, hashes)
+
+	data, err := os.ReadFile("testdata/empty-7.2.rdb")
+	require.NoError(t, err)
+	_, _, err = decode(t, data)
+	assert.NoError(t, err)
+
+	// Types godbase doesn't have fail the load instead of being dropped.
+	data, err = os.ReadFile("testdata/encodings-v9.rdb")
+	require.NoError(t, err)
+	_, _, err = decode(t, data)
+	assert.ErrorIs(t, err, ErrUnsupported)
+	assert.ErrorContains(t, err, `list "list"`)
+}
+
+// each ranges over fields the way Hash wants them.
+func each(fields map[string]string) func(yield func(field, value string) bool) {
+	return func(yield func(field, value string) bool) {
+		for field, value := range fields {
+			if !yield(field, value) {
+				return
+			}
+		}
+	}
+}
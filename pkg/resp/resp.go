@@ -2,9 +2,13 @@ package resp
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"slices"
 	"strconv"
+	"unsafe"
 )
 
 const (
@@ -15,39 +19,112 @@ const (
 	ARRAY   = '*'
 )
 
+// maxArrayPrealloc caps how many elements are allocated up front for an
+// array, whatever length the client claims it has.
+const maxArrayPrealloc = 1024
+
+// maxBulkChunk is how much of a bulk string is read at a time, so memory
+// is only allocated for the payload that actually arrives, whatever
+// length the client claims it has.
+const maxBulkChunk = 1 << 20
+
+// ErrProtocol matches every *ProtocolError through errors.Is.
+var ErrProtocol = errors.New("Protocol error")
+
+// ProtocolError is returned for malformed requests and for requests that
+// break one of the Limits. The stream can't be trusted to be in sync
+// afterwards, so the connection should be closed.
+type ProtocolError struct {
+	Msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.Msg
+}
+
+func (e *ProtocolError) Is(target error) bool {
+	return target == ErrProtocol
+}
+
+// maxLineLen caps the length line holding a type and a length can have.
+const maxLineLen = 64 << 10
+
+var errInvalidInteger = errors.New("invalid integer")
+
+// Limits protect the server from requests that would make it allocate
+// without bound. A zero field means no limit.
+type Limits struct {
+	// Largest length a bulk string may declare.
+	MaxBulkLen int
+	// Largest number of elements an array may declare.
+	MaxMultiBulkLen int
+	// Largest amount of memory a single request may take once parsed.
+	QueryBufferLimit int
+}
+
 type Value struct {
-	Typ     string
-	Str     string
-	Num     int
-	Bulk    string
-	Array   []Value
-	Expires int64
+	Typ   string
+	Str   string
+	Num   int
+	Bulk  string
+	Array []Value
+}
+
+// Command returns the request made of args, an array of bulk strings.
+func Command(args ...string) Value {
+	v := Value{Typ: "array", Array: make([]Value, len(args))}
+	for i, arg := range args {
+		v.Array[i] = Value{Typ: "bulk", Bulk: arg}
+	}
+	return v
 }
 
 type Resp struct {
 	reader *bufio.Reader
+	Limits Limits
+	// memory taken by the request being read, checked against
+	// Limits.QueryBufferLimit
+	queryLen int
 }
 
 func NewResp(rd io.Reader) *Resp {
 	return &Resp{reader: bufio.NewReader(rd)}
 }
 
-// read one byte at a time from the buffer until we reach ‘\r’, which
-// indicates the end of the line. Returns the line without CRLF
-// and the number of bytes in the line.
+// Buffered returns the number of bytes that have been read from the
+// underlying reader but not parsed yet. A non-zero value means more
+// pipelined commands are already waiting.
+func (r *Resp) Buffered() int {
+	return r.reader.Buffered()
+}
+
+// reads from the buffer until we reach '\n' and returns the line without
+// CRLF and the number of bytes consumed. The returned slice points into the
+// reader's buffer and is only valid until the next read.
 func (r *Resp) readLine() (line []byte, n int, err error) {
-	for {
-		b, err := r.reader.ReadByte()
-		if err != nil {
-			return nil, 0, err
-		}
-		n += 1
-		line = append(line, b)
-		if len(line) >= 2 && line[len(line)-2] == '\r' {
-			break
+	line, err = r.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// The line doesn't fit in the buffer, so fall back to copying it
+		// out piece by piece.
+		buf := append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull {
+			if len(buf) > maxLineLen {
+				return nil, 0, &ProtocolError{Msg: "too big count string"}
+			}
+			line, err = r.reader.ReadSlice('\n')
+			buf = append(buf, line...)
 		}
+		line = buf
 	}
-	return line[:len(line)-2], n, nil
+	if err != nil {
+		return nil, 0, err
+	}
+
+	n = len(line)
+	if n < 2 || line[n-2] != '\r' {
+		return nil, n, &ProtocolError{Msg: "expected CRLF"}
+	}
+	return line[:n-2], n, nil
 }
 
 // returns the integer from the buffer and the number of bytes in the buffer.
@@ -56,14 +133,61 @@ func (r *Resp) readInteger() (x int, n int, err error) {
 	if err != nil {
 		return 0, 0, err
 	}
-	i64, err := strconv.ParseInt(string(line), 10, 64)
+	x, err = parseInt(line)
 	if err != nil {
 		return 0, n, err
 	}
-	return int(i64), n, nil
+	return x, n, nil
+}
+
+// parseInt parses a base 10 integer without the allocation that
+// strconv.ParseInt(string(b)) would need.
+func parseInt(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, errInvalidInteger
+	}
+
+	neg := b[0] == '-'
+	if neg {
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, errInvalidInteger
+		}
+	}
+
+	var x int
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, errInvalidInteger
+		}
+		if x > (math.MaxInt-int(c-'0'))/10 {
+			return 0, errInvalidInteger
+		}
+		x = x*10 + int(c-'0')
+	}
+
+	if neg {
+		return -x, nil
+	}
+	return x, nil
 }
 
+// Read parses the next value from the stream.
 func (r *Resp) Read() (Value, error) {
+	r.queryLen = 0
+	return r.read()
+}
+
+// grow accounts for n more bytes of the request being read.
+func (r *Resp) grow(n int) error {
+	r.queryLen += n
+	if r.Limits.QueryBufferLimit > 0 && r.queryLen > r.Limits.QueryBufferLimit {
+		return &ProtocolError{Msg: "client query buffer limit exceeded"}
+	}
+	return nil
+}
+
+func (r *Resp) read() (Value, error) {
 	_type, err := r.reader.ReadByte()
 	if err != nil {
 		return Value{}, err
@@ -85,14 +209,45 @@ func (r *Resp) readArray() (Value, error) {
 	v.Typ = "array"
 
 	len, _, err := r.readInteger()
+	if err == errInvalidInteger || (r.Limits.MaxMultiBulkLen > 0 && len > r.Limits.MaxMultiBulkLen) {
+		return v, &ProtocolError{Msg: "invalid multibulk length"}
+	}
 	if err != nil {
 		return v, err
 	}
+	if len <= 0 {
+		return v, nil
+	}
+
+	// Don't trust the client with the initial allocation, the slice still
+	// grows to the real length as elements arrive.
+	v.Array = make([]Value, 0, min(len, maxArrayPrealloc))
 	for range len {
-		val, err := r.Read()
+		// Every element costs a Value on top of its payload, which matters
+		// for requests made of many tiny bulks.
+		err := r.grow(int(unsafe.Sizeof(Value{})))
+		if err != nil {
+			return v, err
+		}
+
+		// Requests are flat arrays of bulk strings, so nothing else is
+		// allowed inside an array. This also rules out unbounded nesting.
+		_type, err := r.reader.ReadByte()
+		if err != nil {
+			return v, err
+		}
+		if _type != BULK {
+			return v, &ProtocolError{Msg: fmt.Sprintf("expected '$', got '%c'", _type)}
+		}
+
+		val, err := r.readBulk()
 		if err != nil {
 			return v, err
 		}
+		// Like Redis, arguments can't be null.
+		if val.Typ == "null" {
+			return v, &ProtocolError{Msg: "invalid bulk length"}
+		}
 
 		v.Array = append(v.Array, val)
 	}
@@ -104,81 +259,99 @@ func (r *Resp) readBulk() (Value, error) {
 	v.Typ = "bulk"
 
 	len, _, err := r.readInteger()
+	if err == errInvalidInteger || (r.Limits.MaxBulkLen > 0 && len > r.Limits.MaxBulkLen) {
+		return v, &ProtocolError{Msg: "invalid bulk length"}
+	}
 	if err != nil {
 		return v, err
 	}
+	if len < 0 {
+		return Value{Typ: "null"}, nil
+	}
 
-	bulk := make([]byte, len)
-	r.reader.Read(bulk)
-	v.Bulk = string(bulk)
+	err = r.grow(len + 2)
+	if err != nil {
+		return v, err
+	}
 
-	// read the CRLF
-	r.readLine()
+	// Read the payload and its trailing CRLF in chunks, so a huge length
+	// only costs memory once the data shows up. A single Read can return
+	// early when the value straddles the end of the buffer, which happens
+	// all the time with pipelined commands.
+	bulk := make([]byte, 0, min(len+2, maxBulkChunk))
+	for read := 0; read < len+2; {
+		chunk := min(len+2-read, maxBulkChunk)
+		bulk = slices.Grow(bulk, chunk)[:read+chunk]
+		_, err = io.ReadFull(r.reader, bulk[read:])
+		if err != nil {
+			return v, err
+		}
+		read += chunk
+	}
+	if bulk[len] != '\r' || bulk[len+1] != '\n' {
+		return v, &ProtocolError{Msg: "expected CRLF"}
+	}
+
+	// bulk is never touched again, so the string can share its memory
+	// instead of copying it.
+	if len > 0 {
+		v.Bulk = unsafe.String(&bulk[0], len)
+	}
 
 	return v, nil
 }
 
 // Marshal Value to bytes
 func (v Value) Marshal() []byte {
+	return v.AppendMarshal(nil)
+}
+
+// AppendMarshal appends the wire form of v to b and returns the extended
+// buffer, so callers can serialize many replies into one reused buffer.
+func (v Value) AppendMarshal(b []byte) []byte {
 	switch v.Typ {
 	case "array":
-		return v.marshalArray()
+		b = AppendArrayHeader(b, len(v.Array))
+		for i := range v.Array {
+			b = v.Array[i].AppendMarshal(b)
+		}
+		return b
 	case "bulk":
-		return v.marshalBulk()
+		return AppendBulk(b, v.Bulk)
 	case "string":
-		return v.marshalString()
+		return appendLine(b, STRING, v.Str)
+	case "integer":
+		b = append(b, INTEGER)
+		b = strconv.AppendInt(b, int64(v.Num), 10)
+		return append(b, '\r', '\n')
 	case "null":
-		return v.marshallNull()
+		return append(b, "$-1\r\n"...)
 	case "error":
-		return v.marshallError()
+		return appendLine(b, ERROR, v.Str)
 	default:
-		return []byte{}
+		return b
 	}
 }
 
-func (v Value) marshalString() []byte {
-	var bytes []byte
-	bytes = append(bytes, STRING)
-	bytes = append(bytes, v.Str...)
-	bytes = append(bytes, '\r', '\n')
-
-	return bytes
+// AppendArrayHeader appends the header of an array with n elements. The
+// elements have to be appended after it.
+func AppendArrayHeader(b []byte, n int) []byte {
+	b = append(b, ARRAY)
+	b = strconv.AppendInt(b, int64(n), 10)
+	return append(b, '\r', '\n')
 }
 
-func (v Value) marshalBulk() []byte {
-	var bytes []byte
-	bytes = append(bytes, BULK)
-	bytes = append(bytes, strconv.Itoa(len(v.Bulk))...)
-	bytes = append(bytes, '\r', '\n')
-	bytes = append(bytes, v.Bulk...)
-	bytes = append(bytes, '\r', '\n')
-
-	return bytes
-}
-
-func (v Value) marshalArray() []byte {
-	len := len(v.Array)
-	var bytes []byte
-	bytes = append(bytes, ARRAY)
-	bytes = append(bytes, strconv.Itoa(len)...)
-	bytes = append(bytes, '\r', '\n')
-
-	for i := 0; i < len; i++ {
-		bytes = append(bytes, v.Array[i].Marshal()...)
-	}
-
-	return bytes
-}
-
-func (v Value) marshallError() []byte {
-	var bytes []byte
-	bytes = append(bytes, ERROR)
-	bytes = append(bytes, v.Str...)
-	bytes = append(bytes, '\r', '\n')
-
-	return bytes
+// AppendBulk appends s as a bulk string.
+func AppendBulk(b []byte, s string) []byte {
+	b = append(b, BULK)
+	b = strconv.AppendInt(b, int64(len(s)), 10)
+	b = append(b, '\r', '\n')
+	b = append(b, s...)
+	return append(b, '\r', '\n')
 }
 
-func (v Value) marshallNull() []byte {
-	return []byte("$-1\r\n")
+func appendLine(b []byte, typ byte, s string) []byte {
+	b = append(b, typ)
+	b = append(b, s...)
+	return append(b, '\r', '\n')
 }
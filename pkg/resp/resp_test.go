@@ -1,8 +1,13 @@
 package resp
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -99,6 +104,8 @@ func TestMarshal(t *testing.T) {
 		{Value{Typ: "array", Array: []Value{{Typ: "string", Str: "foo"}, {Typ: "string", Str: "bar"}}}, []byte("*2\r\n+foo\r\n+bar\r\n")},
 		{Value{Typ: "error", Str: "oops"}, []byte("-oops\r\n")},
 		{Value{Typ: "null"}, []byte("$-1\r\n")},
+		{Value{Typ: "integer", Num: 42}, []byte(":42\r\n")},
+		{Value{Typ: "integer", Num: -1}, []byte(":-1\r\n")},
 	}
 
 	for _, tc := range tt {
@@ -108,12 +115,22 @@ func TestMarshal(t *testing.T) {
 	}
 }
 
+func TestAppendMarshal(t *testing.T) {
+	b := []byte("+OK\r\n")
+	b = Value{Typ: "bulk", Bulk: "world"}.AppendMarshal(b)
+	b = Value{Typ: "array", Array: []Value{{Typ: "bulk", Bulk: "a"}, {Typ: "null"}}}.AppendMarshal(b)
+	assert.Equal(t, "+OK\r\n$5\r\nworld\r\n*2\r\n$1\r\na\r\n$-1\r\n", string(b))
+}
+
 func TestRead(t *testing.T) {
 	tt := []struct {
 		input    string
 		expected Value
 	}{
 		{"$5\r\nworld\r\n", Value{Typ: "bulk", Bulk: "world"}},
+		{"$0\r\n\r\n", Value{Typ: "bulk", Bulk: ""}},
+		{"$-1\r\n", Value{Typ: "null"}},
+		{"$12\r\nhello\r\nworld\r\n", Value{Typ: "bulk", Bulk: "hello\r\nworld"}},
 		{"*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n", Value{Typ: "array", Array: []Value{
 			{Typ: "bulk", Bulk: "foo"},
 			{Typ: "bulk", Bulk: "bar"},
@@ -128,3 +145,159 @@ func TestRead(t *testing.T) {
 		assert.Equal(t, tc.expected, val)
 	}
 }
+
+func TestReadOneByteAtATime(t *testing.T) {
+	value := strings.Repeat("x", 10000)
+	input := fmt.Sprintf("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$%d\r\n%s\r\n", len(value), value)
+
+	respReader := NewResp(iotest.OneByteReader(strings.NewReader(input)))
+	val, err := respReader.Read()
+	require.NoError(t, err)
+	assert.Equal(t, Value{Typ: "array", Array: []Value{
+		{Typ: "bulk", Bulk: "SET"},
+		{Typ: "bulk", Bulk: "key"},
+		{Typ: "bulk", Bulk: value},
+	}}, val)
+}
+
+func TestReadLongLine(t *testing.T) {
+	digits := strings.Repeat("0", 5000) + "7"
+
+	respReader := NewResp(strings.NewReader(digits + "\r\n"))
+	val, _, err := respReader.readInteger()
+	require.NoError(t, err)
+	assert.Equal(t, 7, val)
+}
+
+func TestReadMalformed(t *testing.T) {
+	tt := []struct {
+		name  string
+		input string
+	}{
+		{"MissingCR", "$5\nhello\r\n"},
+		{"BadLength", "$abc\r\nhello\r\n"},
+		{"EmptyLength", "*\r\n"},
+		{"Overflow", "$99999999999999999999999\r\n"},
+		{"MissingCRLFAfterBulk", "$5\r\nhelloXX"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			respReader := NewResp(strings.NewReader(tc.input))
+			_, err := respReader.Read()
+			assert.ErrorIs(t, err, ErrProtocol)
+		})
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+	limits := Limits{MaxBulkLen: 1024, MaxMultiBulkLen: 16, QueryBufferLimit: 4096}
+
+	tt := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"HugeMultiBulk", "*2147483647\r\n", "Protocol error: invalid multibulk length"},
+		{"MultiBulkOverflow", "*99999999999999999999999\r\n", "Protocol error: invalid multibulk length"},
+		{"MultiBulkOverLimit", "*17\r\n", "Protocol error: invalid multibulk length"},
+		{"HugeBulk", "*1\r\n$999999999999\r\n", "Protocol error: invalid bulk length"},
+		{"BulkOverLimit", "$1025\r\n", "Protocol error: invalid bulk length"},
+		{"BulkNotANumber", "*1\r\n$12ab\r\n", "Protocol error: invalid bulk length"},
+		{"NestedArray", "*1\r\n*1\r\n*1\r\n", "Protocol error: expected '$', got '*'"},
+		{"IntegerInArray", "*1\r\n:1\r\n", "Protocol error: expected '$', got ':'"},
+		{"NullInArray", "*2\r\n$3\r\nGET\r\n$-1\r\n", "Protocol error: invalid bulk length"},
+		{"EndlessLine", "*" + strings.Repeat("1", 100000), "Protocol error: too big count string"},
+		{
+			name:     "QueryBufferLimit",
+			input:    "*8\r\n" + strings.Repeat("$1000\r\n"+strings.Repeat("x", 1000)+"\r\n", 8),
+			expected: "Protocol error: client query buffer limit exceeded",
+		},
+		{
+			name:     "ManyEmptyBulks",
+			input:    "*16\r\n" + strings.Repeat("$0\r\n\r\n", 16) + "*16\r\n" + strings.Repeat("$0\r\n\r\n", 16),
+			expected: "",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			respReader := NewResp(strings.NewReader(tc.input))
+			respReader.Limits = limits
+
+			var err error
+			for err == nil {
+				_, err = respReader.Read()
+			}
+
+			if tc.expected == "" {
+				assert.Equal(t, io.EOF, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrProtocol)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+func TestReadBulkInChunks(t *testing.T) {
+	big := strings.Repeat("x", 2*maxBulkChunk+100)
+	respReader := NewResp(strings.NewReader("*1\r\n$" + fmt.Sprint(len(big)) + "\r\n" + big + "\r\n"))
+	val, err := respReader.Read()
+	require.NoError(t, err)
+	require.Len(t, val.Array, 1)
+	assert.Equal(t, big, val.Array[0].Bulk)
+
+	// A length that's never followed by its payload doesn't get allocated.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	respReader = NewResp(strings.NewReader("*1\r\n$536870911\r\nabc"))
+	_, err = respReader.Read()
+	runtime.ReadMemStats(&after)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(4*maxBulkChunk))
+}
+
+func TestReadQueryBufferLimitIsPerRequest(t *testing.T) {
+	request := "*1\r\n$1000\r\n" + strings.Repeat("x", 1000) + "\r\n"
+
+	respReader := NewResp(strings.NewReader(strings.Repeat(request, 10)))
+	respReader.Limits = Limits{QueryBufferLimit: 2000}
+
+	for range 10 {
+		_, err := respReader.Read()
+		require.NoError(t, err)
+	}
+}
+
+func benchmarkRead(b *testing.B, input []byte) {
+	reader := bytes.NewReader(input)
+	respReader := NewResp(reader)
+
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		reader.Reset(input)
+		respReader.reader.Reset(reader)
+
+		_, err := respReader.Read()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadSet(b *testing.B) {
+	benchmarkRead(b, []byte("*3\r\n$3\r\nSET\r\n$8\r\nuser:123\r\n$16\r\nsome-value-12345\r\n"))
+}
+
+func BenchmarkReadGet(b *testing.B) {
+	benchmarkRead(b, []byte("*2\r\n$3\r\nGET\r\n$8\r\nuser:123\r\n"))
+}
+
+func BenchmarkReadSetLarge(b *testing.B) {
+	value := strings.Repeat("x", 1<<20)
+	benchmarkRead(b, []byte(fmt.Sprintf("*3\r\n$3\r\nSET\r\n$5\r\nlarge\r\n$%d\r\n%s\r\n", len(value), value)))
+}
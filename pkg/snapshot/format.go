@@ -0,0 +1,528 @@
+// Package snapshot reads and writes point in time snapshots of the
+// keyspace, and saves them to disk.
+//
+// A snapshot starts with a header and is a list of sections:
+//
+//	"GODBSNAP" uvarint(version)
+//	section*
+//
+// with every section laid out as
+//
+//	type flags uvarint(raw length) uvarint(stored length) payload crc32c
+//
+// The checksum covers everything in the section before it, so corruption
+// is caught a section at a time. Payloads are compressed with DEFLATE when
+// flags has flagCompressed set. Sections are cut at around sectionSize
+// bytes, and the last one has type sectionEnd and no payload.
+//
+// Payloads are entries back to back, with strings written as
+// uvarint(length) bytes:
+//
+//	aux:              key value
+//	strings:          key value varint(expire time in unix ms, 0 for none)
+//	hashes:           key uvarint(field count) (field value)*
+//	deflated strings: key deflated uvarint(size) varint(expire time)
+//
+// Deflated strings are strings kept compressed in memory, stored as they
+// are, with their size once decompressed. They were added in version 2.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"strings"
+)
+
+const (
+	// Magic starts every snapshot, and tells an AOF with a snapshot preamble
+	// apart from one starting with commands.
+	Magic   = "GODBSNAP"
+	version = 2
+)
+
+// Section types.
+const (
+	sectionAux     byte = 1
+	sectionStrings byte = 2
+	sectionHashes  byte = 3
+	sectionDeflate byte = 4
+	sectionEnd     byte = 0xff
+)
+
+const flagCompressed byte = 1
+
+// sectionSize is the payload size sections are cut at. A single entry
+// bigger than this gets a section of its own.
+const sectionSize = 1 << 20
+
+// maxPayload bounds the lengths a reader accepts.
+const maxPayload = 4 << 30
+
+// maxReadChunk is how much of a payload is read at a time, so a corrupt
+// length doesn't get allocated up front, before the checksum is checked.
+const maxReadChunk = 1 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrFormat is returned for files that aren't snapshots, or that are
+	// malformed in a way the checksums can't explain.
+	ErrFormat = errors.New("invalid snapshot")
+	// ErrChecksum is returned when a section doesn't match its checksum.
+	ErrChecksum = errors.New("snapshot checksum mismatch")
+)
+
+// Encoder writes the entries of a snapshot in some file format. Writer
+// writes the native one.
+type Encoder interface {
+	Aux(key, value string) error
+	String(key, value string, expires int64) error
+	// Hash writes a hash of n fields, which each calls yield with in
+	// turn until it returns false.
+	Hash(key string, n int, each func(yield func(field, value string) bool)) error
+	// Close finishes the file, without closing the underlying writer.
+	Close() error
+}
+
+// DeflatedEncoder is implemented by Encoders that can store strings
+// compressed with DEFLATE as they are.
+type DeflatedEncoder interface {
+	// DeflatedString writes a string key whose value is deflated, size
+	// bytes once decompressed.
+	DeflatedString(key, deflated string, size int, expires int64) error
+}
+
+// Writer writes a snapshot. Entries of the same type are grouped into
+// sections, so writing all entries of a type together keeps the file
+// smallest.
+type Writer struct {
+	w        *bufio.Writer
+	compress bool
+	typ      byte
+	payload  []byte
+	// reused for compressed payloads
+	compressed bytes.Buffer
+	flater     *flate.Writer
+	err        error
+}
+
+// NewWriter writes the snapshot header to w and returns a Writer for the
+// rest. Close must be called to finish the snapshot.
+func NewWriter(w io.Writer, compress bool) *Writer {
+	sw := &Writer{w: bufio.NewWriter(w), compress: compress}
+	sw.w.WriteString(Magic)
+	sw.w.Write(binary.AppendUvarint(nil, version))
+	return sw
+}
+
+// Aux writes a key value pair of metadata about the snapshot.
+func (w *Writer) Aux(key, value string) error {
+	payload := w.start(sectionAux)
+	payload = appendString(payload, key)
+	payload = appendString(payload, value)
+	return w.end(payload)
+}
+
+// String writes a string key, with its expire time in unix milliseconds
+// or 0 if it has none.
+func (w *Writer) String(key, value string, expires int64) error {
+	payload := w.start(sectionStrings)
+	payload = appendString(payload, key)
+	payload = appendString(payload, value)
+	payload = binary.AppendVarint(payload, expires)
+	return w.end(payload)
+}
+
+// DeflatedString writes a string key whose value is deflated, size bytes
+// once decompressed.
+func (w *Writer) DeflatedString(key, deflated string, size int, expires int64) error {
+	payload := w.start(sectionDeflate)
+	payload = appendString(payload, key)
+	payload = appendString(payload, deflated)
+	payload = binary.AppendUvarint(payload, uint64(size))
+	payload = binary.AppendVarint(payload, expires)
+	return w.end(payload)
+}
+
+// Hash writes a hash key with all of its n fields, which each calls
+// yield with.
+func (w *Writer) Hash(key string, n int, each func(yield func(field, value string) bool)) error {
+	payload := w.start(sectionHashes)
+	payload = appendString(payload, key)
+	payload = binary.AppendUvarint(payload, uint64(n))
+	written := 0
+	each(func(field, value string) bool {
+		payload = appendString(payload, field)
+		payload = appendString(payload, value)
+		written++
+		return true
+	})
+	if written != n && w.err == nil {
+		w.err = fmt.Errorf("hash %q has %d fields, not %d", key, written, n)
+	}
+	return w.end(payload)
+}
+
+// Close writes out the last section and the end marker. It doesn't close
+// the underlying writer.
+func (w *Writer) Close() error {
+	w.flush()
+	w.writeSection(sectionEnd, nil)
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// start returns the payload to append an entry of type typ to, ending
+// the current section first if it holds another type.
+func (w *Writer) start(typ byte) []byte {
+	if w.typ != typ {
+		w.flush()
+		w.typ = typ
+	}
+	return w.payload
+}
+
+// end takes back the payload an entry was appended to, ending the section
+// once it's big enough.
+func (w *Writer) end(payload []byte) error {
+	w.payload = payload
+	if len(w.payload) >= sectionSize {
+		w.flush()
+	}
+	return w.err
+}
+
+func (w *Writer) flush() {
+	if len(w.payload) == 0 {
+		return
+	}
+	w.writeSection(w.typ, w.payload)
+	w.payload = w.payload[:0]
+}
+
+func (w *Writer) writeSection(typ byte, payload []byte) {
+	if w.err != nil {
+		return
+	}
+
+	flags := byte(0)
+	stored := payload
+	if w.compress && len(payload) > 0 {
+		compressed, err := w.deflate(payload)
+		if err != nil {
+			w.err = err
+			return
+		}
+		// Incompressible data is stored as it is.
+		if len(compressed) < len(payload) {
+			flags |= flagCompressed
+			stored = compressed
+		}
+	}
+
+	header := []byte{typ, flags}
+	header = binary.AppendUvarint(header, uint64(len(payload)))
+	header = binary.AppendUvarint(header, uint64(len(stored)))
+	crc := crc32.Update(crc32.Checksum(header, crcTable), crcTable, stored)
+
+	w.w.Write(header)
+	w.w.Write(stored)
+	_, w.err = w.w.Write(binary.LittleEndian.AppendUint32(nil, crc))
+}
+
+func (w *Writer) deflate(payload []byte) ([]byte, error) {
+	w.compressed.Reset()
+	if w.flater == nil {
+		var err error
+		w.flater, err = flate.NewWriter(&w.compressed, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		w.flater.Reset(&w.compressed)
+	}
+
+	_, err := w.flater.Write(payload)
+	if err == nil {
+		err = w.flater.Close()
+	}
+	return w.compressed.Bytes(), err
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// Handler receives the entries of a snapshot as it's read. Nil functions
+// skip their entries.
+type Handler struct {
+	Aux    func(key, value string) error
+	String func(key, value string, expires int64) error
+	Hash   func(key string, fields map[string]string) error
+	// DeflatedString, when set, gets deflated strings as they are stored.
+	// They're otherwise decompressed and passed to String.
+	DeflatedString func(key, deflated string, size int, expires int64) error
+}
+
+// Read reads a snapshot from r, passing its entries to h. The entries of a
+// section are only passed on once its checksum is verified. When r is a
+// *bufio.Reader, nothing after the snapshot is consumed from it.
+func Read(r io.Reader, h Handler) error {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(Magic))
+	_, err := io.ReadFull(br, header)
+	if err != nil || string(header) != Magic {
+		return fmt.Errorf("%w: bad header", ErrFormat)
+	}
+	v, err := binary.ReadUvarint(br)
+	if err != nil || v < 1 || v > version {
+		return fmt.Errorf("%w: unsupported version %d", ErrFormat, v)
+	}
+
+	for i := 0; ; i++ {
+		typ, payload, err := readSection(br)
+		if err != nil {
+			return fmt.Errorf("section %d: %w", i, err)
+		}
+		if typ == sectionEnd {
+			return nil
+		}
+
+		err = parseSection(typ, payload, h)
+		if err != nil {
+			return fmt.Errorf("section %d: %w", i, err)
+		}
+	}
+}
+
+func readSection(br *bufio.Reader) (byte, []byte, error) {
+	var header []byte
+	readByte := func() (byte, error) {
+		b, err := br.ReadByte()
+		header = append(header, b)
+		return b, err
+	}
+	readUvarint := func() (uint64, error) {
+		n, err := binary.ReadUvarint(byteReaderFunc(readByte))
+		if err == nil && n > maxPayload {
+			err = fmt.Errorf("%w: section too big", ErrFormat)
+		}
+		return n, err
+	}
+
+	typ, err := readByte()
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	flags, err := readByte()
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	rawLen, err := readUvarint()
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	storedLen, err := readUvarint()
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+
+	stored, err := readChunked(br, int(storedLen)+4)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	stored, sum := stored[:storedLen], stored[storedLen:]
+
+	crc := crc32.Update(crc32.Checksum(header, crcTable), crcTable, stored)
+	if crc != binary.LittleEndian.Uint32(sum) {
+		return 0, nil, ErrChecksum
+	}
+
+	if flags&flagCompressed == 0 {
+		if rawLen != storedLen {
+			return 0, nil, fmt.Errorf("%w: length mismatch", ErrFormat)
+		}
+		return typ, stored, nil
+	}
+
+	payload, err := inflateSized(bytes.NewReader(stored), rawLen)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", ErrFormat, err)
+	}
+	return typ, payload, nil
+}
+
+// readChunked reads n bytes from r, maxReadChunk at a time, so that only
+// as much as r actually has gets allocated.
+func readChunked(r io.Reader, n int) ([]byte, error) {
+	var buf []byte
+	for n > 0 {
+		chunk := min(n, maxReadChunk)
+		buf = slices.Grow(buf, chunk)
+		start := len(buf)
+		buf = buf[:start+chunk]
+		_, err := io.ReadFull(r, buf[start:])
+		if err != nil {
+			return nil, err
+		}
+		n -= chunk
+	}
+	return buf, nil
+}
+
+// inflateSized decompresses r, which must be size bytes once decompressed.
+// The result grows as it's decompressed rather than being allocated from
+// size, which comes from the file.
+func inflateSized(r io.Reader, size uint64) ([]byte, error) {
+	var buf bytes.Buffer
+	// One byte past size is read to tell whether there's more.
+	_, err := buf.ReadFrom(io.LimitReader(flate.NewReader(r), int64(size)+1))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case uint64(buf.Len()) < size:
+		return nil, io.ErrUnexpectedEOF
+	case uint64(buf.Len()) > size:
+		return nil, errors.New("longer than its size")
+	}
+	return buf.Bytes(), nil
+}
+
+// inflate decompresses a deflated string, which must be size bytes once
+// decompressed.
+func inflate(deflated string, size uint64) (string, error) {
+	if size > maxPayload {
+		return "", fmt.Errorf("%w: deflated string too big", ErrFormat)
+	}
+	value, err := inflateSized(strings.NewReader(deflated), size)
+	if err != nil {
+		return "", fmt.Errorf("%w: deflated string: %v", ErrFormat, err)
+	}
+	return string(value), nil
+}
+
+type byteReaderFunc func() (byte, error)
+
+func (f byteReaderFunc) ReadByte() (byte, error) {
+	return f()
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func parseSection(typ byte, payload []byte, h Handler) error {
+	p := parser{b: payload}
+	for len(p.b) > 0 && p.err == nil {
+		var err error
+		switch typ {
+		case sectionAux:
+			key, value := p.string(), p.string()
+			if p.err == nil && h.Aux != nil {
+				err = h.Aux(key, value)
+			}
+		case sectionStrings:
+			key, value, expires := p.string(), p.string(), p.varint()
+			if p.err == nil && h.String != nil {
+				err = h.String(key, value, expires)
+			}
+		case sectionDeflate:
+			key, deflated, size, expires := p.string(), p.string(), p.uvarint(), p.varint()
+			if p.err != nil {
+				break
+			}
+			if h.DeflatedString != nil {
+				err = h.DeflatedString(key, deflated, int(size), expires)
+			} else if h.String != nil {
+				var value string
+				value, err = inflate(deflated, size)
+				if err == nil {
+					err = h.String(key, value, expires)
+				}
+			}
+		case sectionHashes:
+			key := p.string()
+			n := p.uvarint()
+			if n > uint64(len(p.b)) {
+				return fmt.Errorf("%w: bad field count", ErrFormat)
+			}
+			fields := make(map[string]string, n)
+			for range n {
+				field, value := p.string(), p.string()
+				fields[field] = value
+			}
+			if p.err == nil && h.Hash != nil {
+				err = h.Hash(key, fields)
+			}
+		default:
+			// Sections added by later versions are skipped.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return p.err
+}
+
+// parser decodes the entries of a payload. The first error sticks and
+// makes every later call return a zero value.
+type parser struct {
+	b   []byte
+	err error
+}
+
+func (p *parser) uvarint() uint64 {
+	if p.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(p.b)
+	if n <= 0 {
+		p.err = fmt.Errorf("%w: bad length", ErrFormat)
+		return 0
+	}
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *parser) varint() int64 {
+	if p.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(p.b)
+	if n <= 0 {
+		p.err = fmt.Errorf("%w: bad number", ErrFormat)
+		return 0
+	}
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *parser) string() string {
+	n := p.uvarint()
+	if p.err != nil {
+		return ""
+	}
+	if n > uint64(len(p.b)) {
+		p.err = fmt.Errorf("%w: string runs past its section", ErrFormat)
+		return ""
+	}
+	s := string(p.b[:n])
+	p.b = p.b[n:]
+	return s
+}
@@ -0,0 +1,255 @@
+package snapshot
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type entries struct {
+	aux     map[string]string
+	strings map[string]string
+	expires map[string]int64
+	hashes  map[string]map[string]string
+}
+
+func read(t *testing.T, data []byte) (*entries, error) {
+	t.Helper()
+
+	e := &entries{
+		aux:     map[string]string{},
+		strings: map[string]string{},
+		expires: map[string]int64{},
+		hashes:  map[string]map[string]string{},
+	}
+	err := Read(bytes.NewReader(data), Handler{
+		Aux: func(key, value string) error {
+			e.aux[key] = value
+			return nil
+		},
+		String: func(key, value string, expires int64) error {
+			e.strings[key] = value
+			e.expires[key] = expires
+			return nil
+		},
+		Hash: func(key string, fields map[string]string) error {
+			e.hashes[key] = fields
+			return nil
+		},
+	})
+	return e, err
+}
+
+func write(t *testing.T, compress bool, fn func(w *Writer)) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, compress)
+	fn(w)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprint("compress=", compress), func(t *testing.T) {
+			data := write(t, compress, func(w *Writer) {
+				require.NoError(t, w.Aux("ctime", "1760796000"))
+				require.NoError(t, w.String("plain", "value", 0))
+				require.NoError(t, w.String("expiring", "", 1760796000123))
+				require.NoError(t, w.Hash("hash", 2, each(map[string]string{"a": "1", "b": ""})))
+				require.NoError(t, w.String("after", "hash", 0))
+			})
+
+			e, err := read(t, data)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"ctime": "1760796000"}, e.aux)
+			assert.Equal(t, map[string]string{"plain": "value", "expiring": "", "after": "hash"}, e.strings)
+			assert.Equal(t, int64(1760796000123), e.expires["expiring"])
+			assert.Equal(t, map[string]map[string]string{"hash": {"a": "1", "b": ""}}, e.hashes)
+		})
+	}
+}
+
+func TestManySections(t *testing.T) {
+	const n = 50000
+	value := strings.Repeat("v", 100)
+
+	for _, compress := range []bool{false, true} {
+		data := write(t, compress, func(w *Writer) {
+			for i := range n {
+				require.NoError(t, w.String(fmt.Sprint("key", i), value, 0))
+			}
+			require.NoError(t, w.String("big", strings.Repeat("x", 3*sectionSize), 0))
+		})
+		if compress {
+			assert.Less(t, len(data), n*len(value)/10)
+		}
+
+		e, err := read(t, data)
+		require.NoError(t, err)
+		assert.Len(t, e.strings, n+1)
+		assert.Len(t, e.strings["big"], 3*sectionSize)
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	data := write(t, false, func(w *Writer) {
+		require.NoError(t, w.String("key", "value", 0))
+	})
+
+	flipped := bytes.Clone(data)
+	i := bytes.Index(flipped, []byte("value"))
+	flipped[i] ^= 1
+	_, err := read(t, flipped)
+	assert.ErrorIs(t, err, ErrChecksum)
+
+	for n := range len(data) {
+		_, err = read(t, data[:n])
+		assert.Error(t, err, "truncated to %d bytes", n)
+	}
+	_, err = read(t, data[:len(data)-1])
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	_, err = read(t, []byte("REDIS0011"))
+	assert.ErrorIs(t, err, ErrFormat)
+}
+
+func TestCorruptLengths(t *testing.T) {
+	header := append([]byte(Magic), version)
+	section := func(flags byte, rawLen, storedLen uint64, stored []byte) []byte {
+		b := []byte{sectionStrings, flags}
+		b = binary.AppendUvarint(b, rawLen)
+		b = binary.AppendUvarint(b, storedLen)
+		crc := crc32.Update(crc32.Checksum(b, crcTable), crcTable, stored)
+		b = append(b, stored...)
+		return binary.LittleEndian.AppendUint32(append(bytes.Clone(header), b...), crc)
+	}
+	huge := uint64(maxPayload)
+
+	tt := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		// The file ends long before the stored length.
+		{name: "Stored", data: section(0, huge, huge, []byte("short")), err: io.ErrUnexpectedEOF},
+		// The checksum is right, but the payload inflates to much less
+		// than the raw length.
+		{name: "Raw", data: section(flagCompressed, huge, uint64(len(deflate(t, "short"))), []byte(deflate(t, "short"))), err: ErrFormat},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err := read(t, tc.data)
+			runtime.ReadMemStats(&after)
+
+			assert.ErrorIs(t, err, tc.err)
+			assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(4*maxReadChunk))
+		})
+	}
+}
+
+func TestSkipsUnknownSections(t *testing.T) {
+	data := write(t, false, func(w *Writer) {
+		require.NoError(t, w.String("key", "value", 0))
+		w.writeSection(0x7f, []byte("from the future"))
+		require.NoError(t, w.Hash("hash", 1, each(map[string]string{"a": "1"})))
+	})
+
+	e, err := read(t, data)
+	require.NoError(t, err)
+	assert.Len(t, e.strings, 1)
+	assert.Len(t, e.hashes, 1)
+}
+
+func TestHashFieldCountMismatch(t *testing.T) {
+	w := NewWriter(io.Discard, false)
+	assert.Error(t, w.Hash("hash", 2, each(map[string]string{"a": "1"})))
+	assert.Error(t, w.Close())
+}
+
+func deflate(t *testing.T, s string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, s)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.String()
+}
+
+func TestDeflatedStrings(t *testing.T) {
+	value := strings.Repeat("compressible ", 100)
+	deflated := deflate(t, value)
+	data := write(t, true, func(w *Writer) {
+		require.NoError(t, w.DeflatedString("key", deflated, len(value), 1760796000123))
+	})
+
+	// Handlers that take deflated strings get them as they are,
+	var got string
+	require.NoError(t, Read(bytes.NewReader(data), Handler{
+		DeflatedString: func(key, d string, size int, expires int64) error {
+			assert.Equal(t, "key", key)
+			assert.Equal(t, len(value), size)
+			assert.Equal(t, int64(1760796000123), expires)
+			got = d
+			return nil
+		},
+	}))
+	assert.Equal(t, deflated, got)
+
+	// and others get them decompressed.
+	e, err := read(t, data)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": value}, e.strings)
+	assert.Equal(t, int64(1760796000123), e.expires["key"])
+
+	// A size that doesn't match is caught.
+	for _, size := range []int{len(value) - 1, len(value) + 1} {
+		data = write(t, false, func(w *Writer) {
+			require.NoError(t, w.DeflatedString("key", deflated, size, 0))
+		})
+		_, err = read(t, data)
+		assert.ErrorIs(t, err, ErrFormat, size)
+	}
+}
+
+func TestReadsVersion1(t *testing.T) {
+	data := write(t, false, func(w *Writer) {
+		require.NoError(t, w.String("key", "value", 0))
+	})
+	data[len(Magic)] = 1
+
+	e, err := read(t, data)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": "value"}, e.strings)
+
+	data[len(Magic)] = 3
+	_, err = read(t, data)
+	assert.ErrorIs(t, err, ErrFormat)
+}
+
+// each ranges over fields the way Hash wants them.
+func each(fields map[string]string) func(yield func(field, value string) bool) {
+	return func(yield func(field, value string) bool) {
+		for field, value := range fields {
+			if !yield(field, value) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package snapshot
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Rule saves a snapshot once Changes writes were made in Seconds seconds,
+// like the save directive in redis.conf.
+type Rule struct {
+	Seconds int
+	Changes int64
+}
+
+// retryDelay is how long a failed background save holds off the next one
+// triggered by a rule.
+const retryDelay = 5 * time.Second
+
+// ErrSaveInProgress is returned when a save is requested while a
+// background save is running.
+var ErrSaveInProgress = errors.New("ERR Background save already in progress")
+
+// Snapshots saves snapshots of the dataset to Path, on request or when a
+// save rule matches.
+type Snapshots struct {
+	Path     string
+	Compress bool
+	Rules    []Rule
+	// Dump writes the dataset to w. It's called from the goroutine doing a
+	// background save, and should only hold up writers for as long as it
+	// takes to get a consistent view of the dataset.
+	Dump func(w Encoder) error
+	// Encode, when set, saves snapshots in another file format than the
+	// native one. Decode, when set, loads files that aren't in the native
+	// format.
+	Encode func(w io.Writer) Encoder
+	Decode func(r io.Reader, h Handler) error
+	// Progress, when set, is called every now and then while loading, with
+	// how many bytes of the file were read so far.
+	Progress func(loaded, total int64)
+
+	Mu sync.Mutex
+	// writes made since the last successful save
+	dirty int64
+	// writes made when the running save started
+	dirtyAtStart int64
+
+	saving       bool
+	saveStart    time.Time
+	lastSave     time.Time
+	lastSaveErr  error
+	lastSaveTime time.Duration
+	lastAttempt  time.Time
+	saves        int64
+	wg           sync.WaitGroup
+	done         chan struct{}
+	ruleWg       sync.WaitGroup
+}
+
+// New returns Snapshots saving to path. Rules are checked once a second
+// until Close.
+func New(path string, rules []Rule) *Snapshots {
+	s := &Snapshots{
+		Path:     path,
+		Rules:    rules,
+		lastSave: time.Now(),
+		done:     make(chan struct{}),
+	}
+
+	s.ruleWg.Add(1)
+	go s.checkRules()
+
+	return s
+}
+
+func (s *Snapshots) checkRules() {
+	defer s.ruleWg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.Mu.Lock()
+		if s.shouldSave() {
+			s.startSave()
+		}
+		s.Mu.Unlock()
+	}
+}
+
+// shouldSave must be called with Mu held.
+func (s *Snapshots) shouldSave() bool {
+	if s.saving || s.Dump == nil {
+		return false
+	}
+	if s.lastSaveErr != nil && time.Since(s.lastAttempt) < retryDelay {
+		return false
+	}
+	if s.lastSaveErr != nil && len(s.Rules) > 0 {
+		// Writes may be refused until a save succeeds, see Err, so don't
+		// wait for the rules to match again.
+		return true
+	}
+
+	for _, rule := range s.Rules {
+		if s.dirty >= rule.Changes && s.dirty > 0 && time.Since(s.lastSave) >= time.Duration(rule.Seconds)*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+// Changed counts a write to the dataset towards the save rules.
+func (s *Snapshots) Changed() {
+	s.Mu.Lock()
+	s.dirty++
+	s.Mu.Unlock()
+}
+
+// Save saves a snapshot and waits for it to finish.
+func (s *Snapshots) Save() error {
+	s.Mu.Lock()
+	if s.saving {
+		s.Mu.Unlock()
+		return ErrSaveInProgress
+	}
+	s.saving = true
+	s.begin()
+	s.Mu.Unlock()
+
+	err := s.save()
+	s.finish(err)
+	return err
+}
+
+// BgSave starts saving a snapshot in the background.
+func (s *Snapshots) BgSave() error {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	if s.saving {
+		return ErrSaveInProgress
+	}
+	s.startSave()
+	return nil
+}
+
+// startSave must be called with Mu held.
+func (s *Snapshots) startSave() {
+	s.saving = true
+	s.begin()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		err := s.save()
+		if err != nil {
+			fmt.Println("Error saving snapshot:", err)
+		}
+		s.finish(err)
+	}()
+}
+
+// begin must be called with Mu held.
+func (s *Snapshots) begin() {
+	s.saveStart = time.Now()
+	s.lastAttempt = s.saveStart
+	s.dirtyAtStart = s.dirty
+}
+
+func (s *Snapshots) finish(err error) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	s.saving = false
+	s.lastSaveErr = err
+	s.lastSaveTime = time.Since(s.saveStart)
+	if err == nil {
+		// Writes made while saving may or may not be in the snapshot, so
+		// they still count towards the next one.
+		s.dirty -= s.dirtyAtStart
+		s.lastSave = s.saveStart
+		s.saves++
+	}
+}
+
+// save writes the snapshot to a temporary file, and renames it over Path
+// once it's safely on disk.
+func (s *Snapshots) save() error {
+	if s.Dump == nil {
+		return errors.New("no dump function set")
+	}
+
+	dir := filepath.Dir(s.Path)
+	tmp := filepath.Join(dir, fmt.Sprintf("temp-%d.%s", os.Getpid(), filepath.Base(s.Path)))
+	err := s.write(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, s.Path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func (s *Snapshots) write(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w Encoder
+	if s.Encode != nil {
+		w = s.Encode(f)
+	} else {
+		w = NewWriter(f, s.Compress)
+	}
+	err = s.Dump(w)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// Load reads the snapshot at Path into h. It returns false without an
+// error when there is none. Files in the native format are told apart by
+// their header, and the rest are left to Decode.
+func (s *Snapshots) Load(h Handler) (bool, error) {
+	f, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	var r io.Reader = f
+	if s.Progress != nil {
+		r = &progressReader{r: f, total: info.Size(), fn: s.Progress}
+		s.Progress(0, info.Size())
+	}
+
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(len(Magic))
+	if string(header) != Magic && s.Decode != nil {
+		err = s.Decode(br, h)
+	} else {
+		err = Read(br, h)
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", s.Path, err)
+	}
+	if s.Progress != nil {
+		s.Progress(info.Size(), info.Size())
+	}
+
+	s.Mu.Lock()
+	s.lastSave = info.ModTime()
+	s.Mu.Unlock()
+	return true, nil
+}
+
+// progressInterval is how many bytes Load reads in between calls to
+// Progress.
+const progressInterval = 1 << 20
+
+// progressReader calls fn with the number of bytes read so far once every
+// progressInterval bytes.
+type progressReader struct {
+	r        io.Reader
+	n        int64
+	reported int64
+	total    int64
+	fn       func(loaded, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if p.n-p.reported >= progressInterval {
+		p.reported = p.n
+		p.fn(p.n, p.total)
+	}
+	return n, err
+}
+
+// Err returns the error of the last save, or nil if it succeeded.
+func (s *Snapshots) Err() error {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	return s.lastSaveErr
+}
+
+// LastSave returns when the last successful save started.
+func (s *Snapshots) LastSave() time.Time {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	return s.lastSave
+}
+
+// Close stops checking the save rules and waits for a running background
+// save.
+func (s *Snapshots) Close() {
+	close(s.done)
+	s.ruleWg.Wait()
+	s.wg.Wait()
+}
+
+// Info returns the snapshot fields of the persistence section of INFO.
+func (s *Snapshots) Info() []string {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	saving, current := 0, -1
+	if s.saving {
+		saving = 1
+		current = int(time.Since(s.saveStart).Seconds())
+	}
+
+	last := -1
+	if !s.lastAttempt.IsZero() {
+		last = int(s.lastSaveTime.Seconds())
+	}
+
+	status := "ok"
+	if s.lastSaveErr != nil {
+		status = "err"
+	}
+
+	return []string{
+		fmt.Sprintf("rdb_changes_since_last_save:%d", s.dirty),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", saving),
+		fmt.Sprintf("rdb_last_save_time:%d", s.lastSave.Unix()),
+		"rdb_last_bgsave_status:" + status,
+		fmt.Sprintf("rdb_last_bgsave_time_sec:%d", last),
+		fmt.Sprintf("rdb_current_bgsave_time_sec:%d", current),
+		fmt.Sprintf("rdb_saves:%d", s.saves),
+	}
+}
@@ -0,0 +1,165 @@
+package snapshot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSnapshots(t *testing.T, rules []Rule) *Snapshots {
+	t.Helper()
+
+	s := New(filepath.Join(t.TempDir(), "dump.gdb"), rules)
+	t.Cleanup(s.Close)
+	s.Dump = func(w Encoder) error {
+		return w.String("key", "value", 0)
+	}
+	return s
+}
+
+func load(t *testing.T, s *Snapshots) map[string]string {
+	t.Helper()
+
+	strings := map[string]string{}
+	loaded, err := s.Load(Handler{
+		String: func(key, value string, expires int64) error {
+			strings[key] = value
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, loaded)
+	return strings
+}
+
+func TestSave(t *testing.T) {
+	s := newTestSnapshots(t, nil)
+
+	loaded, err := s.Load(Handler{})
+	require.NoError(t, err)
+	assert.False(t, loaded)
+
+	s.Changed()
+	require.NoError(t, s.Save())
+	assert.Equal(t, map[string]string{"key": "value"}, load(t, s))
+	assert.Contains(t, s.Info(), "rdb_changes_since_last_save:0")
+	assert.Contains(t, s.Info(), "rdb_saves:1")
+
+	// Nothing but the snapshot is left behind.
+	entries, err := os.ReadDir(filepath.Dir(s.Path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestLoadProgress(t *testing.T) {
+	s := newTestSnapshots(t, nil)
+	require.NoError(t, s.Save())
+	info, err := os.Stat(s.Path)
+	require.NoError(t, err)
+
+	var loaded []int64
+	s.Progress = func(l, total int64) {
+		assert.Equal(t, info.Size(), total)
+		loaded = append(loaded, l)
+	}
+	load(t, s)
+	assert.Equal(t, []int64{0, info.Size()}, loaded)
+}
+
+func TestBgSave(t *testing.T) {
+	s := newTestSnapshots(t, nil)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s.Dump = func(w Encoder) error {
+		close(started)
+		<-release
+		return w.String("key", "value", 0)
+	}
+
+	s.Changed()
+	require.NoError(t, s.BgSave())
+	<-started
+	assert.ErrorIs(t, s.BgSave(), ErrSaveInProgress)
+	assert.ErrorIs(t, s.Save(), ErrSaveInProgress)
+	assert.Contains(t, s.Info(), "rdb_bgsave_in_progress:1")
+
+	// Writes made during the save count towards the next one.
+	s.Changed()
+	close(release)
+	s.wg.Wait()
+
+	assert.Equal(t, map[string]string{"key": "value"}, load(t, s))
+	assert.Contains(t, s.Info(), "rdb_changes_since_last_save:1")
+	assert.Contains(t, s.Info(), "rdb_last_bgsave_status:ok")
+}
+
+func TestSaveError(t *testing.T) {
+	s := newTestSnapshots(t, nil)
+	require.NoError(t, s.Save())
+
+	s.Dump = func(w Encoder) error {
+		return errors.New("dump failed")
+	}
+	s.Changed()
+	assert.Error(t, s.Save())
+	assert.Contains(t, s.Info(), "rdb_last_bgsave_status:err")
+	assert.Contains(t, s.Info(), "rdb_changes_since_last_save:1")
+
+	// The last good snapshot is kept.
+	assert.Equal(t, map[string]string{"key": "value"}, load(t, s))
+}
+
+func TestSaveErrorRetry(t *testing.T) {
+	s := newTestSnapshots(t, []Rule{{Seconds: 3600, Changes: 1000}})
+	dump := s.Dump
+
+	s.Mu.Lock()
+	s.Dump = func(w Encoder) error {
+		return errors.New("dump failed")
+	}
+	s.Mu.Unlock()
+	require.NoError(t, s.BgSave())
+	s.wg.Wait()
+	assert.Error(t, s.Err())
+
+	// Failed saves are retried without waiting for the rules to match.
+	s.Mu.Lock()
+	assert.False(t, s.shouldSave())
+	attempt := s.lastAttempt
+	s.lastAttempt = attempt.Add(-retryDelay)
+	assert.True(t, s.shouldSave())
+	s.lastAttempt = attempt
+	s.Dump = dump
+	s.Mu.Unlock()
+
+	require.NoError(t, s.Save())
+	assert.NoError(t, s.Err())
+	s.Mu.Lock()
+	assert.False(t, s.shouldSave())
+	s.Mu.Unlock()
+}
+
+func TestRules(t *testing.T) {
+	s := newTestSnapshots(t, []Rule{{Seconds: 1, Changes: 2}})
+	before := s.LastSave()
+
+	s.Changed()
+	time.Sleep(1500 * time.Millisecond)
+	s.Mu.Lock()
+	assert.Zero(t, s.saves)
+	s.Mu.Unlock()
+
+	s.Changed()
+	assert.Eventually(t, func() bool {
+		s.Mu.Lock()
+		defer s.Mu.Unlock()
+		return s.saves == 1 && !s.saving
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.True(t, s.LastSave().After(before))
+}
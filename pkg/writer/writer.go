@@ -1,26 +1,82 @@
 package writer
 
 import (
+	"bufio"
 	"io"
+	"strconv"
 
 	"github.com/maniktherana/godbase/pkg/resp"
 )
 
+const bulkOverhead = 1 + 20 + 4
+
 type Writer struct {
-	writer io.Writer
+	writer *bufio.Writer
 }
 
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{writer: w}
+	return &Writer{writer: bufio.NewWriter(w)}
 }
 
+// Write marshals v and sends it to the underlying writer right away.
 func (w *Writer) Write(v resp.Value) error {
-	var bytes = v.Marshal()
+	err := w.Buffer(v)
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
 
-	_, err := w.writer.Write(bytes)
+// Buffer queues v without sending it. Replies to pipelined commands are
+// buffered and sent together with a single Flush.
+func (w *Writer) Buffer(v resp.Value) error {
+	// Marshal straight into the free space of the buffer. If the reply
+	// doesn't fit, bufio copies it out and flushes as needed.
+	_, err := w.writer.Write(v.AppendMarshal(w.writer.AvailableBuffer()))
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// WriteArrayHeader starts a streamed array of n elements. Exactly n
+// elements have to be written after it. Like the other methods, it only
+// blocks when the buffer is full and the client isn't reading, which
+// keeps large replies from piling up in memory.
+func (w *Writer) WriteArrayHeader(n int) error {
+	_, err := w.writer.Write(resp.AppendArrayHeader(w.writer.AvailableBuffer(), n))
+	return err
+}
+
+// WriteBulk writes s as a bulk string, usually as an element of a
+// streamed array.
+func (w *Writer) WriteBulk(s string) error {
+	// Room for the type byte, length and both CRLFs around the value.
+	if len(s)+bulkOverhead <= w.writer.Available() {
+		_, err := w.writer.Write(resp.AppendBulk(w.writer.AvailableBuffer(), s))
+		return err
+	}
+
+	// Large values go out without first being copied next to their header.
+	header := w.writer.AvailableBuffer()
+	header = append(header, resp.BULK)
+	header = strconv.AppendInt(header, int64(len(s)), 10)
+	header = append(header, '\r', '\n')
+	_, err := w.writer.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.writer.WriteString(s)
+	if err != nil {
+		return err
+	}
+	_, err = w.writer.WriteString("\r\n")
+	return err
+}
+
+// Flush sends everything buffered so far to the underlying writer.
+func (w *Writer) Flush() error {
+	return w.writer.Flush()
+}
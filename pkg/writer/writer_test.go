@@ -2,6 +2,8 @@ package writer
 
 import (
 	"bytes"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/maniktherana/godbase/pkg/resp"
@@ -56,7 +58,7 @@ func TestWriterWrite(t *testing.T) {
 				Typ: "integer",
 				Num: 123,
 			},
-			expected: "",
+			expected: ":123\r\n",
 		},
 	}
 
@@ -70,3 +72,41 @@ func TestWriterWrite(t *testing.T) {
 		})
 	}
 }
+
+func TestWriterBuffer(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewWriter(&buf)
+
+	assert.NoError(t, writer.Buffer(resp.Value{Typ: "string", Str: "OK"}))
+	assert.NoError(t, writer.Buffer(resp.Value{Typ: "bulk", Bulk: "value"}))
+	assert.Equal(t, "", buf.String())
+
+	assert.NoError(t, writer.Flush())
+	assert.Equal(t, "+OK\r\n$5\r\nvalue\r\n", buf.String())
+}
+
+func TestWriterStreamArray(t *testing.T) {
+	large := strings.Repeat("x", 10000)
+
+	var buf bytes.Buffer
+	writer := NewWriter(&buf)
+
+	assert.NoError(t, writer.WriteArrayHeader(3))
+	assert.NoError(t, writer.WriteBulk("hello"))
+	assert.NoError(t, writer.WriteBulk(""))
+	assert.NoError(t, writer.WriteBulk(large))
+	assert.NoError(t, writer.Flush())
+
+	expected := "*3\r\n$5\r\nhello\r\n$0\r\n\r\n$10000\r\n" + large + "\r\n"
+	assert.Equal(t, expected, buf.String())
+}
+
+func BenchmarkWriterBuffer(b *testing.B) {
+	writer := NewWriter(io.Discard)
+	value := resp.Value{Typ: "bulk", Bulk: "some-value-12345"}
+
+	b.ReportAllocs()
+	for range b.N {
+		writer.Buffer(value)
+	}
+}